@@ -543,17 +543,29 @@ namespace ZitiDesktopEdge {
 		}
 
 		private void ServiceClient_OnBulkServiceEvent(object sender, BulkServiceEvent e) {
-			var found = identities.Find(id => id.Fingerprint == e.Fingerprint);
-			if (found == null) {
-				logger.Warn($"{e.Action} service event for {e.Fingerprint} but the provided identity fingerprint was not found!");
-				return;
-			} else {
-				foreach (var removed in e.RemovedServices) {
+			// changes of several identities arrive together in Identities. older services only send a single identity
+			var changes = e.Identities;
+			if (changes == null) {
+				changes = new List<ServiceChanges>() {
+					new ServiceChanges() { Fingerprint = e.Fingerprint, AddedServices = e.AddedServices, RemovedServices = e.RemovedServices }
+				};
+			}
+			var anyFound = false;
+			foreach (var change in changes) {
+				var found = identities.Find(id => id.Fingerprint == change.Fingerprint);
+				if (found == null) {
+					logger.Warn($"{e.Action} service event for {change.Fingerprint} but the provided identity fingerprint was not found!");
+					continue;
+				}
+				anyFound = true;
+				foreach (var removed in change.RemovedServices) {
 					removeService(found, removed);
 				}
-				foreach (var added in e.AddedServices) {
+				foreach (var added in change.AddedServices) {
 					addService(found, added);
 				}
+			}
+			if (anyFound) {
 				LoadIdentities(false);
 				this.Dispatcher.Invoke(() => {
 					IdentityDetails deets = ((MainWindow)Application.Current.MainWindow).IdentityMenu;
@@ -424,6 +424,13 @@ namespace ZitiDesktopEdge.DataStructures {
         public string Fingerprint { get; set; }
         public List<Service> AddedServices { get; set; }
         public List<Service> RemovedServices { get; set; }
+        public List<ServiceChanges> Identities { get; set; }
+    }
+
+    public class ServiceChanges {
+        public string Fingerprint { get; set; }
+        public List<Service> AddedServices { get; set; }
+        public List<Service> RemovedServices { get; set; }
     }
 
     public class IdentityEvent : ActionEvent
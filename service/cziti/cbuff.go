@@ -14,26 +14,30 @@
  * limitations under the License.
  *
  */
-
 package cziti
 
-var cbuff = make([][]byte, MaxDnsRequests)
-var pos int32 = -1
-
-func init() {
-	initDnsMsgBuffer()
+// dnsBufferRing hands out the buffers udp DNS messages are read into. A buffer is reused once MaxDnsRequests more
+// messages have been read. Every listener has its own ring as a ring must only be used by one goroutine
+type dnsBufferRing struct {
+	buffers [][]byte
+	pos     int
 }
 
-func initDnsMsgBuffer() {
-	for i := 0; i < MaxDnsRequests; i++ {
-		cbuff[i] = make([]byte, DnsMsgBufferSize)
+func newDnsBufferRing() *dnsBufferRing {
+	r := &dnsBufferRing{
+		buffers: make([][]byte, MaxDnsRequests),
+		pos:     -1,
+	}
+	for i := range r.buffers {
+		r.buffers[i] = make([]byte, DnsMsgBufferSize)
 	}
+	return r
 }
 
-func nextBuffer() *[]byte {
-	pos = pos + 1
-	if pos == MaxDnsRequests {
-		pos = 0
+func (r *dnsBufferRing) next() []byte {
+	r.pos++
+	if r.pos == len(r.buffers) {
+		r.pos = 0
 	}
-	return &cbuff[pos]
+	return r.buffers[r.pos]
 }
@@ -0,0 +1,166 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/openziti/desktop-edge-win/service/windns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+// CheckConsistency compares the services of the given identities with the hostnames the DNS counts and resolves, and
+// the hostnames with the NRPT rules. Only active identities are expected to have hostnames
+func CheckConsistency(ids []*ZIdentity) dto.ConsistencyReport {
+	report := dto.ConsistencyReport{
+		PendingChanges: PendingServiceChanges.Len(),
+		Divergences:    make([]dto.Divergence, 0),
+	}
+	diverged := func(kind string, name string, fingerprint string, format string, args ...interface{}) {
+		report.Divergences = append(report.Divergences, dto.Divergence{
+			Kind:        kind,
+			Name:        name,
+			FingerPrint: fingerprint,
+			Detail:      fmt.Sprintf(format, args...),
+		})
+	}
+
+	// how many services of each identity intercept each hostname, counted the same way eventCB counts them
+	expected := make(map[string]map[string]int)
+	intercepted := make(map[string]bool) // hostnames the tunneler intercepts, unlike record names
+	for _, zid := range ids {
+		report.Identities++
+		zid.Services.Range(func(key interface{}, value interface{}) bool {
+			zs := value.(*ZService)
+			if zs == nil || zs.Service == nil {
+				return true
+			}
+			report.Services++
+			count := func(hostname string) {
+				k := hostnameKey(hostname)
+				if expected[k] == nil {
+					expected[k] = make(map[string]int)
+				}
+				expected[k][zid.Fingerprint]++
+			}
+			for _, addr := range zs.Service.Addresses {
+				if addr.IsHost {
+					count(addr.HostName)
+					intercepted[hostnameKey(addr.HostName)] = true
+				}
+			}
+			for _, name := range serviceRecords.names(zid.Fingerprint, zs.Id) {
+				count(name)
+			}
+			return true
+		})
+	}
+
+	dns := dnsMgrPrivate
+	dns.mu.RLock()
+	report.Hostnames = len(dns.refs)
+	for key, byId := range expected {
+		for fp, n := range byId {
+			actual := dns.refs[key][fp]
+			if actual == 0 {
+				diverged(dto.DivergenceDnsMissing, key, fp, "intercepted by %d service(s) but not known to the DNS", n)
+			} else if actual != n {
+				diverged(dto.DivergenceDnsCount, key, fp, "intercepted by %d service(s) but counted for %d", n, actual)
+			}
+		}
+	}
+	for key, byId := range dns.refs {
+		for fp, actual := range byId {
+			if expected[key][fp] == 0 {
+				diverged(dto.DivergenceDnsStale, key, fp, "counted for %d service(s) but no service of the identity intercepts it", actual)
+			}
+		}
+		if !intercepted[key] {
+			continue
+		}
+		if strings.HasPrefix(key, "*") {
+			if dns.wildcardMap[wildcardSuffix(key)] == nil {
+				diverged(dto.DivergenceUnresolved, key, "", "intercepted but the DNS has no address for it")
+			}
+		} else if dns.hostnameMap[normalizeDnsName(key)] == nil {
+			diverged(dto.DivergenceUnresolved, key, "", "intercepted but the DNS has no address for it")
+		}
+	}
+	for name, c := range dns.hostnameMap {
+		if name == dnsProbeName {
+			continue
+		}
+		if _, found := dns.refs[hostnameKey(name)]; !found {
+			diverged(dto.DivergenceResolverStale, hostnameKey(name), "", "resolves to %s but no service intercepts it", c.ip)
+		}
+	}
+	for suffix, c := range dns.wildcardMap {
+		if _, found := dns.refs["*"+strings.TrimSuffix(suffix, ".")]; !found {
+			diverged(dto.DivergenceResolverStale, "*"+strings.TrimSuffix(suffix, "."), "", "resolves to %s but no service intercepts it", c.ip)
+		}
+	}
+	dns.mu.RUnlock()
+
+	checkNrptConsistency(&report, diverged)
+
+	sort.SliceStable(report.Divergences, func(i, j int) bool {
+		a, b := report.Divergences[i], report.Divergences[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+	report.Consistent = len(report.Divergences) == 0 && report.NrptError == ""
+	return report
+}
+
+// checkNrptConsistency compares the NRPT rules of the tunnel with the namespaces which need one
+func checkNrptConsistency(report *dto.ConsistencyReport, diverged func(string, string, string, string, ...interface{})) {
+	dnsIp := dnsServerIp()
+	if dnsIp == nil {
+		report.NrptError = "the DNS server is not running"
+		return
+	}
+	dnsServer := dnsIp.String()
+	actual, err := windns.Nrpt.List()
+	if err != nil {
+		report.NrptError = fmt.Sprintf("could not read the NRPT rules: %v", err)
+		return
+	}
+	report.NrptRules = len(actual)
+
+	desired := make(map[string]bool)
+	for ns := range desiredNrptNamespaces() {
+		desired[strings.ToLower(ns)] = true
+	}
+	for ns := range desired {
+		servers, found := actual[ns]
+		if !found {
+			diverged(dto.DivergenceNrptMissing, ns, "", "no NRPT rule sends it to %s", dnsServer)
+		} else if !containsServer(servers, dnsServer) {
+			diverged(dto.DivergenceNrptWrongServer, ns, "", "the NRPT rule sends it to %v instead of %s", servers, dnsServer)
+		}
+	}
+	for ns, servers := range actual {
+		if !desired[ns] {
+			diverged(dto.DivergenceNrptStale, ns, "", "the NRPT rule to %v is not needed by any hostname or domain", servers)
+		}
+	}
+}
@@ -46,6 +46,7 @@ void readIdle(uv_prepare_t *idler);
 void call_on_packet(void *packet, ssize_t len, packet_cb cb, void *ctx);
 void remove_intercepts(uv_async_t *handle);
 void add_intercepts(uv_async_t *handle);
+void init_tunneler_dns(uv_async_t *handle);
 void free_async(uv_handle_t* timer);
 
 dns_manager* get_dns_mgr_from_c();
@@ -262,6 +263,33 @@ func AddIntercept(addWaitGroup *TunnelerActionWaitGroup) {
 	C.uv_async_send((*C.uv_async_t)(unsafe.Pointer(async)))
 }
 
+// tunnelerDnsRange is the TUN range handed to the tunneler on the libuv loop
+type tunnelerDnsRange struct {
+	wg     sync.WaitGroup
+	ipBase uint32
+	mask   int
+}
+
+// ReinitTunnelerDns hands a new TUN range to the tunneler while the libuv loop runs. The tunneler is not thread-safe
+// so the range is set on the loop and this waits for it
+func ReinitTunnelerDns(ipBase uint32, mask int) {
+	r := &tunnelerDnsRange{ipBase: ipBase, mask: mask}
+	r.wg.Add(1)
+	async := (*C.uv_async_t)(C.malloc(C.sizeof_uv_async_t))
+	async.data = unsafe.Pointer(r)
+	C.uv_async_init(_impl.libuvCtx.l, async, C.uv_async_cb(C.init_tunneler_dns))
+	C.uv_async_send((*C.uv_async_t)(unsafe.Pointer(async)))
+	r.wg.Wait()
+}
+
+//export init_tunneler_dns
+func init_tunneler_dns(async *C.uv_async_t) {
+	r := (*tunnelerDnsRange)(async.data)
+	C.ziti_tunneler_init_dns(C.uint32_t(r.ipBase), C.int(r.mask))
+	C.uv_close((*C.uv_handle_t)(unsafe.Pointer(async)), C.uv_close_cb(C.free_async))
+	r.wg.Done()
+}
+
 //export remove_intercepts
 func remove_intercepts(async *C.uv_async_t) {
 	removeWaitGroup := (*TunnelerActionWaitGroup)(async.data)
@@ -276,7 +304,7 @@ func remove_intercepts(async *C.uv_async_t) {
 func add_intercepts(async *C.uv_async_t) {
 	addWaitGroup := (*TunnelerActionWaitGroup)(async.data)
 
-	C.ziti_sdk_c_on_service(addWaitGroup.Czsvc.Czctx, addWaitGroup.Czsvc.Czsvc, C.ZITI_OK, unsafe.Pointer(theTun.tunCtx))
+	interceptService(addWaitGroup.Czsvc.Czctx, addWaitGroup.Czsvc.Czsvc)
 	C.uv_close((*C.uv_handle_t)(unsafe.Pointer(async)), C.uv_close_cb(C.free_async))
 	addWaitGroup.Wg.Done()
 }
@@ -305,7 +333,7 @@ func netifAddRoute(_ C.netif_handle, dest *C.char) C.int {
 			return 1
 		}
 
-		_ = goapi.AddRoute(*cidr, dnsip, 1)
+		_ = goapi.AddRoute(*cidr, dnsServerIp(), 1)
 
 	} else {
 		log.Debugf("route appears to be an IP (not CIDR): %s", routeAsString)
@@ -314,7 +342,7 @@ func netifAddRoute(_ C.netif_handle, dest *C.char) C.int {
 			log.Errorf("An error occurred while parsing IP: %s", routeAsString)
 			return 1
 		}
-		_ = goapi.AddRoute(net.IPNet{IP: ip, Mask: net.IPMask{255, 255, 255, 255}}, dnsip, 1)
+		_ = goapi.AddRoute(net.IPNet{IP: ip, Mask: net.IPMask{255, 255, 255, 255}}, dnsServerIp(), 1)
 	}
 	return 0
 }
@@ -0,0 +1,542 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+// DefaultInterceptAddressRetention is how long the address of a hostname which is no longer intercepted is kept so
+// that it gets the same address when it comes back
+const DefaultInterceptAddressRetention = 30 * 24 * time.Hour
+
+// the first addresses of the TUN range are never handed out by the tunneler
+const reservedTunOffsets = 2
+
+// interceptAddress is the address a hostname resolves to. Owners are the identity/service pairs which intercept it.
+// A wildcard may have a block of addresses instead, Bits is then the size of its network
+type interceptAddress struct {
+	Hostname string
+	Address  string
+	Bits     int      `json:",omitempty"`
+	Owners   []string `json:",omitempty"`
+	LastUsed time.Time
+
+	ip uint32
+}
+
+type interceptAddressFile struct {
+	Version   int
+	Addresses []*interceptAddress
+}
+
+// addressStore hands out the address each intercepted hostname resolves to and persists them so a hostname resolves
+// to the same address after a restart. The tunneler is given these addresses in place of the hostnames so it never
+// assigns addresses of its own. A wildcard gets a block of addresses the names below it are given addresses from
+type addressStore struct {
+	mu        sync.Mutex
+	path      string
+	retention time.Duration
+	restored  bool
+
+	cidr      uint32
+	broadcast uint32
+	tunIp     uint32
+
+	byHost     map[string]*interceptAddress
+	byIp       map[uint32]*interceptAddress
+	blocks     map[uint32]*interceptAddress // the blocks of the wildcards keyed by their first address
+	active     map[string]bool              // hostnames the tunneler intercepts right now
+	unassigned map[string]bool              // hostnames which could not get an address
+	save       chan struct{}
+}
+
+var interceptAddresses = &addressStore{
+	retention:  DefaultInterceptAddressRetention,
+	byHost:     make(map[string]*interceptAddress),
+	byIp:       make(map[uint32]*interceptAddress),
+	blocks:     make(map[uint32]*interceptAddress),
+	active:     make(map[string]bool),
+	unassigned: make(map[string]bool),
+	save:       make(chan struct{}, 1),
+}
+
+// LoadInterceptAddresses reads the addresses kept from earlier runs and keeps every change in the given file. Must be
+// called before Start
+func LoadInterceptAddresses(path string, retention time.Duration) {
+	s := interceptAddresses
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	if retention > 0 {
+		s.retention = retention
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("could not read intercept addresses from %s: %v", path, err)
+		}
+	} else {
+		var f interceptAddressFile
+		if err = json.Unmarshal(b, &f); err != nil {
+			log.Warnf("intercept addresses in %s are not valid and are ignored: %v", path, err)
+		} else {
+			for _, a := range f.Addresses {
+				ip := net.ParseIP(a.Address).To4()
+				if ip == nil || a.Hostname == "" {
+					continue
+				}
+				a.ip = binary.BigEndian.Uint32(ip)
+				s.add(a)
+			}
+			s.restored = true
+			log.Infof("loaded %d intercept address(es) from %s", len(s.byHost), path)
+		}
+	}
+	s.gc()
+	go s.runSaver()
+}
+
+// SetInterceptAddressRetention changes how long unused addresses are kept and drops the ones now too old
+func SetInterceptAddressRetention(retention time.Duration) {
+	if retention <= 0 {
+		retention = DefaultInterceptAddressRetention
+	}
+	s := interceptAddresses
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retention = retention
+	s.gc()
+}
+
+// ForgetInterceptAddresses drops the identity as an owner of every address. Addresses left without an owner are freed
+// unless the hostname is still intercepted
+func ForgetInterceptAddresses(fingerprint string) {
+	s := interceptAddresses
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefix := fingerprint + "/"
+	for host, a := range s.byHost {
+		owners := a.Owners[:0]
+		for _, o := range a.Owners {
+			if !strings.HasPrefix(o, prefix) {
+				owners = append(owners, o)
+			}
+		}
+		a.Owners = owners
+		if len(owners) == 0 && !s.active[host] {
+			s.drop(a)
+		}
+	}
+	s.changed()
+}
+
+// GetInterceptAddressStats reports how much of the TUN range is handed out
+func GetInterceptAddressStats() dto.InterceptAddressStats {
+	s := interceptAddresses
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := dto.InterceptAddressStats{
+		PoolSize:  s.poolSize(),
+		Assigned:  len(s.byHost),
+		Active:    len(s.active),
+		Exhausted: len(s.unassigned) > 0,
+	}
+	for host := range s.unassigned {
+		stats.Unassigned = append(stats.Unassigned, host)
+	}
+	sort.Strings(stats.Unassigned)
+	return stats
+}
+
+// setRange moves the store to a new TUN range. Addresses outside of the range are dropped
+func (s *addressStore) setRange(cidr uint32, mask uint32, tunIp uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cidr = cidr
+	s.broadcast = cidr | ^mask
+	s.tunIp = tunIp
+	s.active = make(map[string]bool)
+	s.unassigned = make(map[string]bool)
+	dropped := 0
+	for _, a := range s.byHost {
+		if !s.fits(a.ip, a.size()) {
+			s.drop(a)
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		log.Infof("dropped %d intercept address(es) outside of the TUN range", dropped)
+		s.restored = false
+		s.changed()
+	}
+}
+
+// assign returns the address the hostname resolves to. The address kept for the hostname is used if there is one,
+// otherwise the first free address. nil is returned when the TUN range is exhausted
+func (s *addressStore) assign(hostname string) net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a := s.kept(hostname); a != nil {
+		if s.blockAt(a.ip) == nil {
+			return uint32ToIp(a.ip)
+		}
+		// the name had an address below a wildcard. intercepted on its own it needs one the wildcard does not cover
+		s.drop(a)
+	}
+	return s.assignFree(hostname)
+}
+
+// assignBlock returns the block of addresses of a wildcard. The block kept for the wildcard is used if there is one,
+// otherwise the first free block of the given size. A single address is returned when no such block is free, nil when
+// the TUN range is exhausted
+func (s *addressStore) assignBlock(hostname string, bits int) *net.IPNet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a := s.kept(hostname); a != nil {
+		return a.network()
+	}
+	if bits < 31 {
+		size := uint32(1) << uint(32-bits)
+		first := (s.cidr + reservedTunOffsets + size) &^ (size - 1) // the first aligned block after the reserved addresses
+		for base := first; base > s.cidr && base+size-1 < s.broadcast; base += size {
+			if !s.blockFree(base, size) {
+				continue
+			}
+			a := &interceptAddress{Hostname: hostname, Address: uint32ToIp(base).String(), Bits: bits, LastUsed: time.Now(), ip: base}
+			s.add(a)
+			s.active[hostname] = true
+			delete(s.unassigned, hostname)
+			s.changed()
+			return a.network()
+		}
+		log.Warnf("no block of %d addresses is left in the TUN range for %s. names below it share one address", size, hostname)
+	}
+	ip := s.assignFree(hostname)
+	if ip == nil {
+		return nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+}
+
+// assignIn returns the address of a name below a wildcard from the block of the wildcard. The address kept for the
+// name is used if it is inside the block. When every address of the block is taken the address unused for the longest
+// time is taken from its name. nil is returned when the block has no address to give
+func (s *addressStore) assignIn(hostname string, block *net.IPNet) net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	base := binary.BigEndian.Uint32(block.IP.To4())
+	ones, _ := block.Mask.Size()
+	end := base + uint32(1)<<uint(32-ones)
+	if a, found := s.byHost[hostname]; found {
+		if a.ip > base && a.ip < end {
+			return uint32ToIp(s.kept(hostname).ip)
+		}
+		s.drop(a)
+	}
+
+	ip, ok := uint32(0), false
+	for candidate := base + 1; candidate < end; candidate++ {
+		if s.inRange(candidate) && s.byIp[candidate] == nil {
+			ip, ok = candidate, true
+			break
+		}
+	}
+	if !ok {
+		var oldest *interceptAddress
+		for host, a := range s.byHost {
+			if a.ip > base && a.ip < end && !s.active[host] && (oldest == nil || a.LastUsed.Before(oldest.LastUsed)) {
+				oldest = a
+			}
+		}
+		if oldest == nil {
+			return nil
+		}
+		log.Debugf("block %v is full. reusing the address of %s which was last used %v", block, oldest.Hostname, oldest.LastUsed)
+		s.drop(oldest)
+		ip = oldest.ip
+	}
+
+	a := &interceptAddress{Hostname: hostname, Address: uint32ToIp(ip).String(), LastUsed: time.Now(), ip: ip}
+	s.add(a)
+	s.active[hostname] = true
+	s.changed()
+	return uint32ToIp(ip)
+}
+
+// kept marks the hostname as intercepted and returns the address kept for it, if it has one. must hold the lock
+func (s *addressStore) kept(hostname string) *interceptAddress {
+	a, found := s.byHost[hostname]
+	if !found {
+		return nil
+	}
+	a.LastUsed = time.Now()
+	s.active[hostname] = true
+	s.changed()
+	return a
+}
+
+// assignFree gives the hostname the first free address. must hold the lock
+func (s *addressStore) assignFree(hostname string) net.IP {
+	ip, ok := s.free()
+	if !ok {
+		log.Errorf("no address is left in the TUN range for %s", hostname)
+		s.unassigned[hostname] = true
+		return nil
+	}
+	a := &interceptAddress{Hostname: hostname, Address: uint32ToIp(ip).String(), LastUsed: time.Now(), ip: ip}
+	s.add(a)
+	s.active[hostname] = true
+	delete(s.unassigned, hostname)
+	s.changed()
+	return uint32ToIp(ip)
+}
+
+// own records the identity/service pair as an owner of the address of the hostname, if it has one
+func (s *addressStore) own(hostname string, owner string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, found := s.byHost[hostname]
+	if !found {
+		return
+	}
+	for _, o := range a.Owners {
+		if o == owner {
+			return
+		}
+	}
+	a.Owners = append(a.Owners, owner)
+	s.changed()
+}
+
+// inherit makes the owners of one hostname the owners of another, as for a name below a wildcard
+func (s *addressStore) inherit(hostname string, from string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, found := s.byHost[hostname]
+	f, ok := s.byHost[from]
+	if !found || !ok {
+		return
+	}
+	a.Owners = append([]string(nil), f.Owners...)
+	s.changed()
+}
+
+// release marks the hostname as no longer intercepted. Its address is kept for the retention period
+func (s *addressStore) release(hostname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.active, hostname)
+	delete(s.unassigned, hostname)
+	if a, found := s.byHost[hostname]; found {
+		a.LastUsed = time.Now()
+		s.changed()
+	}
+}
+
+// free finds an address no hostname has outside of the blocks of the wildcards. When every address is taken the
+// address unused for the longest time is taken from its hostname. must hold the lock
+func (s *addressStore) free() (uint32, bool) {
+	for ip := s.cidr + reservedTunOffsets + 1; ip < s.broadcast; ip++ {
+		if b := s.blockAt(ip); b != nil {
+			ip = b.ip + b.size() - 1
+			continue
+		}
+		if s.inRange(ip) && s.byIp[ip] == nil {
+			return ip, true
+		}
+	}
+	var oldest *interceptAddress
+	for host, a := range s.byHost {
+		if !s.active[host] && a.Bits == 0 && s.blockAt(a.ip) == nil && (oldest == nil || a.LastUsed.Before(oldest.LastUsed)) {
+			oldest = a
+		}
+	}
+	if oldest == nil {
+		return 0, false
+	}
+	log.Infof("TUN range is full. reusing the address of %s which was last used %v", oldest.Hostname, oldest.LastUsed)
+	s.drop(oldest)
+	return oldest.ip, true
+}
+
+// inRange reports if the address is inside the TUN range and may be handed out. must hold the lock
+func (s *addressStore) inRange(ip uint32) bool {
+	return ip > s.cidr+reservedTunOffsets && ip < s.broadcast && ip != s.tunIp
+}
+
+// fits reports if every one of size addresses from ip may be handed out. must hold the lock
+func (s *addressStore) fits(ip uint32, size uint32) bool {
+	last := ip + size - 1
+	return last >= ip && s.inRange(ip) && s.inRange(last) && (s.tunIp < ip || s.tunIp > last)
+}
+
+// blockFree reports if no hostname and no other block has an address of the block. must hold the lock
+func (s *addressStore) blockFree(base uint32, size uint32) bool {
+	if !s.fits(base, size) {
+		return false
+	}
+	for _, b := range s.blocks {
+		if b.ip < base+size && base < b.ip+b.size() {
+			return false
+		}
+	}
+	for ip := base; ip < base+size; ip++ {
+		if s.byIp[ip] != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// blockAt returns the block of a wildcard holding the address, nil when there is none. must hold the lock
+func (s *addressStore) blockAt(ip uint32) *interceptAddress {
+	for _, b := range s.blocks {
+		if ip >= b.ip && ip < b.ip+b.size() {
+			return b
+		}
+	}
+	return nil
+}
+
+// must hold the lock
+func (s *addressStore) poolSize() int {
+	if s.broadcast <= s.cidr+reservedTunOffsets+1 {
+		return 0
+	}
+	size := int(s.broadcast - s.cidr - reservedTunOffsets - 1)
+	if s.tunIp > s.cidr+reservedTunOffsets && s.tunIp < s.broadcast {
+		size--
+	}
+	return size
+}
+
+// gc drops the addresses of hostnames not intercepted for longer than the retention period. must hold the lock
+func (s *addressStore) gc() {
+	cutoff := time.Now().Add(-s.retention)
+	dropped := 0
+	for host, a := range s.byHost {
+		if !s.active[host] && a.LastUsed.Before(cutoff) {
+			s.drop(a)
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		log.Infof("dropped %d intercept address(es) unused since %v", dropped, cutoff)
+		s.changed()
+	}
+}
+
+// must hold the lock
+func (s *addressStore) add(a *interceptAddress) {
+	s.byHost[a.Hostname] = a
+	s.byIp[a.ip] = a
+	if a.Bits > 0 {
+		s.blocks[a.ip] = a
+	}
+}
+
+// must hold the lock
+func (s *addressStore) drop(a *interceptAddress) {
+	delete(s.byHost, a.Hostname)
+	if s.byIp[a.ip] == a {
+		delete(s.byIp, a.ip)
+	}
+	if s.blocks[a.ip] == a {
+		delete(s.blocks, a.ip)
+	}
+}
+
+// changed asks for the addresses to be written. must hold the lock
+func (s *addressStore) changed() {
+	select {
+	case s.save <- struct{}{}:
+	default:
+	}
+}
+
+// runSaver writes the addresses whenever they change. The file is written off the libuv thread as addresses are
+// assigned from tunneler callbacks
+func (s *addressStore) runSaver() {
+	for range s.save {
+		s.mu.Lock()
+		f := interceptAddressFile{Version: 1, Addresses: make([]*interceptAddress, 0, len(s.byHost))}
+		for _, a := range s.byHost {
+			c := *a
+			c.Owners = append([]string(nil), a.Owners...)
+			f.Addresses = append(f.Addresses, &c)
+		}
+		path := s.path
+		s.mu.Unlock()
+
+		sort.Slice(f.Addresses, func(i, j int) bool { return f.Addresses[i].Hostname < f.Addresses[j].Hostname })
+		b, err := json.MarshalIndent(f, "", "  ")
+		if err != nil {
+			log.Errorf("could not serialize intercept addresses: %v", err)
+			continue
+		}
+		tmp := path + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, path)
+		}
+		if err != nil {
+			log.Errorf("could not write intercept addresses to %s: %v", path, err)
+		}
+	}
+}
+
+// wasRestored reports if every hostname resolves to the address it had before the service started
+func (s *addressStore) wasRestored() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.restored
+}
+
+// size is how many addresses the hostname has: one, or the size of the block of a wildcard
+func (a *interceptAddress) size() uint32 {
+	if a.Bits == 0 {
+		return 1
+	}
+	return uint32(1) << uint(32-a.Bits)
+}
+
+// network returns the address or block of addresses of the hostname
+func (a *interceptAddress) network() *net.IPNet {
+	bits := a.Bits
+	if bits == 0 {
+		bits = 32
+	}
+	return &net.IPNet{IP: uint32ToIp(a.ip), Mask: net.CIDRMask(bits, 32)}
+}
+
+func uint32ToIp(ip uint32) net.IP {
+	b := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(b, ip)
+	return b
+}
@@ -0,0 +1,350 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+// the ttl of the answers to blocked names
+const blockedTtl = 60
+
+// names hosts files map to themselves. they are never blocked even when a hosts format list has them
+var hostsFileOwnNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"0.0.0.0":               true,
+}
+
+// blocklist is the domains of one blocklist file
+type blocklist struct {
+	name     string
+	path     string
+	domains  map[string]bool // lower case without the trailing period
+	modTime  time.Time
+	size     int64
+	loadedAt time.Time
+	err      error
+	hits     uint64 // atomic
+	lastHit  int64  // atomic. unix nanoseconds
+}
+
+// dnsBlocker answers names found on a blocklist instead of sending them to the upstream DNS. Names intercepted by a
+// service are resolved before the blocker is asked so they are never blocked
+type dnsBlocker struct {
+	mu    sync.RWMutex
+	lists []*blocklist
+	allow map[string]bool
+	mode  string
+	// the hits of every list when the last hit event was built
+	reported map[string]uint64
+}
+
+var blocker = &dnsBlocker{allow: make(map[string]bool), reported: make(map[string]uint64)}
+
+// SetDnsBlocklists replaces the blocklists, the allowlist and how blocked names are answered. Lists which were loaded
+// before keep their hit counters and are only read again when the file changed
+func SetDnsBlocklists(paths []string, allowlist []string, mode string) dto.DnsBlocklistStatus {
+	allow := make(map[string]bool, len(allowlist))
+	for _, d := range allowlist {
+		allow[blocklistKey(d)] = true
+	}
+	if mode == "" {
+		mode = constants.DnsBlockModeNxdomain
+	}
+
+	blocker.mu.RLock()
+	previous := make(map[string]*blocklist, len(blocker.lists))
+	for _, l := range blocker.lists {
+		previous[l.path] = l
+	}
+	blocker.mu.RUnlock()
+
+	lists := make([]*blocklist, 0, len(paths))
+	for _, path := range paths {
+		lists = append(lists, refreshBlocklist(path, previous[path], false))
+	}
+
+	blocker.mu.Lock()
+	blocker.lists = lists
+	blocker.allow = allow
+	blocker.mode = mode
+	blocker.mu.Unlock()
+	log.Infof("DNS blocklists set. lists: %d, allowed domains: %d, mode: %s", len(lists), len(allow), mode)
+	return GetDnsBlocklists()
+}
+
+// ReloadDnsBlocklists reads the blocklist files again. Unless forced only files which changed since they were last
+// read are read. true is returned when any list was read
+func ReloadDnsBlocklists(force bool) bool {
+	blocker.mu.RLock()
+	current := append([]*blocklist(nil), blocker.lists...)
+	blocker.mu.RUnlock()
+
+	reloaded := false
+	lists := make([]*blocklist, 0, len(current))
+	for _, l := range current {
+		refreshed := refreshBlocklist(l.path, l, force)
+		reloaded = reloaded || refreshed != l
+		lists = append(lists, refreshed)
+	}
+	if !reloaded {
+		return false
+	}
+
+	blocker.mu.Lock()
+	// the lists may have been replaced while the files were read. only the lists still in use are swapped
+	for i, l := range blocker.lists {
+		for j, old := range current {
+			if l == old && lists[j] != old {
+				// hits counted while the file was read
+				lists[j].hits = atomic.LoadUint64(&old.hits)
+				lists[j].lastHit = atomic.LoadInt64(&old.lastHit)
+				blocker.lists[i] = lists[j]
+			}
+		}
+	}
+	blocker.mu.Unlock()
+	return true
+}
+
+// refreshBlocklist reads the file of a list when it is new, when it changed or when forced. Otherwise the previous
+// list is returned as it is. When the file cannot be read the domains of the previous list are kept
+func refreshBlocklist(path string, previous *blocklist, force bool) *blocklist {
+	info, err := os.Stat(path)
+	if previous != nil && !force && err == nil && info.ModTime().Equal(previous.modTime) && info.Size() == previous.size {
+		return previous
+	}
+	if previous != nil && !force && err != nil && previous.err != nil {
+		// still missing. nothing to log again
+		return previous
+	}
+
+	l := &blocklist{
+		name:     strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+		path:     path,
+		loadedAt: time.Now(),
+	}
+	if previous != nil {
+		l.hits = atomic.LoadUint64(&previous.hits)
+		l.lastHit = atomic.LoadInt64(&previous.lastHit)
+	}
+	if err == nil {
+		l.modTime = info.ModTime()
+		l.size = info.Size()
+		l.domains, err = readBlocklist(path)
+	}
+	if err != nil {
+		log.Errorf("could not read DNS blocklist %s: %v", path, err)
+		l.err = err
+		if previous != nil {
+			l.domains = previous.domains
+		}
+		return l
+	}
+	log.Infof("loaded DNS blocklist %s with %d domains", path, len(l.domains))
+	return l
+}
+
+// readBlocklist reads a file in hosts format (an address followed by names) or domain list format (one domain per
+// line). Both formats may be mixed. Comments start with # or !. Entries written as *.example.com, ||example.com^ or
+// .example.com are read as example.com. The [Adblock Plus] header of adblock lists is skipped
+func readBlocklist(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	domains := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), "[") {
+			continue
+		}
+		if i := strings.IndexAny(line, "#!"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) != nil {
+			// hosts format. every name after the address is blocked
+			fields = fields[1:]
+		}
+		for _, f := range fields {
+			f = strings.TrimSuffix(strings.TrimPrefix(f, "||"), "^")
+			d := blocklistKey(strings.TrimPrefix(f, "*"))
+			if d == "" || hostsFileOwnNames[d] {
+				continue
+			}
+			if _, ok := dns.IsDomainName(d); !ok {
+				continue
+			}
+			domains[d] = true
+		}
+	}
+	return domains, scanner.Err()
+}
+
+// blocklistKey is the form domains are kept in: lower case without leading or trailing periods
+func blocklistKey(name string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(name), "."))
+}
+
+// match returns the list blocking the name or nil. A name is blocked when it or any domain above it is on a list and
+// neither it nor any domain above it is on the allowlist
+func (b *dnsBlocker) match(name string) *blocklist {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.lists) == 0 {
+		return nil
+	}
+	key := blocklistKey(name)
+	for d := key; d != ""; d = parentDomain(d) {
+		if b.allow[d] {
+			return nil
+		}
+	}
+	for d := key; d != ""; d = parentDomain(d) {
+		for _, l := range b.lists {
+			if l.domains[d] {
+				return l
+			}
+		}
+	}
+	return nil
+}
+
+func parentDomain(d string) string {
+	if i := strings.Index(d, "."); i >= 0 {
+		return d[i+1:]
+	}
+	return ""
+}
+
+// reply answers a blocked query with NXDOMAIN, or with 0.0.0.0 and :: in zero mode. Other types get an empty answer
+// in zero mode
+func (b *dnsBlocker) reply(q *dns.Msg) *dns.Msg {
+	b.mu.RLock()
+	mode := b.mode
+	b.mu.RUnlock()
+
+	query := q.Question[0]
+	msg := &dns.Msg{}
+	msg.SetReply(q)
+	msg.Authoritative = true
+	msg.RecursionAvailable = true
+	if mode == constants.DnsBlockModeZero {
+		hdr := dns.RR_Header{Name: query.Name, Rrtype: query.Qtype, Class: dns.ClassINET, Ttl: blockedTtl}
+		switch query.Qtype {
+		case dns.TypeA:
+			msg.Answer = append(msg.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+		case dns.TypeAAAA:
+			msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+		}
+	} else {
+		msg.Rcode = dns.RcodeNameError
+	}
+	if opt := q.IsEdns0(); opt != nil {
+		msg.SetEdns0(uint16(clientUdpSize(q)), opt.Do())
+	}
+	return msg
+}
+
+// resolveBlocked answers a query about a name found on a blocklist and counts the hit. nil is returned when the name
+// is not blocked
+func resolveBlocked(q *dns.Msg) *dns.Msg {
+	l := blocker.match(q.Question[0].Name)
+	if l == nil {
+		return nil
+	}
+	atomic.AddUint64(&l.hits, 1)
+	atomic.StoreInt64(&l.lastHit, time.Now().UnixNano())
+	log.Debugf("blocked %s %s. found on blocklist %s", dns.Type(q.Question[0].Qtype), q.Question[0].Name, l.name)
+	return blocker.reply(q)
+}
+
+func (l *blocklist) stats() dto.DnsBlocklistStats {
+	s := dto.DnsBlocklistStats{
+		Name:     l.name,
+		Path:     l.path,
+		Domains:  len(l.domains),
+		Hits:     atomic.LoadUint64(&l.hits),
+		LoadedAt: l.loadedAt,
+	}
+	if last := atomic.LoadInt64(&l.lastHit); last != 0 {
+		s.LastHit = time.Unix(0, last)
+	}
+	if l.err != nil {
+		s.Error = l.err.Error()
+	}
+	return s
+}
+
+// GetDnsBlocklists returns the blocklists with their hit counters
+func GetDnsBlocklists() dto.DnsBlocklistStatus {
+	blocker.mu.RLock()
+	defer blocker.mu.RUnlock()
+	status := dto.DnsBlocklistStatus{
+		Mode:      blocker.mode,
+		Allowlist: make([]string, 0, len(blocker.allow)),
+		Lists:     make([]dto.DnsBlocklistStats, 0, len(blocker.lists)),
+	}
+	for d := range blocker.allow {
+		status.Allowlist = append(status.Allowlist, d)
+	}
+	for _, l := range blocker.lists {
+		status.Lists = append(status.Lists, l.stats())
+	}
+	return status
+}
+
+// DnsBlocklistHits returns the stats of every list which blocked a query since DnsBlocklistHits was last called. nil
+// is returned when no list did
+func DnsBlocklistHits() []dto.DnsBlocklistStats {
+	blocker.mu.Lock()
+	defer blocker.mu.Unlock()
+	var changed []dto.DnsBlocklistStats
+	for _, l := range blocker.lists {
+		hits := atomic.LoadUint64(&l.hits)
+		if hits != blocker.reported[l.path] {
+			blocker.reported[l.path] = hits
+			changed = append(changed, l.stats())
+		}
+	}
+	return changed
+}
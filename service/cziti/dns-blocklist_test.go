@@ -0,0 +1,231 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+)
+
+// writeBlocklist writes a blocklist file to a temporary directory removed when the test ends
+func writeBlocklist(t *testing.T, name string, content string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useBlocklists replaces the blocklists for the test and drops them when it ends
+func useBlocklists(t *testing.T, paths []string, allowlist []string) {
+	t.Helper()
+	SetDnsBlocklists(paths, allowlist, constants.DnsBlockModeNxdomain)
+	t.Cleanup(func() { SetDnsBlocklists(nil, nil, "") })
+}
+
+func TestReadBlocklist(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name: "hosts",
+			content: "# ads\n" +
+				"127.0.0.1 localhost\n" +
+				"::1 ip6-localhost ip6-loopback\n" +
+				"0.0.0.0 0.0.0.0\n" +
+				"0.0.0.0 ads.example.com tracker.example.com # trailing comment\n" +
+				"127.0.0.1\tMalware.Example.ORG\n",
+			want: []string{"ads.example.com", "malware.example.org", "tracker.example.com"},
+		},
+		{
+			name:    "domain list",
+			content: "ads.example.com\n\n  tracker.example.com.  \n*.wild.example.net\n.dot.example.net\nbad..name\n",
+			want:    []string{"ads.example.com", "dot.example.net", "tracker.example.com", "wild.example.net"},
+		},
+		{
+			name:    "adblock",
+			content: "! Title: ads\n[Adblock Plus 2.0]\n||ads.example.com^\n||tracker.example.com^ ! trailing comment\n",
+			want:    []string{"ads.example.com", "tracker.example.com"},
+		},
+		{
+			name:    "mixed",
+			content: "0.0.0.0 ads.example.com\ntracker.example.com\n||malware.example.org^\n",
+			want:    []string{"ads.example.com", "malware.example.org", "tracker.example.com"},
+		},
+		{
+			name:    "empty",
+			content: "# nothing\n",
+			want:    []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domains, err := readBlocklist(writeBlocklist(t, "list.txt", tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(domains))
+			for d := range domains {
+				got = append(got, d)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readBlocklist = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadBlocklistWithoutFile(t *testing.T) {
+	if _, err := readBlocklist(filepath.Join(os.TempDir(), "no-such-blocklist.txt")); err == nil {
+		t.Error("a missing blocklist was read")
+	}
+}
+
+func TestBlocklistMatch(t *testing.T) {
+	ads := writeBlocklist(t, "ads.txt", "0.0.0.0 ads.example.com\n||tracker.example.org^\n")
+	malware := writeBlocklist(t, "malware.txt", "example.net\nads.example.com\n")
+	useBlocklists(t, []string{ads, malware}, []string{"good.ads.example.com", "Example.NET."})
+
+	tests := []struct {
+		name string
+		want string // the list blocking the name, empty when it is not blocked
+	}{
+		{name: "ads.example.com.", want: "ads"},
+		{name: "ADS.example.com", want: "ads"},
+		{name: "deep.sub.ads.example.com.", want: "ads"},
+		{name: "x.tracker.example.org.", want: "ads"},
+		{name: "example.com."},
+		{name: "notads.example.com."},
+		{name: "good.ads.example.com."},
+		{name: "x.good.ads.example.com."},
+		{name: "example.net."},
+		{name: "www.example.net."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if l := blocker.match(tt.name); l != nil {
+				got = l.name
+			}
+			if got != tt.want {
+				t.Errorf("match(%s) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlocklistAllowlistOfParentDomain(t *testing.T) {
+	list := writeBlocklist(t, "ads.txt", "ads.example.com\n")
+	useBlocklists(t, []string{list}, []string{"example.com"})
+	if l := blocker.match("ads.example.com."); l != nil {
+		t.Errorf("ads.example.com was blocked by %s while example.com is allowed", l.name)
+	}
+}
+
+func blockedQuery(t *testing.T, name string) {
+	t.Helper()
+	q := &dns.Msg{}
+	q.SetQuestion(name, dns.TypeA)
+	reply := resolveBlocked(q)
+	if reply == nil || reply.Rcode != dns.RcodeNameError {
+		t.Fatalf("%s was not blocked: %v", name, reply)
+	}
+}
+
+func TestBlocklistHitsSurviveReload(t *testing.T) {
+	path := writeBlocklist(t, "ads.txt", "ads.example.com\n")
+	useBlocklists(t, []string{path}, nil)
+	blockedQuery(t, "ads.example.com.")
+	blockedQuery(t, "x.ads.example.com.")
+
+	if ReloadDnsBlocklists(false) {
+		t.Error("an unchanged blocklist was read again")
+	}
+	if err := ioutil.WriteFile(path, []byte("ads.example.com\ntracker.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !ReloadDnsBlocklists(false) {
+		t.Fatal("a changed blocklist was not read again")
+	}
+	blockedQuery(t, "tracker.example.com.")
+
+	lists := GetDnsBlocklists().Lists
+	if len(lists) != 1 || lists[0].Domains != 2 || lists[0].Hits != 3 {
+		t.Fatalf("blocklists = %+v, want one with 2 domains and 3 hits", lists)
+	}
+	if lists[0].LastHit.IsZero() {
+		t.Error("last hit was not kept")
+	}
+
+	if !ReloadDnsBlocklists(true) {
+		t.Error("a forced reload did not read the blocklist")
+	}
+	if lists = GetDnsBlocklists().Lists; lists[0].Hits != 3 {
+		t.Errorf("hits = %d after a forced reload, want 3", lists[0].Hits)
+	}
+
+	// the lists are set again after the file changed
+	if err := ioutil.WriteFile(path, []byte("tracker.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	SetDnsBlocklists([]string{path}, nil, constants.DnsBlockModeNxdomain)
+	if lists = GetDnsBlocklists().Lists; lists[0].Domains != 1 || lists[0].Hits != 3 {
+		t.Errorf("blocklist has %d domains and %d hits after it was set again, want 1 and 3", lists[0].Domains, lists[0].Hits)
+	}
+}
+
+func TestBlocklistKeepsItsDomainsWhenTheFileIsRemoved(t *testing.T) {
+	path := writeBlocklist(t, "ads.txt", "ads.example.com\n")
+	useBlocklists(t, []string{path}, nil)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if !ReloadDnsBlocklists(false) {
+		t.Fatal("a removed blocklist was not noticed")
+	}
+	lists := GetDnsBlocklists().Lists
+	if len(lists) != 1 || lists[0].Error == "" {
+		t.Errorf("blocklists = %+v, want one with an error", lists)
+	}
+	blockedQuery(t, "ads.example.com.")
+}
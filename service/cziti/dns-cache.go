@@ -0,0 +1,246 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+const (
+	// the most responses held in the upstream cache. the entry closest to expiring is evicted when full
+	MaxDnsCacheEntries = 4096
+	// no response is cached for longer than this regardless of its ttl
+	MaxDnsCacheTtl = time.Hour
+	// negative responses are cached for the SOA minimum up to this long
+	MaxDnsNegativeCacheTtl = 5 * time.Minute
+)
+
+type dnsCacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type dnsCacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache holds upstream responses keyed by question. Both answers and negative responses (NXDOMAIN and NODATA) are
+// cached according to RFC 2308
+type dnsCache struct {
+	mu         sync.Mutex
+	entries    map[dnsCacheKey]*dnsCacheEntry
+	maxEntries int
+	hits       uint64
+	misses     uint64
+}
+
+var upstreamCache = newDnsCache(MaxDnsCacheEntries)
+
+func newDnsCache(maxEntries int) *dnsCache {
+	return &dnsCache{
+		entries:    make(map[dnsCacheKey]*dnsCacheEntry),
+		maxEntries: maxEntries,
+	}
+}
+
+func cacheKey(q *dns.Msg) dnsCacheKey {
+	question := q.Question[0]
+	return dnsCacheKey{
+		name:   strings.ToLower(question.Name),
+		qtype:  question.Qtype,
+		qclass: question.Qclass,
+	}
+}
+
+// get returns a reply to the query from the cache with the ttls reduced by the time spent in the cache
+func (c *dnsCache) get(q *dns.Msg) *dns.Msg {
+	return c.lookup(q, true)
+}
+
+// peek is get without counting a hit or a miss
+func (c *dnsCache) peek(q *dns.Msg) *dns.Msg {
+	return c.lookup(q, false)
+}
+
+func (c *dnsCache) lookup(q *dns.Msg, count bool) *dns.Msg {
+	if len(q.Question) == 0 {
+		return nil
+	}
+	key := cacheKey(q)
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, found := c.entries[key]
+	if found && now.After(entry.expires) {
+		delete(c.entries, key)
+		found = false
+	}
+	c.mu.Unlock()
+
+	if !found {
+		if count {
+			atomic.AddUint64(&c.misses, 1)
+		}
+		return nil
+	}
+	if count {
+		atomic.AddUint64(&c.hits, 1)
+	}
+
+	reply := entry.msg.Copy()
+	reply.Id = q.Id
+	// the cached OPT record reflects whichever client asked first
+	extra := reply.Extra[:0]
+	for _, rr := range reply.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	reply.Extra = extra
+	if opt := q.IsEdns0(); opt != nil {
+		reply.SetEdns0(uint16(clientUdpSize(q)), opt.Do())
+	}
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return reply
+}
+
+// put stores the upstream reply when it is cacheable
+func (c *dnsCache) put(q *dns.Msg, reply *dns.Msg) {
+	if len(q.Question) == 0 || reply.Truncated {
+		return
+	}
+	ttl, ok := cacheTtl(reply)
+	if !ok || ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	entry := &dnsCacheEntry{
+		msg:     reply.Copy(),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.maxEntries {
+		c.evict(now)
+	}
+	c.entries[cacheKey(q)] = entry
+}
+
+// evict drops every expired entry, or the entry closest to expiring when none have expired. must hold the lock
+func (c *dnsCache) evict(now time.Time) {
+	var soonestKey dnsCacheKey
+	var soonest *dnsCacheEntry
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+			continue
+		}
+		if soonest == nil || e.expires.Before(soonest.expires) {
+			soonestKey, soonest = k, e
+		}
+	}
+	if len(c.entries) >= c.maxEntries && soonest != nil {
+		delete(c.entries, soonestKey)
+	}
+}
+
+// cacheTtl returns how long a reply may be cached. Answers use their lowest ttl. Negative responses use the SOA from
+// the authority section and are not cached without one
+func cacheTtl(reply *dns.Msg) (time.Duration, bool) {
+	switch {
+	case reply.Rcode == dns.RcodeSuccess && len(reply.Answer) > 0:
+		min := uint32(MaxDnsCacheTtl / time.Second)
+		for _, rr := range reply.Answer {
+			if rr.Header().Ttl < min {
+				min = rr.Header().Ttl
+			}
+		}
+		return time.Duration(min) * time.Second, true
+	case reply.Rcode == dns.RcodeNameError || reply.Rcode == dns.RcodeSuccess:
+		for _, rr := range reply.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				d := time.Duration(ttl) * time.Second
+				if d > MaxDnsNegativeCacheTtl {
+					d = MaxDnsNegativeCacheTtl
+				}
+				return d, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (c *dnsCache) flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count := len(c.entries)
+	c.entries = make(map[dnsCacheKey]*dnsCacheEntry)
+	return count
+}
+
+func (c *dnsCache) stats() dto.DnsCacheStats {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+	return dto.DnsCacheStats{
+		Entries: entries,
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+	}
+}
+
+// FlushDnsCache drops every cached upstream response and returns the cache statistics from before the flush
+func FlushDnsCache() dto.DnsCacheStats {
+	s := upstreamCache.stats()
+	flushed := upstreamCache.flush()
+	log.Infof("flushed %d DNS cache entries. hits: %d, misses: %d", flushed, s.Hits, s.Misses)
+	return s
+}
+
+func GetDnsCacheStats() dto.DnsCacheStats {
+	return upstreamCache.stats()
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func cacheQuery(name string) *dns.Msg {
+	q := &dns.Msg{}
+	q.SetQuestion(name, dns.TypeA)
+	return q
+}
+
+func cacheAnswer(q *dns.Msg, ttls ...uint32) *dns.Msg {
+	reply := &dns.Msg{}
+	reply.SetReply(q)
+	for i, ttl := range ttls {
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IPv4(192, 0, 2, byte(i+1)),
+		})
+	}
+	return reply
+}
+
+func negativeAnswer(q *dns.Msg, rcode int, soaTtl uint32, minTtl uint32) *dns.Msg {
+	reply := &dns.Msg{}
+	reply.SetRcode(q, rcode)
+	reply.Ns = append(reply.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soaTtl},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: minTtl,
+	})
+	return reply
+}
+
+// age makes the cached entry of the query look stored that long ago
+func (c *dnsCache) age(q *dns.Msg, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[cacheKey(q)]
+	e.stored = e.stored.Add(-d)
+	e.expires = e.expires.Add(-d)
+}
+
+func TestDnsCacheDecrementsTtlOnHit(t *testing.T) {
+	c := newDnsCache(16)
+	q := cacheQuery("web.example.com.")
+	c.put(q, cacheAnswer(q, 300, 120))
+
+	c.age(q, 100*time.Second)
+	again := cacheQuery("WEB.example.com.")
+	reply := c.get(again)
+	if reply == nil {
+		t.Fatal("cached answer was not found")
+	}
+	if reply.Id != again.Id {
+		t.Errorf("reply id = %d, want the id of the query %d", reply.Id, again.Id)
+	}
+	if got := []uint32{reply.Answer[0].Header().Ttl, reply.Answer[1].Header().Ttl}; got[0] != 200 || got[1] != 20 {
+		t.Errorf("ttls = %v after 100s in the cache, want [200 20]", got)
+	}
+	if s := c.stats(); s.Hits != 1 || s.Misses != 0 {
+		t.Errorf("hits = %d, misses = %d, want one hit", s.Hits, s.Misses)
+	}
+
+	// the cached reply itself is not changed by a hit
+	if reply = c.peek(q); reply.Answer[0].Header().Ttl != 200 {
+		t.Errorf("ttl = %d on the second hit, want 200", reply.Answer[0].Header().Ttl)
+	}
+
+	c.age(q, 21*time.Second)
+	if reply = c.get(q); reply != nil {
+		t.Errorf("expired answer was returned: %v", reply)
+	}
+	if s := c.stats(); s.Entries != 0 || s.Misses != 1 {
+		t.Errorf("entries = %d, misses = %d after the answer expired, want 0 and 1", s.Entries, s.Misses)
+	}
+}
+
+func TestCacheTtl(t *testing.T) {
+	q := cacheQuery("web.example.com.")
+	truncated := cacheAnswer(q, 300)
+	truncated.Truncated = true
+	tests := []struct {
+		name   string
+		reply  *dns.Msg
+		want   time.Duration
+		cached bool
+	}{
+		{name: "lowest ttl of the answers", reply: cacheAnswer(q, 300, 60, 120), want: time.Minute, cached: true},
+		{name: "answer ttl is capped", reply: cacheAnswer(q, 86400), want: MaxDnsCacheTtl, cached: true},
+		{name: "NXDOMAIN uses the SOA minimum", reply: negativeAnswer(q, dns.RcodeNameError, 3600, 60), want: time.Minute, cached: true},
+		{name: "SOA ttl below its minimum", reply: negativeAnswer(q, dns.RcodeNameError, 30, 60), want: 30 * time.Second, cached: true},
+		{name: "NODATA uses the SOA minimum", reply: negativeAnswer(q, dns.RcodeSuccess, 3600, 90), want: 90 * time.Second, cached: true},
+		{name: "negative ttl is capped", reply: negativeAnswer(q, dns.RcodeNameError, 86400, 86400), want: MaxDnsNegativeCacheTtl, cached: true},
+		{name: "NXDOMAIN without SOA", reply: new(dns.Msg).SetRcode(q, dns.RcodeNameError)},
+		{name: "SERVFAIL", reply: negativeAnswer(q, dns.RcodeServerFailure, 3600, 60)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, cached := cacheTtl(tt.reply)
+			if cached != tt.cached || got != tt.want {
+				t.Errorf("cacheTtl = %v, %t, want %v, %t", got, cached, tt.want, tt.cached)
+			}
+
+			c := newDnsCache(16)
+			c.put(q, tt.reply)
+			if stored := c.peek(q) != nil; stored != tt.cached {
+				t.Errorf("reply stored = %t, want %t", stored, tt.cached)
+			}
+		})
+	}
+
+	c := newDnsCache(16)
+	for _, reply := range []*dns.Msg{truncated, cacheAnswer(q, 0)} {
+		c.put(q, reply)
+	}
+	if c.stats().Entries != 0 {
+		t.Error("a truncated reply or a reply with a ttl of 0 was cached")
+	}
+}
+
+func TestNegativeAnswerIsCachedForTheSoaMinimum(t *testing.T) {
+	c := newDnsCache(16)
+	q := cacheQuery("missing.example.com.")
+	c.put(q, negativeAnswer(q, dns.RcodeNameError, 3600, 60))
+
+	c.age(q, 59*time.Second)
+	reply := c.get(q)
+	if reply == nil || reply.Rcode != dns.RcodeNameError {
+		t.Fatalf("negative answer was not cached: %v", reply)
+	}
+	if ttl := reply.Ns[0].Header().Ttl; ttl != 3600-59 {
+		t.Errorf("SOA ttl = %d, want %d", ttl, 3600-59)
+	}
+	c.age(q, 2*time.Second)
+	if reply = c.get(q); reply != nil {
+		t.Errorf("negative answer was cached beyond the SOA minimum: %v", reply)
+	}
+}
+
+func TestDnsCacheEvictsAtMaxEntries(t *testing.T) {
+	c := newDnsCache(2)
+	a, b, d := cacheQuery("a.example.com."), cacheQuery("b.example.com."), cacheQuery("d.example.com.")
+	c.put(a, cacheAnswer(a, 100))
+	c.put(b, cacheAnswer(b, 300))
+	c.put(d, cacheAnswer(d, 200))
+	if c.peek(a) != nil || c.peek(b) == nil || c.peek(d) == nil {
+		t.Error("the entry closest to expiring was not the one evicted")
+	}
+
+	// expired entries go first, even when they are not the closest to expiring
+	c.age(b, 301*time.Second)
+	e := cacheQuery("e.example.com.")
+	c.put(e, cacheAnswer(e, 50))
+	if s := c.stats(); s.Entries != 2 {
+		t.Errorf("entries = %d, want 2", s.Entries)
+	}
+	if c.peek(d) == nil || c.peek(e) == nil {
+		t.Error("an entry was evicted while an expired one was held")
+	}
+}
+
+func TestDnsCacheLookupAnswersWithTheOptOfTheQuery(t *testing.T) {
+	c := newDnsCache(16)
+	first := cacheQuery("web.example.com.")
+	first.SetEdns0(4096, true)
+	reply := cacheAnswer(first, 300)
+	reply.SetEdns0(4096, true)
+	c.put(first, reply)
+
+	tests := []struct {
+		name     string
+		edns     uint16 // 0 for a query without OPT
+		do       bool
+		wantSize uint16
+	}{
+		{name: "without OPT"},
+		{name: "smaller size", edns: 1232, wantSize: 1232},
+		{name: "DO bit", edns: 1232, do: true, wantSize: 1232},
+		{name: "larger size is capped", edns: 65000, wantSize: MaxEdnsUdpSize},
+		{name: "size below the minimum", edns: 100, wantSize: dns.MinMsgSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := cacheQuery("web.example.com.")
+			if tt.edns > 0 {
+				q.SetEdns0(tt.edns, tt.do)
+			}
+			got := c.get(q)
+			if got == nil {
+				t.Fatal("cached answer was not found")
+			}
+			opts := 0
+			for _, rr := range got.Extra {
+				if rr.Header().Rrtype == dns.TypeOPT {
+					opts++
+				}
+			}
+			if tt.edns == 0 {
+				if opts != 0 {
+					t.Errorf("reply to a query without OPT has %d OPT record(s)", opts)
+				}
+				return
+			}
+			if opts != 1 {
+				t.Fatalf("reply has %d OPT record(s), want one", opts)
+			}
+			if opt := got.IsEdns0(); opt.UDPSize() != tt.wantSize || opt.Do() != tt.do {
+				t.Errorf("OPT has size %d and DO %t, want %d and %t", opt.UDPSize(), opt.Do(), tt.wantSize, tt.do)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/openziti/desktop-edge-win/service/windns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+// ResolveDiagnostic resolves a name through the same stages as a query sent to the ziti DNS server and reports which
+// stage answered and whether NRPT sends the name to the ziti DNS server at all. The answer is not cached and the query
+// is not added to the DNS log
+func ResolveDiagnostic(name string, qtype string) (dto.DnsResolution, error) {
+	if qtype == "" {
+		qtype = "A"
+	}
+	t, found := dns.StringToType[strings.ToUpper(qtype)]
+	if !found {
+		return dto.DnsResolution{}, fmt.Errorf("unknown query type: %s", qtype)
+	}
+	if strings.TrimSpace(name) == "" {
+		return dto.DnsResolution{}, fmt.Errorf("no name given")
+	}
+
+	q := &dns.Msg{}
+	q.SetQuestion(dns.Fqdn(strings.TrimSpace(name)), t)
+	result := dto.DnsResolution{
+		Name:    q.Question[0].Name,
+		Type:    dns.Type(t).String(),
+		Answers: make([]string, 0),
+		IPs:     make([]string, 0),
+	}
+
+	start := time.Now()
+	var reply *dns.Msg
+	if reply = resolveRecords(q); reply != nil {
+		result.Stage = dto.DnsStageRecords
+	} else if reply = resolveLocally(q); reply != nil {
+		result.Stage = dto.DnsStageZiti
+		if dnsMgrPrivate.resolveWithConnectionSpecificDomain(q.Question[0].Name, false) == nil {
+			result.Stage = dto.DnsStageZitiSuffix
+		}
+	} else if l := blocker.match(q.Question[0].Name); l != nil {
+		result.Stage = dto.DnsStageBlocklist
+		result.Blocklist = l.name
+		reply = blocker.reply(q)
+	} else if reply = upstreamCache.peek(q); reply != nil {
+		result.Stage = dto.DnsStageCache
+	} else {
+		result.Stage = dto.DnsStageUpstream
+		var err error
+		pool := poolFor(q.Question[0].Name)
+		result.Upstream = strings.Join(pool.addrs(), ",")
+		if reply, err = pool.exchange(q, "udp"); err != nil {
+			result.Error = err.Error()
+		}
+	}
+	result.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+
+	if reply != nil {
+		result.Rcode = dns.RcodeToString[reply.Rcode]
+		for _, rr := range reply.Answer {
+			result.Answers = append(result.Answers, rr.String())
+			switch a := rr.(type) {
+			case *dns.A:
+				result.IPs = append(result.IPs, a.A.String())
+			case *dns.AAAA:
+				result.IPs = append(result.IPs, a.AAAA.String())
+			}
+		}
+	}
+
+	namespace, servers, err := windns.NrptRouteFor(result.Name)
+	if err != nil {
+		result.NrptError = err.Error()
+	}
+	result.NrptNamespace = namespace
+	result.NrptServers = servers
+	if dnsServer := dnsServerIp(); dnsServer != nil {
+		for _, s := range servers {
+			if strings.TrimSpace(s) == dnsServer.String() {
+				result.NrptRoutesToZiti = true
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"github.com/openziti/desktop-edge-win/service/windns"
+)
+
+// forwardRule sends every query for a name at or below suffix to its own pool of upstream servers
+type forwardRule struct {
+	suffix string // lower case and fully qualified. e.g. lab.local.
+	pool   *upstreamPool
+}
+
+var forwardMutex sync.RWMutex
+var forwardRules []*forwardRule // longest suffix first
+var pinnedUpstreams []string
+
+// ConfigureDnsForwarding sets the upstream servers used instead of the servers detected on the local interfaces and
+// the rules forwarding names below a suffix to specific servers. Servers are given in any form accepted by
+// dnsutil.ParseUpstream. An empty pinned list goes back to the detected servers. fallback allows queries to be sent
+// to the detected servers when every encrypted server fails. ReloadDnsUpstreams must be called afterwards for pinned
+// servers to take effect
+func ConfigureDnsForwarding(pinned []string, rules map[string][]string, fallback bool) {
+	newRules := make([]*forwardRule, 0, len(rules))
+	for suffix, servers := range rules {
+		pool := &upstreamPool{}
+		pool.setServers(servers)
+		newRules = append(newRules, &forwardRule{
+			suffix: dns.Fqdn(strings.ToLower(strings.Trim(suffix, "."))),
+			pool:   pool,
+		})
+	}
+	sort.Slice(newRules, func(i, j int) bool {
+		return len(newRules[i].suffix) > len(newRules[j].suffix)
+	})
+
+	forwardMutex.Lock()
+	previous := forwardNrptNamespaces(forwardRules)
+	forwardRules = newRules
+	pinnedUpstreams = pinned
+	forwardMutex.Unlock()
+
+	if fallback {
+		atomic.StoreInt32(&plainFallbackEnabled, 1)
+	} else {
+		atomic.StoreInt32(&plainFallbackEnabled, 0)
+	}
+
+	// answers from the previous upstreams may not match what the new upstreams would answer
+	upstreamCache.flush()
+
+	for _, r := range newRules {
+		log.Infof("forwarding DNS queries for %s to %v", r.suffix, r.pool.addrs())
+	}
+
+	dnsIp := dnsServerIp()
+	if dnsIp == nil {
+		// NRPT rules are added once the DNS server is running
+		return
+	}
+	current := forwardNrptNamespaces(newRules)
+	removed := make(map[string]bool)
+	for ns := range previous {
+		if !current[ns] {
+			removed[ns] = true
+		}
+	}
+	windns.RemoveNrptRules(removed)
+	windns.AddNrptRules(current, dnsIp.String())
+}
+
+// forwardNrptNamespaces returns the NRPT namespace of every rule. The Windows resolver only sends names to the ziti DNS
+// server when they match an NRPT rule, so every forwarded suffix needs one
+func forwardNrptNamespaces(rules []*forwardRule) map[string]bool {
+	namespaces := make(map[string]bool)
+	for _, r := range rules {
+		namespaces[fmt.Sprintf(".%s", strings.TrimSuffix(r.suffix, "."))] = true
+	}
+	return namespaces
+}
+
+func currentForwardNrptNamespaces() map[string]bool {
+	forwardMutex.RLock()
+	defer forwardMutex.RUnlock()
+	return forwardNrptNamespaces(forwardRules)
+}
+
+func getPinnedUpstreams() []string {
+	forwardMutex.RLock()
+	defer forwardMutex.RUnlock()
+	return pinnedUpstreams
+}
+
+// poolFor returns the pool of the longest forwarding rule matching the name, or the default upstreams when no rule
+// matches
+func poolFor(name string) *upstreamPool {
+	name = strings.ToLower(name)
+	forwardMutex.RLock()
+	defer forwardMutex.RUnlock()
+	for _, r := range forwardRules {
+		if name == r.suffix || strings.HasSuffix(name, "."+r.suffix) {
+			return r.pool
+		}
+	}
+	return upstreams
+}
+
+// allPools returns the default upstreams, the plain fallback when enabled and the pool of every forwarding rule
+func allPools() []*upstreamPool {
+	forwardMutex.RLock()
+	defer forwardMutex.RUnlock()
+	pools := make([]*upstreamPool, 0, len(forwardRules)+2)
+	pools = append(pools, upstreams)
+	if atomic.LoadInt32(&plainFallbackEnabled) == 1 {
+		pools = append(pools, plainFallback)
+	}
+	for _, r := range forwardRules {
+		pools = append(pools, r.pool)
+	}
+	return pools
+}
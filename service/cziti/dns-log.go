@@ -0,0 +1,237 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+const (
+	// the most queries kept in memory. the oldest query is dropped when full
+	MaxDnsLogEntries = 1000
+	// the most names counters are kept for. the name seen least recently is dropped when full
+	MaxDnsLogNames = 1000
+	// the log file is moved to <file>.1 once it grows past this size
+	MaxDnsLogFileSize = 10 * 1024 * 1024
+)
+
+// queryLog keeps the most recent DNS queries and counters per name. Queries can also be appended to a file as json
+// lines
+type queryLog struct {
+	mu       sync.Mutex
+	entries  []dto.DnsLogEntry // ring buffer. next is the oldest entry once the buffer is full
+	next     int
+	names    map[string]*dto.DnsNameStats
+	sink     *os.File
+	sinkPath string
+	sinkSize int64
+}
+
+var dnsLog = &queryLog{
+	entries: make([]dto.DnsLogEntry, 0, MaxDnsLogEntries),
+	names:   make(map[string]*dto.DnsNameStats),
+}
+
+// logQuery records how a query was answered. received is when the query arrived at the DNS server
+func logQuery(q *dns.Msg, client net.Addr, disposition string, received time.Time) {
+	now := time.Now()
+	question := q.Question[0]
+	entry := dto.DnsLogEntry{
+		Time:        received,
+		Name:        strings.ToLower(question.Name),
+		Type:        dns.Type(question.Qtype).String(),
+		Disposition: disposition,
+		LatencyMs:   float64(now.Sub(received).Microseconds()) / 1000,
+	}
+	if client != nil {
+		entry.Client = client.String()
+	}
+	dnsLog.add(entry)
+}
+
+// localDisposition classifies a reply built by the ziti DNS itself
+func localDisposition(reply *dns.Msg) string {
+	if reply.Rcode == dns.RcodeRefused {
+		return dto.DnsDispositionRefused
+	}
+	return dto.DnsDispositionZiti
+}
+
+// upstreamDisposition classifies the result of sending a query to the upstream DNS
+func upstreamDisposition(err error) string {
+	if err == nil {
+		return dto.DnsDispositionProxied
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return dto.DnsDispositionExpired
+	}
+	return dto.DnsDispositionFailed
+}
+
+func (l *queryLog) add(entry dto.DnsLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.entries) < MaxDnsLogEntries {
+		l.entries = append(l.entries, entry)
+	} else {
+		l.entries[l.next] = entry
+		l.next = (l.next + 1) % MaxDnsLogEntries
+	}
+
+	stats, found := l.names[entry.Name]
+	if !found {
+		if len(l.names) >= MaxDnsLogNames {
+			l.evictName()
+		}
+		stats = &dto.DnsNameStats{Name: entry.Name, Dispositions: make(map[string]uint64)}
+		l.names[entry.Name] = stats
+	}
+	stats.Queries++
+	stats.Dispositions[entry.Disposition]++
+	stats.LastSeen = entry.Time
+
+	if l.sink != nil {
+		l.writeSink(entry)
+	}
+}
+
+// evictName drops the name seen least recently. must hold the lock
+func (l *queryLog) evictName() {
+	var oldest *dto.DnsNameStats
+	for _, s := range l.names {
+		if oldest == nil || s.LastSeen.Before(oldest.LastSeen) {
+			oldest = s
+		}
+	}
+	if oldest != nil {
+		delete(l.names, oldest.Name)
+	}
+}
+
+// writeSink appends the entry to the log file, rotating it when it is too large. must hold the lock
+func (l *queryLog) writeSink(entry dto.DnsLogEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	if l.sinkSize+int64(len(b)) > MaxDnsLogFileSize {
+		_ = l.sink.Close()
+		_ = os.Remove(l.sinkPath + ".1")
+		if err = os.Rename(l.sinkPath, l.sinkPath+".1"); err != nil {
+			log.Warnf("could not rotate DNS log file %s: %v", l.sinkPath, err)
+		}
+		if err = l.openSink(l.sinkPath); err != nil {
+			log.Errorf("DNS queries are no longer written to %s: %v", l.sinkPath, err)
+			l.sink = nil
+			return
+		}
+	}
+	n, err := l.sink.Write(b)
+	l.sinkSize += int64(n)
+	if err != nil {
+		log.Warnf("could not write to DNS log file %s: %v", l.sinkPath, err)
+	}
+}
+
+// openSink opens the log file for appending. must hold the lock
+func (l *queryLog) openSink(path string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	l.sink = f
+	l.sinkPath = path
+	l.sinkSize = info.Size()
+	return nil
+}
+
+// SetDnsLogFile appends every DNS query to the given file as json lines. An empty path stops writing to the file
+func SetDnsLogFile(path string) error {
+	dnsLog.mu.Lock()
+	defer dnsLog.mu.Unlock()
+	if dnsLog.sink != nil {
+		_ = dnsLog.sink.Close()
+		dnsLog.sink = nil
+	}
+	if strings.TrimSpace(path) == "" {
+		return nil
+	}
+	if err := dnsLog.openSink(path); err != nil {
+		return fmt.Errorf("could not open DNS log file %s: %v", path, err)
+	}
+	log.Infof("writing DNS queries to %s", path)
+	return nil
+}
+
+// GetDnsLog returns up to limit of the most recent queries, newest first, and the counters of every name. When name is
+// not empty only queries and counters for names containing it are returned. A limit of 0 returns every query
+func GetDnsLog(limit int, name string) dto.DnsLog {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	dnsLog.mu.Lock()
+	defer dnsLog.mu.Unlock()
+
+	result := dto.DnsLog{
+		Entries: make([]dto.DnsLogEntry, 0),
+		Names:   make([]dto.DnsNameStats, 0),
+	}
+	count := len(dnsLog.entries)
+	for i := 0; i < count; i++ {
+		// walk backwards from the newest entry
+		e := dnsLog.entries[(dnsLog.next-1-i+2*count)%count]
+		if name != "" && !strings.Contains(e.Name, name) {
+			continue
+		}
+		result.Entries = append(result.Entries, e)
+		if limit > 0 && len(result.Entries) >= limit {
+			break
+		}
+	}
+	for _, s := range dnsLog.names {
+		if name != "" && !strings.Contains(s.Name, name) {
+			continue
+		}
+		c := *s
+		c.Dispositions = make(map[string]uint64, len(s.Dispositions))
+		for k, v := range s.Dispositions {
+			c.Dispositions[k] = v
+		}
+		result.Names = append(result.Names, c)
+	}
+	sort.Slice(result.Names, func(i, j int) bool {
+		return result.Names[i].Queries > result.Names[j].Queries
+	})
+	return result
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/openziti/desktop-edge-win/service/windns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+// desiredNrptNamespaces returns every namespace which needs an NRPT rule pointing at the ziti DNS server: the
+// intercepted hostnames, the search suffixes, the forwarded suffixes and the reverse lookup zone of the TUN range
+func desiredNrptNamespaces() map[string]bool {
+	desired := make(map[string]bool)
+	for _, host := range DNSMgr.Hostnames() {
+		desired[NrptNamespace(host)] = true
+	}
+	for ns := range currentSuffixNrptNamespaces() {
+		desired[ns] = true
+	}
+	for ns := range currentForwardNrptNamespaces() {
+		desired[ns] = true
+	}
+	if ns := reverseNrptNamespace(); ns != "" {
+		desired[ns] = true
+	}
+	return desired
+}
+
+// ReconcileNrpt compares the NRPT rules of the tunnel with the rules it needs. Missing rules and rules pointing at
+// another DNS server are added again and rules no longer needed are removed. The returned event holds the counts
+func ReconcileNrpt() (dto.NrptDriftEvent, error) {
+	drift := dto.NrptDriftEvent{}
+	dnsIp := dnsServerIp()
+	if dnsIp == nil {
+		return drift, fmt.Errorf("the DNS server is not running")
+	}
+	dnsServer := dnsIp.String()
+
+	// the actual rules are read first. a hostname added in between then looks missing and is added twice rather
+	// than looking stale and being removed
+	actual, err := windns.Nrpt.List()
+	if err != nil {
+		return drift, fmt.Errorf("could not read the NRPT rules: %v", err)
+	}
+	desired := make(map[string]string)
+	for ns := range desiredNrptNamespaces() {
+		desired[strings.ToLower(ns)] = ns
+	}
+	drift.Desired = len(desired)
+
+	missing := make([]string, 0)
+	for key, ns := range desired {
+		servers, found := actual[key]
+		if !found || !containsServer(servers, dnsServer) {
+			missing = append(missing, ns)
+		}
+	}
+	stale := make([]string, 0)
+	for ns := range actual {
+		if _, found := desired[ns]; !found {
+			stale = append(stale, ns)
+		}
+	}
+	drift.Missing = len(missing)
+	drift.Stale = len(stale)
+
+	if len(missing) > 0 {
+		log.Warnf("%d NRPT rule(s) were missing or changed and are added again: %v", len(missing), missing)
+		drift.Failed += len(windns.NrptFailures(windns.Nrpt.Add(missing, dnsServer)))
+	}
+	if len(stale) > 0 {
+		log.Infof("removing %d NRPT rule(s) which are no longer needed: %v", len(stale), stale)
+		drift.Failed += len(windns.NrptFailures(windns.Nrpt.Remove(stale)))
+	}
+	return drift, nil
+}
+
+// CurrentNrptChanges drops the namespaces of a queued NRPT change which are out of date: namespaces to add which no
+// longer need a rule and namespaces to remove which need one again, e.g. after the identity was disconnected or
+// connected while the change was queued
+func CurrentNrptChanges(toAdd map[string]bool, toRemove map[string]bool) (map[string]bool, map[string]bool) {
+	desired := make(map[string]bool)
+	for ns := range desiredNrptNamespaces() {
+		desired[nrptKey(ns)] = true
+	}
+	add := make(map[string]bool, len(toAdd))
+	for ns := range toAdd {
+		if desired[nrptKey(ns)] {
+			add[ns] = true
+		}
+	}
+	remove := make(map[string]bool, len(toRemove))
+	for ns := range toRemove {
+		if !desired[nrptKey(ns)] {
+			remove[ns] = true
+		}
+	}
+	return add, remove
+}
+
+// nrptKey is the form namespaces are compared in
+func nrptKey(ns string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(ns), "."))
+}
+
+func containsServer(servers []string, server string) bool {
+	for _, s := range servers {
+		if strings.TrimSpace(s) == server {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/openziti/desktop-edge-win/service/windns"
+)
+
+// useFakeNrpt keeps the NRPT rules of the test in memory
+func useFakeNrpt(t *testing.T) *windns.FakeNrptManager {
+	t.Helper()
+	saved := windns.Nrpt
+	fake := windns.NewFakeNrptManager()
+	windns.Nrpt = fake
+	t.Cleanup(func() { windns.Nrpt = saved })
+	return fake
+}
+
+func TestReconcileNrptRepairsDrift(t *testing.T) {
+	resetTestDns(t, "100.64.0.1", 10)
+	fake := useFakeNrpt(t)
+	savedSuffixes := dnsSuffixes
+	dnsSuffixes = &suffixSearch{}
+	t.Cleanup(func() { dnsSuffixes = savedSuffixes })
+
+	dnsMgrPrivate.AddHostname("identity", "Server.Example.com")
+	dnsMgrPrivate.AddHostname("identity", "*.corp.example.com")
+	dnsSuffixes.set([]string{"lab.example.com"}, nil)
+
+	fake.Add([]string{"server.example.com"}, "10.0.0.1") // pointing at another DNS server
+	fake.Add([]string{".CORP.example.com", ".old.example.com", ".stuck.example.com"}, "100.64.0.1")
+	fake.Fail[".stuck.example.com"] = errors.New("access denied")
+
+	repaired := []string{".100.in-addr.arpa", ".corp.example.com", ".lab.example.com", "server.example.com"}
+	stuck := []string{".100.in-addr.arpa", ".corp.example.com", ".lab.example.com", ".stuck.example.com", "server.example.com"}
+	tests := []struct {
+		name   string
+		before func()
+		want   dnsDrift
+		rules  []string
+	}{
+		{
+			name:  "drift",
+			want:  dnsDrift{missing: 3, stale: 2, failed: 1},
+			rules: stuck,
+		},
+		{
+			name:  "rule which cannot be removed",
+			want:  dnsDrift{stale: 1, failed: 1},
+			rules: stuck,
+		},
+		{
+			name:   "rule which can be removed again",
+			before: func() { delete(fake.Fail, ".stuck.example.com") },
+			want:   dnsDrift{stale: 1},
+			rules:  repaired,
+		},
+		{
+			name:  "no drift",
+			want:  dnsDrift{},
+			rules: repaired,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.before != nil {
+				tt.before()
+			}
+			drift, err := ReconcileNrpt()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := dnsDrift{missing: drift.Missing, stale: drift.Stale, failed: drift.Failed}
+			if drift.Desired != 4 || got != tt.want {
+				t.Errorf("ReconcileNrpt() = %d desired and %+v, want 4 desired and %+v", drift.Desired, got, tt.want)
+			}
+			if got := fake.Namespaces(); !reflect.DeepEqual(got, tt.rules) {
+				t.Errorf("rules are %v, want %v", got, tt.rules)
+			}
+			rules, _ := fake.List()
+			for ns, servers := range rules {
+				if ns != ".stuck.example.com" && !reflect.DeepEqual(servers, []string{"100.64.0.1"}) {
+					t.Errorf("rule of %s points at %v", ns, servers)
+				}
+			}
+		})
+	}
+}
+
+type dnsDrift struct {
+	missing, stale, failed int
+}
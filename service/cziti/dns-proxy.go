@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"github.com/miekg/dns"
 	"github.com/openziti/desktop-edge-win/service/windns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
 	"io"
 	"net"
 	"os"
@@ -29,84 +30,115 @@ import (
 	"time"
 )
 
-var domains []string // get any connection-specific local domains
 const (
-	MaxDnsRequests   = 64
-	DnsMsgBufferSize = 1024
+	MaxDnsRequests = 64
+	// the largest query read from a client over udp
+	DnsMsgBufferSize = MaxEdnsUdpSize
+	// the largest EDNS0 udp payload size honoured. clients advertising more are treated as if they advertised this
+	MaxEdnsUdpSize = 4096
 )
 
 var reqch = make(chan dnsreq, MaxDnsRequests)
 var proxiedRequests = make(chan *proxiedReq, MaxDnsRequests)
-var respChan = make(chan []byte, MaxDnsRequests)
 
 func processDNSquery(packet []byte, p *net.UDPAddr, s *net.UDPConn, ipVer int) {
+	received := time.Now()
 	q := &dns.Msg{}
 	if err := q.Unpack(packet); err != nil {
 		log.Errorf("unexpected error in processDNSquery. [len(packet):%d] [ipVer:%v] [error: %v]", len(packet), ipVer, err)
 		return
 	}
 
-	msg := dns.Msg{}
-	msg.SetReply(q)
-	msg.RecursionAvailable = false
-	msg.Authoritative = false
-	msg.Rcode = dns.RcodeRefused
-
-	var query dns.Question
 	if len(q.Question) > 0 {
-		query = q.Question[0]
-		log.Tracef("processing a dns query. type:%s, for:%s on %v. id:%v", dns.Type(query.Qtype), query.Name, p, q.Id)
+		log.Tracef("processing a dns query. type:%s, for:%s on %v. id:%v", dns.Type(q.Question[0].Qtype), q.Question[0].Name, p, q.Id)
 	} else {
-		log.Warnf("discarding dns message as it contained no question! %v", msg.String())
+		log.Warnf("discarding dns message as it contained no question! %v", q.String())
 		return
 	}
 
-	var ip net.IP
-	dnsName := strings.TrimSpace(query.Name)
-	ip = DNSMgr.Resolve(dnsName)
-
 	// never proxy hostnames that we know about regardless of type
+	msg := resolveRecords(q)
+	if msg == nil {
+		msg = resolveLocally(q)
+	}
+	if msg != nil {
+		writeUDPReply(msg, q, p, s)
+		logQuery(q, p, localDisposition(msg), received)
+	} else if blocked := resolveBlocked(q); blocked != nil {
+		writeUDPReply(blocked, q, p, s)
+		logQuery(q, p, dto.DnsDispositionBlocked, received)
+	} else if cached := upstreamCache.get(q); cached != nil {
+		log.Tracef("answered %s %s from the DNS cache", dns.Type(q.Question[0].Qtype), q.Question[0].Name)
+		writeUDPReply(cached, q, p, s)
+		logQuery(q, p, dto.DnsDispositionCached, received)
+	} else {
+		// log.Debug("proxying ", dns.Type(query.Qtype), query.Name, q.Id, " for ", p)
+		proxyDNS(q, p, s, ipVer, received)
+	}
+}
+
+func writeUDPReply(msg *dns.Msg, q *dns.Msg, p *net.UDPAddr, s *net.UDPConn) {
+	msg.Truncate(clientUdpSize(q))
+	repB, err := msg.Pack()
+	if err == nil {
+		_, _, err = s.WriteMsgUDP(repB, nil, p)
+	}
+	if err != nil {
+		log.Error("unexpected dns error", err)
+	}
+}
+
+// resolveLocally builds the reply for a query about a hostname known to ziti. nil is returned when the name is not
+// known and the query needs to be proxied to the upstream DNS
+func resolveLocally(q *dns.Msg) *dns.Msg {
+	query := q.Question[0]
+
+	// Resolve also tries the name with any search suffix removed
+	ip := DNSMgr.Resolve(strings.TrimSpace(query.Name))
 	if ip == nil {
-		// no direct hit. need to now check to see if the dns query used a connection-specific local domain
-		for _, d := range domains {
-			domain := d
-			if strings.HasSuffix(dnsName, domain) {
-				dnsNameTrimmed := strings.TrimRight(dnsName, domain)
-				// dns request has domain appended - removing and resolving
-				ip = DNSMgr.Resolve(dnsNameTrimmed)
-				break
-			}
-		}
+		return nil
 	}
 
-	// never proxy hostnames that we know about regardless of type
-	if ip != nil {
-		log.Debugf("resolved %s as %v", query.Name, ip)
+	log.Debugf("resolved %s as %v", query.Name, ip)
+	msg := &dns.Msg{}
+	msg.SetReply(q)
+	msg.RecursionAvailable = false
+	msg.Authoritative = false
+	msg.Rcode = dns.RcodeRefused
 
-		if query.Qtype == dns.TypeA && len(ip.To4()) == net.IPv4len {
-			answer := &dns.A{
-				Hdr: dns.RR_Header{Name: query.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
-				A:   ip,
-			}
-			msg.Authoritative = true
-			msg.Rcode = dns.RcodeSuccess
-			msg.Answer = append(msg.Answer, answer)
-		} else if query.Qtype == dns.TypeAAAA {
-			log.Trace("AAAA request received for a known domain. A successful DNS response will be generated with no answer")
-			msg.Rcode = dns.RcodeSuccess
+	if query.Qtype == dns.TypeA && len(ip.To4()) == net.IPv4len {
+		answer := &dns.A{
+			Hdr: dns.RR_Header{Name: query.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: answerTtls.answerTtl(query.Name)},
+			A:   ip,
 		}
+		msg.Authoritative = true
+		msg.Rcode = dns.RcodeSuccess
+		msg.Answer = append(msg.Answer, answer)
+	} else if query.Qtype == dns.TypeAAAA {
+		log.Trace("AAAA request received for a known domain. A successful DNS response will be generated with no answer")
+		msg.Rcode = dns.RcodeSuccess
+	}
+	if opt := q.IsEdns0(); opt != nil {
+		msg.SetEdns0(uint16(clientUdpSize(q)), opt.Do())
+	}
+	return msg
+}
 
-		repB, err := msg.Pack()
-		if err == nil {
-			_, _, err = s.WriteMsgUDP(repB, nil, p)
-		}
-		if err != nil {
-			log.Error("unexpected dns error", err)
-		}
-	} else {
-		// log.Debug("proxying ", dns.Type(query.Qtype), query.Name, q.Id, " for ", p)
-		proxyDNS(q, p, s, ipVer)
+// clientUdpSize is the largest reply the client accepts over udp. 512 bytes without EDNS0, otherwise the size the
+// client advertised up to MaxEdnsUdpSize
+func clientUdpSize(q *dns.Msg) int {
+	opt := q.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+	size := int(opt.UDPSize())
+	if size < dns.MinMsgSize {
+		return dns.MinMsgSize
 	}
+	if size > MaxEdnsUdpSize {
+		return MaxEdnsUdpSize
+	}
+	return size
 }
 
 type dnsreq struct {
@@ -121,6 +153,7 @@ func RunDNSserver(dnsBind []net.IP, ready chan bool) {
 
 	for _, bindAddr := range dnsBind {
 		go runListener(&bindAddr, 53, reqch)
+		go runTCPListener(bindAddr, 53)
 	}
 
 	windns.RemoveAllNrptRules()
@@ -132,9 +165,125 @@ func RunDNSserver(dnsBind []net.IP, ready chan bool) {
 	}
 }
 
+// RebindDNSListeners listens on the given addresses instead of the current ones. Used when the TUN is re-addressed
+// while running. Every address is bound before any current listener is closed. When an address cannot be bound the
+// listeners bound so far are closed again and the current ones keep serving. A listener already bound to one of the
+// addresses is kept as it is
+func RebindDNSListeners(dnsBind []net.IP) error {
+	listenersMutex.Lock()
+	existing := dnsListeners
+	existingTcp := dnsTcpListeners
+	listenersMutex.Unlock()
+
+	var udp, newUdp []*net.UDPConn
+	var newUdpIds []int
+	var tcp, newTcp []*net.TCPListener
+	closeNew := func() {
+		for _, l := range newUdp {
+			_ = l.Close()
+		}
+		for _, l := range newTcp {
+			_ = l.Close()
+		}
+	}
+	for _, bindAddr := range dnsBind {
+		if l := findUDPListener(existing, bindAddr); l != nil {
+			udp = append(udp, l)
+		} else {
+			server, id, err := listenUDP(bindAddr, 53)
+			if err != nil {
+				closeNew()
+				return err
+			}
+			udp = append(udp, server)
+			newUdp = append(newUdp, server)
+			newUdpIds = append(newUdpIds, id)
+		}
+
+		if l := findTCPListener(existingTcp, bindAddr); l != nil {
+			tcp = append(tcp, l)
+		} else {
+			server, err := listenTCP(bindAddr, 53)
+			if err != nil {
+				closeNew()
+				return err
+			}
+			tcp = append(tcp, server)
+			newTcp = append(newTcp, server)
+		}
+	}
+
+	listenersMutex.Lock()
+	dnsListeners = udp
+	dnsTcpListeners = tcp
+	listenersMutex.Unlock()
+
+	for _, l := range existing {
+		if findUDPListener(udp, l.LocalAddr().(*net.UDPAddr).IP) != l {
+			log.Infof("closing DNS listener at: %v", l.LocalAddr())
+			_ = l.Close()
+		}
+	}
+	for _, l := range existingTcp {
+		if findTCPListener(tcp, l.Addr().(*net.TCPAddr).IP) != l {
+			log.Infof("closing DNS listener at: %v/tcp", l.Addr())
+			_ = l.Close()
+		}
+	}
+	for i, server := range newUdp {
+		go serveListener(server, newUdpIds[i], reqch)
+	}
+	for _, server := range newTcp {
+		go serveTCPListener(server)
+	}
+	return nil
+}
+
+func findUDPListener(listeners []*net.UDPConn, ip net.IP) *net.UDPConn {
+	for _, l := range listeners {
+		if l.LocalAddr().(*net.UDPAddr).IP.Equal(ip) {
+			return l
+		}
+	}
+	return nil
+}
+
+func findTCPListener(listeners []*net.TCPListener, ip net.IP) *net.TCPListener {
+	for _, l := range listeners {
+		if l.Addr().(*net.TCPAddr).IP.Equal(ip) {
+			return l
+		}
+	}
+	return nil
+}
+
+// ResetNrptRules replaces every NRPT rule with rules for the known hostnames and connection-specific domains pointing
+// at the given DNS server
+func ResetNrptRules(dnsServer string) {
+	windns.RemoveAllNrptRules()
+
+	desired := desiredNrptNamespaces()
+	windns.AddNrptRules(desired, dnsServer)
+	log.Infof("NRPT rules for %d namespace(s) now point to %s", len(desired), dnsServer)
+}
+
 func runListener(ip *net.IP, port int, reqch chan dnsreq) {
+	server, id, err := listenUDP(*ip, port)
+	if err != nil {
+		log.Panicf("An unexpected and unrecoverable error has occurred while %s: %v", "udp listening on network", err)
+	}
+	listenersMutex.Lock()
+	dnsListeners = append(dnsListeners, server)
+	listenersMutex.Unlock()
+	serveListener(server, id, reqch)
+}
+
+var dnsListeners []*net.UDPConn
+var listenersMutex = sync.Mutex{}
+
+func listenUDP(ip net.IP, port int) (*net.UDPConn, int, error) {
 	laddr := &net.UDPAddr{
-		IP:   *ip,
+		IP:   ip,
 		Port: port,
 		Zone: "",
 	}
@@ -146,33 +295,23 @@ func runListener(ip *net.IP, port int, reqch chan dnsreq) {
 		network = "udp4"
 	}
 
-	attempts := 0
 	var server *net.UDPConn
-	var err error
-
-	maxAttempts := 20
-	for attempts < maxAttempts {
-		attempts++
+	err := retryListen(laddr, func() (err error) {
 		server, err = net.ListenUDP(network, laddr)
-		if err == nil {
-			break
-		} else if attempts > maxAttempts {
-			log.Panicf("An unexpected and unrecoverable error has occurred while %s: %v", "udp listening on network", err)
-		} else if attempts < (maxAttempts / 2) {
-			//just ignore the first 1/2 of all attempts...
-		} else if attempts < (3 * maxAttempts / 4) {
-			// only log at debug until we hit 3/4 the max attempts to remove unnecessary warns from the log
-			log.Debugf("System not ready to listen on %v yet. Retrying after 500ms. This has happened %d times.", laddr, attempts)
-		} else {
-			log.Warnf("System not ready to listen on %v yet. Retrying after 500ms. This has happened %d times.", laddr, attempts)
-		}
-		time.Sleep(500 * time.Millisecond)
+		return err
+	})
+	if err != nil {
+		return nil, id, err
 	}
 
 	log.Infof("DNS listening at: %v", laddr)
+	return server, id, nil
+}
 
+func serveListener(server *net.UDPConn, id int, reqch chan dnsreq) {
+	buffers := newDnsBufferRing()
 	for {
-		b := *(nextBuffer())
+		b := buffers.next()
 		nb, _, _, peer, err := server.ReadMsgUDP(b, nil)
 		if err != nil {
 			if err == io.EOF || err == os.ErrClosed || strings.HasSuffix(err.Error(), "use of closed network connection") {
@@ -198,90 +337,83 @@ func runListener(ip *net.IP, port int, reqch chan dnsreq) {
 
 /*******************************************************************/
 type proxiedReq struct {
-	req   *dns.Msg
-	peer  *net.UDPAddr
-	s     *net.UDPConn
-	exp   time.Time
-	ipVer int
+	req      *dns.Msg
+	peer     *net.UDPAddr
+	s        *net.UDPConn
+	ipVer    int
+	received time.Time
 }
 
-func proxyDNS(req *dns.Msg, peer *net.UDPAddr, serv *net.UDPConn, ipVer int) {
+func proxyDNS(req *dns.Msg, peer *net.UDPAddr, serv *net.UDPConn, ipVer int, received time.Time) {
 	if len(proxiedRequests) == cap(proxiedRequests) {
 		log.Warn("proxied DNS requests will be blocked. If this warning is continuously displayed please report")
 	}
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() > MaxEdnsUdpSize {
+		// never ask the upstream for more than will be relayed to the client
+		opt.SetUDPSize(MaxEdnsUdpSize)
+	}
 	proxiedRequests <- &proxiedReq{
-		req:   req,
-		peer:  peer,
-		s:     serv,
-		exp:   time.Now().Add(30 * time.Second),
-		ipVer: ipVer,
+		req:      req,
+		peer:     peer,
+		s:        serv,
+		ipVer:    ipVer,
+		received: received,
 	}
 }
 
-var dnsUpstreams []*net.UDPConn
-var dnsMutex = sync.Mutex{}
-var lastDnsRecover = time.Now()
+var localDnsServers []net.IP
 
-func dnsPanicRecover(localDnsServers []net.IP, now time.Time) {
-	dnsMutex.Lock()
-	defer dnsMutex.Unlock()
-	if now.Before(lastDnsRecover) {
-		log.Warnf("not recovering from dnsPanicRecover. panic recovery was initiated before last recovery")
-		return
+func runDNSproxy(localDns []net.IP) {
+	if !interceptAddresses.wasRestored() {
+		// hostnames may now resolve to a different address than the one cached by windows
+		windns.FlushDNS()
 	}
+	localDnsServers = localDns
+	ReloadDnsUpstreams()
 
-	//close any and all existing upstream
-	log.Warn("recovering from DNS panic initiated")
-	for _, c := range dnsUpstreams {
-		log.Warnf("  - closing DNS proxy to: %s", c.RemoteAddr().String())
-		_ = c.Close()
-		dnsUpstreams = dnsUpstreams[1:]
-	}
-	lastDnsRecover = time.Now()
-	log.Infof("dnsPanicRecovery set time to: %s", lastDnsRecover.String())
+	// bounds the number of queries waiting on an upstream at once
+	inflight := make(chan struct{}, MaxDnsRequests)
 
-	// get dns again and reconfigure
-	go runDNSproxy(localDnsServers)
-}
-
-func trimSuffix(source string, suffix string) string {
-	if strings.HasSuffix(source, suffix) {
-		source = source[:len(source)-len(suffix)]
+	log.Debug("Upstream DNS proxy loop begins")
+	for pr := range proxiedRequests {
+		inflight <- struct{}{}
+		go func(pr *proxiedReq) {
+			defer func() { <-inflight }()
+			resolveUpstream(pr)
+		}(pr)
 	}
-	return source
 }
 
-func cleanDomainsForNrpt() map[string]bool {
-	//AddNrptRules takes a map - so make a map... AND - can't have the trailing period produced from GetConnectionSpecificDomains
-	domainMap := make(map[string]bool)
-	for _, d := range domains {
-		domainMap[fmt.Sprintf(".%s", trimSuffix(d, "."))] = true
+func resolveUpstream(pr *proxiedReq) {
+	q := pr.req.Question[0]
+	reply, err := poolFor(q.Name).exchange(pr.req, "udp")
+	if err != nil {
+		log.Debugf("could not resolve %s %s from ipv%d listener upstream: %v", dns.Type(q.Qtype), q.Name, pr.ipVer, err)
+		reply = &dns.Msg{}
+		reply.SetRcode(pr.req, dns.RcodeServerFailure)
+	} else {
+		log.Tracef("proxy resolved request for %v id:%d", q.Name, reply.Id)
+		upstreamCache.put(pr.req, reply)
 	}
-	return domainMap
+	writeUDPReply(reply, pr.req, pr.peer, pr.s)
+	logQuery(pr.req, pr.peer, upstreamDisposition(err), pr.received)
 }
 
-func runDNSproxy(localDnsServers []net.IP) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Errorf("Recovering from panic due to DNS-related issue. %v", err)
-			dnsPanicRecover(localDnsServers, time.Now())
-		}
-	}()
-	windns.FlushDNS() //do this in case the services come back in different order and the ip returned is no longer the same
-	dnsRetryInterval := 500
-
-GetUpstream:
+// ReloadDnsUpstreams detects the DNS servers and search suffixes of the local interfaces again. Called
+// when the proxy starts and whenever the local network changes
+func ReloadDnsUpstreams() {
 	upstreamDnsServers := windns.GetUpstreamDNS()
-	log.Infof("starting DNS proxy upstream: %v, local: %v", upstreamDnsServers, localDnsServers)
+	log.Infof("detected upstream DNS: %v, local: %v", upstreamDnsServers, localDnsServers)
 
-	domains = windns.GetConnectionSpecificDomains()
-	log.Infof("ConnectionSpecificDomains detected: %v", domains)
+	RefreshDnsSuffixes()
 
-	domainMap := cleanDomainsForNrpt()
-	windns.AddNrptRules(domainMap, dnsip.String())
-	log.Infof("Added connection specific domains to NRPT: %v", domainMap)
+	dnsServer := dnsServerIp().String()
+	windns.AddNrptRules(currentForwardNrptNamespaces(), dnsServer)
+	if ns := reverseNrptNamespace(); ns != "" {
+		windns.AddNrptRules(map[string]bool{ns: true}, dnsServer)
+	}
 
-	log.Infof("establishing links to all upstream DNS. total detected upstream DNS: %d", len(upstreamDnsServers))
+	upstreamAddrs := make([]string, 0, len(upstreamDnsServers))
 outer:
 	for _, s := range upstreamDnsServers {
 		for _, ldns := range localDnsServers {
@@ -298,169 +430,24 @@ outer:
 				// log any errors that are NOT due to this
 				log.Errorf("skipping upstream due to error: %s, %v", s, err.Error())
 			}
-		} else {
-			log.Infof("adding upstream dns server: %s", s)
-			conn, err := net.DialUDP("udp", nil, sAddr)
-			if err != nil {
-				log.Warnf("could not add upstream DNS: %s. error: %v", s, err.Error())
-			} else {
-				dnsUpstreams = append(dnsUpstreams, conn)
-				log.Debugf("established upstream dns: %s", s)
-			}
+			continue
 		}
+		log.Infof("adding upstream dns server: %s", s)
+		upstreamAddrs = append(upstreamAddrs, sAddr.String())
 	}
 
-	if len(upstreamDnsServers) > 0 && len(dnsUpstreams) == 0 {
-		//this almost certainly indicates the network has been disconnected for some reason.
-		//this happens when turning wifi off and waiting a moment - then turning wifi back on again
-		//might happen unplugging the ethernet from one port to another - you get the idea... if this
-		//happens - pause for a small amount of time and reinstitute the proxy establishing loop
-		log.Warnf("no upstream DNS dials succeeded. Does this computer have any network connectivity? Pausing for %d ms and trying again", dnsRetryInterval)
-		time.Sleep(time.Duration(dnsRetryInterval) * time.Millisecond)
-
-		//add 500ms each time around up to 10000 (10 seconds) and then just use 10000...
-		dnsRetryInterval = dnsRetryInterval + 500
-		if dnsRetryInterval >= 10000 {
-			dnsRetryInterval = 10000
-		}
-		goto GetUpstream
-	}
-
-	log.Infof("starting goroutines for all connected DNS proxies. Total goroutines to spawn: %d of %d detected DNS", len(dnsUpstreams), len(upstreamDnsServers))
-	for _, proxy := range dnsUpstreams {
-		log.Debugf("beginning DNS proxy for: %s", proxy.RemoteAddr().String())
-		go func(p *net.UDPConn) {
-			resp := make([]byte, 1024) //make a buffer which is reused
-			for {
-				n, err := p.Read(resp)
-				if err != nil {
-					// something is wrong with the DNS connection panic and let DNS recovery kick in
-					if err == io.EOF || err == os.ErrClosed || strings.HasSuffix(err.Error(), "use of closed network connection") {
-						log.Errorf("DNS proxy closed for : %s. error %v", p.RemoteAddr().String(), err)
-					} else {
-						log.Warnf("unexpected error. DNS proxy closed for %s due to %v", p.RemoteAddr().String(), err)
-					}
-					return
-				} else {
-					if len(respChan) == cap(respChan) {
-						log.Warn("respChan will be blocked. If this warning is continuously displayed please report")
-					} else {
-						log.Tracef("Response received, respChan len: %d, cap: %d ", len(respChan), cap(respChan))
-					}
-
-					respChan <- resp[:n]
-				}
-			}
-		}(proxy)
-	}
-
-	reqs := make(map[uint32]*proxiedReq)
-	var dnsReqMutex = &sync.Mutex{}
-
-	dnsReqChannel := make(chan struct{})
-	ticker := time.NewTicker(5 * time.Second)
-	defer func() {
-		close(dnsReqChannel)
-		log.Tracef("Exiting dns request handling routines.")
-	}()
-	go func() {
-	CleanUpIteration:
-		for {
-			select {
-			case <-ticker.C:
-				if len(reqs) == 0 {
-					continue CleanUpIteration
-				}
-				// cleanup requests we didn't get answers for
-				now := time.Now()
-				log.Tracef("Attempting to lock mutex for the dns requests map in cleanup")
-				dnsReqMutex.Lock()
-				for k, r := range reqs {
-					if now.After(r.exp) {
-						log.Debugf("a DNS request has expired - enable trace logging and reproduce this issue for more information")
-						if len(r.req.Question) > 1 {
-							log.Tracef("expired DNS req: %s %s", dns.Type(r.req.Question[0].Qtype), r.req.Question[0].Name)
-						} else {
-							log.Tracef("expired DNS req - had no question???")
-						}
-
-						delete(reqs, k)
-					}
-				}
-				dnsReqMutex.Unlock()
-				log.Tracef("Unlocked the mutex for the dns requests map in cleanup - duration %v", time.Now().Sub(now))
-			case <-dnsReqChannel:
-				ticker.Stop()
-				log.Tracef("Exiting dns request cleanup go routine.")
-				return
-			}
-		}
-	}()
-
-	go func() {
-		for {
-			select {
-			case rep := <-respChan:
-				reply := dns.Msg{}
-				if err := reply.Unpack(rep); err == nil {
-					id := calcDnsId(&reply)
-					dnsReqMutex.Lock()
-					req, found := reqs[id]
-					if found {
-						delete(reqs, id)
-						dnsReqMutex.Unlock()
-						log.Tracef("proxy resolved request for %v id:%d", reply.Question[0].Name, reply.Id)
-						n, oobn, err := req.s.WriteMsgUDP(rep, nil, req.peer)
-						if err != nil {
-							log.Errorf("an error has occurred while trying to write a udp message. n:%d, oobn:%d, err:%v", n, oobn, err)
-						}
-					} else {
-						dnsReqMutex.Unlock()
-						// keep this log but leave commented out. When two listeners are enabled (ipv4/v6) this msg will
-						// just mean some other request was processed successfully and removed the entry from the map
-						// log.Tracef("matching request was not found for id:%d. %s %s", reply.Id, dns.Type(reply.Question[0].Qtype), reply.Question[0].Name)
-					}
-				}
-			case <-dnsReqChannel:
-				log.Tracef("Exiting the go routine for network interface response channel")
-				return
-			}
-		}
-
-	}()
-
-	log.Debug("Upstream DNS proxy loop begins")
-	for {
-		pr := <-proxiedRequests
-		id := calcDnsId(pr.req)
-		dnsReqMutex.Lock()
-		reqs[id] = pr
-		dnsReqMutex.Unlock()
-		b, _ := pr.req.Pack()
-		for _, proxy := range dnsUpstreams {
-			if _, err := proxy.Write(b); err != nil {
-
-				_ = proxy.Close() //first thing - close the proxy connection
-
-				// when this hits - it never seems to recover. throw a panic which will get recovered
-				// via the defer specified above and try to recreate the connections. this is a heavy
-				// handed way of reconnecting to the DNS server but it should be infrequent
-				log.Panicf("failed to proxy DNS to %s %s %v. %v",
-					dns.Type(pr.req.Question[0].Qtype),
-					pr.req.Question[0].Name,
-					proxy.RemoteAddr(),
-					err)
-			} else {
-				log.Tracef("Proxied request sent to %v from ipv%d listener", proxy.RemoteAddr(), pr.ipVer)
-			}
-		}
+	if len(upstreamAddrs) == 0 {
+		//this almost certainly indicates the network has been disconnected for some reason. the upstream DNS is
+		//detected again once the network comes back
+		log.Warnf("no upstream DNS detected. Does this computer have any network connectivity?")
 	}
-}
+	// the detected servers are still needed to look up the host names of encrypted upstreams and for plain fallback
+	plainFallback.setServers(upstreamAddrs)
 
-func calcDnsId(req *dns.Msg) uint32 {
-	if len(req.Question) > 0 {
-		return (uint32(req.Id) << 16) | uint32(req.Question[0].Qtype)
-	} else {
-		return 0 //this shouldn't be happening - yet a user hit this situation
+	if pinned := getPinnedUpstreams(); len(pinned) > 0 {
+		log.Infof("using configured upstream DNS: %v", pinned)
+		upstreams.setServers(pinned)
+		return
 	}
+	upstreams.setServers(upstreamAddrs)
 }
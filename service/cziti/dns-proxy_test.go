@@ -0,0 +1,173 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startFakeUpstream answers every query with the reply built by answer, regardless of the size the query asked for
+func startFakeUpstream(t *testing.T, answer func(q *dns.Msg) *dns.Msg) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		b := make([]byte, dns.MaxMsgSize)
+		for {
+			n, peer, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			q := &dns.Msg{}
+			if err := q.Unpack(b[:n]); err != nil {
+				continue
+			}
+			reply, err := answer(q).Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteToUDP(reply, peer)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// bigTxtAnswer answers with enough TXT records to make a reply of about 3700 bytes
+func bigTxtAnswer(q *dns.Msg) *dns.Msg {
+	reply := &dns.Msg{}
+	reply.SetReply(q)
+	for i := 0; i < 40; i++ {
+		reply.Answer = append(reply.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+			Txt: []string{fmt.Sprintf("%02d-%s", i, strings.Repeat("x", 60))},
+		})
+	}
+	if opt := q.IsEdns0(); opt != nil {
+		reply.SetEdns0(opt.UDPSize(), false)
+	}
+	return reply
+}
+
+func TestClientUdpSize(t *testing.T) {
+	tests := []struct {
+		name string
+		edns uint16 // 0 for a query without OPT
+		want int
+	}{
+		{name: "no OPT", want: dns.MinMsgSize},
+		{name: "below the minimum", edns: 256, want: dns.MinMsgSize},
+		{name: "common size", edns: 1232, want: 1232},
+		{name: "largest relayed size", edns: MaxEdnsUdpSize, want: MaxEdnsUdpSize},
+		{name: "above the largest relayed size", edns: 65535, want: MaxEdnsUdpSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &dns.Msg{}
+			q.SetQuestion("example.com.", dns.TypeA)
+			if tt.edns > 0 {
+				q.SetEdns0(tt.edns, false)
+			}
+			if got := clientUdpSize(q); got != tt.want {
+				t.Errorf("clientUdpSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxiedReplyFitsClientSize(t *testing.T) {
+	upstream := startFakeUpstream(t, bigTxtAnswer)
+	upstreams.setServers([]string{upstream})
+	t.Cleanup(func() { upstreams.setServers(nil) })
+
+	tests := []struct {
+		name          string
+		edns          uint16 // 0 for a query without OPT
+		wantSize      int
+		wantTruncated bool
+	}{
+		{name: "no OPT", wantSize: dns.MinMsgSize, wantTruncated: true},
+		{name: "OPT smaller than the answer", edns: 1232, wantSize: 1232, wantTruncated: true},
+		{name: "OPT larger than the answer", edns: MaxEdnsUdpSize, wantSize: MaxEdnsUdpSize, wantTruncated: false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = listener.Close() }()
+			client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = client.Close() }()
+
+			q := &dns.Msg{}
+			// a name of its own so the reply is never taken from the cache
+			q.SetQuestion(fmt.Sprintf("big%d.example.com.", i), dns.TypeTXT)
+			if tt.edns > 0 {
+				q.SetEdns0(tt.edns, false)
+			}
+			resolveUpstream(&proxiedReq{
+				req:      q,
+				peer:     client.LocalAddr().(*net.UDPAddr),
+				s:        listener,
+				ipVer:    4,
+				received: time.Now(),
+			})
+
+			b := make([]byte, dns.MaxMsgSize)
+			_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := client.ReadFromUDP(b)
+			if err != nil {
+				t.Fatalf("no reply: %v", err)
+			}
+			if n > tt.wantSize {
+				t.Errorf("reply is %d bytes, the client accepts %d", n, tt.wantSize)
+			}
+			reply := &dns.Msg{}
+			if err := reply.Unpack(b[:n]); err != nil {
+				t.Fatalf("reply cannot be read: %v", err)
+			}
+			if reply.Rcode != dns.RcodeSuccess {
+				t.Errorf("Rcode = %s, want NOERROR", dns.RcodeToString[reply.Rcode])
+			}
+			if reply.Truncated != tt.wantTruncated {
+				t.Errorf("Truncated = %t, want %t", reply.Truncated, tt.wantTruncated)
+			}
+			if tt.wantTruncated && len(reply.Answer) >= 40 {
+				t.Errorf("truncated reply kept all %d answers", len(reply.Answer))
+			}
+			if !tt.wantTruncated && len(reply.Answer) != 40 {
+				t.Errorf("reply has %d answers, want 40", len(reply.Answer))
+			}
+			if (reply.IsEdns0() != nil) != (tt.edns > 0) {
+				t.Errorf("reply has OPT = %t, query had OPT = %t", reply.IsEdns0() != nil, tt.edns > 0)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// the service config type holding extra DNS records for the names of a service
+const CfgDnsRecordsV1 = "ziti-dns-records.v1"
+
+// dnsRecordsV1Cfg is the ziti-dns-records.v1 config. The ttl is the ttl of the answers for the names of the service,
+// including the hostnames it intercepts. e.g.
+//
+//	{"ttl":10,
+//	 "srv":[{"name":"_ldap._tcp.corp.example.com","priority":0,"weight":0,"port":389,"target":"dc1.corp.example.com"}],
+//	 "txt":[{"name":"corp.example.com","values":["v=spf1 -all"]}],
+//	 "cname":[{"name":"wiki.corp.example.com","target":"web.corp.example.com"}]}
+type dnsRecordsV1Cfg struct {
+	Ttl uint32 `json:"ttl"`
+	Srv []struct {
+		Name     string `json:"name"`
+		Priority uint16 `json:"priority"`
+		Weight   uint16 `json:"weight"`
+		Port     uint16 `json:"port"`
+		Target   string `json:"target"`
+	} `json:"srv"`
+	Txt []struct {
+		Name   string   `json:"name"`
+		Values []string `json:"values"`
+	} `json:"txt"`
+	Cname []struct {
+		Name   string `json:"name"`
+		Target string `json:"target"`
+	} `json:"cname"`
+}
+
+// recordStore holds the records supplied by the services of each identity. Records of every service are answered
+// together
+type recordStore struct {
+	mu        sync.RWMutex
+	byService map[string][]dns.RR // keyed by fingerprint/service id
+}
+
+var serviceRecords = &recordStore{byService: make(map[string][]dns.RR)}
+
+// set replaces the records of a service of an identity with the ones in the raw config and returns the names the
+// service now has records for. An empty config removes the records
+func (s *recordStore) set(fingerprint string, svcId string, raw string) []string {
+	var rrs []dns.RR
+	if strings.TrimSpace(raw) != "" {
+		var cfg dnsRecordsV1Cfg
+		if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
+			log.Errorf("could not read %s of service %s: %v", CfgDnsRecordsV1, svcId, err)
+		}
+		rrs = cfg.records()
+	}
+
+	owner := fingerprint + "/" + svcId
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(rrs) == 0 {
+		delete(s.byService, owner)
+		return nil
+	}
+	s.byService[owner] = rrs
+	return recordNames(rrs)
+}
+
+// remove drops the records of a service of an identity and returns the names it had records for
+func (s *recordStore) remove(fingerprint string, svcId string) []string {
+	owner := fingerprint + "/" + svcId
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := recordNames(s.byService[owner])
+	delete(s.byService, owner)
+	return names
+}
+
+// names returns the names a service of an identity has records for
+func (s *recordStore) names(fingerprint string, svcId string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return recordNames(s.byService[fingerprint+"/"+svcId])
+}
+
+// ForgetServiceRecords drops the records of every service of an identity which is removed
+func ForgetServiceRecords(fingerprint string) {
+	s := serviceRecords
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for owner := range s.byService {
+		if strings.HasPrefix(owner, fingerprint+"/") {
+			delete(s.byService, owner)
+		}
+	}
+}
+
+// lookup returns a copy of every record of the given type and name. A service available to several identities
+// supplies its records once
+func (s *recordStore) lookup(name string, qtype uint16) []dns.RR {
+	name = normalizeDnsName(name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	found := make([]dns.RR, 0)
+	for _, rrs := range s.byService {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == qtype && rr.Header().Name == name && !containsRecord(found, rr) {
+				found = append(found, dns.Copy(rr))
+			}
+		}
+	}
+	return found
+}
+
+func containsRecord(rrs []dns.RR, rr dns.RR) bool {
+	for _, r := range rrs {
+		if dns.IsDuplicate(r, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *dnsRecordsV1Cfg) records() []dns.RR {
+	rrs := make([]dns.RR, 0)
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		// the ttl is set when the record is answered
+		return dns.RR_Header{Name: normalizeDnsName(name), Rrtype: rrtype, Class: dns.ClassINET}
+	}
+	for _, r := range c.Srv {
+		rrs = append(rrs, &dns.SRV{
+			Hdr:      hdr(r.Name, dns.TypeSRV),
+			Priority: r.Priority,
+			Weight:   r.Weight,
+			Port:     r.Port,
+			Target:   normalizeDnsName(r.Target),
+		})
+	}
+	for _, r := range c.Txt {
+		rrs = append(rrs, &dns.TXT{Hdr: hdr(r.Name, dns.TypeTXT), Txt: r.Values})
+	}
+	for _, r := range c.Cname {
+		rrs = append(rrs, &dns.CNAME{Hdr: hdr(r.Name, dns.TypeCNAME), Target: normalizeDnsName(r.Target)})
+	}
+	return rrs
+}
+
+// recordNames returns every distinct owner name without the trailing period, ready to be used as an NRPT rule
+func recordNames(rrs []dns.RR) []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, rr := range rrs {
+		name := strings.TrimSuffix(rr.Header().Name, ".")
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// resolveRecords answers PTR queries for the TUN range and queries matching the records supplied by services. nil is
+// returned when the query is not about either
+func resolveRecords(q *dns.Msg) *dns.Msg {
+	query := q.Question[0]
+	msg := &dns.Msg{}
+	msg.SetReply(q)
+	msg.Authoritative = true
+	msg.RecursionAvailable = false
+
+	if query.Qtype == dns.TypePTR {
+		ip := ptrToIp(query.Name)
+		if ip == nil || !dnsMgrPrivate.inRange(ip) {
+			return nil
+		}
+		if host := dnsMgrPrivate.reverse(ip); host != "" {
+			msg.Answer = append(msg.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: query.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: answerTtls.answerTtl(host)},
+				Ptr: host,
+			})
+		} else {
+			log.Debugf("%v is in the TUN range but not assigned to any intercept", ip)
+			msg.Rcode = dns.RcodeNameError
+		}
+	} else if answer := serviceRecords.lookup(query.Name, query.Qtype); len(answer) > 0 {
+		msg.Answer = answer
+		setRecordTtls(msg.Answer)
+	} else if cnames := serviceRecords.lookup(query.Name, dns.TypeCNAME); len(cnames) > 0 {
+		// a name with a CNAME has no other records. the target is added when it is an intercepted name
+		msg.Answer = cnames[:1]
+		setRecordTtls(msg.Answer)
+		target := cnames[0].(*dns.CNAME).Target
+		if ip := DNSMgr.Resolve(target); query.Qtype == dns.TypeA && ip != nil && len(ip.To4()) == net.IPv4len {
+			msg.Answer = append(msg.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: answerTtls.answerTtl(target)},
+				A:   ip,
+			})
+		}
+	} else {
+		return nil
+	}
+
+	if opt := q.IsEdns0(); opt != nil {
+		msg.SetEdns0(uint16(clientUdpSize(q)), opt.Do())
+	}
+	return msg
+}
+
+// ptrToIp reads the ipv4 address from a reverse lookup name such as 5.0.64.100.in-addr.arpa.
+func ptrToIp(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if !strings.HasSuffix(name, ".in-addr.arpa") {
+		return nil
+	}
+	octets := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+	if len(octets) != net.IPv4len {
+		return nil
+	}
+	for i, j := 0, len(octets)-1; i < j; i, j = i+1, j-1 {
+		octets[i], octets[j] = octets[j], octets[i]
+	}
+	return net.ParseIP(strings.Join(octets, ".")).To4()
+}
+
+// reverseNrptNamespace is the NRPT namespace sending reverse lookups of the TUN range to the ziti DNS server. NRPT
+// works on whole labels so the namespace covers the TUN range rounded out to an octet. Lookups of addresses outside
+// the TUN range are proxied as usual
+func reverseNrptNamespace() string {
+	dnsMgrPrivate.mu.RLock()
+	defer dnsMgrPrivate.mu.RUnlock()
+	octets := dnsMgrPrivate.maskBits / 8
+	if octets == 0 {
+		return ""
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, dnsMgrPrivate.cidr)
+	labels := make([]string, 0, octets)
+	for i := octets - 1; i >= 0; i-- {
+		labels = append(labels, fmt.Sprintf("%d", ip[i]))
+	}
+	return fmt.Sprintf(".%s.in-addr.arpa", strings.Join(labels, "."))
+}
+
+// setRecordTtls sets the ttl of records supplied by services to the ttl of their names
+func setRecordTtls(rrs []dns.RR) {
+	for _, rr := range rrs {
+		rr.Header().Ttl = answerTtls.answerTtl(rr.Header().Name)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecordsOfServiceSharedByIdentities(t *testing.T) {
+	s := &recordStore{byService: make(map[string][]dns.RR)}
+	const raw = `{"txt":[{"name":"corp.example.com","values":["v=spf1 -all"]}]}`
+
+	s.set("first", "svc", raw)
+	s.set("second", "svc", raw)
+	if got := s.lookup("corp.example.com", dns.TypeTXT); len(got) != 1 {
+		t.Errorf("lookup() = %v, want the record once", got)
+	}
+
+	if got := s.remove("first", "svc"); !reflect.DeepEqual(got, []string{"corp.example.com"}) {
+		t.Errorf("remove() = %v, want [corp.example.com]", got)
+	}
+	if got := s.lookup("corp.example.com", dns.TypeTXT); len(got) != 1 {
+		t.Errorf("lookup() = %v after the first identity lost the service, want the record of the second", got)
+	}
+	if got := s.names("second", "svc"); !reflect.DeepEqual(got, []string{"corp.example.com"}) {
+		t.Errorf("names() = %v, want [corp.example.com]", got)
+	}
+	if got := s.names("first", "svc"); len(got) != 0 {
+		t.Errorf("names() = %v for the identity which lost the service", got)
+	}
+
+	s.set("second", "svc", "")
+	if got := s.lookup("corp.example.com", dns.TypeTXT); len(got) != 0 {
+		t.Errorf("lookup() = %v after the config was removed", got)
+	}
+}
+
+func TestForgetServiceRecords(t *testing.T) {
+	saved := serviceRecords
+	serviceRecords = &recordStore{byService: make(map[string][]dns.RR)}
+	t.Cleanup(func() { serviceRecords = saved })
+
+	serviceRecords.set("first", "svc", `{"txt":[{"name":"a.example.com","values":["a"]}]}`)
+	serviceRecords.set("firstborn", "svc", `{"txt":[{"name":"b.example.com","values":["b"]}]}`)
+	ForgetServiceRecords("first")
+	if got := serviceRecords.lookup("a.example.com", dns.TypeTXT); len(got) != 0 {
+		t.Errorf("records of the removed identity are still answered: %v", got)
+	}
+	if got := serviceRecords.lookup("b.example.com", dns.TypeTXT); len(got) != 1 {
+		t.Errorf("records of another identity were dropped: %v", got)
+	}
+}
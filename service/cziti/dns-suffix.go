@@ -0,0 +1,170 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/openziti/desktop-edge-win/service/windns"
+)
+
+// suffixSearch holds the DNS suffixes windows appends to names before querying them. A query for
+// server.corp.example.com where corp.example.com is a search suffix is also resolved as server so that intercepted
+// single label names work the same as they do with the suffix appended
+type suffixSearch struct {
+	mu       sync.RWMutex
+	detected []string // the global suffix search list followed by the connection-specific suffixes
+	extra    []string // configured with DnsSearchSuffixes. searched before the detected suffixes
+
+	// serializes detecting the suffixes and applying the NRPT changes so the changes reach NRPT in the order they
+	// were made
+	refresh sync.Mutex
+}
+
+var dnsSuffixes = &suffixSearch{}
+
+// normalizeSuffix returns the suffix in lower case with a trailing period and without a leading one. An empty string
+// is returned for a suffix which is not usable
+func normalizeSuffix(suffix string) string {
+	suffix = strings.ToLower(strings.Trim(strings.TrimSpace(suffix), "."))
+	if suffix == "" {
+		return ""
+	}
+	return suffix + "."
+}
+
+// dedupeSuffixes normalizes the suffixes, keeping the first of any duplicates
+func dedupeSuffixes(suffixes []string) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(suffixes))
+	for _, s := range suffixes {
+		if s = normalizeSuffix(s); s != "" && !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// list returns every suffix in search order
+func (s *suffixSearch) list() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.listLocked()
+}
+
+// must hold the lock
+func (s *suffixSearch) listLocked() []string {
+	all := make([]string, 0, len(s.extra)+len(s.detected))
+	all = append(all, s.extra...)
+	all = append(all, s.detected...)
+	return dedupeSuffixes(all)
+}
+
+// candidates returns the name with each matching suffix removed, in search order. A suffix only matches whole labels
+// and never the entire name
+func (s *suffixSearch) candidates(name string) []string {
+	name = normalizeDnsName(name)
+	result := make([]string, 0)
+	for _, suffix := range s.list() {
+		if strings.HasSuffix(name, "."+suffix) {
+			result = append(result, name[:len(name)-len(suffix)])
+		}
+	}
+	return result
+}
+
+// set replaces the suffixes and returns the NRPT namespaces added and removed by the change
+func (s *suffixSearch) set(detected []string, extra []string) (added map[string]bool, removed map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := nrptNamespaces(s.listLocked())
+	if detected != nil {
+		s.detected = dedupeSuffixes(detected)
+	}
+	if extra != nil {
+		s.extra = dedupeSuffixes(extra)
+	}
+	after := nrptNamespaces(s.listLocked())
+
+	added, removed = make(map[string]bool), make(map[string]bool)
+	for ns := range after {
+		if !before[ns] {
+			added[ns] = true
+		}
+	}
+	for ns := range before {
+		if !after[ns] {
+			removed[ns] = true
+		}
+	}
+	return added, removed
+}
+
+// nrptNamespaces turns suffixes into NRPT namespaces, which need a leading period and cannot have a trailing one
+func nrptNamespaces(suffixes []string) map[string]bool {
+	namespaces := make(map[string]bool)
+	for _, s := range suffixes {
+		namespaces[fmt.Sprintf(".%s", strings.TrimSuffix(s, "."))] = true
+	}
+	return namespaces
+}
+
+// currentSuffixNrptNamespaces returns the NRPT namespaces of every search suffix
+func currentSuffixNrptNamespaces() map[string]bool {
+	return nrptNamespaces(dnsSuffixes.list())
+}
+
+// RefreshDnsSuffixes detects the suffix search list and the connection-specific suffixes of the local interfaces
+// again and updates the NRPT rules to match
+func RefreshDnsSuffixes() {
+	dnsSuffixes.refresh.Lock()
+	defer dnsSuffixes.refresh.Unlock()
+	detected := windns.GetConnectionSpecificDomains()
+	log.Infof("DNS search suffixes detected: %v", detected)
+	applySuffixNrptChanges(dnsSuffixes.set(detected, nil))
+}
+
+// SetDnsSearchSuffixes adds suffixes to search in addition to the ones detected on the local interfaces. They are
+// searched first
+func SetDnsSearchSuffixes(extra []string) {
+	if extra == nil {
+		extra = []string{}
+	}
+	dnsSuffixes.refresh.Lock()
+	defer dnsSuffixes.refresh.Unlock()
+	applySuffixNrptChanges(dnsSuffixes.set(nil, extra))
+}
+
+func applySuffixNrptChanges(added map[string]bool, removed map[string]bool) {
+	dnsIp := dnsServerIp()
+	if dnsIp == nil {
+		// the rules are added once the DNS server starts
+		return
+	}
+	if len(removed) > 0 {
+		windns.RemoveNrptRules(removed)
+		log.Infof("removed DNS search suffixes from NRPT: %v", removed)
+	}
+	if len(added) > 0 {
+		windns.AddNrptRules(added, dnsIp.String())
+		log.Infof("added DNS search suffixes to NRPT: %v", added)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSuffixCandidates(t *testing.T) {
+	s := &suffixSearch{}
+	s.set([]string{"corp.example.com", "Example.com.", "lab.example.com"}, []string{"lab.example.com", "dev.example.com"})
+
+	if got, want := s.list(), []string{"lab.example.com.", "dev.example.com.", "corp.example.com.", "example.com."}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("list() = %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{name: "server.corp.example.com", want: []string{"server.", "server.corp."}},
+		{name: "SERVER.Corp.Example.Com.", want: []string{"server.", "server.corp."}},
+		{name: "server.lab.example.com", want: []string{"server.", "server.lab."}},
+		{name: "server.dev.example.com", want: []string{"server.", "server.dev."}},
+		{name: "a.b.corp.example.com", want: []string{"a.b.", "a.b.corp."}},
+		{name: "server.notcorp.example.com", want: []string{"server.notcorp."}},
+		{name: "notexample.com", want: []string{}},
+		{name: "corp.example.com", want: []string{"corp."}},
+		{name: "example.com", want: []string{}},
+		{name: "server.example.org", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.candidates(tt.name); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("candidates(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSuffixSetReturnsNrptChanges(t *testing.T) {
+	s := &suffixSearch{}
+	added, removed := s.set([]string{"corp.example.com", "lab.example.com"}, nil)
+	if want := map[string]bool{".corp.example.com": true, ".lab.example.com": true}; !reflect.DeepEqual(added, want) || len(removed) != 0 {
+		t.Errorf("set() = %v, %v, want %v and nothing removed", added, removed, want)
+	}
+
+	// configured suffixes are kept when the detected ones change
+	s.set(nil, []string{"dev.example.com", "lab.example.com"})
+	added, removed = s.set([]string{"corp.example.com"}, nil)
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("set() = %v, %v, lab.example.com is still configured so nothing should change", added, removed)
+	}
+
+	added, removed = s.set([]string{"Corp.Example.com."}, []string{})
+	if want := map[string]bool{".dev.example.com": true, ".lab.example.com": true}; len(added) != 0 || !reflect.DeepEqual(removed, want) {
+		t.Errorf("set() = %v, %v, want nothing added and %v removed", added, removed, want)
+	}
+}
+
+func TestConcurrentSuffixChangesMatchFinalList(t *testing.T) {
+	s := &suffixSearch{}
+	var mu sync.Mutex
+	count := make(map[string]int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				detected := []string{fmt.Sprintf("s%d.example.com", (i+j)%5), "corp.example.com"}
+				var extra []string
+				if j%3 == 0 {
+					extra = []string{fmt.Sprintf("s%d.example.com", j%4)}
+				}
+				added, removed := s.set(detected, extra)
+				mu.Lock()
+				for ns := range added {
+					count[ns]++
+				}
+				for ns := range removed {
+					count[ns]--
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	final := nrptNamespaces(s.list())
+	for ns, n := range count {
+		if want := map[bool]int{true: 1, false: 0}[final[ns]]; n != want {
+			t.Errorf("%s was added %d more times than it was removed, want %d", ns, n, want)
+		}
+	}
+	for ns := range final {
+		if _, ok := count[ns]; !ok {
+			t.Errorf("%s is searched but was never added", ns)
+		}
+	}
+}
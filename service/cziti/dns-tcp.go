@@ -0,0 +1,169 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+// how long a client may keep an idle TCP connection open to the DNS listener
+const DnsTcpIdleTimeout = 10 * time.Second
+
+var dnsTcpListeners []*net.TCPListener
+
+func runTCPListener(ip net.IP, port int) {
+	server, err := listenTCP(ip, port)
+	if err != nil {
+		log.Errorf("DNS over TCP is not available on %v:%d: %v", ip, port, err)
+		return
+	}
+	listenersMutex.Lock()
+	dnsTcpListeners = append(dnsTcpListeners, server)
+	listenersMutex.Unlock()
+	serveTCPListener(server)
+}
+
+func listenTCP(ip net.IP, port int) (*net.TCPListener, error) {
+	laddr := &net.TCPAddr{
+		IP:   ip,
+		Port: port,
+	}
+	network := "tcp6"
+	if len(ip.To4()) == net.IPv4len {
+		network = "tcp4"
+	}
+
+	var server *net.TCPListener
+	err := retryListen(laddr, func() (err error) {
+		server, err = net.ListenTCP(network, laddr)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("DNS listening at: %v/tcp", laddr)
+	return server, nil
+}
+
+func serveTCPListener(server *net.TCPListener) {
+	for {
+		conn, err := server.Accept()
+		if err != nil {
+			if err == io.EOF || err == os.ErrClosed || strings.HasSuffix(err.Error(), "use of closed network connection") {
+				log.Warnf("DNS TCP listener closing.")
+			} else {
+				log.Errorf("unexpected error accepting a DNS TCP connection. the TCP listener is closing: %v", err)
+			}
+			_ = server.Close()
+			return
+		}
+		go serveTCPConn(conn)
+	}
+}
+
+// serveTCPConn answers every length-prefixed query sent on the connection until the client closes it or goes idle
+func serveTCPConn(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	dc := &dns.Conn{Conn: conn}
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(DnsTcpIdleTimeout))
+		q, err := dc.ReadMsg()
+		received := time.Now()
+		if err != nil {
+			if err != io.EOF {
+				log.Tracef("DNS TCP connection from %v closed: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(q.Question) == 0 {
+			log.Warnf("discarding dns message as it contained no question! %v", q.String())
+			continue
+		}
+		log.Tracef("processing a dns query over tcp. type:%s, for:%s on %v. id:%v", dns.Type(q.Question[0].Qtype), q.Question[0].Name, conn.RemoteAddr(), q.Id)
+
+		reply := resolveRecords(q)
+		if reply == nil {
+			reply = resolveLocally(q)
+		}
+		disposition := ""
+		if reply != nil {
+			disposition = localDisposition(reply)
+		} else if reply = resolveBlocked(q); reply != nil {
+			disposition = dto.DnsDispositionBlocked
+		} else if reply = upstreamCache.get(q); reply != nil {
+			disposition = dto.DnsDispositionCached
+		} else {
+			var err error
+			reply, err = proxyDNSOverTCP(q)
+			disposition = upstreamDisposition(err)
+			if err == nil {
+				upstreamCache.put(q, reply)
+			}
+		}
+		if err = dc.WriteMsg(reply); err != nil {
+			log.Errorf("could not write DNS reply over tcp to %v: %v", conn.RemoteAddr(), err)
+			return
+		}
+		logQuery(q, conn.RemoteAddr(), disposition, received)
+	}
+}
+
+// proxyDNSOverTCP asks the upstream DNS over tcp. SERVFAIL is returned along with the error when no upstream answers
+func proxyDNSOverTCP(q *dns.Msg) (*dns.Msg, error) {
+	reply, err := poolFor(q.Question[0].Name).exchange(q, "tcp")
+	if err != nil {
+		log.Debugf("could not proxy %s %s over tcp: %v", dns.Type(q.Question[0].Qtype), q.Question[0].Name, err)
+		failed := &dns.Msg{}
+		failed.SetRcode(q, dns.RcodeServerFailure)
+		return failed, err
+	}
+	return reply, nil
+}
+
+// retryListen calls listen until it succeeds, waiting 500ms between attempts. The system may not be ready for the
+// service to listen on the TUN ip right after the TUN is created
+func retryListen(laddr net.Addr, listen func() error) error {
+	attempts := 0
+	maxAttempts := 20
+	for {
+		attempts++
+		err := listen()
+		if err == nil {
+			return nil
+		} else if attempts >= maxAttempts {
+			return fmt.Errorf("could not listen on %v after %d attempts: %v", laddr, attempts, err)
+		} else if attempts < (maxAttempts / 2) {
+			//just ignore the first 1/2 of all attempts...
+		} else if attempts < (3 * maxAttempts / 4) {
+			// only log at debug until we hit 3/4 the max attempts to remove unnecessary warns from the log
+			log.Debugf("System not ready to listen on %v yet. Retrying after 500ms. This has happened %d times.", laddr, attempts)
+		} else {
+			log.Warnf("System not ready to listen on %v yet. Retrying after 500ms. This has happened %d times.", laddr, attempts)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
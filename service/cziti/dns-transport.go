@@ -0,0 +1,371 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/util/dnsutil"
+)
+
+const (
+	// how long an idle connection to an encrypted upstream is kept for reuse
+	EncryptedUpstreamIdleTimeout = 30 * time.Second
+	// how many idle connections to a DNS over TLS upstream are kept for reuse
+	maxIdleTlsConns = 4
+	// the shortest time the address of an encrypted upstream is kept, for answers with a ttl of 0 or close to it
+	minBootstrapTtl = 30 * time.Second
+)
+
+// upstreamTransport sends a single query to an upstream DNS server. network is the protocol the client used and only
+// matters to plain DNS. encrypted transports always use their own protocol
+type upstreamTransport interface {
+	exchange(q *dns.Msg, network string) (*dns.Msg, time.Duration, error)
+}
+
+func newTransport(up *dnsutil.Upstream) upstreamTransport {
+	switch up.Proto {
+	case dnsutil.ProtoTLS:
+		return &tlsTransport{
+			addr: up.Addr(),
+			client: &dns.Client{
+				Net:       "tcp-tls",
+				Timeout:   UpstreamTimeout,
+				TLSConfig: upstreamTLSConfig(up),
+			},
+		}
+	case dnsutil.ProtoHTTPS:
+		return &httpsTransport{
+			url: fmt.Sprintf("https://%s%s", up.Addr(), up.Path),
+			client: &http.Client{
+				Timeout: UpstreamTimeout,
+				Transport: &http.Transport{
+					DialContext:       bootstrapDial,
+					TLSClientConfig:   upstreamTLSConfig(up),
+					ForceAttemptHTTP2: true,
+					IdleConnTimeout:   EncryptedUpstreamIdleTimeout,
+				},
+			},
+		}
+	default:
+		return &plainTransport{addr: up.Addr()}
+	}
+}
+
+type plainTransport struct {
+	addr string
+}
+
+func (t *plainTransport) exchange(q *dns.Msg, network string) (*dns.Msg, time.Duration, error) {
+	if opt := q.IsEdns0(); opt != nil && opt.UDPSize() < MaxEdnsUdpSize && network == "udp" {
+		// the reply is read into a buffer of the size the query asks for. asking for as much as is ever relayed keeps
+		// an upstream which ignores the size from failing the query. the reply is truncated to the size of the client
+		// when it is written
+		q = q.Copy()
+		q.IsEdns0().SetUDPSize(MaxEdnsUdpSize)
+	}
+	c := &dns.Client{Net: network, Timeout: UpstreamTimeout, UDPSize: MaxEdnsUdpSize}
+	return c.Exchange(q, t.addr)
+}
+
+// tlsTransport is DNS over TLS as described in RFC 7858. Connections are kept open and reused for later queries as
+// the RFC recommends, one query at a time per connection
+type tlsTransport struct {
+	addr   string
+	client *dns.Client
+
+	mu    sync.Mutex
+	idle  []*idleTlsConn // the most recently used last
+	sweep *time.Timer    // closes the connections idle for too long. nil when no connection is idle
+}
+
+type idleTlsConn struct {
+	conn  *dns.Conn
+	since time.Time
+}
+
+func (t *tlsTransport) exchange(q *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	if conn := t.takeIdle(); conn != nil {
+		reply, rtt, err := t.client.ExchangeWithConn(q, conn)
+		if err == nil {
+			t.putIdle(conn)
+			return reply, rtt, nil
+		}
+		_ = conn.Close()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, 0, err
+		}
+		// the server closed the connection while it was idle. the query is sent again on a new one
+		log.Tracef("idle connection to upstream DNS %s failed, reconnecting: %v", t.addr, err)
+	}
+
+	conn, err := t.dial()
+	if err != nil {
+		return nil, 0, err
+	}
+	reply, rtt, err := t.client.ExchangeWithConn(q, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, 0, err
+	}
+	t.putIdle(conn)
+	return reply, rtt, nil
+}
+
+func (t *tlsTransport) dial() (*dns.Conn, error) {
+	host, port, err := net.SplitHostPort(t.addr)
+	if err != nil {
+		return nil, err
+	}
+	addr := t.addr
+	if net.ParseIP(host) == nil {
+		ip, err := bootstrapLookup(host)
+		if err != nil {
+			return nil, err
+		}
+		addr = net.JoinHostPort(ip.String(), port)
+	}
+	conn, err := t.client.Dial(addr)
+	if err != nil && addr != t.addr {
+		// the upstream may have moved. its address is looked up again next time
+		bootstrapAddresses.forget(host)
+	}
+	return conn, err
+}
+
+// takeIdle returns the connection used most recently, or nil when there is none
+func (t *tlsTransport) takeIdle() *dns.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closeExpiredLocked()
+	if len(t.idle) == 0 {
+		return nil
+	}
+	last := t.idle[len(t.idle)-1]
+	t.idle = t.idle[:len(t.idle)-1]
+	return last.conn
+}
+
+// putIdle keeps a connection which answered for the next query
+func (t *tlsTransport) putIdle(conn *dns.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle) >= maxIdleTlsConns {
+		_ = conn.Close()
+		return
+	}
+	t.idle = append(t.idle, &idleTlsConn{conn: conn, since: time.Now()})
+	if t.sweep == nil {
+		t.sweep = time.AfterFunc(EncryptedUpstreamIdleTimeout, t.closeExpired)
+	}
+}
+
+func (t *tlsTransport) closeExpired() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep = nil
+	t.closeExpiredLocked()
+	if len(t.idle) > 0 {
+		t.sweep = time.AfterFunc(time.Until(t.idle[0].since.Add(EncryptedUpstreamIdleTimeout)), t.closeExpired)
+	}
+}
+
+// closeExpiredLocked closes the connections idle for longer than EncryptedUpstreamIdleTimeout. must hold the lock
+func (t *tlsTransport) closeExpiredLocked() {
+	cutoff := time.Now().Add(-EncryptedUpstreamIdleTimeout)
+	expired := 0
+	for expired < len(t.idle) && !t.idle[expired].since.After(cutoff) {
+		_ = t.idle[expired].conn.Close()
+		expired++
+	}
+	t.idle = append(t.idle[:0], t.idle[expired:]...)
+}
+
+// httpsTransport is DNS over HTTPS as described in RFC 8484 using POST
+type httpsTransport struct {
+	url    string
+	client *http.Client
+}
+
+func (t *httpsTransport) exchange(q *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	// RFC 8484 asks for an id of 0 so responses can be cached by http caches
+	out := q.Copy()
+	out.Id = 0
+	packed, err := out.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	start := time.Now()
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s answered %s", t.url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	rtt := time.Since(start)
+
+	reply := &dns.Msg{}
+	if err = reply.Unpack(body); err != nil {
+		return nil, 0, fmt.Errorf("invalid DNS message from %s: %v", t.url, err)
+	}
+	reply.Id = q.Id
+	return reply, rtt, nil
+}
+
+// upstreamTLSConfig verifies the server against the system roots, or only against the pinned public key when one is
+// configured
+func upstreamTLSConfig(up *dnsutil.Upstream) *tls.Config {
+	cfg := &tls.Config{
+		ServerName: up.Host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(up.Pin) == 0 {
+		return cfg
+	}
+	pin := up.Pin
+	// the pin replaces verification of the chain. VerifyPeerCertificate still runs when verification is skipped
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				continue
+			}
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+		return fmt.Errorf("no certificate presented by %s matches the pinned public key", up.Host)
+	}
+	return cfg
+}
+
+// bootstrapDial connects to an encrypted upstream. Host names are looked up using the DNS servers of the local
+// interfaces. Using the system resolver could send the lookup back to this proxy
+func bootstrapDial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	lookedUp := false
+	if net.ParseIP(host) == nil {
+		ip, err := bootstrapLookup(host)
+		if err != nil {
+			return nil, err
+		}
+		addr = net.JoinHostPort(ip.String(), port)
+		lookedUp = true
+	}
+	d := &net.Dialer{Timeout: UpstreamTimeout}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil && lookedUp {
+		bootstrapAddresses.forget(host)
+	}
+	return conn, err
+}
+
+// bootstrapCache keeps the addresses of encrypted upstreams for the ttl of the answer so the name of the upstream is
+// not sent in plain text with every query
+type bootstrapCache struct {
+	mu      sync.Mutex
+	entries map[string]*bootstrapEntry
+}
+
+type bootstrapEntry struct {
+	ip      net.IP
+	expires time.Time
+}
+
+var bootstrapAddresses = &bootstrapCache{entries: make(map[string]*bootstrapEntry)}
+
+func (c *bootstrapCache) get(host string) net.IP {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[host]
+	if e == nil {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, host)
+		return nil
+	}
+	return e.ip
+}
+
+func (c *bootstrapCache) put(host string, ip net.IP, ttl time.Duration) {
+	if ttl < minBootstrapTtl {
+		ttl = minBootstrapTtl
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[host] = &bootstrapEntry{ip: ip, expires: time.Now().Add(ttl)}
+}
+
+func (c *bootstrapCache) forget(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, host)
+}
+
+// bootstrapLookup finds the ipv4 address of an encrypted upstream using the DNS servers of the local interfaces. The
+// address is kept for the ttl of the answer
+func bootstrapLookup(host string) (net.IP, error) {
+	if ip := bootstrapAddresses.get(host); ip != nil {
+		return ip, nil
+	}
+	q := &dns.Msg{}
+	q.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	reply, err := plainFallback.exchangeOwn(q, "udp")
+	if err != nil {
+		return nil, fmt.Errorf("could not look up upstream DNS %s: %v", host, err)
+	}
+	for _, rr := range reply.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			bootstrapAddresses.put(host, a.A, time.Duration(a.Hdr.Ttl)*time.Second)
+			return a.A, nil
+		}
+	}
+	return nil, fmt.Errorf("no address found for upstream DNS %s", host)
+}
@@ -0,0 +1,267 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/util/dnsutil"
+)
+
+const testUpstreamName = "dns.example.test"
+
+// testCertificate makes a self signed certificate and returns it with the pin of its public key
+func testCertificate(t *testing.T) (tls.Certificate, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: testUpstreamName},
+		DNSNames:     []string{testUpstreamName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pin[:]
+}
+
+// answerA answers every question with 192.0.2.1
+func answerA(q *dns.Msg) *dns.Msg {
+	reply := &dns.Msg{}
+	reply.SetReply(q)
+	reply.Answer = append(reply.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 1),
+	})
+	return reply
+}
+
+// useBootstrapServer makes a local fake the DNS server of the local interfaces. It resolves the name of the test
+// upstream to 127.0.0.1 and counts the lookups
+func useBootstrapServer(t *testing.T) *int32 {
+	t.Helper()
+	lookups := new(int32)
+	addr := startFakeUpstream(t, func(q *dns.Msg) *dns.Msg {
+		atomic.AddInt32(lookups, 1)
+		reply := &dns.Msg{}
+		reply.SetReply(q)
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(127, 0, 0, 1),
+		})
+		return reply
+	})
+	plainFallback.setServers([]string{addr})
+	bootstrapAddresses.forget(testUpstreamName)
+	t.Cleanup(func() {
+		plainFallback.setServers(nil)
+		bootstrapAddresses.forget(testUpstreamName)
+	})
+	return lookups
+}
+
+// startFakeDoT answers DNS over TLS, any number of queries per connection. The connections are counted
+func startFakeDoT(t *testing.T, cert tls.Certificate) (int, *int32) {
+	t.Helper()
+	l, err := tls.Listen("tcp4", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	conns := new(int32)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(conns, 1)
+			go func() {
+				conn := &dns.Conn{Conn: c}
+				defer func() { _ = conn.Close() }()
+				for {
+					q, err := conn.ReadMsg()
+					if err != nil {
+						return
+					}
+					if err = conn.WriteMsg(answerA(q)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port, conns
+}
+
+// startFakeDoH answers DNS over HTTPS. The connections are counted
+func startFakeDoH(t *testing.T, cert tls.Certificate) (int, *int32) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		q := &dns.Msg{}
+		if err == nil {
+			err = q.Unpack(b)
+		}
+		if err != nil || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "not a DNS message", http.StatusBadRequest)
+			return
+		}
+		reply, _ := answerA(q).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(reply)
+	}))
+	conns := new(int32)
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return p, conns
+}
+
+func TestEncryptedTransportsReuseConnectionsAndLookups(t *testing.T) {
+	cert, pin := testCertificate(t)
+	dotPort, dotConns := startFakeDoT(t, cert)
+	dohPort, dohConns := startFakeDoH(t, cert)
+
+	tests := []struct {
+		name     string
+		upstream *dnsutil.Upstream
+		conns    *int32
+	}{
+		{
+			name:     "tls",
+			upstream: &dnsutil.Upstream{Proto: dnsutil.ProtoTLS, Host: testUpstreamName, Port: dotPort, Pin: pin},
+			conns:    dotConns,
+		},
+		{
+			name:     "https",
+			upstream: &dnsutil.Upstream{Proto: dnsutil.ProtoHTTPS, Host: testUpstreamName, Port: dohPort, Path: "/dns-query", Pin: pin},
+			conns:    dohConns,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookups := useBootstrapServer(t)
+			transport := newTransport(tt.upstream)
+			for i := 0; i < 5; i++ {
+				q := &dns.Msg{}
+				q.SetQuestion("www.example.com.", dns.TypeA)
+				reply, _, err := transport.exchange(q, "udp")
+				if err != nil {
+					t.Fatalf("query %d failed: %v", i, err)
+				}
+				if reply.Id != q.Id || len(reply.Answer) != 1 {
+					t.Fatalf("query %d answered with id %d and %d answer(s), want id %d and 1 answer", i, reply.Id, len(reply.Answer), q.Id)
+				}
+			}
+			if got := atomic.LoadInt32(tt.conns); got != 1 {
+				t.Errorf("5 queries opened %d connections, want 1", got)
+			}
+			if got := atomic.LoadInt32(lookups); got != 1 {
+				t.Errorf("the upstream name was looked up %d times, want 1", got)
+			}
+		})
+	}
+}
+
+func TestTlsTransportReconnectsWhenIdleConnectionIsClosed(t *testing.T) {
+	cert, pin := testCertificate(t)
+	port, conns := startFakeDoT(t, cert)
+	transport := newTransport(&dnsutil.Upstream{Proto: dnsutil.ProtoTLS, Host: "127.0.0.1", Port: port, Pin: pin}).(*tlsTransport)
+
+	q := &dns.Msg{}
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	if _, _, err := transport.exchange(q, "udp"); err != nil {
+		t.Fatal(err)
+	}
+	// the server going away closes the idle connection
+	transport.mu.Lock()
+	for _, idle := range transport.idle {
+		_ = idle.conn.Close()
+	}
+	transport.mu.Unlock()
+
+	if _, _, err := transport.exchange(q, "udp"); err != nil {
+		t.Fatalf("query on a closed idle connection failed: %v", err)
+	}
+	if got := atomic.LoadInt32(conns); got != 2 {
+		t.Errorf("opened %d connections, want 2", got)
+	}
+}
+
+func TestBootstrapLookupKeepsAddressForTtl(t *testing.T) {
+	lookups := useBootstrapServer(t)
+	for i := 0; i < 3; i++ {
+		ip, err := bootstrapLookup(testUpstreamName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Fatalf("bootstrapLookup() = %v, want 127.0.0.1", ip)
+		}
+	}
+	if got := atomic.LoadInt32(lookups); got != 1 {
+		t.Errorf("looked up %d times, want 1", got)
+	}
+
+	// an expired address is looked up again
+	bootstrapAddresses.mu.Lock()
+	bootstrapAddresses.entries[testUpstreamName].expires = time.Now().Add(-time.Second)
+	bootstrapAddresses.mu.Unlock()
+	if _, err := bootstrapLookup(testUpstreamName); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(lookups); got != 2 {
+		t.Errorf("looked up %d times after the address expired, want 2", got)
+	}
+}
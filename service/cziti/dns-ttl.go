@@ -0,0 +1,228 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+const (
+	// DefaultDnsTtl is the ttl of the answers for intercepted names when neither the config nor the service set one
+	DefaultDnsTtl = 60 * time.Second
+	// DefaultDnsInaccessibleTtl is the ttl of the answers for names whose services all fail their posture checks
+	DefaultDnsInaccessibleTtl = 5 * time.Second
+)
+
+// serviceTtl is what a service of an identity says about the ttl of the names it intercepts
+type serviceTtl struct {
+	ttl        uint32 // seconds. 0 when the service does not set one
+	accessible bool   // false while the posture checks of the service fail
+	active     bool   // false while the identity is disconnected
+	names      []string
+}
+
+// ttlStore decides the ttl of the answers for intercepted names. A name intercepted by several services gets the
+// lowest ttl any accessible service asks for so the service wanting the fastest failover wins. A name no accessible
+// service intercepts gets the short inaccessible ttl so clients ask again soon after the posture checks pass
+type ttlStore struct {
+	mu           sync.RWMutex
+	ttl          uint32
+	inaccessible uint32
+	services     map[string]*serviceTtl     // keyed by fingerprint/service id
+	byName       map[string]map[string]bool // the services intercepting each hostname key
+}
+
+var answerTtls = &ttlStore{
+	ttl:          uint32(DefaultDnsTtl / time.Second),
+	inaccessible: uint32(DefaultDnsInaccessibleTtl / time.Second),
+	services:     make(map[string]*serviceTtl),
+	byName:       make(map[string]map[string]bool),
+}
+
+// SetDnsTtl changes the ttl of the answers for intercepted names and of the names no accessible service intercepts.
+// 0 selects the default
+func SetDnsTtl(ttl time.Duration, inaccessible time.Duration) {
+	if ttl <= 0 {
+		ttl = DefaultDnsTtl
+	}
+	if inaccessible <= 0 {
+		inaccessible = DefaultDnsInaccessibleTtl
+	}
+	answerTtls.mu.Lock()
+	answerTtls.ttl = uint32(ttl / time.Second)
+	answerTtls.inaccessible = uint32(inaccessible / time.Second)
+	answerTtls.mu.Unlock()
+	log.Infof("DNS answer ttl set to %v, %v for inaccessible services", ttl, inaccessible)
+}
+
+// configuredTtl reads the ttl of a ziti-dns-records.v1 config. 0 is returned when the config does not set one.
+// recordStore.set reports configs which cannot be read
+func configuredTtl(raw string) uint32 {
+	if strings.TrimSpace(raw) == "" {
+		return 0
+	}
+	var cfg dnsRecordsV1Cfg
+	if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
+		return 0
+	}
+	return cfg.Ttl
+}
+
+// set records the ttl and the accessibility of a service of an identity along with the hostnames and record names
+// it intercepts, replacing what was recorded before
+func (t *ttlStore) set(fingerprint string, svc *dto.Service, raw string, recordNames []string) {
+	names := make([]string, 0, len(svc.Addresses)+len(recordNames))
+	for _, addr := range svc.Addresses {
+		if addr.IsHost {
+			names = append(names, hostnameKey(addr.HostName))
+		}
+	}
+	for _, name := range recordNames {
+		names = append(names, hostnameKey(name))
+	}
+	owner := fingerprint + "/" + svc.Id
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removeLocked(owner)
+	t.services[owner] = &serviceTtl{
+		ttl:        configuredTtl(raw),
+		accessible: svc.IsAccessable,
+		active:     true,
+		names:      names,
+	}
+	for _, key := range names {
+		if t.byName[key] == nil {
+			t.byName[key] = make(map[string]bool)
+		}
+		t.byName[key][owner] = true
+	}
+}
+
+// remove forgets a service of an identity
+func (t *ttlStore) remove(fingerprint string, svcId string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removeLocked(fingerprint + "/" + svcId)
+}
+
+func (t *ttlStore) removeLocked(owner string) {
+	s := t.services[owner]
+	if s == nil {
+		return
+	}
+	for _, key := range s.names {
+		delete(t.byName[key], owner)
+		if len(t.byName[key]) == 0 {
+			delete(t.byName, key)
+		}
+	}
+	delete(t.services, owner)
+}
+
+// activate marks a service of an identity as intercepting its names again, as when the identity is connected
+func (t *ttlStore) activate(fingerprint string, svcId string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s := t.services[fingerprint+"/"+svcId]; s != nil {
+		s.active = true
+	}
+}
+
+// deactivateIdentity marks every service of an identity which is disconnected as no longer intercepting its names.
+// What the services said is kept for when the identity is connected again
+func (t *ttlStore) deactivateIdentity(fingerprint string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for owner, s := range t.services {
+		if strings.HasPrefix(owner, fingerprint+"/") {
+			s.active = false
+		}
+	}
+}
+
+// ForgetServiceTtls drops what the services of an identity which is removed said about their ttl
+func ForgetServiceTtls(fingerprint string) {
+	t := answerTtls
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for owner := range t.services {
+		if strings.HasPrefix(owner, fingerprint+"/") {
+			t.removeLocked(owner)
+		}
+	}
+}
+
+// answerTtl returns the ttl of an answer about a name. The name is looked up the same way it is resolved: as it is,
+// with each search suffix removed, and through the wildcards above it
+func (t *ttlStore) answerTtl(name string) uint32 {
+	names := append([]string{normalizeDnsName(name)}, dnsSuffixes.candidates(name)...)
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, n := range names {
+		key := hostnameKey(n)
+		for _, k := range append([]string{key}, wildcardKeys(key)...) {
+			if owners := t.byName[k]; len(owners) > 0 {
+				return t.ttlOfLocked(owners)
+			}
+		}
+	}
+	return t.ttl
+}
+
+// ttlOfLocked returns the ttl of a name intercepted by the given services
+func (t *ttlStore) ttlOfLocked(owners map[string]bool) uint32 {
+	var ttl uint32
+	intercepted, accessible := false, false
+	for owner := range owners {
+		s := t.services[owner]
+		if s == nil || !s.active {
+			continue
+		}
+		intercepted = true
+		if !s.accessible {
+			continue
+		}
+		accessible = true
+		if s.ttl > 0 && (ttl == 0 || s.ttl < ttl) {
+			ttl = s.ttl
+		}
+	}
+	if intercepted && !accessible {
+		return t.inaccessible
+	}
+	if ttl == 0 {
+		return t.ttl
+	}
+	return ttl
+}
+
+// wildcardKeys returns the keys of every wildcard matching a hostname key, the most specific first
+func wildcardKeys(key string) []string {
+	keys := make([]string, 0)
+	for d := parentDomain(strings.TrimPrefix(key, "*.")); d != ""; d = parentDomain(d) {
+		keys = append(keys, "*."+d)
+	}
+	return keys
+}
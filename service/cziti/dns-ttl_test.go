@@ -0,0 +1,250 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+// useTestTtls replaces the ttls of the answers with an empty store for the test
+func useTestTtls(t *testing.T) *ttlStore {
+	t.Helper()
+	saved := answerTtls
+	answerTtls = &ttlStore{
+		ttl:          uint32(DefaultDnsTtl / time.Second),
+		inaccessible: uint32(DefaultDnsInaccessibleTtl / time.Second),
+		services:     make(map[string]*serviceTtl),
+		byName:       make(map[string]map[string]bool),
+	}
+	t.Cleanup(func() { answerTtls = saved })
+	return answerTtls
+}
+
+// ttlService is a service intercepting the hostnames which sets the ttl in its ziti-dns-records.v1 config, unless 0
+type ttlService struct {
+	fingerprint string
+	id          string
+	ttl         uint32
+	denied      bool // the posture checks fail
+	hostnames   []string
+}
+
+func (s ttlService) setIn(t *ttlStore) {
+	svc := &dto.Service{Id: s.id, Name: s.id, IsAccessable: !s.denied}
+	for _, h := range s.hostnames {
+		svc.Addresses = append(svc.Addresses, dto.Address{IsHost: true, HostName: h})
+	}
+	svc.Addresses = append(svc.Addresses, dto.Address{IP: "10.0.0.1", Prefix: 32})
+	raw := ""
+	if s.ttl > 0 {
+		raw = fmt.Sprintf(`{"ttl": %d}`, s.ttl)
+	}
+	t.set(s.fingerprint, svc, raw, nil)
+}
+
+func TestAnswerTtl(t *testing.T) {
+	tests := []struct {
+		name        string
+		services    []ttlService
+		deactivated []string // fingerprints of the identities which are disconnected
+		query       string
+		want        uint32
+	}{
+		{
+			name:  "not intercepted",
+			query: "web.example.com.",
+			want:  60,
+		},
+		{
+			name:     "service without ttl",
+			services: []ttlService{{fingerprint: "a", id: "web", hostnames: []string{"web.example.com"}}},
+			query:    "WEB.example.com.",
+			want:     60,
+		},
+		{
+			name: "lowest ttl wins across services",
+			services: []ttlService{
+				{fingerprint: "a", id: "web", ttl: 300, hostnames: []string{"web.example.com"}},
+				{fingerprint: "a", id: "web-failover", ttl: 10, hostnames: []string{"web.example.com", "other.example.com"}},
+				{fingerprint: "b", id: "web", hostnames: []string{"web.example.com"}},
+				{fingerprint: "b", id: "other", ttl: 5, hostnames: []string{"other.example.com"}},
+			},
+			query: "web.example.com.",
+			want:  10,
+		},
+		{
+			name: "services failing posture checks are ignored",
+			services: []ttlService{
+				{fingerprint: "a", id: "web", ttl: 300, hostnames: []string{"web.example.com"}},
+				{fingerprint: "a", id: "web-failover", ttl: 10, denied: true, hostnames: []string{"web.example.com"}},
+			},
+			query: "web.example.com.",
+			want:  300,
+		},
+		{
+			name: "inaccessible when every service fails its posture checks",
+			services: []ttlService{
+				{fingerprint: "a", id: "web", ttl: 300, denied: true, hostnames: []string{"web.example.com"}},
+				{fingerprint: "b", id: "web", denied: true, hostnames: []string{"web.example.com"}},
+			},
+			query: "web.example.com.",
+			want:  5,
+		},
+		{
+			name: "deactivated identity",
+			services: []ttlService{
+				{fingerprint: "a", id: "web", ttl: 10, hostnames: []string{"web.example.com"}},
+				{fingerprint: "b", id: "web", ttl: 300, hostnames: []string{"web.example.com"}},
+			},
+			deactivated: []string{"a"},
+			query:       "web.example.com.",
+			want:        300,
+		},
+		{
+			name: "deactivated identity failing posture checks",
+			services: []ttlService{
+				{fingerprint: "a", id: "web", denied: true, hostnames: []string{"web.example.com"}},
+				{fingerprint: "b", id: "web", ttl: 300, hostnames: []string{"web.example.com"}},
+			},
+			deactivated: []string{"b"},
+			query:       "web.example.com.",
+			want:        5,
+		},
+		{
+			name:        "every identity deactivated",
+			services:    []ttlService{{fingerprint: "a", id: "web", ttl: 10, hostnames: []string{"web.example.com"}}},
+			deactivated: []string{"a"},
+			query:       "web.example.com.",
+			want:        60,
+		},
+		{
+			name:     "wildcard",
+			services: []ttlService{{fingerprint: "a", id: "corp", ttl: 20, hostnames: []string{"*.corp.example.com"}}},
+			query:    "a.b.corp.example.com.",
+			want:     20,
+		},
+		{
+			name: "most specific wildcard",
+			services: []ttlService{
+				{fingerprint: "a", id: "corp", ttl: 20, hostnames: []string{"*.corp.example.com"}},
+				{fingerprint: "a", id: "eng", ttl: 40, hostnames: []string{"*.eng.corp.example.com"}},
+			},
+			query: "x.eng.corp.example.com.",
+			want:  40,
+		},
+		{
+			name: "hostname before wildcard",
+			services: []ttlService{
+				{fingerprint: "a", id: "corp", ttl: 20, hostnames: []string{"*.corp.example.com"}},
+				{fingerprint: "a", id: "web", ttl: 300, hostnames: []string{"web.corp.example.com"}},
+			},
+			query: "web.corp.example.com.",
+			want:  300,
+		},
+		{
+			name:     "wildcard does not match its own domain",
+			services: []ttlService{{fingerprint: "a", id: "corp", ttl: 20, hostnames: []string{"*.corp.example.com"}}},
+			query:    "corp.example.com.",
+			want:     60,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := useTestTtls(t)
+			for _, s := range tt.services {
+				s.setIn(store)
+			}
+			for _, fp := range tt.deactivated {
+				store.deactivateIdentity(fp)
+			}
+			if got := store.answerTtl(tt.query); got != tt.want {
+				t.Errorf("answerTtl(%s) = %d, want %d", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnswerTtlFollowsServiceChanges(t *testing.T) {
+	store := useTestTtls(t)
+	web := ttlService{fingerprint: "a", id: "web", ttl: 10, hostnames: []string{"web.example.com"}}
+	web.setIn(store)
+	ttlService{fingerprint: "b", id: "web", ttl: 300, hostnames: []string{"web.example.com"}}.setIn(store)
+
+	store.deactivateIdentity("a")
+	store.activate("a", "web")
+	if got := store.answerTtl("web.example.com."); got != 10 {
+		t.Errorf("ttl = %d after the identity was connected again, want 10", got)
+	}
+
+	// the service changes its hostname
+	web.hostnames = []string{"www.example.com"}
+	web.setIn(store)
+	if got := store.answerTtl("web.example.com."); got != 300 {
+		t.Errorf("ttl = %d after the service stopped intercepting the name, want 300", got)
+	}
+
+	store.remove("b", "web")
+	if got := store.answerTtl("web.example.com."); got != 60 {
+		t.Errorf("ttl = %d after the last service was removed, want the default", got)
+	}
+
+	ForgetServiceTtls("a")
+	if got := store.answerTtl("www.example.com."); got != 60 || len(store.services) != 0 || len(store.byName) != 0 {
+		t.Errorf("ttl = %d with %d service(s) left after the identity was forgotten", got, len(store.services))
+	}
+}
+
+func TestAnswerTtlOfRecordNamesAndSearchSuffixes(t *testing.T) {
+	savedSuffixes := dnsSuffixes
+	dnsSuffixes = &suffixSearch{}
+	t.Cleanup(func() { dnsSuffixes = savedSuffixes })
+	dnsSuffixes.set([]string{"lab.example.com"}, nil)
+
+	store := useTestTtls(t)
+	ttlService{fingerprint: "a", id: "web", ttl: 30, hostnames: []string{"web"}}.setIn(store)
+	store.set("a", &dto.Service{Id: "srv", IsAccessable: true}, `{"ttl": 15}`, []string{"_ldap._tcp.example.com"})
+
+	if got := store.answerTtl("web.lab.example.com."); got != 30 {
+		t.Errorf("ttl of web with the search suffix = %d, want 30", got)
+	}
+	if got := store.answerTtl("_ldap._tcp.example.com."); got != 15 {
+		t.Errorf("ttl of the record name = %d, want 15", got)
+	}
+}
+
+func TestSetDnsTtl(t *testing.T) {
+	store := useTestTtls(t)
+	ttlService{fingerprint: "a", id: "web", denied: true, hostnames: []string{"web.example.com"}}.setIn(store)
+
+	SetDnsTtl(2*time.Minute, 30*time.Second)
+	if got := store.answerTtl("other.example.com."); got != 120 {
+		t.Errorf("default ttl = %d, want 120", got)
+	}
+	if got := store.answerTtl("web.example.com."); got != 30 {
+		t.Errorf("inaccessible ttl = %d, want 30", got)
+	}
+
+	SetDnsTtl(0, 0)
+	if store.ttl != 60 || store.inaccessible != 5 {
+		t.Errorf("ttls = %d and %d after they were reset, want the defaults", store.ttl, store.inaccessible)
+	}
+}
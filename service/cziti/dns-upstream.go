@@ -0,0 +1,358 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/util/dnsutil"
+)
+
+const (
+	// an upstream is considered unhealthy after this many consecutive failures
+	UpstreamMaxFailures = 3
+	// how long to wait on a single upstream for an answer
+	UpstreamTimeout = 2 * time.Second
+	// how often unhealthy upstreams are probed to see if they have recovered
+	UpstreamProbeInterval = 15 * time.Second
+)
+
+var errNoUpstreams = errors.New("no upstream DNS servers are available")
+
+// upstreamServer tracks the health of a single upstream DNS server
+type upstreamServer struct {
+	addr      string // canonical form as returned by dnsutil.Upstream.String
+	encrypted bool
+	transport upstreamTransport
+	mu        sync.Mutex
+	latency   time.Duration // moving average of successful exchanges
+	failures  int           // consecutive failures
+	healthy   bool
+	queries   uint64
+	errors    uint64
+}
+
+func newUpstreamServer(spec string) (*upstreamServer, error) {
+	up, err := dnsutil.ParseUpstream(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &upstreamServer{
+		addr:      up.String(),
+		encrypted: up.IsEncrypted(),
+		transport: newTransport(up),
+		healthy:   true,
+	}, nil
+}
+
+func (u *upstreamServer) exchange(q *dns.Msg, network string) (*dns.Msg, error) {
+	reply, rtt, err := u.transport.exchange(q, network)
+	u.record(rtt, err)
+	return reply, err
+}
+
+func (u *upstreamServer) record(rtt time.Duration, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.queries++
+	if err == nil {
+		if !u.healthy {
+			log.Infof("upstream DNS %s is healthy", u.addr)
+		}
+		u.healthy = true
+		u.failures = 0
+		if u.latency == 0 {
+			u.latency = rtt
+		} else {
+			u.latency = (u.latency*7 + rtt) / 8
+		}
+		return
+	}
+
+	u.errors++
+	u.failures++
+	if u.healthy && u.failures >= UpstreamMaxFailures {
+		log.Warnf("upstream DNS %s failed %d times in a row and is marked unhealthy: %v", u.addr, u.failures, err)
+		u.healthy = false
+	}
+}
+
+func (u *upstreamServer) isHealthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy
+}
+
+func (u *upstreamServer) status() dto.DnsUpstream {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return dto.DnsUpstream{
+		Address:   u.addr,
+		Healthy:   u.healthy,
+		LatencyMs: u.latency.Milliseconds(),
+		Failures:  u.failures,
+		Queries:   u.queries,
+		Errors:    u.errors,
+	}
+}
+
+// upstreamPool sends proxied queries to the upstream DNS servers according to the selected mode
+type upstreamPool struct {
+	mu      sync.RWMutex
+	servers []*upstreamServer
+	next    uint32
+}
+
+var upstreams = &upstreamPool{}
+
+// plainFallback holds the servers of the local interfaces. Queries are sent to it when every server of a pool made of
+// encrypted servers fails and plain fallback is enabled
+var plainFallback = &upstreamPool{}
+var plainFallbackEnabled int32
+
+var modeMutex sync.RWMutex
+var upstreamMode = constants.DnsUpstreamModeRace
+
+var probeOnce sync.Once
+
+// setServers replaces the upstream servers. Servers which remain keep their health and latency. Servers which cannot
+// be parsed are logged and skipped
+func (p *upstreamPool) setServers(addrs []string) {
+	p.mu.Lock()
+	existing := make(map[string]*upstreamServer)
+	for _, s := range p.servers {
+		existing[s.addr] = s
+	}
+	servers := make([]*upstreamServer, 0, len(addrs))
+	for _, addr := range addrs {
+		s, err := newUpstreamServer(addr)
+		if err != nil {
+			log.Errorf("skipping upstream DNS %s: %v", addr, err)
+			continue
+		}
+		if found, ok := existing[s.addr]; ok {
+			s = found
+		}
+		servers = append(servers, s)
+	}
+	p.servers = servers
+	p.mu.Unlock()
+
+	probeOnce.Do(func() {
+		go probeUnhealthy()
+	})
+}
+
+func (p *upstreamPool) addrs() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	addrs := make([]string, 0, len(p.servers))
+	for _, s := range p.servers {
+		addrs = append(addrs, s.addr)
+	}
+	return addrs
+}
+
+// encryptedOnly reports if every server of the pool is reached over TLS or HTTPS
+func (p *upstreamPool) encryptedOnly() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, s := range p.servers {
+		if !s.encrypted {
+			return false
+		}
+	}
+	return len(p.servers) > 0
+}
+
+// SetDnsUpstreamMode selects how proxied queries are sent to the upstream DNS servers
+func SetDnsUpstreamMode(mode string) error {
+	switch mode {
+	case "":
+		mode = constants.DnsUpstreamModeRace
+	case constants.DnsUpstreamModeSequential, constants.DnsUpstreamModeRace, constants.DnsUpstreamModeRoundRobin:
+	default:
+		return fmt.Errorf("unknown upstream DNS mode: %s", mode)
+	}
+	modeMutex.Lock()
+	upstreamMode = mode
+	modeMutex.Unlock()
+	log.Infof("upstream DNS mode set to %s", mode)
+	return nil
+}
+
+// GetDnsUpstreams returns the health of every upstream DNS server, including the servers of the forwarding rules
+func GetDnsUpstreams() []dto.DnsUpstream {
+	status := make([]dto.DnsUpstream, 0)
+	for _, s := range allServers() {
+		status = append(status, s.status())
+	}
+	return status
+}
+
+// allServers returns every server of every pool once
+func allServers() []*upstreamServer {
+	seen := make(map[*upstreamServer]bool)
+	servers := make([]*upstreamServer, 0)
+	for _, p := range allPools() {
+		p.mu.RLock()
+		for _, s := range p.servers {
+			if !seen[s] {
+				seen[s] = true
+				servers = append(servers, s)
+			}
+		}
+		p.mu.RUnlock()
+	}
+	return servers
+}
+
+// candidates returns the healthy servers in order, or every server when none are healthy
+func (p *upstreamPool) candidates() []*upstreamServer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	healthy := make([]*upstreamServer, 0, len(p.servers))
+	for _, s := range p.servers {
+		if s.isHealthy() {
+			healthy = append(healthy, s)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = append(healthy, p.servers...)
+	}
+	return healthy
+}
+
+// exchange sends the query to the servers of the pool. When the pool only holds encrypted servers and none of them
+// answer, the query is sent in plain text to the servers of the local interfaces if plain fallback is enabled
+func (p *upstreamPool) exchange(q *dns.Msg, network string) (*dns.Msg, error) {
+	reply, err := p.exchangeOwn(q, network)
+	if (err != nil || reply.Rcode == dns.RcodeServerFailure) && p != plainFallback &&
+		atomic.LoadInt32(&plainFallbackEnabled) == 1 && p.encryptedOnly() {
+		log.Debugf("encrypted upstream DNS failed for %s. falling back to plain DNS: %v", q.Question[0].Name, err)
+		return plainFallback.exchangeOwn(q, network)
+	}
+	return reply, err
+}
+
+func (p *upstreamPool) exchangeOwn(q *dns.Msg, network string) (*dns.Msg, error) {
+	servers := p.candidates()
+	if len(servers) == 0 {
+		return nil, errNoUpstreams
+	}
+
+	modeMutex.RLock()
+	mode := upstreamMode
+	modeMutex.RUnlock()
+	switch mode {
+	case constants.DnsUpstreamModeRace:
+		return race(servers, q, network)
+	case constants.DnsUpstreamModeRoundRobin:
+		start := int(atomic.AddUint32(&p.next, 1) % uint32(len(servers)))
+		rotated := make([]*upstreamServer, 0, len(servers))
+		rotated = append(rotated, servers[start:]...)
+		rotated = append(rotated, servers[:start]...)
+		return sequential(rotated, q, network)
+	default:
+		return sequential(servers, q, network)
+	}
+}
+
+// sequential asks each server in turn, moving on when a server fails or answers SERVFAIL
+func sequential(servers []*upstreamServer, q *dns.Msg, network string) (*dns.Msg, error) {
+	var lastReply *dns.Msg
+	var lastErr error
+	for _, s := range servers {
+		reply, err := s.exchange(q, network)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if reply.Rcode == dns.RcodeServerFailure {
+			lastReply = reply
+			continue
+		}
+		return reply, nil
+	}
+	if lastReply != nil {
+		return lastReply, nil
+	}
+	return nil, lastErr
+}
+
+type raceResult struct {
+	reply *dns.Msg
+	err   error
+}
+
+// race asks every server at once and returns the first answer which is not SERVFAIL
+func race(servers []*upstreamServer, q *dns.Msg, network string) (*dns.Msg, error) {
+	results := make(chan raceResult, len(servers))
+	for _, s := range servers {
+		go func(s *upstreamServer, q *dns.Msg) {
+			reply, err := s.exchange(q, network)
+			results <- raceResult{reply: reply, err: err}
+		}(s, q.Copy())
+	}
+
+	var lastReply *dns.Msg
+	var lastErr error
+	for range servers {
+		r := <-results
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		if r.reply.Rcode == dns.RcodeServerFailure {
+			lastReply = r.reply
+			continue
+		}
+		return r.reply, nil
+	}
+	if lastReply != nil {
+		return lastReply, nil
+	}
+	return nil, lastErr
+}
+
+// probeUnhealthy periodically queries every unhealthy server so it's put back in use once it recovers
+func probeUnhealthy() {
+	probe := &dns.Msg{}
+	probe.SetQuestion(".", dns.TypeNS)
+
+	ticker := time.NewTicker(UpstreamProbeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, s := range allServers() {
+			if s.isHealthy() {
+				continue
+			}
+			log.Debugf("probing unhealthy upstream DNS %s", s.addr)
+			if _, err := s.exchange(probe.Copy(), "udp"); err != nil {
+				log.Debugf("upstream DNS %s is still unhealthy: %v", s.addr, err)
+			}
+		}
+	}
+}
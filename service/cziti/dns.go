@@ -24,41 +24,406 @@ import (
 	"net"
 	"strings"
 	"sync"
-)
 
-var dnsip net.IP
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
 
+// DnsManager resolves the hostnames intercepted by the services of every identity. It is safe for concurrent use
 type DnsManager interface {
 	Resolve(dnsName string) net.IP
+	// ApplyDNS records the ip a hostname resolves to
 	ApplyDNS(dnsNameToReg string, ip string)
+	// AddHostname counts a service of the identity intercepting the hostname. true is returned when no service
+	// intercepted the hostname before
+	AddHostname(fingerprint string, hostname string) bool
+	// RemoveHostname releases a service of the identity intercepting the hostname. true is returned when no service
+	// intercepts the hostname anymore. The hostname then stops resolving
+	RemoveHostname(fingerprint string, hostname string) bool
+	// RemoveIdentity releases every hostname of the identity and returns the hostnames no service intercepts anymore
+	RemoveIdentity(fingerprint string) []string
+	// Hostnames returns every hostname intercepted by at least one service
+	Hostnames() []string
 }
 
 var initOnce = sync.Once{}
-var dnsMgrPrivate = &dnsImpl{}
+var dnsMgrPrivate = &dnsImpl{refs: make(map[string]map[string]int)}
 var DNSMgr DnsManager = dnsMgrPrivate
 
 type dnsImpl struct {
+	// guards every map and the TUN range. ApplyDNS is called on the libuv thread while queries are resolved on the
+	// DNS server goroutines
+	mu          sync.RWMutex
+	tunIp       net.IP // the DNS server listens on it. nil until the DNS is initialized
 	cidr        uint32
+	mask        uint32
+	maskBits    int
 	ipCount     uint32
 	serviceMap  map[string]*ctxService
 	hostnameMap map[string]*ctxIp
+	// wildcard and suffix intercepts keyed by the normalized suffix with its leading period, e.g. .corp.example.com.
+	wildcardMap map[string]*ctxIp
+	// the names below a wildcard which were resolved with an address of their own, keyed by the normalized name
+	wildcardNames map[string]*wildcardName
+	// how many services of each identity intercept a hostname, keyed by hostnameKey then by fingerprint. not reset
+	// when the TUN range moves as the services keep their hostnames
+	refs map[string]map[string]int
 }
 
 func (dns *dnsImpl) ApplyDNS(dnsNameToReg string, ip string) {
-	dnsName := normalizeDnsName(dnsNameToReg)
-	log.Debugf("adding dns to resolver: %s=%s", dnsName, ip)
-	ipnet := net.ParseIP(ip)
+	assigned := net.ParseIP(ip).To4()
+	if assigned == nil {
+		log.Errorf("%s was assigned an address which is not ipv4: %s", dnsNameToReg, ip)
+		return
+	}
+	dns.apply(dnsNameToReg, &net.IPNet{IP: assigned, Mask: net.CIDRMask(32, 32)})
+}
+
+// apply records the address a hostname resolves to. A wildcard resolves the names below it to addresses of the block,
+// or to its one address when the block holds a single address
+func (dns *dnsImpl) apply(dnsNameToReg string, block *net.IPNet) {
 	c := &ctxIp{
-		ip:         ipnet,
+		ip:         block.IP,
+		block:      block,
 		ctx:        nil,
 		network:    "nolongerused",
 		dnsEnabled: true,
 		refCount:   1,
 	}
+	dns.mu.Lock()
+	defer dns.mu.Unlock()
+	if isWildcard(dnsNameToReg) {
+		suffix := wildcardSuffix(dnsNameToReg)
+		log.Debugf("adding wildcard dns to resolver: *%s=%s", suffix, block)
+		dns.wildcardMap[suffix] = c
+		for name, n := range dns.wildcardNames {
+			if n.suffix == suffix && !block.Contains(n.ip) || len(n.suffix) < len(suffix) && strings.HasSuffix(name, suffix) {
+				// resolved again from the new block, or with the more specific wildcard
+				dns.releaseWildcardName(name)
+			}
+		}
+		return
+	}
+	dnsName := normalizeDnsName(dnsNameToReg)
+	log.Debugf("adding dns to resolver: %s=%s", dnsName, block.IP)
 	dns.hostnameMap[dnsName] = c
+	// the name may have had an address below a wildcard. the store gave the hostname another one
+	delete(dns.wildcardNames, dnsName)
 	log.Tracef("ADDED %s to resolver from source: %s", dnsName, dnsNameToReg)
 }
 
+// hostnameKey is the form hostnames are counted by: lower case without the trailing period. Wildcards always start
+// with *. so *.example.com and .example.com are counted together
+func hostnameKey(hostname string) string {
+	if isWildcard(hostname) {
+		return "*" + strings.TrimSuffix(wildcardSuffix(hostname), ".")
+	}
+	return strings.TrimSuffix(normalizeDnsName(hostname), ".")
+}
+
+func (dns *dnsImpl) AddHostname(fingerprint string, hostname string) bool {
+	key := hostnameKey(hostname)
+	dns.mu.Lock()
+	defer dns.mu.Unlock()
+	byId, found := dns.refs[key]
+	if !found {
+		byId = make(map[string]int)
+		dns.refs[key] = byId
+	}
+	byId[fingerprint]++
+	log.Debugf("hostname added: %s by %s. count now: %d", key, fingerprint, byId[fingerprint])
+	return !found
+}
+
+func (dns *dnsImpl) RemoveHostname(fingerprint string, hostname string) bool {
+	key := hostnameKey(hostname)
+	dns.mu.Lock()
+	defer dns.mu.Unlock()
+	byId, found := dns.refs[key]
+	if !found || byId[fingerprint] == 0 {
+		log.Debugf("hostname %s was not added by %s", key, fingerprint)
+		return false
+	}
+	byId[fingerprint]--
+	log.Debugf("hostname removed: %s by %s. count now: %d", key, fingerprint, byId[fingerprint])
+	if byId[fingerprint] == 0 {
+		delete(byId, fingerprint)
+	}
+	if len(byId) > 0 {
+		return false
+	}
+	dns.release(key)
+	return true
+}
+
+func (dns *dnsImpl) RemoveIdentity(fingerprint string) []string {
+	dns.mu.Lock()
+	defer dns.mu.Unlock()
+	released := make([]string, 0)
+	for key, byId := range dns.refs {
+		if _, found := byId[fingerprint]; !found {
+			continue
+		}
+		delete(byId, fingerprint)
+		if len(byId) == 0 {
+			dns.release(key)
+			released = append(released, key)
+		}
+	}
+	log.Debugf("released %d hostname(s) of %s", len(released), fingerprint)
+	return released
+}
+
+// release stops resolving a hostname no service intercepts anymore. must hold the lock
+func (dns *dnsImpl) release(key string) {
+	delete(dns.refs, key)
+	if strings.HasPrefix(key, "*") {
+		suffix := wildcardSuffix(key)
+		delete(dns.wildcardMap, suffix)
+		for name, n := range dns.wildcardNames {
+			if n.suffix == suffix {
+				dns.releaseWildcardName(name)
+			}
+		}
+	} else {
+		delete(dns.hostnameMap, normalizeDnsName(key))
+	}
+	interceptAddresses.release(key)
+	log.Debugf("removed %s from resolver", key)
+}
+
+func (dns *dnsImpl) Hostnames() []string {
+	dns.mu.RLock()
+	defer dns.mu.RUnlock()
+	hostnames := make([]string, 0, len(dns.refs))
+	for key := range dns.refs {
+		hostnames = append(hostnames, key)
+	}
+	return hostnames
+}
+
+// claimHostname counts the hostname for the identity and records the service as an owner of the address of the
+// hostname. true is returned when no service intercepted the hostname before
+func claimHostname(fingerprint string, svcId string, hostname string) bool {
+	interceptAddresses.own(hostnameKey(hostname), fingerprint+"/"+svcId)
+	return DNSMgr.AddHostname(fingerprint, hostname)
+}
+
+// claimServiceNames counts the hostnames and record names of a service the identity gained. The NRPT namespaces which
+// need a rule are added to namespaces
+func claimServiceNames(fingerprint string, svc *dto.Service, rawRecords string, namespaces map[string]bool) {
+	for _, addr := range svc.Addresses {
+		if addr.IsHost && claimHostname(fingerprint, svc.Id, addr.HostName) {
+			namespaces[NrptNamespace(addr.HostName)] = true
+		}
+	}
+	recordNames := serviceRecords.set(fingerprint, svc.Id, rawRecords)
+	for _, name := range recordNames {
+		if DNSMgr.AddHostname(fingerprint, name) {
+			namespaces[name] = true
+		}
+	}
+	answerTtls.set(fingerprint, svc, rawRecords, recordNames)
+}
+
+// removeServiceNames releases the hostnames and record names of a service the identity lost. The NRPT namespaces no
+// service needs anymore are added to namespaces
+func removeServiceNames(fingerprint string, svc *dto.Service, namespaces map[string]bool) {
+	releaseNames(fingerprint, svc, serviceRecords.remove(fingerprint, svc.Id), namespaces)
+	answerTtls.remove(fingerprint, svc.Id)
+}
+
+// changeServiceNames moves the names of a service whose config changed from the old config to the new one. The new
+// names are claimed before the old ones are released so a name both configs intercept keeps resolving to its address
+func changeServiceNames(fingerprint string, old *dto.Service, updated *dto.Service, rawRecords string, added map[string]bool, removed map[string]bool) {
+	oldRecordNames := serviceRecords.names(fingerprint, old.Id)
+	claimServiceNames(fingerprint, updated, rawRecords, added)
+	releaseNames(fingerprint, old, oldRecordNames, removed)
+}
+
+func releaseNames(fingerprint string, svc *dto.Service, recordNames []string, namespaces map[string]bool) {
+	for _, addr := range svc.Addresses {
+		if addr.IsHost && DNSMgr.RemoveHostname(fingerprint, addr.HostName) {
+			namespaces[NrptNamespace(addr.HostName)] = true
+		}
+	}
+	for _, name := range recordNames {
+		if DNSMgr.RemoveHostname(fingerprint, name) {
+			namespaces[name] = true
+		}
+	}
+}
+
+// ClaimServiceHostnames counts the hostnames and record names of a service for the identity again, as when an
+// identity which was disconnected is connected. The NRPT namespaces which need a rule are returned
+func ClaimServiceHostnames(fingerprint string, svc *ZService) map[string]bool {
+	namespaces := make(map[string]bool)
+	if svc == nil || svc.Service == nil {
+		return namespaces
+	}
+	for _, addr := range svc.Service.Addresses {
+		if addr.IsHost && claimHostname(fingerprint, svc.Id, addr.HostName) {
+			namespaces[NrptNamespace(addr.HostName)] = true
+		}
+	}
+	for _, name := range serviceRecords.names(fingerprint, svc.Id) {
+		if DNSMgr.AddHostname(fingerprint, name) {
+			namespaces[name] = true
+		}
+	}
+	answerTtls.activate(fingerprint, svc.Id)
+	return namespaces
+}
+
+// ReleaseIdentityHostnames releases every hostname of an identity which is disconnected or removed. The NRPT namespaces
+// no service needs anymore are returned
+func ReleaseIdentityHostnames(fingerprint string) map[string]bool {
+	namespaces := make(map[string]bool)
+	for _, host := range DNSMgr.RemoveIdentity(fingerprint) {
+		namespaces[NrptNamespace(host)] = true
+	}
+	answerTtls.deactivateIdentity(fingerprint)
+	return namespaces
+}
+
+// HostsEntries returns the address of every intercepted hostname keyed by hostname, as written to the hosts file.
+// Wildcards are left out as the hosts file cannot express them
+func HostsEntries() map[string]string {
+	return dnsMgrPrivate.hostsEntries()
+}
+
+func (dns *dnsImpl) hostsEntries() map[string]string {
+	dns.mu.RLock()
+	defer dns.mu.RUnlock()
+	entries := make(map[string]string, len(dns.refs))
+	for key := range dns.refs {
+		if strings.HasPrefix(key, "*") {
+			continue
+		}
+		if c := dns.hostnameMap[normalizeDnsName(key)]; c != nil && c.ip != nil {
+			entries[key] = c.ip.String()
+		}
+	}
+	return entries
+}
+
+// isWildcard reports if the intercept address matches every name below a domain. Both *.example.com and .example.com
+// are accepted
+func isWildcard(hostname string) bool {
+	h := strings.TrimSpace(hostname)
+	return strings.HasPrefix(h, "*.") || strings.HasPrefix(h, ".")
+}
+
+// wildcardSuffix normalizes a wildcard intercept address to the suffix it matches: *.Example.com becomes .example.com.
+func wildcardSuffix(hostname string) string {
+	return normalizeDnsName(strings.TrimPrefix(strings.TrimSpace(hostname), "*"))
+}
+
+// NrptNamespace returns the NRPT namespace for an intercepted hostname. A wildcard becomes a single suffix rule rather
+// than a rule per host
+func NrptNamespace(hostname string) string {
+	if isWildcard(hostname) {
+		return strings.TrimSuffix(wildcardSuffix(hostname), ".")
+	}
+	return hostname
+}
+
+// matchWildcard finds the longest wildcard suffix matching the name. An empty string is returned when no wildcard
+// matches. must hold the lock
+func (dns *dnsImpl) matchWildcard(dnsName string) string {
+	best := ""
+	for suffix := range dns.wildcardMap {
+		if len(suffix) > len(best) && strings.HasSuffix(dnsName, suffix) {
+			best = suffix
+		}
+	}
+	return best
+}
+
+// addWildcardName gives a name below a wildcard an address of its own from the block of the wildcard. The tunneler
+// intercepts the whole block. The name keeps its address while the wildcard is intercepted and gets it back within the
+// retention period, like any hostname. Once the block is full the name resolves to the address of the wildcard
+func (dns *dnsImpl) addWildcardName(dnsName string) *ctxIp {
+	dns.mu.Lock()
+	defer dns.mu.Unlock()
+	if n := dns.wildcardNames[dnsName]; n != nil {
+		return n.ctxIp
+	}
+	suffix := dns.matchWildcard(dnsName)
+	if suffix == "" {
+		return nil
+	}
+	w := dns.wildcardMap[suffix]
+	log.Tracef("%s matched wildcard *%s", dnsName, suffix)
+	if ones, _ := w.block.Mask.Size(); ones == 32 {
+		return w
+	}
+
+	key := hostnameKey(dnsName)
+	ip := interceptAddresses.assignIn(key, w.block)
+	if ip == nil {
+		log.Debugf("%s resolves to the address of *%s: no address of %v is left", dnsName, suffix, w.block)
+		return w
+	}
+	interceptAddresses.inherit(key, hostnameKey("*"+suffix))
+	n := &wildcardName{
+		suffix: suffix,
+		ctxIp: &ctxIp{
+			ip:         ip,
+			network:    w.network,
+			dnsEnabled: w.dnsEnabled,
+			refCount:   1,
+		},
+	}
+	dns.wildcardNames[dnsName] = n
+	log.Debugf("adding dns to resolver: %s=%s below *%s", dnsName, ip, suffix)
+	return n.ctxIp
+}
+
+// releaseWildcardName stops resolving a name below a wildcard. Its address is kept for when it is resolved again.
+// must hold the lock
+func (dns *dnsImpl) releaseWildcardName(name string) {
+	delete(dns.wildcardNames, name)
+	interceptAddresses.release(hostnameKey(name))
+}
+
+// dnsServerIp returns the address the DNS server listens on, or nil before the DNS is initialized
+func dnsServerIp() net.IP {
+	dnsMgrPrivate.mu.RLock()
+	defer dnsMgrPrivate.mu.RUnlock()
+	return dnsMgrPrivate.tunIp
+}
+
+// inRange reports if the ip is inside the TUN range intercept addresses are handed out from
+func (dns *dnsImpl) inRange(ip net.IP) bool {
+	dns.mu.RLock()
+	defer dns.mu.RUnlock()
+	ip4 := ip.To4()
+	return ip4 != nil && binary.BigEndian.Uint32(ip4)&dns.mask == dns.cidr
+}
+
+// reverse returns the intercepted name assigned the ip, or an empty string when the ip is not assigned. A name below a
+// wildcard returns the name, the address of the wildcard itself returns its domain
+func (dns *dnsImpl) reverse(ip net.IP) string {
+	dns.mu.RLock()
+	defer dns.mu.RUnlock()
+	for name, c := range dns.hostnameMap {
+		if c.dnsEnabled && c.ip.Equal(ip) {
+			return name
+		}
+	}
+	for name, n := range dns.wildcardNames {
+		if n.dnsEnabled && n.ip.Equal(ip) {
+			return name
+		}
+	}
+	for suffix, c := range dns.wildcardMap {
+		if c.dnsEnabled && c.ip.Equal(ip) {
+			return strings.TrimPrefix(suffix, ".")
+		}
+	}
+	return ""
+}
+
 type intercept struct {
 	host string
 	port uint16
@@ -82,11 +447,18 @@ func (i intercept) AsDnsName() string {
 type ctxIp struct {
 	ctx        *ZIdentity
 	ip         net.IP
+	block      *net.IPNet // the addresses the tunneler intercepts: ip alone, or the block of a wildcard
 	network    string
 	dnsEnabled bool
 	refCount   int
 }
 
+// wildcardName is a name below a wildcard intercept which was resolved to an address of the block of the wildcard
+type wildcardName struct {
+	*ctxIp
+	suffix string // the wildcard the name was resolved with
+}
+
 type ctxService struct {
 	ctx       *ZIdentity
 	name      string
@@ -112,23 +484,28 @@ func (dns *dnsImpl) Resolve(toResolve string) net.IP {
 
 func (dns *dnsImpl) resolveWithConnectionSpecificDomain(toResolve string, useConnectionSpecificDomain bool) net.IP {
 	dnsName := normalizeDnsName(toResolve)
+	dns.mu.RLock()
 	found := dns.hostnameMap[dnsName]
+	if n := dns.wildcardNames[dnsName]; found == nil && n != nil {
+		found = n.ctxIp
+	}
+	matched := found == nil && dns.matchWildcard(dnsName) != ""
+	dns.mu.RUnlock()
+	if matched {
+		found = dns.addWildcardName(dnsName)
+	}
 	if found != nil {
 		if found.dnsEnabled {
 			return found.ip
 		} else {
 			log.Debugf("resolved %s as %v but service is not active", toResolve, found.ip)
 		}
-	} else {
-		if useConnectionSpecificDomain {
-			//check to see if this ends with a connection specific domain...
-			//if it does, remove the domain and check...
-			for _, csd := range domains {
-				if strings.HasSuffix(toResolve, csd) {
-					toResolveWithoutCSD := trimSuffix(toResolve, csd)
-					log.Debugf("request to resolve %s matches a connection specific domain. Attempting to resolve: %s", toResolve, toResolveWithoutCSD)
-					return dns.resolveWithConnectionSpecificDomain(toResolveWithoutCSD, false)
-				}
+	} else if useConnectionSpecificDomain {
+		// the name may be an intercepted name with a search suffix appended. suffixes are tried in search order
+		for _, candidate := range dnsSuffixes.candidates(toResolve) {
+			if ip := dns.resolveWithConnectionSpecificDomain(candidate, false); ip != nil {
+				log.Debugf("resolved %s as %s with the search suffix removed", toResolve, candidate)
+				return ip
 			}
 		}
 	}
@@ -139,17 +516,42 @@ func DnsInit(ip string, maskBits int) {
 	initOnce.Do(func() {
 		dnsMgrPrivate.serviceMap = make(map[string]*ctxService)
 		//DNS.ipMap = make(map[uint32]string)
-		dnsMgrPrivate.hostnameMap = make(map[string]*ctxIp)
-		//register the test dns entry:
-		dnsMgrPrivate.hostnameMap[normalizeDnsName("dew-dns-probe.openziti.org")] = &ctxIp{
-			ip:         net.ParseIP("127.0.0.1"),
-			dnsEnabled: true,
-			refCount:   0,
-		}
-
-		dnsip = net.ParseIP(ip).To4()
-		mask := net.CIDRMask(maskBits, 32)
-		dnsMgrPrivate.cidr = binary.BigEndian.Uint32(dnsip) & binary.BigEndian.Uint32(mask)
-		dnsMgrPrivate.ipCount = 2
+		resetDns(ip, maskBits)
 	})
 }
+
+// DnsReinit moves the resolver to a new TUN range. Every hostname is dropped and gets an address from the new range
+// when the intercepts are added again. Hostnames keep their address when it is inside the new range
+func DnsReinit(ip string, maskBits int) {
+	log.Infof("moving DNS resolver to %s/%d", ip, maskBits)
+	resetDns(ip, maskBits)
+}
+
+// the name the DNS always resolves to check that queries reach it. no service intercepts it
+var dnsProbeName = normalizeDnsName("dew-dns-probe.openziti.org")
+
+func resetDns(ip string, maskBits int) {
+	hostnameMap := make(map[string]*ctxIp)
+	//register the test dns entry:
+	hostnameMap[dnsProbeName] = &ctxIp{
+		ip:         net.ParseIP("127.0.0.1"),
+		dnsEnabled: true,
+		refCount:   0,
+	}
+	tunIp := net.ParseIP(ip).To4()
+	mask := net.CIDRMask(maskBits, 32)
+
+	dnsMgrPrivate.mu.Lock()
+	defer dnsMgrPrivate.mu.Unlock()
+	dnsMgrPrivate.tunIp = tunIp
+	dnsMgrPrivate.hostnameMap = hostnameMap
+	dnsMgrPrivate.wildcardMap = make(map[string]*ctxIp)
+	dnsMgrPrivate.wildcardNames = make(map[string]*wildcardName)
+	dnsMgrPrivate.mask = binary.BigEndian.Uint32(mask)
+	dnsMgrPrivate.maskBits = maskBits
+	dnsMgrPrivate.cidr = binary.BigEndian.Uint32(tunIp) & dnsMgrPrivate.mask
+	dnsMgrPrivate.ipCount = 2
+
+	// the hostnames get their addresses again as the intercepts are added again
+	interceptAddresses.setRange(dnsMgrPrivate.cidr, dnsMgrPrivate.mask, binary.BigEndian.Uint32(tunIp))
+}
@@ -0,0 +1,386 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+// resetTestDns starts the resolver over on the TUN range with no hostname and no kept address
+func resetTestDns(t *testing.T, ip string, maskBits int) {
+	t.Helper()
+	interceptAddresses.mu.Lock()
+	interceptAddresses.byHost = make(map[string]*interceptAddress)
+	interceptAddresses.byIp = make(map[uint32]*interceptAddress)
+	interceptAddresses.blocks = make(map[uint32]*interceptAddress)
+	interceptAddresses.mu.Unlock()
+	dnsMgrPrivate.mu.Lock()
+	dnsMgrPrivate.refs = make(map[string]map[string]int)
+	dnsMgrPrivate.mu.Unlock()
+	resetDns(ip, maskBits)
+}
+
+// wildcardBlock intercepts the wildcard the way a service does and returns the block of addresses it got
+func wildcardBlock(t *testing.T, wildcard string) *net.IPNet {
+	t.Helper()
+	_, block, err := net.ParseCIDR(tunnelerAddress(wildcard, true))
+	if err != nil {
+		t.Fatalf("%s did not get a block of addresses: %v", wildcard, err)
+	}
+	return block
+}
+
+func TestWildcardNamesGetTheirOwnAddress(t *testing.T) {
+	resetTestDns(t, "100.64.0.1", 10)
+	const fp = "identity"
+	corp := wildcardBlock(t, "*.corp.example.com")
+	dnsMgrPrivate.AddHostname(fp, "*.corp.example.com")
+	if ones, _ := corp.Mask.Size(); ones != 22 {
+		t.Errorf("wildcard got the block %v, want a /22", corp)
+	}
+
+	a := dnsMgrPrivate.Resolve("a.corp.example.com")
+	b := dnsMgrPrivate.Resolve("B.Corp.Example.com.")
+	if a == nil || b == nil {
+		t.Fatalf("names below the wildcard resolved to %v and %v", a, b)
+	}
+	if a.Equal(b) || a.Equal(corp.IP) || b.Equal(corp.IP) {
+		t.Errorf("names below the wildcard share addresses: %v, %v and the wildcard %v", a, b, corp.IP)
+	}
+	if !corp.Contains(a) || !corp.Contains(b) {
+		t.Errorf("names below the wildcard resolved to %v and %v outside of its block %v", a, b, corp)
+	}
+	if again := dnsMgrPrivate.Resolve("a.corp.example.com"); !again.Equal(a) {
+		t.Errorf("a.corp.example.com resolved to %v, then to %v", a, again)
+	}
+	if got := dnsMgrPrivate.reverse(b); got != "b.corp.example.com." {
+		t.Errorf("reverse(%v) = %q, want b.corp.example.com.", b, got)
+	}
+
+	dnsMgrPrivate.RemoveHostname(fp, "*.corp.example.com")
+	if got := dnsMgrPrivate.Resolve("a.corp.example.com"); got != nil {
+		t.Errorf("a.corp.example.com resolves to %v after the wildcard was removed", got)
+	}
+
+	// the wildcard comes back: it gets its block and the names get their address back
+	if again := wildcardBlock(t, "*.corp.example.com"); again.String() != corp.String() {
+		t.Errorf("wildcard got the block %v when it came back, want %v", again, corp)
+	}
+	dnsMgrPrivate.AddHostname(fp, "*.corp.example.com")
+	if got := dnsMgrPrivate.Resolve("a.corp.example.com"); !got.Equal(a) {
+		t.Errorf("a.corp.example.com resolves to %v when it comes back, want %v", got, a)
+	}
+
+	// a more specific wildcard takes the names below it into its own block
+	dnsMgrPrivate.Resolve("x.eng.corp.example.com")
+	eng := wildcardBlock(t, "*.eng.corp.example.com")
+	dnsMgrPrivate.AddHostname(fp, "*.eng.corp.example.com")
+	if eng.Contains(corp.IP) || corp.Contains(eng.IP) {
+		t.Errorf("blocks %v and %v overlap", corp, eng)
+	}
+	if got := dnsMgrPrivate.Resolve("x.eng.corp.example.com"); !eng.Contains(got) {
+		t.Errorf("x.eng.corp.example.com resolves to %v below the more specific wildcard, want an address of %v", got, eng)
+	}
+
+	// a hostname intercepted on its own gets an address the wildcard does not intercept
+	own := net.ParseIP(tunnelerAddress("a.corp.example.com", true))
+	dnsMgrPrivate.AddHostname(fp, "a.corp.example.com")
+	if own == nil || corp.Contains(own) || eng.Contains(own) {
+		t.Fatalf("a.corp.example.com got %v when intercepted on its own, want an address outside of %v and %v", own, corp, eng)
+	}
+	if got := dnsMgrPrivate.Resolve("a.corp.example.com"); !got.Equal(own) {
+		t.Errorf("a.corp.example.com resolves to %v when intercepted on its own, want %v", got, own)
+	}
+	dnsMgrPrivate.RemoveHostname(fp, "*.corp.example.com")
+	if got := dnsMgrPrivate.Resolve("a.corp.example.com"); !got.Equal(own) {
+		t.Errorf("removing the wildcard changed the hostname from %v to %v", own, got)
+	}
+}
+
+func TestWildcardNamesShareTheWildcardAddressWhenTheBlockIsFull(t *testing.T) {
+	// a /24 gives every wildcard a block of 16 addresses
+	resetTestDns(t, "100.64.0.1", 24)
+	corp := wildcardBlock(t, "*.corp.example.com")
+	dnsMgrPrivate.AddHostname("identity", "*.corp.example.com")
+	if ones, _ := corp.Mask.Size(); ones != 28 {
+		t.Fatalf("wildcard got the block %v, want a /28", corp)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 15; i++ {
+		name := fmt.Sprintf("%d.corp.example.com", i)
+		ip := dnsMgrPrivate.Resolve(name)
+		if ip == nil || seen[ip.String()] || ip.Equal(corp.IP) || !corp.Contains(ip) {
+			t.Fatalf("%s resolved to %v", name, ip)
+		}
+		seen[ip.String()] = true
+	}
+	if got := dnsMgrPrivate.Resolve("full.corp.example.com"); !got.Equal(corp.IP) {
+		t.Errorf("full.corp.example.com resolved to %v with the block full, want the wildcard address %v", got, corp.IP)
+	}
+	if got := dnsMgrPrivate.reverse(corp.IP); got != "corp.example.com." {
+		t.Errorf("reverse(%v) = %q, want corp.example.com.", corp.IP, got)
+	}
+	if stats := GetInterceptAddressStats(); stats.Exhausted {
+		t.Errorf("a full block reports the TUN range exhausted for %v", stats.Unassigned)
+	}
+}
+
+func TestWildcardGetsOneAddressWhenNoBlockFits(t *testing.T) {
+	// 100.64.0.3 to 100.64.0.6 can be handed out
+	resetTestDns(t, "100.64.0.1", 29)
+	ip := net.ParseIP(tunnelerAddress("*.corp.example.com", true))
+	dnsMgrPrivate.AddHostname("identity", "*.corp.example.com")
+	if ip == nil {
+		t.Fatal("wildcard got no address")
+	}
+	for _, name := range []string{"a.corp.example.com", "b.corp.example.com"} {
+		if got := dnsMgrPrivate.Resolve(name); !got.Equal(ip) {
+			t.Errorf("%s resolved to %v, want the wildcard address %v", name, got, ip)
+		}
+	}
+}
+
+func TestHostnameRefcounts(t *testing.T) {
+	type step struct {
+		op       string // add, remove or removeIdentity
+		fp       string
+		hostname string
+		want     bool     // what add and remove return
+		released []string // what removeIdentity returns
+	}
+	tests := []struct {
+		name      string
+		steps     []step
+		hostnames []string // Hostnames() after the steps
+	}{
+		{
+			name: "first service of any identity adds",
+			steps: []step{
+				{op: "add", fp: "a", hostname: "web.example.com", want: true},
+				{op: "add", fp: "a", hostname: "web.example.com"},
+				{op: "add", fp: "b", hostname: "web.example.com"},
+			},
+			hostnames: []string{"web.example.com"},
+		},
+		{
+			name: "released by the last service of the last identity",
+			steps: []step{
+				{op: "add", fp: "a", hostname: "web.example.com", want: true},
+				{op: "add", fp: "a", hostname: "web.example.com"},
+				{op: "add", fp: "b", hostname: "web.example.com"},
+				{op: "remove", fp: "a", hostname: "web.example.com"},
+				{op: "remove", fp: "a", hostname: "web.example.com"},
+				{op: "remove", fp: "b", hostname: "web.example.com", want: true},
+			},
+			hostnames: []string{},
+		},
+		{
+			name: "identity which never added it",
+			steps: []step{
+				{op: "add", fp: "a", hostname: "web.example.com", want: true},
+				{op: "remove", fp: "b", hostname: "web.example.com"},
+				{op: "remove", fp: "b", hostname: "other.example.com"},
+			},
+			hostnames: []string{"web.example.com"},
+		},
+		{
+			name: "removed more often than added",
+			steps: []step{
+				{op: "add", fp: "a", hostname: "web.example.com", want: true},
+				{op: "add", fp: "b", hostname: "web.example.com"},
+				{op: "remove", fp: "a", hostname: "web.example.com"},
+				{op: "remove", fp: "a", hostname: "web.example.com"},
+			},
+			hostnames: []string{"web.example.com"},
+		},
+		{
+			name: "case and trailing period",
+			steps: []step{
+				{op: "add", fp: "a", hostname: "Web.Example.com.", want: true},
+				{op: "add", fp: "a", hostname: "web.example.com"},
+				{op: "remove", fp: "a", hostname: "WEB.example.com"},
+				{op: "remove", fp: "a", hostname: "web.example.com.", want: true},
+			},
+			hostnames: []string{},
+		},
+		{
+			name: "both wildcard forms",
+			steps: []step{
+				{op: "add", fp: "a", hostname: "*.corp.example.com", want: true},
+				{op: "add", fp: "b", hostname: ".corp.example.com"},
+				{op: "remove", fp: "a", hostname: ".Corp.example.com"},
+			},
+			hostnames: []string{"*.corp.example.com"},
+		},
+		{
+			name: "identity removed",
+			steps: []step{
+				{op: "add", fp: "a", hostname: "only-a.example.com", want: true},
+				{op: "add", fp: "a", hostname: "only-a.example.com"},
+				{op: "add", fp: "a", hostname: "shared.example.com", want: true},
+				{op: "add", fp: "b", hostname: "shared.example.com"},
+				{op: "removeIdentity", fp: "a", released: []string{"only-a.example.com"}},
+				{op: "removeIdentity", fp: "a", released: []string{}},
+			},
+			hostnames: []string{"shared.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetTestDns(t, "100.64.0.1", 10)
+			for i, s := range tt.steps {
+				switch s.op {
+				case "add":
+					if got := dnsMgrPrivate.AddHostname(s.fp, s.hostname); got != s.want {
+						t.Errorf("step %d: AddHostname(%s, %s) = %t, want %t", i, s.fp, s.hostname, got, s.want)
+					}
+				case "remove":
+					if got := dnsMgrPrivate.RemoveHostname(s.fp, s.hostname); got != s.want {
+						t.Errorf("step %d: RemoveHostname(%s, %s) = %t, want %t", i, s.fp, s.hostname, got, s.want)
+					}
+				case "removeIdentity":
+					got := dnsMgrPrivate.RemoveIdentity(s.fp)
+					sort.Strings(got)
+					if !reflect.DeepEqual(got, s.released) {
+						t.Errorf("step %d: RemoveIdentity(%s) = %v, want %v", i, s.fp, got, s.released)
+					}
+				}
+			}
+			got := dnsMgrPrivate.Hostnames()
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.hostnames) {
+				t.Errorf("Hostnames() = %v, want %v", got, tt.hostnames)
+			}
+		})
+	}
+}
+
+func TestReleasedHostnameStopsResolving(t *testing.T) {
+	resetTestDns(t, "100.64.0.1", 10)
+	dnsMgrPrivate.ApplyDNS("web.example.com", "100.64.0.3")
+	dnsMgrPrivate.AddHostname("a", "web.example.com")
+	dnsMgrPrivate.AddHostname("b", "web.example.com")
+
+	dnsMgrPrivate.RemoveIdentity("a")
+	if got := dnsMgrPrivate.Resolve("web.example.com"); got == nil {
+		t.Fatal("web.example.com stopped resolving while another identity intercepts it")
+	}
+	dnsMgrPrivate.RemoveHostname("b", "web.example.com")
+	if got := dnsMgrPrivate.Resolve("web.example.com"); got != nil {
+		t.Errorf("web.example.com resolves to %v after every identity released it", got)
+	}
+}
+
+// run with -race: queries are resolved on the DNS server goroutines while the tunneler and the service events change
+// the hostnames
+func TestResolveDuringHostnameChanges(t *testing.T) {
+	resetTestDns(t, "100.64.0.1", 10)
+	const writers, readers, rounds = 4, 4, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			fp := fmt.Sprintf("identity-%d", w)
+			for i := 0; i < rounds; i++ {
+				host := fmt.Sprintf("host-%d.example.com", i%10)
+				dnsMgrPrivate.ApplyDNS(host, fmt.Sprintf("100.64.1.%d", i%10+1))
+				dnsMgrPrivate.AddHostname(fp, host)
+				dnsMgrPrivate.ApplyDNS("*.corp.example.com", "100.64.2.1")
+				dnsMgrPrivate.AddHostname(fp, "*.corp.example.com")
+				dnsMgrPrivate.RemoveHostname(fp, host)
+				if i%50 == 49 {
+					dnsMgrPrivate.RemoveIdentity(fp)
+				}
+			}
+		}(w)
+	}
+	// the TUN range moves while the DNS server and the NRPT reconciler read its address
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds/10; i++ {
+			DnsReinit("100.64.0.1", 10)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			if dnsServerIp() == nil {
+				t.Error("the DNS server address is nil while the DNS is reset")
+			}
+		}
+	}()
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				ip := dnsMgrPrivate.Resolve(fmt.Sprintf("host-%d.example.com", i%10))
+				dnsMgrPrivate.Resolve(fmt.Sprintf("name-%d.corp.example.com", (i+r)%20))
+				if ip != nil {
+					dnsMgrPrivate.reverse(ip)
+				}
+				dnsMgrPrivate.Hostnames()
+				dnsMgrPrivate.hostsEntries()
+			}
+		}(r)
+	}
+	wg.Wait()
+}
+
+func TestChangedServiceKeepsResolvingItsHostnames(t *testing.T) {
+	resetTestDns(t, "100.64.0.1", 10)
+	const fp = "identity"
+	host := func(name string) dto.Address { return dto.Address{IsHost: true, HostName: name} }
+	old := &dto.Service{Id: "svc", Addresses: []dto.Address{host("web.example.com"), host("old.example.com")}}
+	claimServiceNames(fp, old, "", make(map[string]bool))
+	dnsMgrPrivate.ApplyDNS("web.example.com", "100.64.0.3")
+	dnsMgrPrivate.ApplyDNS("old.example.com", "100.64.0.4")
+	before := dnsMgrPrivate.Resolve("web.example.com")
+
+	// only the ports and one of the hostnames change
+	updated := &dto.Service{
+		Id:        "svc",
+		Addresses: []dto.Address{host("Web.Example.com"), host("new.example.com")},
+		Ports:     []dto.PortRange{{Low: 8443, High: 8443}},
+	}
+	added, removed := make(map[string]bool), make(map[string]bool)
+	changeServiceNames(fp, old, updated, "", added, removed)
+
+	if got := dnsMgrPrivate.Resolve("web.example.com"); got == nil || !got.Equal(before) {
+		t.Errorf("web.example.com resolves to %v after the service changed, want %v", got, before)
+	}
+	if got := dnsMgrPrivate.Resolve("old.example.com"); got != nil {
+		t.Errorf("old.example.com resolves to %v after the service dropped it", got)
+	}
+	if want := map[string]bool{"new.example.com": true}; !reflect.DeepEqual(added, want) {
+		t.Errorf("NRPT namespaces added = %v, want %v", added, want)
+	}
+	if want := map[string]bool{"old.example.com": true}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("NRPT namespaces removed = %v, want %v", removed, want)
+	}
+}
@@ -16,6 +16,7 @@
  */
 
 #include "sdk.h"
+#include <string.h>
 #include <ziti/ziti_tunnel.h>
 #include <ziti/ziti_log.h>
 #include <ziti/ziti_events.h>
@@ -155,4 +156,25 @@ char* ziti_char_array_get(char** arr, int idx) {
     return arr ? arr[idx] : NULL;
 }
 
+// returns a copy of the service with the config of the given type replaced. every other field is shared with the
+// service so the copy must only be freed with ziti_service_free_copy
+ziti_service* ziti_service_with_config(ziti_service *service, const char *cfg_type, const char *cfg) {
+    ziti_service *copy = malloc(sizeof(ziti_service));
+    *copy = *service;
+    memset(&copy->config, 0, sizeof(copy->config));
+    model_map_iter it = model_map_iterator(&service->config);
+    while (it != NULL) {
+        model_map_set(&copy->config, model_map_it_key(it), model_map_it_value(it));
+        it = model_map_it_next(it);
+    }
+    model_map_set(&copy->config, cfg_type, (void *) cfg);
+    return copy;
+}
+
+void ziti_service_free_copy(ziti_service *copy) {
+    // the values belong to the service that was copied
+    model_map_clear(&copy->config, NULL);
+    free(copy);
+}
+
 
@@ -59,10 +59,10 @@ import (
 var log = logging.Logger()
 var noFileLog = logging.NoFilenameLogger()
 var Version dto.ServiceVersion
-var BulkServiceChanges = make(chan BulkServiceChange, 32)
 
 var cCfgZitiTunnelerClientV1 = C.CString("ziti-tunneler-client.v1")
 var cCfgInterceptV1 = C.CString("intercept.v1")
+var cCfgDnsRecordsV1 = C.CString(CfgDnsRecordsV1)
 
 type sdk struct {
 	libuvCtx *C.libuv_ctx
@@ -238,6 +238,43 @@ type clientV1Cfg struct {
 	PortRanges []dto.PortRange `json:"portRanges"`
 	Protocols  []string        `json:"protocols"`
 }
+
+// interceptService hands the service to the tunneler with every intercepted hostname replaced by the address it
+// resolves to, so the tunneler intercepts the addresses the DNS answers with and never assigns addresses of its own.
+// Must be called on the libuv thread
+func interceptService(ztx C.ziti_context, service *C.ziti_service) {
+	if service.perm_flags&C.ZITI_CAN_DIAL == 0 {
+		C.ziti_sdk_c_on_service(ztx, service, C.ZITI_OK, unsafe.Pointer(theTun.tunCtx))
+		return
+	}
+	cfgType := cCfgInterceptV1
+	raw := C.GoString(C.ziti_service_get_raw_config(service, cCfgInterceptV1))
+	var cfg string
+	var ok bool
+	if raw != "" {
+		cfg, ok = interceptV1Addresses(raw)
+	} else {
+		cfgType = cCfgZitiTunnelerClientV1
+		raw = C.GoString(C.ziti_service_get_raw_config(service, cCfgZitiTunnelerClientV1))
+		cfg, ok = tunnelerClientV1Address(raw)
+	}
+	if !ok {
+		log.Errorf("service %s is not intercepted: none of its hostnames has an address", C.GoString(service.name))
+		return
+	}
+	if cfg == raw {
+		C.ziti_sdk_c_on_service(ztx, service, C.ZITI_OK, unsafe.Pointer(theTun.tunCtx))
+		return
+	}
+
+	// the tunneler parses the config when it is handed the service. the copy is not needed once it returns
+	cCfg := C.CString(cfg)
+	defer C.free(unsafe.Pointer(cCfg))
+	rewritten := C.ziti_service_with_config(service, cfgType, cCfg)
+	defer C.ziti_service_free_copy(rewritten)
+	C.ziti_sdk_c_on_service(ztx, rewritten, C.ZITI_OK, unsafe.Pointer(theTun.tunCtx))
+}
+
 type v1ClientCfg struct {
 	//{"hostname":"192.168.15.15","port":80}
 	Hostname string `json:"hostname"`
@@ -253,7 +290,11 @@ func serviceCB(ziti_ctx C.ziti_context, service *C.ziti_service, status C.int, z
 	name := C.GoString(service.name)
 	svcId := C.GoString(service.id)
 	log.Debugf("============ INSIDE serviceCB - status: %s:%s - %v, %v ============", name, svcId, status, service.perm_flags)
-	C.ziti_sdk_c_on_service(ziti_ctx, service, status, unsafe.Pointer(theTun.tunCtx))
+	if status == C.ZITI_OK {
+		interceptService(ziti_ctx, service)
+	} else {
+		C.ziti_sdk_c_on_service(ziti_ctx, service, status, unsafe.Pointer(theTun.tunCtx))
+	}
 
 	var protocols []string
 	var portRanges []dto.PortRange
@@ -464,12 +505,7 @@ func eventCB(ztx C.ziti_context, event *C.ziti_event_t) {
 
 			svcToRemove := serviceCB(ztx, removed, C.ZITI_SERVICE_UNAVAILABLE, zid)
 			if svcToRemove != nil {
-				remAddys := svcToRemove.Addresses
-				for _, toRemove := range remAddys {
-					if toRemove.IsHost && hostnameRemoved(toRemove.HostName) == 0 {
-						hostnamesToRemove[toRemove.HostName] = true
-					}
-				}
+				removeServiceNames(zid.Fingerprint, svcToRemove, hostnamesToRemove)
 				servicesToRemove = append(servicesToRemove, svcToRemove)
 			}
 		}
@@ -481,25 +517,20 @@ func eventCB(ztx C.ziti_context, event *C.ziti_event_t) {
 
 			log.Info("service changed remove the service then add it back immediately", C.GoString(changed.name))
 			svcToRemove := serviceCB(ztx, changed, C.ZITI_SERVICE_UNAVAILABLE, zid)
+			svcToAdd := serviceCB(ztx, changed, C.ZITI_OK, zid)
+			rawRecords := C.GoString(C.ziti_service_get_raw_config(changed, cCfgDnsRecordsV1))
+			switch {
+			case svcToRemove != nil && svcToAdd != nil:
+				changeServiceNames(zid.Fingerprint, svcToRemove, svcToAdd, rawRecords, hostnamesToAdd, hostnamesToRemove)
+			case svcToRemove != nil:
+				removeServiceNames(zid.Fingerprint, svcToRemove, hostnamesToRemove)
+			case svcToAdd != nil:
+				claimServiceNames(zid.Fingerprint, svcToAdd, rawRecords, hostnamesToAdd)
+			}
 			if svcToRemove != nil {
-
-				remAddys := svcToRemove.Addresses
-				for _, toRemove := range remAddys {
-					if toRemove.IsHost && hostnameRemoved(toRemove.HostName) == 0 {
-						hostnamesToRemove[toRemove.HostName] = true
-					}
-				}
 				servicesToRemove = append(servicesToRemove, svcToRemove)
 			}
-
-			svcToAdd := serviceCB(ztx, changed, C.ZITI_OK, zid)
 			if svcToAdd != nil {
-				addAddys := svcToAdd.Addresses
-				for _, toAdd := range addAddys {
-					if toAdd.IsHost && hostnameAdded(toAdd.HostName) == 1 {
-						hostnamesToAdd[toAdd.HostName] = true
-					}
-				}
 				servicesToAdd = append(servicesToAdd, svcToAdd)
 			}
 		}
@@ -510,12 +541,8 @@ func eventCB(ztx C.ziti_context, event *C.ziti_event_t) {
 			}
 			svcToAdd := serviceCB(ztx, added, C.ZITI_OK, zid)
 			if svcToAdd != nil {
-				addAddys := svcToAdd.Addresses
-				for _, toAdd := range addAddys {
-					if toAdd.IsHost && hostnameAdded(toAdd.HostName) == 1 {
-						hostnamesToAdd[toAdd.HostName] = true
-					}
-				}
+				rawRecords := C.GoString(C.ziti_service_get_raw_config(added, cCfgDnsRecordsV1))
+				claimServiceNames(zid.Fingerprint, svcToAdd, rawRecords, hostnamesToAdd)
 				servicesToAdd = append(servicesToAdd, svcToAdd)
 			}
 		}
@@ -527,12 +554,7 @@ func eventCB(ztx C.ziti_context, event *C.ziti_event_t) {
 			ServicesToAdd:     servicesToAdd,
 			ServicesToRemove:  servicesToRemove,
 		}
-
-		if len(BulkServiceChanges) == cap(BulkServiceChanges) {
-			log.Warn("Service changes are not being processed fast enough. This client is out of date from the controller! This is unexpected. If you see this warning please report")
-		} else {
-			BulkServiceChanges <- svcChange
-		}
+		PendingServiceChanges.push(svcChange)
 	default:
 		log.Infof("event %d not handled", event._type)
 	}
@@ -675,29 +697,8 @@ func ZitiDumpOnShutdown(zid *ZIdentity) {
 	log.Infof("working around the c sdk's limitation of embedding newlines on calling ziti_shutdown\n %s", sb.String())
 }
 
+// InitTunnelerDns hands the TUN range to the tunneler before the libuv loop starts. ReinitTunnelerDns is used once the
+// loop runs
 func InitTunnelerDns(ipBase uint32, mask int) {
 	C.ziti_tunneler_init_dns(C.uint32_t(ipBase), C.int(mask))
 }
-
-var addressCount = make(map[string]int)
-
-func hostnameAdded(host string) int {
-	count := 1
-	if cur, ok := addressCount[host]; ok {
-		count = cur + 1
-	}
-	addressCount[host] = count
-	log.Debugf("hostname added: %s. count now: %d", host, count)
-	return count
-}
-func hostnameRemoved(host string) int {
-	count := 0
-	if cur, ok := addressCount[host]; ok {
-		if cur > 0 {
-			count = cur - 1
-		}
-	}
-	addressCount[host] = count
-	log.Debugf("hostname removed %s. count now: %d", host, count)
-	return count
-}
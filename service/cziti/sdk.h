@@ -71,6 +71,8 @@ struct ziti_router_event* ziti_event_router_event(ziti_event_t *ev);
 struct ziti_service_event* ziti_event_service_event(ziti_event_t *ev);
 
 ziti_service* ziti_service_array_get(ziti_service_array arr, int idx);
+ziti_service* ziti_service_with_config(ziti_service *service, const char *cfg_type, const char *cfg);
+void ziti_service_free_copy(ziti_service *copy);
 
 void ziti_dump_go(char *msg);
 
@@ -0,0 +1,63 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import "sync"
+
+// PendingServiceChanges holds the service changes produced on the libuv thread until the service takes them
+var PendingServiceChanges = &serviceChangeQueue{ready: make(chan struct{}, 1)}
+
+// serviceChangeQueue is an unbounded queue of service changes. Unlike a buffered channel it never fills up, so a
+// change is never dropped and the libuv thread never waits for the service
+type serviceChangeQueue struct {
+	mu      sync.Mutex
+	pending []BulkServiceChange
+	ready   chan struct{}
+}
+
+func (q *serviceChangeQueue) push(sc BulkServiceChange) {
+	q.mu.Lock()
+	q.pending = append(q.pending, sc)
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+		// already signalled. the next Take returns this change too
+	}
+}
+
+// Ready is signalled when changes were queued since the last Take
+func (q *serviceChangeQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Take returns every queued change in the order they were produced and empties the queue
+func (q *serviceChangeQueue) Take() []BulkServiceChange {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	taken := q.pending
+	q.pending = nil
+	return taken
+}
+
+// Len returns how many changes are queued
+func (q *serviceChangeQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestServiceChangeQueue() *serviceChangeQueue {
+	return &serviceChangeQueue{ready: make(chan struct{}, 1)}
+}
+
+func TestServiceChangeQueueKeepsOrder(t *testing.T) {
+	q := newTestServiceChangeQueue()
+	for _, fp := range []string{"a", "b", "c"} {
+		q.push(BulkServiceChange{Fingerprint: fp})
+	}
+	if q.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", q.Len())
+	}
+	taken := q.Take()
+	if len(taken) != 3 || taken[0].Fingerprint != "a" || taken[1].Fingerprint != "b" || taken[2].Fingerprint != "c" {
+		t.Errorf("Take() = %+v, want the changes of a, b and c in order", taken)
+	}
+	if again := q.Take(); len(again) != 0 || q.Len() != 0 {
+		t.Errorf("queue still holds %d change(s) after Take", len(again))
+	}
+}
+
+func TestServiceChangeQueueCoalescesReady(t *testing.T) {
+	q := newTestServiceChangeQueue()
+	select {
+	case <-q.Ready():
+		t.Fatal("an empty queue is ready")
+	default:
+	}
+
+	q.push(BulkServiceChange{Fingerprint: "a"})
+	q.push(BulkServiceChange{Fingerprint: "b"})
+	<-q.Ready()
+	select {
+	case <-q.Ready():
+		t.Error("ready was signalled once for every change")
+	default:
+	}
+	if taken := q.Take(); len(taken) != 2 {
+		t.Errorf("Take() returned %d change(s), want both", len(taken))
+	}
+
+	q.push(BulkServiceChange{Fingerprint: "c"})
+	select {
+	case <-q.Ready():
+	default:
+		t.Error("ready was not signalled for a change queued after Take")
+	}
+}
+
+// run with -race: the libuv thread pushes while the service takes
+func TestServiceChangeQueueDropsNothingUnderConcurrentPushAndTake(t *testing.T) {
+	const producers, changes = 4, 500
+	q := newTestServiceChangeQueue()
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < changes; i++ {
+				q.push(BulkServiceChange{Fingerprint: fmt.Sprintf("%d/%d", p, i)})
+			}
+		}(p)
+	}
+
+	next := make([]int, producers) // the next change expected from each producer
+	received := 0
+	timeout := time.After(10 * time.Second)
+	for received < producers*changes {
+		select {
+		case <-q.Ready():
+		case <-timeout:
+			t.Fatalf("received %d of %d changes: a change was queued without signalling ready", received, producers*changes)
+		}
+		for _, sc := range q.Take() {
+			var p, i int
+			if _, err := fmt.Sscanf(sc.Fingerprint, "%d/%d", &p, &i); err != nil {
+				t.Fatalf("unexpected change %q", sc.Fingerprint)
+			}
+			if i != next[p] {
+				t.Fatalf("producer %d: got change %d, want %d", p, i, next[p])
+			}
+			next[p]++
+			received++
+		}
+	}
+	wg.Wait()
+	if q.Len() != 0 {
+		t.Errorf("%d change(s) left after every change was received", q.Len())
+	}
+}
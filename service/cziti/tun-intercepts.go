@@ -0,0 +1,149 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"encoding/json"
+	"net"
+)
+
+// names below a wildcard get addresses from a block of at most 1024 addresses. A block never takes more than a
+// sixteenth of the TUN range
+const (
+	maxWildcardBlockBits    = 10
+	minWildcardBlocksPerTun = 4 // in bits: 16 blocks
+)
+
+// wildcardBlockBits returns the size in bits of the network of the block of a wildcard in a TUN range of maskBits
+func wildcardBlockBits(maskBits int) int {
+	if bits := maskBits + minWildcardBlocksPerTun; bits > 32-maxWildcardBlockBits {
+		return bits
+	}
+	return 32 - maxWildcardBlockBits
+}
+
+// tunnelerAddress returns what the tunneler intercepts in place of a hostname: the address the hostname resolves to, or
+// the block of addresses the names below a wildcard resolve to. Without blocks a wildcard gets one address every name
+// below it resolves to. The hostname resolves to it from then on. An empty string is returned when the TUN range has
+// no address left
+func tunnelerAddress(hostname string, blocks bool) string {
+	key := hostnameKey(hostname)
+	if !isWildcard(hostname) {
+		ip := interceptAddresses.assign(key)
+		if ip == nil {
+			return ""
+		}
+		dnsMgrPrivate.apply(hostname, &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)})
+		return ip.String()
+	}
+
+	bits := 32
+	if blocks {
+		dnsMgrPrivate.mu.RLock()
+		bits = wildcardBlockBits(dnsMgrPrivate.maskBits)
+		dnsMgrPrivate.mu.RUnlock()
+	}
+	block := interceptAddresses.assignBlock(key, bits)
+	if block == nil {
+		return ""
+	}
+	dnsMgrPrivate.apply(hostname, block)
+	if ones, _ := block.Mask.Size(); ones == 32 {
+		return block.IP.String()
+	}
+	return block.String()
+}
+
+// isHostname reports if an intercept address is a hostname or wildcard rather than an ip or CIDR block
+func isHostname(address string) bool {
+	if net.ParseIP(address) != nil {
+		return false
+	}
+	_, _, err := net.ParseCIDR(address)
+	return err != nil
+}
+
+// interceptV1Addresses replaces every hostname in the addresses of an intercept.v1 config by what the tunneler
+// intercepts for it. Hostnames without an address are left out. false is returned when nothing is left to intercept
+func interceptV1Addresses(raw string) (string, bool) {
+	var cfg map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
+		log.Errorf("could not parse intercept.v1 config: %v", err)
+		return raw, true
+	}
+	var addresses []string
+	if err := json.Unmarshal(cfg["addresses"], &addresses); err != nil {
+		log.Errorf("could not parse the addresses of intercept.v1 config: %v", err)
+		return raw, true
+	}
+
+	rewritten := make([]string, 0, len(addresses))
+	changed := false
+	for _, a := range addresses {
+		if !isHostname(a) {
+			rewritten = append(rewritten, a)
+			continue
+		}
+		changed = true
+		if ip := tunnelerAddress(a, true); ip != "" {
+			rewritten = append(rewritten, ip)
+		} else {
+			log.Errorf("%s is not intercepted: no address is left in the TUN range", a)
+		}
+	}
+	if !changed {
+		return raw, true
+	}
+	if len(rewritten) == 0 {
+		return "", false
+	}
+	cfg["addresses"], _ = json.Marshal(rewritten)
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		log.Errorf("could not serialize intercept.v1 config: %v", err)
+		return "", false
+	}
+	return string(b), true
+}
+
+// tunnelerClientV1Address replaces the hostname of a ziti-tunneler-client.v1 config by the address it resolves to.
+// false is returned when the hostname has no address
+func tunnelerClientV1Address(raw string) (string, bool) {
+	var cfg map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
+		log.Errorf("could not parse ziti-tunneler-client.v1 config: %v", err)
+		return raw, true
+	}
+	var hostname string
+	if err := json.Unmarshal(cfg["hostname"], &hostname); err != nil || !isHostname(hostname) {
+		return raw, true
+	}
+	// the config holds a single address so a wildcard cannot be given a block
+	ip := tunnelerAddress(hostname, false)
+	if ip == "" {
+		log.Errorf("%s is not intercepted: no address is left in the TUN range", hostname)
+		return "", false
+	}
+	cfg["hostname"], _ = json.Marshal(ip)
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		log.Errorf("could not serialize ziti-tunneler-client.v1 config: %v", err)
+		return "", false
+	}
+	return string(b), true
+}
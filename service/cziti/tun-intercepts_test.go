@@ -0,0 +1,227 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cziti
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestInterceptV1Addresses(t *testing.T) {
+	resetTestDns(t, "100.64.0.1", 10)
+	raw := `{"addresses":["*.corp.example.com","web.example.com","10.0.0.1","10.1.0.0/16"],"portRanges":[{"low":80,"high":443}],"protocols":["tcp"]}`
+	got, ok := interceptV1Addresses(raw)
+	if !ok {
+		t.Fatalf("interceptV1Addresses(%s) left nothing to intercept", raw)
+	}
+
+	var cfg struct {
+		Addresses  []string
+		PortRanges []map[string]int
+		Protocols  []string
+	}
+	if err := json.Unmarshal([]byte(got), &cfg); err != nil {
+		t.Fatalf("interceptV1Addresses returned %s: %v", got, err)
+	}
+	if len(cfg.Addresses) != 4 {
+		t.Fatalf("addresses = %v, want four", cfg.Addresses)
+	}
+	_, corp, err := net.ParseCIDR(cfg.Addresses[0])
+	if err != nil || !corp.Contains(dnsMgrPrivate.Resolve("a.corp.example.com")) {
+		t.Errorf("wildcard was replaced by %s, want the block a.corp.example.com resolves in", cfg.Addresses[0])
+	}
+	if web := dnsMgrPrivate.Resolve("web.example.com"); web == nil || cfg.Addresses[1] != web.String() {
+		t.Errorf("web.example.com was replaced by %s, want the address it resolves to: %v", cfg.Addresses[1], web)
+	}
+	if cfg.Addresses[2] != "10.0.0.1" || cfg.Addresses[3] != "10.1.0.0/16" {
+		t.Errorf("addresses and blocks were changed to %v", cfg.Addresses[2:])
+	}
+	if !reflect.DeepEqual(cfg.PortRanges, []map[string]int{{"low": 80, "high": 443}}) || !reflect.DeepEqual(cfg.Protocols, []string{"tcp"}) {
+		t.Errorf("the rest of the config was changed: %s", got)
+	}
+
+	// the same config again gets the same addresses
+	if again, _ := interceptV1Addresses(raw); again != got {
+		t.Errorf("interceptV1Addresses returned %s, then %s", got, again)
+	}
+}
+
+func TestInterceptV1AddressesWithoutHostnamesAreUnchanged(t *testing.T) {
+	resetTestDns(t, "100.64.0.1", 10)
+	raw := `{"addresses": ["10.0.0.1", "10.1.0.0/16"], "protocols": ["udp"]}`
+	if got, ok := interceptV1Addresses(raw); got != raw || !ok {
+		t.Errorf("interceptV1Addresses(%s) = %s, %t", raw, got, ok)
+	}
+}
+
+func TestInterceptV1AddressesWhenTheRangeIsExhausted(t *testing.T) {
+	// 100.64.0.3 to 100.64.0.6 can be handed out
+	resetTestDns(t, "100.64.0.1", 29)
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("%d.example.com", i)
+		if tunnelerAddress(name, true) == "" {
+			t.Fatalf("%s got no address", name)
+		}
+		dnsMgrPrivate.AddHostname("identity", name)
+	}
+
+	if got, ok := interceptV1Addresses(`{"addresses":["web.example.com"]}`); ok {
+		t.Errorf("a config with a hostname without address was kept: %s", got)
+	}
+	got, ok := interceptV1Addresses(`{"addresses":["web.example.com","10.0.0.1"]}`)
+	if want := `{"addresses":["10.0.0.1"]}`; got != want || !ok {
+		t.Errorf("interceptV1Addresses = %s, %t, want %s", got, ok, want)
+	}
+}
+
+func TestTunnelerClientV1Address(t *testing.T) {
+	resetTestDns(t, "100.64.0.1", 10)
+	tests := []struct {
+		name     string
+		raw      string
+		resolves string
+	}{
+		{name: "hostname", raw: `{"hostname":"web.example.com","port":443}`, resolves: "web.example.com"},
+		{name: "wildcard", raw: `{"hostname":"*.corp.example.com","port":22}`, resolves: "a.corp.example.com"},
+		{name: "address", raw: `{"hostname":"10.0.0.1","port":80}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tunnelerClientV1Address(tt.raw)
+			if !ok {
+				t.Fatalf("tunnelerClientV1Address(%s) left nothing to intercept", tt.raw)
+			}
+			if tt.resolves == "" {
+				if got != tt.raw {
+					t.Errorf("tunnelerClientV1Address(%s) = %s", tt.raw, got)
+				}
+				return
+			}
+			var cfg struct {
+				Hostname string
+				Port     int
+			}
+			if err := json.Unmarshal([]byte(got), &cfg); err != nil {
+				t.Fatalf("tunnelerClientV1Address returned %s: %v", got, err)
+			}
+			if ip := dnsMgrPrivate.Resolve(tt.resolves); ip == nil || cfg.Hostname != ip.String() {
+				t.Errorf("hostname was replaced by %s, want the address %s resolves to: %v", cfg.Hostname, tt.resolves, ip)
+			}
+			if cfg.Port == 0 {
+				t.Errorf("the port was dropped: %s", got)
+			}
+		})
+	}
+}
+
+func TestHostnamesAreNotGivenAddressesOfABlock(t *testing.T) {
+	resetTestDns(t, "100.64.0.1", 24)
+	corp := wildcardBlock(t, "*.corp.example.com")
+	if corp.String() != "100.64.0.16/28" {
+		t.Errorf("wildcard got the block %v, want the first aligned block 100.64.0.16/28", corp)
+	}
+	eng := wildcardBlock(t, "*.eng.example.com")
+	if eng.String() != "100.64.0.32/28" {
+		t.Errorf("second wildcard got the block %v, want 100.64.0.32/28", eng)
+	}
+
+	assigned := 0
+	for ; assigned < 256; assigned++ {
+		ip := interceptAddresses.assign(fmt.Sprintf("%d.example.com", assigned))
+		if ip == nil {
+			break
+		}
+		if corp.Contains(ip) || eng.Contains(ip) {
+			t.Fatalf("hostname got %v from a block", ip)
+		}
+	}
+	// the pool of a /24 is 100.64.0.3 to 100.64.0.254 without the blocks
+	if want := 252 - 32; assigned != want {
+		t.Errorf("%d hostnames got an address, want %d", assigned, want)
+	}
+
+	// with no block left a wildcard gets a single address
+	released := interceptAddresses.assign("0.example.com")
+	interceptAddresses.release("0.example.com")
+	if block := interceptAddresses.assignBlock("*.full.example.com", 28); block == nil || !block.IP.Equal(released) {
+		t.Errorf("a wildcard got %v with the range full, want the address %v no longer intercepted", block, released)
+	} else if ones, _ := block.Mask.Size(); ones != 32 {
+		t.Errorf("a wildcard got the block %v with the range full", block)
+	}
+}
+
+func TestNamesBelowAWildcardReuseAddressesOfTheirBlock(t *testing.T) {
+	resetTestDns(t, "100.64.0.1", 24)
+	_, block, _ := net.ParseCIDR("100.64.0.16/28")
+	for i := 0; i < 15; i++ {
+		if ip := interceptAddresses.assignIn(fmt.Sprintf("%d.corp.example.com", i), block); !block.Contains(ip) {
+			t.Fatalf("name %d got %v outside of %v", i, ip, block)
+		}
+	}
+	if ip := interceptAddresses.assignIn("full.corp.example.com", block); ip != nil {
+		t.Errorf("a name got %v with every name of the block intercepted", ip)
+	}
+
+	kept := interceptAddresses.assignIn("3.corp.example.com", block)
+	interceptAddresses.release("3.corp.example.com")
+	if ip := interceptAddresses.assignIn("new.corp.example.com", block); !ip.Equal(kept) {
+		t.Errorf("a name got %v, want the address %v of the name no longer intercepted", ip, kept)
+	}
+}
+
+func TestBlocksAreKeptAcrossRestarts(t *testing.T) {
+	resetTestDns(t, "100.64.0.1", 10)
+	corp := wildcardBlock(t, "*.corp.example.com")
+	inside := dnsMgrPrivate.Resolve("a.corp.example.com")
+
+	interceptAddresses.mu.Lock()
+	b, err := json.Marshal(interceptAddressFile{Addresses: []*interceptAddress{
+		interceptAddresses.byHost[hostnameKey("*.corp.example.com")],
+		interceptAddresses.byHost[hostnameKey("a.corp.example.com")],
+	}})
+	interceptAddresses.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resetTestDns(t, "100.64.0.1", 10)
+	var f interceptAddressFile
+	if err = json.Unmarshal(b, &f); err != nil {
+		t.Fatal(err)
+	}
+	interceptAddresses.mu.Lock()
+	for _, a := range f.Addresses {
+		a.ip = binary.BigEndian.Uint32(net.ParseIP(a.Address).To4())
+		interceptAddresses.add(a)
+	}
+	interceptAddresses.mu.Unlock()
+
+	if again := wildcardBlock(t, "*.corp.example.com"); again.String() != corp.String() {
+		t.Errorf("wildcard got the block %v after a restart, want %v", again, corp)
+	}
+	if got := dnsMgrPrivate.Resolve("a.corp.example.com"); !got.Equal(inside) {
+		t.Errorf("a.corp.example.com resolves to %v after a restart, want %v", got, inside)
+	}
+	if ip := interceptAddresses.assign("web.example.com"); corp.Contains(ip) {
+		t.Errorf("hostname got %v from the block kept across the restart", ip)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package windns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/miekg/dns"
+)
+
+// the lines surrounding the entries the tunnel manages in the hosts file. Everything outside of them is left alone
+var (
+	hostsBlockBegin = fmt.Sprintf("# BEGIN %s managed block. changes inside this block are overwritten", exeName)
+	hostsBlockEnd   = fmt.Sprintf("# END %s managed block", exeName)
+)
+
+// HostsFile returns the location of the windows hosts file
+func HostsFile() string {
+	root := os.Getenv("SystemRoot")
+	if root == "" {
+		root = `C:\Windows`
+	}
+	return filepath.Join(root, "System32", "drivers", "etc", "hosts")
+}
+
+// validHostsEntry reports if the hostname and address can be written to the hosts file as a single entry. The names
+// come from the controller so a name which could end the line, start a comment or add a second name is refused
+func validHostsEntry(hostname string, address string) bool {
+	if _, ok := dns.IsDomainName(hostname); !ok || hostname == "" {
+		return false
+	}
+	if strings.ContainsAny(hostname, "#*") || strings.IndexFunc(hostname, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) >= 0 {
+		return false
+	}
+	return net.ParseIP(address) != nil
+}
+
+// ReplaceHostsBlock returns the hosts file content with the managed block replaced by one holding the given entries,
+// keyed by hostname. Any existing managed block is removed, including a block left unterminated by an interrupted
+// write. The block is appended to the end of the file and left out entirely when there are no entries. Entries which
+// are not a valid hostname and address are left out
+func ReplaceHostsBlock(content string, entries map[string]string) string {
+	// keep the line endings of the file. windows tools write crlf
+	newline := "\r\n"
+	if strings.Contains(content, "\n") && !strings.Contains(content, "\r\n") {
+		newline = "\n"
+	}
+
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	kept := make([]string, 0, len(lines))
+	inBlock := false
+	for _, l := range lines {
+		switch strings.TrimSpace(l) {
+		case hostsBlockBegin:
+			inBlock = true
+			continue
+		case hostsBlockEnd:
+			if inBlock {
+				inBlock = false
+				continue
+			}
+		}
+		if !inBlock {
+			kept = append(kept, l)
+		}
+	}
+	// drop the trailing empty lines so the file does not grow every time the block is rewritten
+	for len(kept) > 0 && strings.TrimSpace(kept[len(kept)-1]) == "" {
+		kept = kept[:len(kept)-1]
+	}
+
+	hostnames := make([]string, 0, len(entries))
+	for h, addr := range entries {
+		if !validHostsEntry(h, addr) {
+			log.Warnf("not writing %q for %q to the hosts file. it is not a valid hostname and address", addr, h)
+			continue
+		}
+		hostnames = append(hostnames, h)
+	}
+	if len(hostnames) > 0 {
+		sort.Strings(hostnames)
+		if len(kept) > 0 {
+			kept = append(kept, "")
+		}
+		kept = append(kept, hostsBlockBegin)
+		for _, h := range hostnames {
+			kept = append(kept, fmt.Sprintf("%s\t%s", entries[h], h))
+		}
+		kept = append(kept, hostsBlockEnd)
+	}
+	if len(kept) == 0 {
+		return ""
+	}
+	return strings.Join(kept, newline) + newline
+}
+
+// WriteHostsEntries replaces the managed block of the hosts file at path with the given entries. The file is
+// rewritten in place rather than replaced so it keeps its owner and access control list. The file is not touched when
+// the block is unchanged
+func WriteHostsEntries(path string, entries map[string]string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not read %s: %v", path, err)
+	}
+	current := string(b)
+	updated := ReplaceHostsBlock(current, entries)
+	if updated == current {
+		return nil
+	}
+
+	// windows cannot open a read-only file for writing. the attribute is cleared for the write and set again after
+	mode := os.FileMode(0644)
+	readOnly := false
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+		readOnly = mode&0200 == 0
+	}
+	if readOnly {
+		if err = os.Chmod(path, mode|0200); err != nil {
+			return fmt.Errorf("could not write %s: %v", path, err)
+		}
+	}
+	err = writeInPlace(path, updated, mode)
+	if readOnly {
+		if chmodErr := os.Chmod(path, mode); chmodErr != nil {
+			log.Warnf("could not make %s read-only again: %v", path, chmodErr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("could not write %s: %v", path, err)
+	}
+	log.Debugf("hosts file %s now holds %d managed entries", path, len(entries))
+	return nil
+}
+
+// writeInPlace truncates and writes the file at path, creating it with mode when it does not exist
+func writeInPlace(path string, content string, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode|0200)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
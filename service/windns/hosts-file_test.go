@@ -0,0 +1,187 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package windns
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplaceHostsBlock(t *testing.T) {
+	entries := map[string]string{"b.example.com": "100.64.0.4", "a.example.com": "100.64.0.3"}
+	block := func(nl string) string {
+		return strings.Join([]string{hostsBlockBegin, "100.64.0.3\ta.example.com", "100.64.0.4\tb.example.com", hostsBlockEnd}, nl) + nl
+	}
+	const user = "# Copyright (c) Microsoft Corp.\r\n#\t127.0.0.1   localhost  \r\n10.0.0.1\tfiler # the nas\r\n"
+
+	tests := []struct {
+		name    string
+		content string
+		entries map[string]string
+		want    string
+	}{
+		{name: "insert into an empty file", content: "", entries: entries, want: block("\r\n")},
+		{name: "insert with crlf", content: user, entries: entries, want: user + "\r\n" + block("\r\n")},
+		{name: "insert with lf", content: "127.0.0.1 localhost\n", entries: entries, want: "127.0.0.1 localhost\n\n" + block("\n")},
+		{name: "insert without a final newline", content: "127.0.0.1 localhost", entries: entries, want: "127.0.0.1 localhost\r\n\r\n" + block("\r\n")},
+		{
+			name:    "replace",
+			content: user + "\r\n" + hostsBlockBegin + "\r\n100.64.0.9\told.example.com\r\n" + hostsBlockEnd + "\r\n",
+			entries: entries,
+			want:    user + "\r\n" + block("\r\n"),
+		},
+		{
+			name:    "replace a block in the middle",
+			content: "127.0.0.1 localhost\n" + hostsBlockBegin + "\n100.64.0.9\told.example.com\n" + hostsBlockEnd + "\n10.0.0.1 filer\n",
+			entries: entries,
+			want:    "127.0.0.1 localhost\n10.0.0.1 filer\n\n" + block("\n"),
+		},
+		{
+			name:    "replace an unterminated block",
+			content: user + "\r\n" + hostsBlockBegin + "\r\n100.64.0.9\told.example.com\r\n",
+			entries: entries,
+			want:    user + "\r\n" + block("\r\n"),
+		},
+		{
+			name:    "remove",
+			content: user + "\r\n" + hostsBlockBegin + "\r\n100.64.0.9\told.example.com\r\n" + hostsBlockEnd + "\r\n\r\n",
+			want:    user,
+		},
+		{name: "remove the only block", content: block("\n"), want: ""},
+		{name: "remove an unterminated block", content: "127.0.0.1 localhost\n" + hostsBlockBegin + "\n", want: "127.0.0.1 localhost\n"},
+		{name: "nothing to remove", content: user, want: user},
+		{name: "end without a begin is kept", content: "a\n" + hostsBlockEnd + "\n", want: "a\n" + hostsBlockEnd + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ReplaceHostsBlock(tt.content, tt.entries)
+			if got != tt.want {
+				t.Fatalf("ReplaceHostsBlock() = %q, want %q", got, tt.want)
+			}
+			if again := ReplaceHostsBlock(got, tt.entries); again != got {
+				t.Errorf("ReplaceHostsBlock() changed its own output to %q", again)
+			}
+		})
+	}
+}
+
+func TestReplaceHostsBlockRefusesUnsafeEntries(t *testing.T) {
+	want := strings.Join([]string{hostsBlockBegin, "100.64.0.3\ta.example.com", hostsBlockEnd}, "\r\n") + "\r\n"
+	tests := []struct {
+		name     string
+		hostname string
+		address  string
+	}{
+		{name: "crlf", hostname: "b.example.com\r\n10.0.0.1 filer.example.com", address: "100.64.0.4"},
+		{name: "newline", hostname: "b.example.com\n10.0.0.1 filer.example.com", address: "100.64.0.4"},
+		{name: "space", hostname: "b.example.com filer.example.com", address: "100.64.0.4"},
+		{name: "tab", hostname: "b.example.com\tfiler.example.com", address: "100.64.0.4"},
+		{name: "comment", hostname: "b.example.com#", address: "100.64.0.4"},
+		{name: "control character", hostname: "b.example\x00.com", address: "100.64.0.4"},
+		{name: "wildcard", hostname: "*.example.com", address: "100.64.0.4"},
+		{name: "empty", hostname: "", address: "100.64.0.4"},
+		{name: "too long", hostname: strings.Repeat("b", 64) + ".example.com", address: "100.64.0.4"},
+		{name: "address with a second name", hostname: "b.example.com", address: "100.64.0.4 filer.example.com"},
+		{name: "no address", hostname: "b.example.com", address: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := map[string]string{"a.example.com": "100.64.0.3", tt.hostname: tt.address}
+			if got := ReplaceHostsBlock("", entries); got != want {
+				t.Errorf("ReplaceHostsBlock() = %q, want %q", got, want)
+			}
+		})
+	}
+
+	if got := ReplaceHostsBlock("", map[string]string{"b.example.com\n10.0.0.1 filer": "100.64.0.4"}); got != "" {
+		t.Errorf("ReplaceHostsBlock() with only unsafe entries = %q, want no block", got)
+	}
+}
+
+func TestWriteHostsEntriesRewritesInPlace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte("127.0.0.1 localhost\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteHostsEntries(path, map[string]string{"a.example.com": "100.64.0.3"}); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a replaced file would lose the owner and access control list of the hosts file
+	if !os.SameFile(before, after) {
+		t.Errorf("hosts file was replaced by a new file, want it rewritten in place")
+	}
+}
+
+func TestWriteHostsEntriesKeepsReadOnlyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	path := filepath.Join(dir, "hosts")
+	const user = "127.0.0.1 localhost\r\n"
+	if err := ioutil.WriteFile(path, []byte(user), 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := map[string]string{"a.example.com": "100.64.0.3"}
+	if err := WriteHostsEntries(path, entries); err != nil {
+		t.Fatalf("WriteHostsEntries() failed on a read-only hosts file: %v", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ReplaceHostsBlock(user, entries); string(b) != want {
+		t.Errorf("hosts file is %q, want %q", b, want)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&0200 != 0 {
+		t.Errorf("hosts file is writable after the write, mode %v", info.Mode())
+	}
+
+	if err := WriteHostsEntries(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ = ioutil.ReadFile(path); string(b) != user {
+		t.Errorf("hosts file is %q after removing the entries, want %q", b, user)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files left next to the hosts file, want only the hosts file", len(files))
+	}
+}
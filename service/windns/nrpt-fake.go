@@ -0,0 +1,103 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package windns
+
+import (
+	"sort"
+	"sync"
+)
+
+// FakeNrptManager keeps NRPT rules in memory so the rules the tunnel keeps can be checked without touching the
+// machine. Adding or removing a namespace found in Fail returns the error instead
+type FakeNrptManager struct {
+	mu    sync.Mutex
+	rules map[string][]string
+	Fail  map[string]error
+	Calls int // how many batches were applied
+}
+
+var _ NrptManager = &FakeNrptManager{}
+
+func NewFakeNrptManager() *FakeNrptManager {
+	return &FakeNrptManager{
+		rules: make(map[string][]string),
+		Fail:  make(map[string]error),
+	}
+}
+
+func (f *FakeNrptManager) Add(namespaces []string, dnsServer string) []NrptResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls++
+	results := make([]NrptResult, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if err := f.Fail[normalizeNamespace(ns)]; err != nil {
+			results = append(results, NrptResult{Namespace: ns, Err: err})
+			continue
+		}
+		f.rules[normalizeNamespace(ns)] = []string{dnsServer}
+		results = append(results, NrptResult{Namespace: ns})
+	}
+	return results
+}
+
+func (f *FakeNrptManager) Remove(namespaces []string) []NrptResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls++
+	results := make([]NrptResult, 0, len(namespaces))
+	for _, ns := range namespaces {
+		if err := f.Fail[normalizeNamespace(ns)]; err != nil {
+			results = append(results, NrptResult{Namespace: ns, Err: err})
+			continue
+		}
+		delete(f.rules, normalizeNamespace(ns))
+		results = append(results, NrptResult{Namespace: ns})
+	}
+	return results
+}
+
+func (f *FakeNrptManager) RemoveAll() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls++
+	f.rules = make(map[string][]string)
+	return nil
+}
+
+func (f *FakeNrptManager) List() (map[string][]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := make(map[string][]string, len(f.rules))
+	for ns, servers := range f.rules {
+		result[ns] = append([]string(nil), servers...)
+	}
+	return result, nil
+}
+
+// Namespaces returns every namespace with a rule, sorted
+func (f *FakeNrptManager) Namespaces() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := make([]string, 0, len(f.rules))
+	for ns := range f.rules {
+		result = append(result, ns)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package windns
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestFakeNrptBatchesReturnOneResultPerNamespace(t *testing.T) {
+	f := NewFakeNrptManager()
+	denied := errors.New("access denied")
+	f.Fail[".denied.example.com"] = denied
+	namespaces := []string{".a.example.com", ".Denied.Example.com", "b.example.com"}
+
+	tests := []struct {
+		name  string
+		apply func() []NrptResult
+		rules []string
+	}{
+		{
+			name:  "add",
+			apply: func() []NrptResult { return f.Add(namespaces, "100.64.0.2") },
+			rules: []string{".a.example.com", "b.example.com"},
+		},
+		{
+			name:  "remove",
+			apply: func() []NrptResult { return f.Remove(namespaces) },
+			rules: []string{},
+		},
+		{
+			name:  "remove without rules",
+			apply: func() []NrptResult { return f.Remove(namespaces) },
+			rules: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := tt.apply()
+			if len(results) != len(namespaces) {
+				t.Fatalf("%d results for %d namespaces", len(results), len(namespaces))
+			}
+			for i, r := range results {
+				if r.Namespace != namespaces[i] {
+					t.Errorf("result %d is for %q, want %q", i, r.Namespace, namespaces[i])
+				}
+				if wantErr := i == 1; (r.Err != nil) != wantErr {
+					t.Errorf("result for %q has error %v", r.Namespace, r.Err)
+				}
+			}
+			if got := f.Namespaces(); !reflect.DeepEqual(got, tt.rules) {
+				t.Errorf("rules are %v, want %v", got, tt.rules)
+			}
+		})
+	}
+	if f.Calls != len(tests) {
+		t.Errorf("Calls = %d, want one per batch", f.Calls)
+	}
+}
+
+func TestFakeNrptReplacesRulesIgnoringCase(t *testing.T) {
+	f := NewFakeNrptManager()
+	f.Add([]string{".Corp.Example.com"}, "100.64.0.2")
+	f.Add([]string{".corp.example.COM"}, "100.64.0.3")
+
+	rules, err := f.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][]string{".corp.example.com": {"100.64.0.3"}}; !reflect.DeepEqual(rules, want) {
+		t.Errorf("List() = %v, want %v", rules, want)
+	}
+
+	if failed := NrptFailures(f.Remove([]string{".CORP.example.com"})); len(failed) != 0 {
+		t.Errorf("Remove() failed: %v", failed)
+	}
+	if got := f.Namespaces(); len(got) != 0 {
+		t.Errorf("rules are %v after removing in another case", got)
+	}
+}
+
+func TestNrptFailures(t *testing.T) {
+	denied := errors.New("access denied")
+	tests := []struct {
+		name    string
+		results []NrptResult
+		want    []NrptResult
+	}{
+		{name: "none", results: nil, want: []NrptResult{}},
+		{name: "all succeeded", results: []NrptResult{{Namespace: ".a"}, {Namespace: ".b"}}, want: []NrptResult{}},
+		{
+			name:    "some failed",
+			results: []NrptResult{{Namespace: ".a", Err: denied}, {Namespace: ".b"}, {Namespace: ".c", Err: denied}},
+			want:    []NrptResult{{Namespace: ".a", Err: denied}, {Namespace: ".c", Err: denied}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NrptFailures(tt.results); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NrptFailures() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package windns
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+// the local NRPT rules, the same place Add-DnsClientNrptRule writes to. Each rule is a subkey
+const nrptRegistryPath = `SYSTEM\CurrentControlSet\Services\Dnscache\Parameters\DnsPolicyConfig`
+
+const (
+	nrptRuleVersion = 2
+	// the rule sends matching names to GenericDNSServers
+	nrptConfigGenericDnsServers = 0x8
+)
+
+var (
+	moddnsapi                 = windows.NewLazySystemDLL("dnsapi.dll")
+	procDnsFlushResolverCache = moddnsapi.NewProc("DnsFlushResolverCache")
+)
+
+// registryNrptManager writes NRPT rules to the registry directly. A single rule takes a few registry writes where a
+// PowerShell script took a process start, and every rule succeeds or fails on its own
+type registryNrptManager struct {
+	mu   sync.Mutex
+	path string
+}
+
+// registryRule is a rule added by the tunnel as found in the registry
+type registryRule struct {
+	key        string
+	namespaces []string
+	servers    []string
+}
+
+func NewRegistryNrptManager() NrptManager {
+	return &registryNrptManager{path: nrptRegistryPath}
+}
+
+func (r *registryNrptManager) Add(namespaces []string, dnsServer string) []NrptResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	results := make([]NrptResult, 0, len(namespaces))
+	parent, _, err := registry.CreateKey(registry.LOCAL_MACHINE, r.path, registry.CREATE_SUB_KEY)
+	if err != nil {
+		for _, ns := range namespaces {
+			results = append(results, NrptResult{Namespace: ns, Err: fmt.Errorf("could not open %s: %v", r.path, err)})
+		}
+		return results
+	}
+	defer parent.Close()
+
+	for _, ns := range namespaces {
+		results = append(results, NrptResult{Namespace: ns, Err: writeRule(parent, ns, dnsServer)})
+	}
+	log.Tracef("added %d nrpt rule(s) pointing at %s", len(namespaces), dnsServer)
+	flushResolverCache()
+	return results
+}
+
+func writeRule(parent registry.Key, namespace string, dnsServer string) error {
+	k, _, err := registry.CreateKey(parent, ruleKeyName(namespace), registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	if err = k.SetDWordValue("Version", nrptRuleVersion); err != nil {
+		return err
+	}
+	if err = k.SetStringsValue("Name", []string{namespace}); err != nil {
+		return err
+	}
+	if err = k.SetStringValue("GenericDNSServers", dnsServer); err != nil {
+		return err
+	}
+	if err = k.SetDWordValue("ConfigOptions", nrptConfigGenericDnsServers); err != nil {
+		return err
+	}
+	if err = k.SetStringValue("IPSECCARestriction", ""); err != nil {
+		return err
+	}
+	if err = k.SetStringValue("Comment", ruleComment); err != nil {
+		return err
+	}
+	return k.SetStringValue("DisplayName", fmt.Sprintf("%s:%s", exeName, namespace))
+}
+
+func (r *registryNrptManager) Remove(namespaces []string) []NrptResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	results := make([]NrptResult, 0, len(namespaces))
+	rules, err := r.rules()
+	if err != nil {
+		for _, ns := range namespaces {
+			results = append(results, NrptResult{Namespace: ns, Err: err})
+		}
+		return results
+	}
+	// rules added by earlier versions with PowerShell are found by namespace as they have random key names
+	byNamespace := make(map[string][]string)
+	for _, rule := range rules {
+		for _, ns := range rule.namespaces {
+			byNamespace[normalizeNamespace(ns)] = append(byNamespace[normalizeNamespace(ns)], rule.key)
+		}
+	}
+
+	for _, ns := range namespaces {
+		var failed error
+		for _, key := range byNamespace[normalizeNamespace(ns)] {
+			if err = r.deleteRule(key); err != nil {
+				failed = err
+			}
+		}
+		results = append(results, NrptResult{Namespace: ns, Err: failed})
+	}
+	flushResolverCache()
+	return results
+}
+
+func (r *registryNrptManager) RemoveAll() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rules, err := r.rules()
+	if err != nil {
+		return err
+	}
+	failures := make([]string, 0)
+	for _, rule := range rules {
+		if err = r.deleteRule(rule.key); err != nil {
+			failures = append(failures, fmt.Sprintf("%v: %v", rule.namespaces, err))
+		}
+	}
+	flushResolverCache()
+	if len(failures) > 0 {
+		return fmt.Errorf("could not remove %d of %d nrpt rules: %s", len(failures), len(rules), strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+func (r *registryNrptManager) List() (map[string][]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rules, err := r.rules()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]string)
+	for _, rule := range rules {
+		for _, ns := range rule.namespaces {
+			result[normalizeNamespace(ns)] = rule.servers
+		}
+	}
+	return result, nil
+}
+
+// rules reads every rule added by the tunnel. must hold the lock
+func (r *registryNrptManager) rules() ([]registryRule, error) {
+	parent, err := registry.OpenKey(registry.LOCAL_MACHINE, r.path, registry.ENUMERATE_SUB_KEYS)
+	if err == registry.ErrNotExist {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %v", r.path, err)
+	}
+	defer parent.Close()
+
+	names, err := parent.ReadSubKeyNames(-1)
+	if err != nil {
+		return nil, fmt.Errorf("could not list the rules in %s: %v", r.path, err)
+	}
+	rules := make([]registryRule, 0, len(names))
+	for _, name := range names {
+		k, err := registry.OpenKey(parent, name, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		comment, _, err := k.GetStringValue("Comment")
+		if err != nil || !strings.HasPrefix(comment, ruleComment) {
+			k.Close()
+			continue
+		}
+		rule := registryRule{key: name}
+		rule.namespaces, _, _ = k.GetStringsValue("Name")
+		if servers, _, err := k.GetStringValue("GenericDNSServers"); err == nil && servers != "" {
+			rule.servers = strings.Split(servers, ";")
+		}
+		k.Close()
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// must hold the lock
+func (r *registryNrptManager) deleteRule(key string) error {
+	err := registry.DeleteKey(registry.LOCAL_MACHINE, r.path+`\`+key)
+	if err == registry.ErrNotExist {
+		return nil
+	}
+	return err
+}
+
+// ruleKeyName names the rule of a namespace after its hash so adding a namespace twice replaces the rule
+func ruleKeyName(namespace string) string {
+	h := sha1.Sum([]byte(normalizeNamespace(namespace)))
+	return fmt.Sprintf("{%x-%x-%x-%x-%x}", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// flushResolverCache drops names cached by the DNS client so the changed rules apply to the next query
+func flushResolverCache() {
+	if err := procDnsFlushResolverCache.Find(); err != nil {
+		log.Debugf("DnsFlushResolverCache is not available: %v", err)
+		return
+	}
+	_, _, _ = procDnsFlushResolverCache.Call()
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package windns
+
+import "strings"
+
+// NrptResult is the outcome of adding or removing the rule of one namespace
+type NrptResult struct {
+	Namespace string
+	Err       error
+}
+
+// NrptManager adds and removes the NRPT rules sending names to the ziti DNS server. Only rules added by the tunnel are
+// ever listed or removed
+type NrptManager interface {
+	// Add adds or replaces a rule for each namespace. Every namespace gets a result
+	Add(namespaces []string, dnsServer string) []NrptResult
+	// Remove removes the rules of each namespace. Removing a namespace without a rule succeeds
+	Remove(namespaces []string) []NrptResult
+	// RemoveAll removes every rule added by the tunnel
+	RemoveAll() error
+	// List returns the DNS servers of every rule added by the tunnel keyed by namespace
+	List() (map[string][]string, error)
+}
+
+// Nrpt is the NrptManager used by the tunnel
+var Nrpt NrptManager = NewRegistryNrptManager()
+
+// the comment every rule added by the tunnel carries
+var ruleComment = "Added by " + exeName
+
+// NrptFailures returns the results which failed
+func NrptFailures(results []NrptResult) []NrptResult {
+	failed := make([]NrptResult, 0)
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+func AddNrptRules(domainsToMap map[string]bool, dnsServer string) {
+	if len(domainsToMap) == 0 {
+		log.Debug("no domains to map specified to AddNrptRules. exiting early")
+		return
+	}
+	logNrptFailures("adding", Nrpt.Add(Namespaces(domainsToMap), dnsServer))
+}
+
+func RemoveNrptRules(domainsToRemove map[string]bool) {
+	if len(domainsToRemove) == 0 {
+		log.Debug("no domains to map specified to RemoveNrptRules. exiting early")
+		return
+	}
+	logNrptFailures("removing", Nrpt.Remove(Namespaces(domainsToRemove)))
+}
+
+func RemoveAllNrptRules() {
+	if err := Nrpt.RemoveAll(); err != nil {
+		log.Errorf("ERROR removing all nrpt rules: %v", err)
+	}
+}
+
+func logNrptFailures(action string, results []NrptResult) {
+	failed := NrptFailures(results)
+	for _, r := range failed {
+		log.Errorf("ERROR %s nrpt rule for %s: %v", action, r.Namespace, r.Err)
+	}
+	log.Debugf("%s nrpt rules: %d of %d succeeded", action, len(results)-len(failed), len(results))
+}
+
+// Namespaces returns the namespaces of the map namespaces are usually collected in
+func Namespaces(m map[string]bool) []string {
+	result := make([]string, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	return result
+}
+
+// normalizeNamespace is the form namespaces are compared in. NRPT namespaces are not case sensitive
+func normalizeNamespace(namespace string) string {
+	return strings.ToLower(strings.TrimSpace(namespace))
+}
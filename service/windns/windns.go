@@ -27,15 +27,13 @@ import (
 	"strings"
 )
 
-const (
-	MAX_POWERSHELL_SCRIPT_LEN = 7500 //represents how long the powershell script can be. as of apr 2021 the limit was 8k (8192). leaves a little room for the rest of the script
-)
-
 var log = logging.Logger()
 var exeName = "ziti-tunnel"
 
+// GetConnectionSpecificDomains returns the DNS suffixes in the order windows searches them: the global suffix search
+// list followed by the connection-specific suffix of each interface. Every suffix ends with a period
 func GetConnectionSpecificDomains() []string {
-	script := `Get-DnsClient | Select-Object ConnectionSpecificSuffix -Unique | ForEach-Object { $_.ConnectionSpecificSuffix }; (Get-DnsClientGlobalSetting).SuffixSearchList`
+	script := `(Get-DnsClientGlobalSetting).SuffixSearchList; Get-DnsClient | Select-Object ConnectionSpecificSuffix -Unique | ForEach-Object { $_.ConnectionSpecificSuffix }`
 
 	cmd := exec.Command("powershell", "-Command", script)
 	cmd.Stderr = os.Stdout
@@ -50,6 +48,7 @@ func GetConnectionSpecificDomains() []string {
 	}
 
 	var names []string
+	seen := make(map[string]bool)
 	for {
 		domain, err := output.ReadString('\n')
 		if err != nil {
@@ -58,7 +57,11 @@ func GetConnectionSpecificDomains() []string {
 		domain = strings.TrimSpace(domain)
 		if "" != domain {
 			if !strings.HasSuffix(domain, ".") {
-				names = append(names, domain+".")
+				domain += "."
+			}
+			if !seen[strings.ToLower(domain)] {
+				seen[strings.ToLower(domain)] = true
+				names = append(names, domain)
 			}
 		}
 	}
@@ -107,141 +110,15 @@ func FlushDNS() {
 	}
 }
 
-func RemoveAllNrptRules() {
-	script := fmt.Sprintf(`Get-DnsClientNrptRule | Where { $_.Comment.StartsWith("Added by %s") } | Remove-DnsClientNrptRule -ErrorAction SilentlyContinue -Force`, exeName)
-	log.Tracef("removing all nrpt rules with: %s", script)
-
-	cmd := exec.Command("powershell", "-Command", script)
-	cmd.Stderr = os.Stdout
-	cmd.Stdout = os.Stdout
-
-	err := cmd.Run()
-	if err != nil {
-		log.Errorf("ERROR removing all nrpt rules: %v", err)
-	}
-}
-
-var namespaceTemplate = `%s@{n="%s";}`
-var namespaceTemplatePadding = len(namespaceTemplate)
-
-func AddNrptRules(domainsToMap map[string]bool, dnsServer string) {
-	if len(domainsToMap) == 0 {
-		log.Debug("no domains to map specified to AddNrptRules. exiting early")
-		return
-	}
-
-	maxBucketSize := 500
-	currentSize := 0
-	hostnames := make([]string, maxBucketSize)
-	ruleSize := 0
-	for hostname := range domainsToMap {
-		ruleSize = ruleSize + len(hostname) + namespaceTemplatePadding
-		if ruleSize > MAX_POWERSHELL_SCRIPT_LEN || currentSize >= maxBucketSize {
-			log.Debugf("sending chunk of domains to be added to NRPT")
-			chunkedAddNrptRules(hostnames[:currentSize], dnsServer)
-			hostnames = make([]string, maxBucketSize)
-			currentSize = 0
-			ruleSize = len(hostname) + namespaceTemplatePadding
-		}
-		hostnames[currentSize] = hostname
-		currentSize++
-	}
-	if currentSize > 0 {
-		//means there's a chunk still to add....
-		chunkedAddNrptRules(hostnames[:currentSize], dnsServer)
-	}
-}
-
-func chunkedAddNrptRules(domainsToAdd []string, dnsServer string) {
-	sb := strings.Builder{}
-	sb.WriteString(`$Namespaces = @(
-`)
-
-	for _, hostname := range domainsToAdd {
-		sb.WriteString(fmt.Sprintf(namespaceTemplate, "\n", hostname))
-	}
-
-	sb.WriteString(fmt.Sprintf(`)
-
-ForEach ($Namespace in $Namespaces) {
-    $ns=$Namespace["n"]
-    $Rule = @{Namespace="${ns}"; NameServers=@("%s"); Comment="Added by %s"; DisplayName="%s:${ns}"; }
-    Add-DnsClientNrptRule @Rule
-}`, dnsServer, exeName, exeName))
-
-	script := sb.String()
-	log.Tracef("Executing    ADD NRPT script containing %d domains. total script size: %d\n%s", len(domainsToAdd), len(script), script)
-
-	cmd := exec.Command("powershell", "-Command", script)
-	cmd.Stderr = os.Stdout
-	cmd.Stdout = os.Stdout
-
-	err := cmd.Run()
-	if err != nil {
-		log.Errorf("ERROR adding nrpt rules: %v", err)
-	}
-}
-
-func RemoveNrptRules(domainsToRemove map[string]bool) {
-	if len(domainsToRemove) == 0 {
-		log.Debug("no domains to map specified to RemoveNrptRules. exiting early")
-		return
-	}
-
-	maxBucketSize := 500
-	currentSize := 0
-	hostnames := make([]string, maxBucketSize)
-	ruleSize := 0
-	for hostname := range domainsToRemove {
-		ruleSize = ruleSize + len(hostname) + namespaceTemplatePadding
-		if ruleSize > MAX_POWERSHELL_SCRIPT_LEN || currentSize >= maxBucketSize {
-			log.Debugf("sending chunk of domains to be added to NRPT")
-			chunkedRemoveNrptRules(hostnames[:currentSize])
-			hostnames = make([]string, maxBucketSize)
-			currentSize = 0
-			ruleSize = len(hostname) + namespaceTemplatePadding
-		}
-		hostnames[currentSize] = hostname
-		currentSize++
-	}
-
-	if currentSize > 0 {
-		//means there's a chunk still to add....
-		chunkedRemoveNrptRules(hostnames[:currentSize])
-	}
-}
-
-func chunkedRemoveNrptRules(domainsToRemove []string) {
-	sb := strings.Builder{}
-	sb.WriteString(`$toRemove = @(`)
-
-	for _, hostname := range domainsToRemove {
-		sb.WriteString(fmt.Sprintf(namespaceTemplate, "\n", hostname))
-	}
-
-	sb.WriteString(fmt.Sprintf(`)
-
-ForEach ($ns in $toRemove){
-  Get-DnsClientNrptRule | where Namespace -eq $ns["n"] | Remove-DnsClientNrptRule -Force -ErrorAction SilentlyContinue
-}
-`))
-
-	script := sb.String()
-	log.Tracef("Executing REMOVE NRPT script containing %d domains. total script size: %d\n%s", len(domainsToRemove), len(script), script)
-
-	cmd := exec.Command("powershell", "-Command", script)
-	cmd.Stderr = os.Stdout
-	cmd.Stdout = os.Stdout
-
-	err := cmd.Run()
-	if err != nil {
-		log.Errorf("ERROR removing nrpt rules: %v", err)
+func IsNrptPoliciesEffective(dnsserver string) bool {
+	testRule := []string{".ziti.test"}
+	if failed := NrptFailures(Nrpt.Add(testRule, dnsserver)); len(failed) > 0 {
+		log.Errorf("ERROR adding the test nrpt rules: %v", failed[0].Err)
+		return false
 	}
-}
+	defer Nrpt.Remove(testRule)
 
-func IsNrptPoliciesEffective(dnsserver string) bool {
-	script := fmt.Sprintf(`Add-DnsClientNrptRule -Namespace ".ziti.test" -NameServers "%s" -Comment "Added by ziti-tunnel" -DisplayName "ziti-tunnel:.ziti.test"
-	Get-DnsClientNrptPolicy -Effective | Select-Object Namespace -Unique | Where-Object Namespace -Eq ".ziti.test"`, dnsserver)
+	script := `Get-DnsClientNrptPolicy -Effective | Select-Object Namespace -Unique | Where-Object Namespace -Eq ".ziti.test"`
 	log.Debugf("checking the nrpt policies with: %s", script)
 
 	cmd := exec.Command("powershell", "-Command", script)
@@ -251,7 +128,7 @@ func IsNrptPoliciesEffective(dnsserver string) bool {
 
 	err := cmd.Run()
 	if err != nil {
-		log.Errorf("ERROR adding the test nrpt rules: %v", err)
+		log.Errorf("ERROR reading the effective nrpt policies: %v", err)
 		return false
 	}
 
@@ -269,26 +146,9 @@ func IsNrptPoliciesEffective(dnsserver string) bool {
 			break
 		}
 	}
-	removeSingleNrtpRule(".ziti.test")
-
 	return policyFound
 }
 
-func removeSingleNrtpRule(nrptRule string) {
-	script := fmt.Sprintf(`Get-DnsClientNrptRule | where Namespace -eq "%s" | Remove-DnsClientNrptRule -Force -ErrorAction SilentlyContinue`, nrptRule)
-	log.Debugf("Removing the nrpt rule with: %s", script)
-
-	cmd := exec.Command("powershell", "-Command", script)
-	cmd.Stderr = os.Stdout
-	output := new(bytes.Buffer)
-	cmd.Stdout = output
-
-	err := cmd.Run()
-	if err != nil {
-		log.Errorf("ERROR removing the nrpt rules: %v", err)
-	}
-}
-
 func CleanUpNetworkAdapterProfile() {
 	script := fmt.Sprintf(`$key="Microsoft.PowerShell.Core\Registry::HKEY_LOCAL_MACHINE\SOFTWARE\Microsoft\Windows NT\CurrentVersion\NetworkList\Signatures\Unmanaged\*"
 Get-ItemProperty -Path $key | where {$_.FirstNetwork -match "ziti.*"} | Remove-Item
@@ -307,4 +167,41 @@ Get-ItemProperty -Path $key | where {$_.ProfileName -match "Ziti.*"} | Remove-It
 		log.Errorf("ERROR Cleaning up the Network Adapter profiles: %v", err)
 	}
 
-}
\ No newline at end of file
+}
+
+// NrptRouteFor finds the effective NRPT rule which applies to the name. The longest matching namespace wins. An empty
+// namespace is returned when no rule applies and the name is resolved by the DNS servers of the interfaces
+func NrptRouteFor(name string) (string, []string, error) {
+	script := `Get-DnsClientNrptPolicy -Effective | ForEach-Object { "$($_.Namespace)|$($_.NameServers -join ',')" }`
+	log.Debugf("reading the effective nrpt policies with: %s", script)
+
+	cmd := exec.Command("powershell", "-Command", script)
+	cmd.Stderr = os.Stdout
+	output := new(bytes.Buffer)
+	cmd.Stdout = output
+	if err := cmd.Run(); err != nil {
+		return "", nil, fmt.Errorf("could not read the effective nrpt policies: %v", err)
+	}
+
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	bestNamespace := ""
+	var bestServers []string
+	for _, l := range strings.Split(output.String(), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(l), "|", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		namespace := strings.ToLower(parts[0])
+		matches := false
+		if strings.HasPrefix(namespace, ".") {
+			matches = strings.HasSuffix(name, namespace) || name == strings.TrimPrefix(namespace, ".")
+		} else {
+			matches = name == namespace
+		}
+		if matches && len(namespace) > len(bestNamespace) {
+			bestNamespace = parts[0]
+			bestServers = strings.Split(parts[1], ",")
+		}
+	}
+	return bestNamespace, bestServers, nil
+}
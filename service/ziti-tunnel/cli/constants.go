@@ -46,6 +46,30 @@ var UPDATE_TUN_IPV4 = dto.CommandMsg{
 	Function: "UpdateTunIpv4",
 }
 
+var GET_CONFIG = dto.CommandMsg{
+	Function: "GetConfig",
+}
+
+var SET_CONFIG = dto.CommandMsg{
+	Function: "SetConfig",
+}
+
+var GET_DNS_LOG = dto.CommandMsg{
+	Function: "GetDnsLog",
+}
+
+var RESOLVE_DNS = dto.CommandMsg{
+	Function: "ResolveDns",
+}
+
+var GET_DNS_BLOCKLISTS = dto.CommandMsg{
+	Function: "GetDnsBlocklists",
+}
+
+var CHECK_CONSISTENCY = dto.CommandMsg{
+	Function: "CheckConsistency",
+}
+
 var monitorIpcPipe = `\\.\pipe\OpenZiti\ziti-monitor\ipc`
 
 var templateIdentity = `{{printf "%40s" "Name"}} | {{printf "%41s" "FingerPrint"}} | {{printf "%6s" "Active"}} | {{printf "%30s" "Config"}} | {{"Status"}}
@@ -56,4 +80,39 @@ var templateService = `{{printf "%40s" "Name"}} | {{printf "%15s" "Id"}} | {{pri
 {{range .}}{{printf "%40s" .Name}} | {{printf "%15s" .Id}} | {{printf "%9s" .Protocols}} | {{printf "%14s" .Ports}} | {{printf "%60s" .Addresses}}
 {{end}}`
 
+var templateConfig = `{{printf "%-20s" "Key"}} | {{printf "%-30s" "Value"}} | {{printf "%6s" "Policy"}} | {{"Description"}}
+{{range .}}{{printf "%-20s" .Key}} | {{printf "%-30s" .Value}} | {{printf "%6t" .PolicyManaged}} | {{.Description}}
+{{end}}`
+
+var templateDnsLog = `{{printf "%-12s" "Time"}} | {{printf "%-50s" "Name"}} | {{printf "%-6s" "Type"}} | {{printf "%-22s" "Client"}} | {{printf "%-8s" "Result"}} | {{"Latency"}}
+{{range .}}{{.Time.Format "15:04:05.000"}} | {{printf "%-50s" .Name}} | {{printf "%-6s" .Type}} | {{printf "%-22s" .Client}} | {{printf "%-8s" .Disposition}} | {{printf "%.1fms" .LatencyMs}}
+{{end}}`
+
+var templateDnsNames = `{{printf "%-50s" "Name"}} | {{printf "%7s" "Queries"}} | {{printf "%7s" "Ziti"}} | {{printf "%7s" "Proxied"}} | {{printf "%7s" "Cached"}} | {{printf "%7s" "Refused"}} | {{printf "%7s" "Expired"}} | {{printf "%7s" "Failed"}} | {{printf "%7s" "Blocked"}} | {{"Last Seen"}}
+{{range .}}{{printf "%-50s" .Name}} | {{printf "%7d" .Queries}} | {{printf "%7d" (index .Dispositions "ziti")}} | {{printf "%7d" (index .Dispositions "proxied")}} | {{printf "%7d" (index .Dispositions "cached")}} | {{printf "%7d" (index .Dispositions "refused")}} | {{printf "%7d" (index .Dispositions "expired")}} | {{printf "%7d" (index .Dispositions "failed")}} | {{printf "%7d" (index .Dispositions "blocked")}} | {{.LastSeen.Format "15:04:05"}}
+{{end}}`
+
+var templateDnsResolution = `Name:      {{.Name}} ({{.Type}})
+Answered:  {{.Stage}}{{if .Upstream}} by {{.Upstream}}{{end}}{{if .Blocklist}} by {{.Blocklist}}{{end}} in {{printf "%.1fms" .LatencyMs}}
+Result:    {{.Rcode}}{{if .Error}} ({{.Error}}){{end}}
+{{range .Answers}}           {{.}}
+{{end}}Owners:    {{if not .Owners}}none{{end}}
+{{range .Owners}}           {{.Service}} ({{.Address}}) of identity {{.Identity}} [{{.FingerPrint}}]
+{{end}}NRPT:      {{if .NrptError}}unknown ({{.NrptError}}){{else if .NrptNamespace}}{{.NrptNamespace}} -> {{range .NrptServers}}{{.}} {{end}}{{if .NrptRoutesToZiti}}(ziti DNS){{else}}(not the ziti DNS){{end}}{{else}}no rule. the DNS servers of the interfaces are used{{end}}
+`
+
+var templateConsistency = `Consistent: {{.Consistent}}
+Checked:    {{.Identities}} identities, {{.Services}} services, {{.Hostnames}} hostnames, {{.NrptRules}} NRPT rules
+Pending:    {{.PendingChanges}} service change(s) not applied yet
+{{if .NrptError}}NRPT:       unknown ({{.NrptError}})
+{{end}}{{if .Divergences}}{{printf "%-17s" "Kind"}} | {{printf "%-50s" "Name"}} | {{printf "%-41s" "FingerPrint"}} | {{"Detail"}}
+{{range .Divergences}}{{printf "%-17s" .Kind}} | {{printf "%-50s" .Name}} | {{printf "%-41s" .FingerPrint}} | {{.Detail}}
+{{end}}{{end}}`
+
+var templateDnsBlocklists = `Mode:      {{.Mode}}
+Allowlist: {{if not .Allowlist}}none{{end}}{{range .Allowlist}}{{.}} {{end}}
+{{printf "%-30s" "Name"}} | {{printf "%8s" "Domains"}} | {{printf "%8s" "Hits"}} | {{printf "%-8s" "Last Hit"}} | {{printf "%-8s" "Loaded"}} | {{"Path"}}
+{{range .Lists}}{{printf "%-30s" .Name}} | {{printf "%8d" .Domains}} | {{printf "%8d" .Hits}} | {{if .LastHit.IsZero}}{{printf "%-8s" "never"}}{{else}}{{.LastHit.Format "15:04:05"}}{{end}} | {{.LoadedAt.Format "15:04:05"}} | {{.Path}}{{if .Error}} ({{.Error}}){{end}}
+{{end}}`
+
 var log = logging.Logger()
@@ -222,6 +222,131 @@ func GetIdentityResponseObjectFromRTS(args []string, status dto.Response, flags
 	}
 }
 
+// GetConfigFromRTS prints the config entries returned by the RTS
+func GetConfigFromRTS(args []string, status dto.Response, flags map[string]bool) dto.Response {
+	if status.Code != service.SUCCESS {
+		return status
+	}
+
+	var entries []dto.ConfigEntry
+	b, err := json.Marshal(status.Payload)
+	if err == nil {
+		err = json.Unmarshal(b, &entries)
+	}
+	if err != nil {
+		log.Error(err)
+		return dto.Response{Message: status.Message, Code: service.ERROR, Error: "Could not read config from Runtime", Payload: nil}
+	}
+
+	response := generateResponse("config", status.Message, entries, flags, templateConfig)
+	if response.Code == service.SUCCESS {
+		fmt.Println(response.Payload.(string))
+		response.Payload = nil
+	}
+	return response
+}
+
+// GetDnsLogFromRTS prints the DNS queries, or the counters per name when the stats flag is set
+func GetDnsLogFromRTS(args []string, status dto.Response, flags map[string]bool) dto.Response {
+	if status.Code != service.SUCCESS {
+		return status
+	}
+
+	var dnsLog dto.DnsLog
+	b, err := json.Marshal(status.Payload)
+	if err == nil {
+		err = json.Unmarshal(b, &dnsLog)
+	}
+	if err != nil {
+		log.Error(err)
+		return dto.Response{Message: status.Message, Code: service.ERROR, Error: "Could not read the DNS log from Runtime", Payload: nil}
+	}
+
+	var response dto.Response
+	if flags["stats"] {
+		response = generateResponse("dns log", status.Message, dnsLog.Names, flags, templateDnsNames)
+	} else {
+		response = generateResponse("dns log", status.Message, dnsLog.Entries, flags, templateDnsLog)
+	}
+	if response.Code == service.SUCCESS {
+		fmt.Println(response.Payload.(string))
+		response.Payload = nil
+	}
+	return response
+}
+
+// GetDnsResolutionFromRTS prints how the ziti DNS server resolved a name
+func GetDnsResolutionFromRTS(args []string, status dto.Response, flags map[string]bool) dto.Response {
+	if status.Code != service.SUCCESS {
+		return status
+	}
+
+	var resolution dto.DnsResolution
+	b, err := json.Marshal(status.Payload)
+	if err == nil {
+		err = json.Unmarshal(b, &resolution)
+	}
+	if err != nil {
+		log.Error(err)
+		return dto.Response{Message: status.Message, Code: service.ERROR, Error: "Could not read the DNS resolution from Runtime", Payload: nil}
+	}
+
+	response := generateResponse("dns resolution", status.Message, resolution, flags, templateDnsResolution)
+	if response.Code == service.SUCCESS {
+		fmt.Println(response.Payload.(string))
+		response.Payload = nil
+	}
+	return response
+}
+
+// GetDnsBlocklistsFromRTS is to print the DNS blocklists with their hits
+func GetDnsBlocklistsFromRTS(args []string, status dto.Response, flags map[string]bool) dto.Response {
+	if status.Code != service.SUCCESS {
+		return status
+	}
+
+	var blocklists dto.DnsBlocklistStatus
+	b, err := json.Marshal(status.Payload)
+	if err == nil {
+		err = json.Unmarshal(b, &blocklists)
+	}
+	if err != nil {
+		log.Error(err)
+		return dto.Response{Message: status.Message, Code: service.ERROR, Error: "Could not read the DNS blocklists from Runtime", Payload: nil}
+	}
+
+	response := generateResponse("dns blocklists", status.Message, blocklists, flags, templateDnsBlocklists)
+	if response.Code == service.SUCCESS {
+		fmt.Println(response.Payload.(string))
+		response.Payload = nil
+	}
+	return response
+}
+
+// GetConsistencyReportFromRTS is to print the divergences found by the consistency check
+func GetConsistencyReportFromRTS(args []string, status dto.Response, flags map[string]bool) dto.Response {
+	if status.Code != service.SUCCESS {
+		return status
+	}
+
+	var report dto.ConsistencyReport
+	b, err := json.Marshal(status.Payload)
+	if err == nil {
+		err = json.Unmarshal(b, &report)
+	}
+	if err != nil {
+		log.Error(err)
+		return dto.Response{Message: status.Message, Code: service.ERROR, Error: "Could not read the consistency report from Runtime", Payload: nil}
+	}
+
+	response := generateResponse("consistency report", status.Message, report, flags, templateConsistency)
+	if response.Code == service.SUCCESS {
+		fmt.Println(response.Payload.(string))
+		response.Payload = nil
+	}
+	return response
+}
+
 // GetResponseObjectFromRTS is to get response object info from the RTS
 func GetResponseObjectFromRTS(args []string, status dto.Response, flags map[string]bool) dto.Response {
 	return status
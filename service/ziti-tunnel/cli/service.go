@@ -18,6 +18,7 @@ package cli
  */
 
 import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
 	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
 	"net"
 	"strconv"
@@ -108,3 +109,80 @@ func UpdateConfigIPSubnet(args []string, flags map[string]interface{}) {
 	}
 
 }
+
+//ShowConfig is to print the effective config of the running service through cmdline
+func ShowConfig(args []string, flags map[string]bool) {
+	GET_CONFIG.Payload = make(map[string]interface{})
+	GetDataFromIpcPipe(&GET_CONFIG, nil, GetConfigFromRTS, args, flags)
+}
+
+//GetConfig is to print a single config value through cmdline
+func GetConfig(args []string, flags map[string]bool) {
+	GET_CONFIG.Payload = map[string]interface{}{
+		"Key": args[0],
+	}
+	GetDataFromIpcPipe(&GET_CONFIG, nil, GetConfigFromRTS, args, flags)
+}
+
+//SetConfig is to change a single config value through cmdline
+func SetConfig(args []string, flags map[string]bool) {
+	SET_CONFIG.Payload = map[string]interface{}{
+		"Key":   args[0],
+		"Value": args[1],
+	}
+	log.Debugf("SetConfig Payload %v", SET_CONFIG)
+	GetDataFromIpcPipe(&SET_CONFIG, nil, GetConfigFromRTS, args, flags)
+}
+
+//GetDnsLog is to print the recent DNS queries or the counters per name through cmdline
+func GetDnsLog(args []string, flags map[string]bool, limit int, name string) {
+	GET_DNS_LOG.Payload = map[string]interface{}{
+		"Limit": limit,
+		"Name":  name,
+	}
+	GetDataFromIpcPipe(&GET_DNS_LOG, nil, GetDnsLogFromRTS, args, flags)
+}
+
+//ResolveDns is to show how the ziti DNS server resolves a name through cmdline
+func ResolveDns(args []string, flags map[string]bool, qtype string) {
+	RESOLVE_DNS.Payload = map[string]interface{}{
+		"Name": args[0],
+		"Type": qtype,
+	}
+	GetDataFromIpcPipe(&RESOLVE_DNS, nil, GetDnsResolutionFromRTS, args, flags)
+}
+
+//GetDnsBlocklists is to print the DNS blocklists and their hits through cmdline. reload reads every list again first
+func GetDnsBlocklists(args []string, flags map[string]bool, reload bool) {
+	GET_DNS_BLOCKLISTS.Payload = map[string]interface{}{
+		"Reload": reload,
+	}
+	GetDataFromIpcPipe(&GET_DNS_BLOCKLISTS, nil, GetDnsBlocklistsFromRTS, args, flags)
+}
+
+//CheckConsistency is to compare the services, the DNS and the NRPT rules of the running service through cmdline
+func CheckConsistency(args []string, flags map[string]bool) {
+	CHECK_CONSISTENCY.Payload = make(map[string]interface{})
+	GetDataFromIpcPipe(&CHECK_CONSISTENCY, nil, GetConsistencyReportFromRTS, args, flags)
+}
+
+//ValidateConfig checks a config file without sending it to the service. returns true if the file is valid
+func ValidateConfig(args []string) bool {
+	filename := args[0]
+	cfg, fromVersion, err := config.Read(filename)
+	if err != nil {
+		log.Errorf("%s could not be read: %v", filename, err)
+		return false
+	}
+	if fromVersion < config.SchemaVersion {
+		log.Infof("%s has schema version %d and will be migrated to %d when loaded", filename, fromVersion, config.SchemaVersion)
+	} else if fromVersion > config.SchemaVersion {
+		log.Warnf("%s has schema version %d which is newer than this version supports (%d)", filename, fromVersion, config.SchemaVersion)
+	}
+	if err = cfg.Validate(); err != nil {
+		log.Errorf("%s is not valid: %v", filename, err)
+		return false
+	}
+	log.Infof("%s is valid. identities: %d", filename, len(cfg.Identities))
+	return true
+}
@@ -0,0 +1,49 @@
+package cmd
+
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/cli"
+	"github.com/spf13/cobra"
+)
+
+var blocklistJSON bool
+var blocklistReload bool
+
+// blocklistCmd represents the dns blocklist command
+var blocklistCmd = &cobra.Command{
+	Use:   "blocklist",
+	Short: "Shows the DNS blocklists and how often each blocked a query",
+	Long: `blocklist shows the blocklists of the ziti DNS server, the allowlist and how blocked names are answered.
+	Lists are set with the DnsBlocklists, DnsAllowlist and DnsBlockMode settings. Changed list files are read again
+	automatically, --reload reads every list file again immediately.
+	eg: ziti-tunnel dns blocklist
+	    ziti-tunnel dns blocklist --reload`,
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := map[string]bool{}
+		flags["prettyJSON"] = blocklistJSON
+		cli.GetDnsBlocklists(args, flags, blocklistReload)
+	},
+}
+
+func init() {
+	dnsCmd.AddCommand(blocklistCmd)
+
+	blocklistCmd.Flags().BoolVarP(&blocklistJSON, "json", "j", false, "display data in json format")
+	blocklistCmd.Flags().BoolVarP(&blocklistReload, "reload", "r", false, "read every blocklist file again first")
+}
@@ -0,0 +1,47 @@
+package cmd
+
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/cli"
+	"github.com/spf13/cobra"
+)
+
+var checkJSON bool
+
+// checkCmd represents the check command
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Checks that the services, the DNS and the NRPT rules agree",
+	Long: `check compares the services of every active identity with the hostnames the ziti DNS server counts and
+	resolves, and the hostnames with the NRPT rules. Every divergence is listed. Service changes which have been
+	received but not applied yet are reported as pending and may show up as divergences until they are applied.
+	eg: ziti-tunnel check
+	    ziti-tunnel check --json`,
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := map[string]bool{}
+		flags["prettyJSON"] = checkJSON
+		cli.CheckConsistency(args, flags)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+
+	checkCmd.Flags().BoolVarP(&checkJSON, "json", "j", false, "display data in json format")
+}
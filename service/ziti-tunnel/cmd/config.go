@@ -24,13 +24,12 @@ import (
 // configCmd represents the config command
 var configCmd = &cobra.Command{
 	Use:   "config",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+	Short: "View or change the configuration of the ziti-tunnel",
+	Long: `config command should be used with one of its sub commands.
+	eg: ziti-tunnel config show
+	    ziti-tunnel config get LogLevel
+	    ziti-tunnel config set AddDns true
+	    ziti-tunnel config validate C:\path\to\config.json`,
 	Run: func(cmd *cobra.Command, args []string) {
 		checkHelp()
 	},
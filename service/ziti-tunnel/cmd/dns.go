@@ -0,0 +1,40 @@
+package cmd
+
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// dnsCmd represents the dns command
+var dnsCmd = &cobra.Command{
+	Use:   "dns",
+	Short: "Inspect the ziti DNS server",
+	Long: `dns command should be used with one of its sub commands.
+	eg: ziti-tunnel dns log
+	    ziti-tunnel dns log --stats
+	    ziti-tunnel dns resolve myservice.ziti
+	    ziti-tunnel dns blocklist`,
+	Run: func(cmd *cobra.Command, args []string) {
+		checkHelp()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(dnsCmd)
+}
@@ -0,0 +1,40 @@
+package cmd
+
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/cli"
+	"github.com/spf13/cobra"
+)
+
+// getCmd represents the config get command
+var getCmd = &cobra.Command{
+	Use:   "get [key]",
+	Short: "Gets a single config value from the ziti-tunnel",
+	Long: `get prints the current value of the given setting.
+	Use 'config show' to list all keys.
+	eg: ziti-tunnel config get TunIpv4`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.GetConfig(args, nil)
+	},
+}
+
+func init() {
+	configCmd.AddCommand(getCmd)
+}
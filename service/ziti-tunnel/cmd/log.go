@@ -0,0 +1,54 @@
+package cmd
+
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/cli"
+	"github.com/spf13/cobra"
+)
+
+var dnsLogJSON bool
+var dnsLogStats bool
+var dnsLogLimit int
+var dnsLogName string
+
+// dnsLogCmd represents the dns log command
+var dnsLogCmd = &cobra.Command{
+	Use:   "log",
+	Short: "Shows the recent queries received by the ziti DNS server",
+	Long: `log prints the most recent DNS queries, newest first, with how each was answered:
+	ziti (an intercepted name), proxied, cached, refused, expired (the upstream did not answer in time) or failed.
+	eg: ziti-tunnel dns log -n 20
+	    ziti-tunnel dns log --name example.com
+	    ziti-tunnel dns log --stats`,
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := map[string]bool{}
+		flags["prettyJSON"] = dnsLogJSON
+		flags["stats"] = dnsLogStats
+		cli.GetDnsLog(args, flags, dnsLogLimit, dnsLogName)
+	},
+}
+
+func init() {
+	dnsCmd.AddCommand(dnsLogCmd)
+
+	dnsLogCmd.Flags().BoolVarP(&dnsLogJSON, "json", "j", false, "display data in json format")
+	dnsLogCmd.Flags().BoolVarP(&dnsLogStats, "stats", "s", false, "display the query counters of each name instead of the queries")
+	dnsLogCmd.Flags().IntVarP(&dnsLogLimit, "limit", "n", 50, "the most queries to display. 0 displays every query kept")
+	dnsLogCmd.Flags().StringVar(&dnsLogName, "name", "", "only display names containing this text")
+}
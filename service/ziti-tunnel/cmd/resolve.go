@@ -0,0 +1,50 @@
+package cmd
+
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/cli"
+	"github.com/spf13/cobra"
+)
+
+var resolveJSON bool
+var resolveType string
+
+// resolveCmd represents the dns resolve command
+var resolveCmd = &cobra.Command{
+	Use:   "resolve [name]",
+	Short: "Resolves a name the same way the ziti DNS server does",
+	Long: `resolve sends the name through the same stages as a query received by the ziti DNS server and shows
+	which stage answered, the answer, the services and identities intercepting the name and whether the NRPT
+	currently sends the name to the ziti DNS server.
+	eg: ziti-tunnel dns resolve myservice.ziti
+	    ziti-tunnel dns resolve _ldap._tcp.corp.example.com --type SRV`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := map[string]bool{}
+		flags["prettyJSON"] = resolveJSON
+		cli.ResolveDns(args, flags, resolveType)
+	},
+}
+
+func init() {
+	dnsCmd.AddCommand(resolveCmd)
+
+	resolveCmd.Flags().BoolVarP(&resolveJSON, "json", "j", false, "display data in json format")
+	resolveCmd.Flags().StringVarP(&resolveType, "type", "t", "A", "the query type. e.g. A, AAAA, PTR, SRV, TXT")
+}
@@ -0,0 +1,40 @@
+package cmd
+
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/cli"
+	"github.com/spf13/cobra"
+)
+
+// setCmd represents the config set command
+var setCmd = &cobra.Command{
+	Use:   "set [key] [value]",
+	Short: "Sets a single config value in the ziti-tunnel",
+	Long: `set validates and stores a new value for the given setting.
+	Use 'config show' to list all keys.
+	eg: ziti-tunnel config set LogLevel debug`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		cli.SetConfig(args, nil)
+	},
+}
+
+func init() {
+	configCmd.AddCommand(setCmd)
+}
@@ -0,0 +1,45 @@
+package cmd
+
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+import (
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/cli"
+	"github.com/spf13/cobra"
+)
+
+var showJSON bool
+
+// showCmd represents the config show command
+var showCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Shows the effective config of the ziti-tunnel",
+	Long: `show prints every setting the ziti-tunnel is currently using,
+	including settings which are managed by policy.
+	eg: ziti-tunnel config show`,
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := map[string]bool{}
+		flags["prettyJSON"] = showJSON
+		cli.ShowConfig(args, flags)
+	},
+}
+
+func init() {
+	configCmd.AddCommand(showCmd)
+
+	showCmd.Flags().BoolVarP(&showJSON, "json", "j", false, "display data in json format")
+}
@@ -38,6 +38,9 @@ func Path() string {
 	path, _ := os.UserConfigDir()
 	return path + string(os.PathSeparator) + "NetFoundry" + string(os.PathSeparator)
 }
+func InterceptAddressesFile() string {
+	return Path() + "intercept-addresses.json"
+}
 func LogFile() string {
 	return filepath.Join(LogsPath(), "ziti-tunneler.log")
 }
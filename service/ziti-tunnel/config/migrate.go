@@ -0,0 +1,90 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package config
+
+import (
+	"fmt"
+)
+
+// SchemaVersion is the version of the config.json layout written by this build. Any change to TunnelConfig which is
+// not purely additive must increment this value and register a migration from the previous version below.
+const SchemaVersion = 1
+
+// a migration upgrades a raw config document from version N to version N+1 in place
+type migration func(raw map[string]interface{}) error
+
+// migrations[N] upgrades a document from version N to N+1
+var migrations = []migration{
+	0: migrateFromTunnelStatus,
+}
+
+func schemaVersionOf(raw map[string]interface{}) int {
+	if v, ok := raw["SchemaVersion"].(float64); ok {
+		return int(v)
+	}
+	// releases before the schema was versioned serialized dto.TunnelStatus and carry no version field
+	return 0
+}
+
+func migrate(raw map[string]interface{}, from int) error {
+	if from > SchemaVersion {
+		// written by a newer release. leave it as is and read whatever is understood rather than refusing to start
+		return nil
+	}
+	for v := from; v < SchemaVersion; v++ {
+		if err := migrations[v](raw); err != nil {
+			return fmt.Errorf("could not migrate config from schema version %d to %d: %v", v, v+1, err)
+		}
+		raw["SchemaVersion"] = v + 1
+	}
+	return nil
+}
+
+// migrateFromTunnelStatus converts the unversioned config.json, which was a serialized dto.TunnelStatus, into schema
+// version 1. Runtime-only values are dropped and only the controller url is kept from the identity's sdk config.
+func migrateFromTunnelStatus(raw map[string]interface{}) error {
+	for _, runtimeOnly := range []string{"Active", "Duration", "IpInfo", "ServiceVersion", "Status"} {
+		delete(raw, runtimeOnly)
+	}
+
+	ids, ok := raw["Identities"].([]interface{})
+	if !ok {
+		raw["Identities"] = make([]interface{}, 0)
+		return nil
+	}
+
+	migrated := make([]interface{}, 0, len(ids))
+	for _, i := range ids {
+		id, ok := i.(map[string]interface{})
+		if !ok {
+			// a null entry was possible in older files. nothing to carry over
+			continue
+		}
+		mid := map[string]interface{}{
+			"Name":        id["Name"],
+			"FingerPrint": id["FingerPrint"],
+			"Active":      id["Active"],
+		}
+		if sdkCfg, ok := id["Config"].(map[string]interface{}); ok {
+			mid["ZtAPI"] = sdkCfg["ztAPI"]
+		}
+		migrated = append(migrated, mid)
+	}
+	raw["Identities"] = migrated
+	return nil
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseMigratesPastReleases(t *testing.T) {
+	tests := []struct {
+		file        string
+		fromVersion int
+		want        *TunnelConfig
+	}{
+		{
+			file:        "config-1.5.0.json",
+			fromVersion: 0,
+			want: &TunnelConfig{
+				SchemaVersion: SchemaVersion,
+				Identities: []*IdentityConfig{
+					{
+						Name:        "home",
+						FingerPrint: "a1b2c3d4e5f60718293a4b5c6d7e8f9012345678",
+						Active:      true,
+						ZtAPI:       "https://ctrl.example.com:1280",
+					},
+				},
+				TunIpv4: "169.254.0.1",
+			},
+		},
+		{
+			file:        "config-1.9.9.json",
+			fromVersion: 0,
+			want: &TunnelConfig{
+				SchemaVersion: SchemaVersion,
+				Identities: []*IdentityConfig{
+					{
+						Name:        "corp",
+						FingerPrint: "2f4b0c1e9a7d3c5b8e6f1a2d4c7b9e0f3a5d8c1b",
+						Active:      true,
+					},
+					{
+						Name:        "lab",
+						FingerPrint: "9c3e5a7b1d2f4e6a8c0b2d4f6a8c0e2b4d6f8a0c",
+						Active:      false,
+					},
+				},
+				LogLevel:    "debug",
+				TunIpv4:     "100.64.0.1",
+				TunIpv4Mask: 10,
+				AddDns:      true,
+			},
+		},
+		{
+			file:        "config-schema-1.json",
+			fromVersion: 1,
+			want: &TunnelConfig{
+				SchemaVersion: SchemaVersion,
+				Identities: []*IdentityConfig{
+					{
+						Name:        "corp",
+						FingerPrint: "2f4b0c1e9a7d3c5b8e6f1a2d4c7b9e0f3a5d8c1b",
+						Active:      true,
+						ZtAPI:       "https://ctrl.corp.example.com:443",
+					},
+				},
+				LogLevel:        "info",
+				TunIpv4:         "100.64.0.1",
+				TunIpv4Mask:     10,
+				DnsUpstreamMode: "sequential",
+				DnsUpstreams:    []string{"tls://1.1.1.1:853"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			b, err := ioutil.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, from, err := Parse(b)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if from != tt.fromVersion {
+				t.Errorf("Parse() version = %d, want %d", from, tt.fromVersion)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %s, want %s", asJson(t, got), asJson(t, tt.want))
+			}
+
+			// what is written back must read as the same config without migrating again
+			var out bytes.Buffer
+			if err := got.Write(&out); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			again, from, err := Parse(out.Bytes())
+			if err != nil {
+				t.Fatalf("Parse() of the written config error = %v", err)
+			}
+			if from != SchemaVersion {
+				t.Errorf("written config has version %d, want %d", from, SchemaVersion)
+			}
+			if !reflect.DeepEqual(again, got) {
+				t.Errorf("written config reads as %s, want %s", asJson(t, again), asJson(t, got))
+			}
+		})
+	}
+}
+
+func TestParseKeepsNewerSchemaVersion(t *testing.T) {
+	got, from, err := Parse([]byte(`{"SchemaVersion": 99, "LogLevel": "warn", "SomethingNew": true}`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if from != 99 || got.SchemaVersion != 99 {
+		t.Errorf("Parse() version = %d, SchemaVersion = %d, want 99", from, got.SchemaVersion)
+	}
+	if got.LogLevel != "warn" {
+		t.Errorf("LogLevel = %q, want warn", got.LogLevel)
+	}
+	if got.Identities == nil {
+		t.Error("Identities is nil")
+	}
+}
+
+func TestParseRejectsInvalidJson(t *testing.T) {
+	if _, _, err := Parse([]byte(`{"Identities": [`)); err == nil {
+		t.Error("Parse() of invalid json did not fail")
+	}
+}
+
+func asJson(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
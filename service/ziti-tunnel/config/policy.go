@@ -0,0 +1,392 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"golang.org/x/sys/windows/registry"
+)
+
+const (
+	PolicyKeyTunIpv4             = "TunIpv4"
+	PolicyKeyTunIpv4Mask         = "TunIpv4Mask"
+	PolicyKeyTunIpv4Mode         = "TunIpv4Mode"
+	PolicyKeyTunCandidatePool    = "TunCandidatePool"
+	PolicyKeyAddDns              = "AddDns"
+	PolicyKeyLogLevel            = "LogLevel"
+	PolicyKeyAllowedControllers  = "AllowedControllers"
+	PolicyKeyAllowIdentityAdd    = "AllowIdentityAdd"
+	PolicyKeyAllowIdentityRemove = "AllowIdentityRemove"
+	PolicyKeyDnsBlocklists       = "DnsBlocklists"
+	PolicyKeyDnsAllowlist        = "DnsAllowlist"
+	PolicyKeyDnsBlockMode        = "DnsBlockMode"
+
+	policyRegistryPath = `SOFTWARE\Policies\NetFoundry\ZitiDesktopEdge`
+)
+
+// Policy holds the machine-wide settings an administrator has locked. A nil field is not managed and the user's own
+// setting from config.json applies.
+type Policy struct {
+	TunCidr             *string
+	AddDns              *bool
+	LogLevel            *string
+	AllowedControllers  []string
+	AllowIdentityAdd    *bool
+	AllowIdentityRemove *bool
+	DnsBlocklists       []string
+	DnsAllowlist        []string
+	DnsBlockMode        *string
+}
+
+// PolicySource provides a Policy. A source with nothing configured returns an empty policy and no error.
+type PolicySource interface {
+	Name() string
+	Load() (*Policy, error)
+}
+
+// PolicyFile returns the path of the policy file, or an empty string when ProgramData is not set. Every other folder
+// it could fall back to is writable by users so no policy file is read at all
+func PolicyFile() string {
+	programData := os.Getenv("ProgramData")
+	if programData == "" {
+		return ""
+	}
+	return filepath.Join(programData, "NetFoundry", "policy.json")
+}
+
+// DefaultPolicySources returns the sources consulted by the service in order of precedence. Values from the registry
+// (as deployed through group policy) win over the policy file.
+func DefaultPolicySources() []PolicySource {
+	return []PolicySource{
+		&registryPolicySource{path: policyRegistryPath},
+		&filePolicySource{path: PolicyFile()},
+	}
+}
+
+// LoadPolicy merges the policy from every source. The first source to set a value wins. A source which fails to load,
+// or a value which is not valid, is returned as an error along with the rest of the policy. An invalid value is
+// dropped so that a single mistake does not unlock every other setting.
+func LoadPolicy(sources []PolicySource) (*Policy, error) {
+	merged := &Policy{}
+	var errs []string
+	for _, src := range sources {
+		p, err := src.Load()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("could not load policy from %s: %v", src.Name(), err))
+			continue
+		}
+		merged.mergeMissing(p)
+	}
+	errs = append(errs, merged.dropInvalid()...)
+	if len(errs) > 0 {
+		return merged, errors.New(strings.Join(errs, ", "))
+	}
+	return merged, nil
+}
+
+func (p *Policy) mergeMissing(from *Policy) {
+	if from == nil {
+		return
+	}
+	if p.TunCidr == nil {
+		p.TunCidr = from.TunCidr
+	}
+	if p.AddDns == nil {
+		p.AddDns = from.AddDns
+	}
+	if p.LogLevel == nil {
+		p.LogLevel = from.LogLevel
+	}
+	if p.AllowedControllers == nil {
+		p.AllowedControllers = from.AllowedControllers
+	}
+	if p.AllowIdentityAdd == nil {
+		p.AllowIdentityAdd = from.AllowIdentityAdd
+	}
+	if p.AllowIdentityRemove == nil {
+		p.AllowIdentityRemove = from.AllowIdentityRemove
+	}
+	if p.DnsBlocklists == nil {
+		p.DnsBlocklists = from.DnsBlocklists
+	}
+	if p.DnsAllowlist == nil {
+		p.DnsAllowlist = from.DnsAllowlist
+	}
+	if p.DnsBlockMode == nil {
+		p.DnsBlockMode = from.DnsBlockMode
+	}
+}
+
+// dropInvalid removes every value which is not valid from the policy and returns why each was removed. The setting
+// of a removed value is no longer managed
+func (p *Policy) dropInvalid() []string {
+	var errs []string
+	if p.TunCidr != nil {
+		if _, _, err := net.ParseCIDR(*p.TunCidr); err != nil {
+			errs = append(errs, fmt.Sprintf("policy contains an invalid TunCidr %s: %v", *p.TunCidr, err))
+			p.TunCidr = nil
+		}
+	}
+	if p.LogLevel != nil {
+		if isLogLevel(*p.LogLevel) {
+			level := strings.ToLower(*p.LogLevel)
+			p.LogLevel = &level
+		} else {
+			errs = append(errs, fmt.Sprintf("policy contains an invalid LogLevel %s", *p.LogLevel))
+			p.LogLevel = nil
+		}
+	}
+	if p.DnsBlockMode != nil {
+		switch strings.ToLower(*p.DnsBlockMode) {
+		case constants.DnsBlockModeNxdomain, constants.DnsBlockModeZero:
+		default:
+			errs = append(errs, fmt.Sprintf("policy contains an invalid DnsBlockMode %s", *p.DnsBlockMode))
+			p.DnsBlockMode = nil
+		}
+	}
+	return errs
+}
+
+// ManagedKeys returns the keys of every setting locked by this policy
+func (p *Policy) ManagedKeys() []string {
+	keys := make([]string, 0)
+	if p == nil {
+		return keys
+	}
+	if p.TunCidr != nil {
+		keys = append(keys, PolicyKeyTunIpv4, PolicyKeyTunIpv4Mask, PolicyKeyTunIpv4Mode, PolicyKeyTunCandidatePool)
+	}
+	if p.AddDns != nil {
+		keys = append(keys, PolicyKeyAddDns)
+	}
+	if p.LogLevel != nil {
+		keys = append(keys, PolicyKeyLogLevel)
+	}
+	if p.AllowedControllers != nil {
+		keys = append(keys, PolicyKeyAllowedControllers)
+	}
+	if p.AllowIdentityAdd != nil {
+		keys = append(keys, PolicyKeyAllowIdentityAdd)
+	}
+	if p.AllowIdentityRemove != nil {
+		keys = append(keys, PolicyKeyAllowIdentityRemove)
+	}
+	if p.DnsBlocklists != nil {
+		keys = append(keys, PolicyKeyDnsBlocklists)
+	}
+	if p.DnsAllowlist != nil {
+		keys = append(keys, PolicyKeyDnsAllowlist)
+	}
+	if p.DnsBlockMode != nil {
+		keys = append(keys, PolicyKeyDnsBlockMode)
+	}
+	return keys
+}
+
+func (p *Policy) IsManaged(key string) bool {
+	for _, k := range p.ManagedKeys() {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply overwrites every managed setting in the given config with the value from the policy
+func (p *Policy) Apply(c *TunnelConfig) {
+	if p == nil {
+		return
+	}
+	if p.TunCidr != nil {
+		ip, ipnet, _ := net.ParseCIDR(*p.TunCidr)
+		ones, _ := ipnet.Mask.Size()
+		c.TunIpv4 = ip.String()
+		c.TunIpv4Mask = ones
+		c.TunIpv4Mode = constants.TunIpv4ModeStatic
+	}
+	if p.AddDns != nil {
+		c.AddDns = *p.AddDns
+	}
+	if p.LogLevel != nil {
+		c.LogLevel = *p.LogLevel
+	}
+	if p.DnsBlocklists != nil {
+		c.DnsBlocklists = p.DnsBlocklists
+	}
+	if p.DnsAllowlist != nil {
+		c.DnsAllowlist = p.DnsAllowlist
+	}
+	if p.DnsBlockMode != nil {
+		c.DnsBlockMode = strings.ToLower(*p.DnsBlockMode)
+	}
+}
+
+// Revert puts the user's own value back for every managed setting so that policy values never end up in config.json
+func (p *Policy) Revert(c *TunnelConfig, user *TunnelConfig) {
+	if p == nil || user == nil {
+		return
+	}
+	if p.TunCidr != nil {
+		c.TunIpv4 = user.TunIpv4
+		c.TunIpv4Mask = user.TunIpv4Mask
+		c.TunIpv4Mode = user.TunIpv4Mode
+		c.TunCandidatePool = user.TunCandidatePool
+	}
+	if p.AddDns != nil {
+		c.AddDns = user.AddDns
+	}
+	if p.LogLevel != nil {
+		c.LogLevel = user.LogLevel
+	}
+	if p.DnsBlocklists != nil {
+		c.DnsBlocklists = user.DnsBlocklists
+	}
+	if p.DnsAllowlist != nil {
+		c.DnsAllowlist = user.DnsAllowlist
+	}
+	if p.DnsBlockMode != nil {
+		c.DnsBlockMode = user.DnsBlockMode
+	}
+}
+
+func (p *Policy) CanAddIdentity() bool {
+	return p == nil || p.AllowIdentityAdd == nil || *p.AllowIdentityAdd
+}
+
+func (p *Policy) CanRemoveIdentity() bool {
+	return p == nil || p.AllowIdentityRemove == nil || *p.AllowIdentityRemove
+}
+
+// IsControllerAllowed reports if identities from the given controller may be used. Controllers are compared by host
+// and port, ignoring the scheme and any path.
+func (p *Policy) IsControllerAllowed(controller string) bool {
+	if p == nil || p.AllowedControllers == nil {
+		return true
+	}
+	want := controllerHostPort(controller)
+	for _, allowed := range p.AllowedControllers {
+		if strings.EqualFold(controllerHostPort(allowed), want) {
+			return true
+		}
+	}
+	return false
+}
+
+func controllerHostPort(url string) string {
+	hostPort := strings.TrimSpace(url)
+	if idx := strings.Index(hostPort, "://"); idx >= 0 {
+		hostPort = hostPort[idx+3:]
+	}
+	if idx := strings.Index(hostPort, "/"); idx >= 0 {
+		hostPort = hostPort[:idx]
+	}
+	return hostPort
+}
+
+type filePolicySource struct {
+	path string
+}
+
+func (f *filePolicySource) Name() string {
+	if f.path == "" {
+		return "the policy file"
+	}
+	return f.path
+}
+
+func (f *filePolicySource) Load() (*Policy, error) {
+	if f.path == "" {
+		return nil, errors.New("ProgramData is not set so the policy file cannot be located")
+	}
+	b, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return &Policy{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err = json.Unmarshal(b, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+type registryPolicySource struct {
+	path string
+}
+
+func (r *registryPolicySource) Name() string {
+	return `HKLM\` + r.path
+}
+
+func (r *registryPolicySource) Load() (*Policy, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, r.path, registry.QUERY_VALUE)
+	if err == registry.ErrNotExist {
+		return &Policy{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer k.Close()
+
+	p := &Policy{
+		TunCidr:             registryString(k, "TunCidr"),
+		AddDns:              registryBool(k, "AddDns"),
+		LogLevel:            registryString(k, "LogLevel"),
+		AllowIdentityAdd:    registryBool(k, "AllowIdentityAdd"),
+		AllowIdentityRemove: registryBool(k, "AllowIdentityRemove"),
+		DnsBlockMode:        registryString(k, "DnsBlockMode"),
+	}
+	if controllers, _, err := k.GetStringsValue("AllowedControllers"); err == nil {
+		p.AllowedControllers = controllers
+	}
+	if lists, _, err := k.GetStringsValue("DnsBlocklists"); err == nil {
+		p.DnsBlocklists = lists
+	}
+	if domains, _, err := k.GetStringsValue("DnsAllowlist"); err == nil {
+		p.DnsAllowlist = domains
+	}
+	return p, nil
+}
+
+func registryString(k registry.Key, name string) *string {
+	v, _, err := k.GetStringValue(name)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+func registryBool(k registry.Key, name string) *bool {
+	v, _, err := k.GetIntegerValue(name)
+	if err != nil {
+		return nil
+	}
+	b := v != 0
+	return &b
+}
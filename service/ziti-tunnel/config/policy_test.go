@@ -0,0 +1,208 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package config
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type fakePolicySource struct {
+	policy *Policy
+	err    error
+}
+
+func (f *fakePolicySource) Name() string {
+	return "fake"
+}
+
+func (f *fakePolicySource) Load() (*Policy, error) {
+	return f.policy, f.err
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestLoadPolicyDropsOnlyInvalidValues(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      *Policy
+		wantErr     string
+		wantManaged []string
+	}{
+		{
+			name: "invalid TunCidr",
+			policy: &Policy{
+				TunCidr:             strPtr("100.64.0.1/99"),
+				AddDns:              boolPtr(true),
+				AllowedControllers:  []string{"https://ctrl.example.com:1280"},
+				AllowIdentityAdd:    boolPtr(false),
+				AllowIdentityRemove: boolPtr(false),
+			},
+			wantErr:     "invalid TunCidr",
+			wantManaged: []string{PolicyKeyAddDns, PolicyKeyAllowedControllers, PolicyKeyAllowIdentityAdd, PolicyKeyAllowIdentityRemove},
+		},
+		{
+			name: "invalid DnsBlockMode",
+			policy: &Policy{
+				TunCidr:       strPtr("100.64.0.1/10"),
+				LogLevel:      strPtr("info"),
+				DnsBlocklists: []string{`C:\lists\ads.txt`},
+				DnsBlockMode:  strPtr("sinkhole"),
+			},
+			wantErr:     "invalid DnsBlockMode",
+			wantManaged: []string{PolicyKeyTunIpv4, PolicyKeyTunIpv4Mask, PolicyKeyTunIpv4Mode, PolicyKeyTunCandidatePool, PolicyKeyLogLevel, PolicyKeyDnsBlocklists},
+		},
+		{
+			name: "invalid LogLevel",
+			policy: &Policy{
+				AddDns:   boolPtr(true),
+				LogLevel: strPtr("loud"),
+			},
+			wantErr:     "invalid LogLevel",
+			wantManaged: []string{PolicyKeyAddDns},
+		},
+		{
+			name: "valid",
+			policy: &Policy{
+				TunCidr:      strPtr("100.64.0.1/10"),
+				LogLevel:     strPtr("Warning"),
+				DnsBlockMode: strPtr("ZERO"),
+			},
+			wantManaged: []string{PolicyKeyTunIpv4, PolicyKeyTunIpv4Mask, PolicyKeyTunIpv4Mode, PolicyKeyTunCandidatePool, PolicyKeyLogLevel, PolicyKeyDnsBlockMode},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := LoadPolicy([]PolicySource{&fakePolicySource{policy: tt.policy}})
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("LoadPolicy() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("LoadPolicy() error = %v, want %q", err, tt.wantErr)
+			}
+			if got := p.ManagedKeys(); !reflect.DeepEqual(got, tt.wantManaged) {
+				t.Errorf("ManagedKeys() = %v, want %v", got, tt.wantManaged)
+			}
+		})
+	}
+}
+
+func TestLoadPolicyKeepsLocksWhenTunCidrIsInvalid(t *testing.T) {
+	p, err := LoadPolicy([]PolicySource{&fakePolicySource{policy: &Policy{
+		TunCidr:             strPtr("not a cidr"),
+		AllowedControllers:  []string{"ctrl.example.com:1280"},
+		AllowIdentityAdd:    boolPtr(false),
+		AllowIdentityRemove: boolPtr(false),
+	}}})
+	if err == nil {
+		t.Fatal("LoadPolicy() did not report the invalid TunCidr")
+	}
+	if p.CanAddIdentity() {
+		t.Error("CanAddIdentity() = true, want false")
+	}
+	if p.CanRemoveIdentity() {
+		t.Error("CanRemoveIdentity() = true, want false")
+	}
+	if p.IsControllerAllowed("https://other.example.com:1280") {
+		t.Error("IsControllerAllowed() = true for a controller not on the list")
+	}
+	if !p.IsControllerAllowed("https://ctrl.example.com:1280/edge/client/v1") {
+		t.Error("IsControllerAllowed() = false for a controller on the list")
+	}
+
+	c := &TunnelConfig{TunIpv4: "169.254.0.1", TunIpv4Mask: 16}
+	p.Apply(c)
+	if c.TunIpv4 != "169.254.0.1" || c.TunIpv4Mask != 16 {
+		t.Errorf("Apply() changed the TUN to %s/%d", c.TunIpv4, c.TunIpv4Mask)
+	}
+}
+
+func TestLoadPolicyFirstSourceWins(t *testing.T) {
+	p, err := LoadPolicy([]PolicySource{
+		&fakePolicySource{err: errors.New("access denied")},
+		&fakePolicySource{policy: &Policy{LogLevel: strPtr("debug"), AddDns: boolPtr(true)}},
+		&fakePolicySource{policy: &Policy{LogLevel: strPtr("trace"), AllowIdentityAdd: boolPtr(false)}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("LoadPolicy() error = %v, want the failing source", err)
+	}
+	if p.LogLevel == nil || *p.LogLevel != "debug" {
+		t.Errorf("LogLevel = %v, want debug", p.LogLevel)
+	}
+	if p.AddDns == nil || !*p.AddDns {
+		t.Errorf("AddDns = %v, want true", p.AddDns)
+	}
+	if p.CanAddIdentity() {
+		t.Error("CanAddIdentity() = true, want false")
+	}
+}
+
+func TestLoadPolicyAcceptsTheLogLevelsOfTheSetting(t *testing.T) {
+	setting, err := FindSetting(PolicyKeyLogLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, level := range []string{"panic", "fatal", "error", "warn", "warning", "info", "debug", "verbose", "TRACE"} {
+		p, err := LoadPolicy([]PolicySource{&fakePolicySource{policy: &Policy{LogLevel: strPtr(level)}}})
+		if err != nil {
+			t.Errorf("LoadPolicy() error = %v for LogLevel %s", err, level)
+			continue
+		}
+		c := &TunnelConfig{}
+		if err = setting.Set(c, level); err != nil {
+			t.Errorf("the LogLevel setting does not accept %s: %v", level, err)
+		}
+		if *p.LogLevel != c.LogLevel {
+			t.Errorf("policy LogLevel = %s, want %s as set by the setting", *p.LogLevel, c.LogLevel)
+		}
+	}
+}
+
+func TestPolicyFileWithoutProgramData(t *testing.T) {
+	programData, found := os.LookupEnv("ProgramData")
+	_ = os.Unsetenv("ProgramData")
+	t.Cleanup(func() {
+		if found {
+			_ = os.Setenv("ProgramData", programData)
+		}
+	})
+
+	if path := PolicyFile(); path != "" {
+		t.Fatalf("PolicyFile() = %s without ProgramData, want none", path)
+	}
+	p, err := LoadPolicy([]PolicySource{
+		&fakePolicySource{policy: &Policy{AllowIdentityAdd: boolPtr(false)}},
+		&filePolicySource{path: PolicyFile()},
+	})
+	if err == nil || !strings.Contains(err.Error(), "ProgramData") {
+		t.Errorf("LoadPolicy() error = %v, want the policy file reported missing", err)
+	}
+	if p.CanAddIdentity() {
+		t.Error("CanAddIdentity() = true, want the other sources still applied")
+	}
+}
@@ -0,0 +1,551 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/util/dnsutil"
+)
+
+const (
+	SettingDnsUpstreamMode  = "DnsUpstreamMode"
+	SettingDnsUpstreams     = "DnsUpstreams"
+	SettingDnsForwardRules  = "DnsForwardRules"
+	SettingDnsPlainFallback = "DnsPlainFallback"
+	SettingDnsLogFile       = "DnsLogFile"
+
+	SettingDnsAddressRetentionDays   = "DnsAddressRetentionDays"
+	SettingDnsSearchSuffixes         = "DnsSearchSuffixes"
+	SettingDnsHostsFile              = "DnsHostsFile"
+	SettingDnsTtlSeconds             = "DnsTtlSeconds"
+	SettingDnsInaccessibleTtlSeconds = "DnsInaccessibleTtlSeconds"
+
+	SettingServiceChangeWindowMs = "ServiceChangeWindowMs"
+)
+
+// Setting describes a single persisted value in TunnelConfig which can be read and changed by key
+type Setting struct {
+	Key         string
+	Description string
+	unset       string // the value of a setting which has never been set. such values are defaulted on startup
+	get         func(c *TunnelConfig) string
+	set         func(c *TunnelConfig, value string) error
+}
+
+var settings = []*Setting{
+	{
+		Key:         "LogLevel",
+		Description: "log level of the service. one of: trace, verbose, debug, info, warn, error, fatal, panic",
+		get:         func(c *TunnelConfig) string { return c.LogLevel },
+		set: func(c *TunnelConfig, value string) error {
+			if !isLogLevel(value) {
+				return fmt.Errorf("unknown log level: %s", value)
+			}
+			c.LogLevel = strings.ToLower(value)
+			return nil
+		},
+	},
+	{
+		Key:         "TunIpv4",
+		Description: "ipv4 address assigned to the TUN interface. also used as the ziti DNS server",
+		get:         func(c *TunnelConfig) string { return c.TunIpv4 },
+		set: func(c *TunnelConfig, value string) error {
+			ip := net.ParseIP(strings.TrimSpace(value))
+			if ip == nil || ip.To4() == nil {
+				return fmt.Errorf("not a valid ipv4 address: %s", value)
+			}
+			c.TunIpv4 = ip.To4().String()
+			return nil
+		},
+	},
+	{
+		Key:         "TunIpv4Mask",
+		Description: fmt.Sprintf("size of the TUN network in bits. between %d and %d", constants.Ipv4MaxMask, constants.Ipv4MinMask),
+		unset:       "0",
+		get:         func(c *TunnelConfig) string { return strconv.Itoa(c.TunIpv4Mask) },
+		set: func(c *TunnelConfig, value string) error {
+			mask, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return fmt.Errorf("not a number: %s", value)
+			}
+			if mask < constants.Ipv4MaxMask || mask > constants.Ipv4MinMask {
+				return fmt.Errorf("mask must be between %d and %d", constants.Ipv4MaxMask, constants.Ipv4MinMask)
+			}
+			c.TunIpv4Mask = mask
+			return nil
+		},
+	},
+	{
+		Key:         "TunIpv4Mode",
+		Description: "static to always use TunIpv4, auto to pick a network from TunCandidatePool which does not conflict with the local networks",
+		get: func(c *TunnelConfig) string {
+			if c.TunIpv4Mode == "" {
+				return constants.TunIpv4ModeStatic
+			}
+			return c.TunIpv4Mode
+		},
+		set: func(c *TunnelConfig, value string) error {
+			switch strings.ToLower(strings.TrimSpace(value)) {
+			case constants.TunIpv4ModeStatic, constants.TunIpv4ModeAuto:
+				c.TunIpv4Mode = strings.ToLower(strings.TrimSpace(value))
+				return nil
+			}
+			return fmt.Errorf("must be %s or %s", constants.TunIpv4ModeStatic, constants.TunIpv4ModeAuto)
+		},
+	},
+	{
+		Key:         "TunCandidatePool",
+		Description: "comma separated list of ipv4 networks searched in order when TunIpv4Mode is auto",
+		get:         func(c *TunnelConfig) string { return strings.Join(c.CandidatePool(), ",") },
+		set: func(c *TunnelConfig, value string) error {
+			pool := make([]string, 0)
+			for _, cidr := range strings.Split(value, ",") {
+				cidr = strings.TrimSpace(cidr)
+				if cidr == "" {
+					continue
+				}
+				_, ipnet, err := net.ParseCIDR(cidr)
+				if err != nil || ipnet.IP.To4() == nil {
+					return fmt.Errorf("not a valid ipv4 network: %s", cidr)
+				}
+				pool = append(pool, ipnet.String())
+			}
+			if len(pool) == 0 {
+				return fmt.Errorf("at least one network is required")
+			}
+			c.TunCandidatePool = pool
+			return nil
+		},
+	},
+	{
+		Key:         SettingDnsUpstreamMode,
+		Description: "how queries are sent to the upstream DNS servers. one of: race (all at once, first answer wins), sequential (in order with failover), roundrobin",
+		get: func(c *TunnelConfig) string {
+			if c.DnsUpstreamMode == "" {
+				return constants.DnsUpstreamModeRace
+			}
+			return c.DnsUpstreamMode
+		},
+		set: func(c *TunnelConfig, value string) error {
+			switch strings.ToLower(strings.TrimSpace(value)) {
+			case constants.DnsUpstreamModeRace, constants.DnsUpstreamModeSequential, constants.DnsUpstreamModeRoundRobin:
+				c.DnsUpstreamMode = strings.ToLower(strings.TrimSpace(value))
+				return nil
+			}
+			return fmt.Errorf("must be one of %s, %s or %s", constants.DnsUpstreamModeRace, constants.DnsUpstreamModeSequential, constants.DnsUpstreamModeRoundRobin)
+		},
+	},
+	{
+		Key:         SettingDnsUpstreams,
+		Description: "comma separated list of upstream DNS servers used instead of the servers of the local interfaces. ip[:port], tls://host[:port] or https://host/path. empty to detect them",
+		get:         func(c *TunnelConfig) string { return strings.Join(c.DnsUpstreams, ",") },
+		set: func(c *TunnelConfig, value string) error {
+			servers, err := parseDnsServers(value)
+			if err != nil {
+				return err
+			}
+			c.DnsUpstreams = servers
+			return nil
+		},
+	},
+	{
+		Key:         SettingDnsForwardRules,
+		Description: "semicolon separated list of suffix=server[,server] rules sending names below the suffix to the given DNS servers. e.g. lab.local=10.0.0.53",
+		get: func(c *TunnelConfig) string {
+			rules := make([]string, 0, len(c.DnsForwardRules))
+			for _, r := range c.DnsForwardRules {
+				rules = append(rules, r.Suffix+"="+strings.Join(r.Servers, ","))
+			}
+			return strings.Join(rules, ";")
+		},
+		set: func(c *TunnelConfig, value string) error {
+			rules := make([]DnsForwardRule, 0)
+			seen := make(map[string]bool)
+			for _, rule := range strings.Split(value, ";") {
+				if strings.TrimSpace(rule) == "" {
+					continue
+				}
+				parts := strings.SplitN(rule, "=", 2)
+				if len(parts) != 2 {
+					return fmt.Errorf("rule must be suffix=servers: %s", rule)
+				}
+				suffix := strings.ToLower(strings.Trim(strings.TrimPrefix(strings.TrimSpace(parts[0]), "*"), "."))
+				if suffix == "" || strings.ContainsAny(suffix, " *") {
+					return fmt.Errorf("not a valid suffix: %s", parts[0])
+				}
+				if seen[suffix] {
+					return fmt.Errorf("more than one rule for %s", suffix)
+				}
+				seen[suffix] = true
+				servers, err := parseDnsServers(parts[1])
+				if err != nil {
+					return err
+				}
+				if len(servers) == 0 {
+					return fmt.Errorf("no servers given for %s", suffix)
+				}
+				rules = append(rules, DnsForwardRule{Suffix: suffix, Servers: servers})
+			}
+			c.DnsForwardRules = rules
+			return nil
+		},
+	},
+	{
+		Key:         SettingDnsPlainFallback,
+		Description: "send queries in plain text to the DNS servers of the local interfaces when every encrypted upstream fails",
+		get:         func(c *TunnelConfig) string { return strconv.FormatBool(c.DnsPlainFallback) },
+		set: func(c *TunnelConfig, value string) error {
+			b, err := strconv.ParseBool(strings.TrimSpace(value))
+			if err != nil {
+				return fmt.Errorf("not a boolean: %s", value)
+			}
+			c.DnsPlainFallback = b
+			return nil
+		},
+	},
+	{
+		Key:         SettingDnsLogFile,
+		Description: "file every DNS query is appended to as a json line. empty to only keep recent queries in memory",
+		get:         func(c *TunnelConfig) string { return c.DnsLogFile },
+		set: func(c *TunnelConfig, value string) error {
+			value = strings.TrimSpace(value)
+			if value != "" && !filepath.IsAbs(value) {
+				return fmt.Errorf("must be an absolute path: %s", value)
+			}
+			c.DnsLogFile = value
+			return nil
+		},
+	},
+	{
+		Key:         SettingDnsAddressRetentionDays,
+		Description: "days the address of a hostname which is no longer intercepted is kept so it gets the same address when it comes back. 0 for the default of 30",
+		unset:       "0",
+		get:         func(c *TunnelConfig) string { return strconv.Itoa(c.DnsAddressRetentionDays) },
+		set: func(c *TunnelConfig, value string) error {
+			days, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || days < 0 {
+				return fmt.Errorf("not a number of days: %s", value)
+			}
+			c.DnsAddressRetentionDays = days
+			return nil
+		},
+	},
+	{
+		Key:         SettingDnsTtlSeconds,
+		Description: "seconds clients may cache the answers for intercepted names. a service can set its own with the ttl of its ziti-dns-records.v1 config. 0 for the default of 60",
+		unset:       "0",
+		get:         func(c *TunnelConfig) string { return strconv.Itoa(c.DnsTtlSeconds) },
+		set: func(c *TunnelConfig, value string) error {
+			seconds, err := parseTtl(value)
+			if err != nil {
+				return err
+			}
+			c.DnsTtlSeconds = seconds
+			return nil
+		},
+	},
+	{
+		Key:         SettingDnsInaccessibleTtlSeconds,
+		Description: "seconds clients may cache the answers for intercepted names whose services all fail their posture checks. 0 for the default of 5",
+		unset:       "0",
+		get:         func(c *TunnelConfig) string { return strconv.Itoa(c.DnsInaccessibleTtlSeconds) },
+		set: func(c *TunnelConfig, value string) error {
+			seconds, err := parseTtl(value)
+			if err != nil {
+				return err
+			}
+			c.DnsInaccessibleTtlSeconds = seconds
+			return nil
+		},
+	},
+	{
+		Key:         SettingDnsSearchSuffixes,
+		Description: "comma separated DNS suffixes removed from queries before looking up intercepted names. searched before the suffixes of the local interfaces",
+		get:         func(c *TunnelConfig) string { return strings.Join(c.DnsSearchSuffixes, ",") },
+		set: func(c *TunnelConfig, value string) error {
+			suffixes, err := parseDomains(value)
+			if err != nil {
+				return err
+			}
+			c.DnsSearchSuffixes = suffixes
+			return nil
+		},
+	},
+	{
+		Key:         SettingDnsHostsFile,
+		Description: "write the intercepted hostnames to the hosts file. one of: off, auto (only when NRPT rules are not effective), always",
+		get: func(c *TunnelConfig) string {
+			if c.DnsHostsFile == "" {
+				return constants.DnsHostsFileOff
+			}
+			return c.DnsHostsFile
+		},
+		set: func(c *TunnelConfig, value string) error {
+			switch strings.ToLower(strings.TrimSpace(value)) {
+			case constants.DnsHostsFileOff, constants.DnsHostsFileAuto, constants.DnsHostsFileAlways:
+				c.DnsHostsFile = strings.ToLower(strings.TrimSpace(value))
+				return nil
+			}
+			return fmt.Errorf("must be one of %s, %s or %s", constants.DnsHostsFileOff, constants.DnsHostsFileAuto, constants.DnsHostsFileAlways)
+		},
+	},
+	{
+		Key:         PolicyKeyDnsBlocklists,
+		Description: "comma separated absolute paths of blocklists in hosts or domain list format. names on them, and every name below them, are blocked unless intercepted",
+		get:         func(c *TunnelConfig) string { return strings.Join(c.DnsBlocklists, ",") },
+		set: func(c *TunnelConfig, value string) error {
+			paths := make([]string, 0)
+			for _, p := range strings.Split(value, ",") {
+				p = strings.TrimSpace(p)
+				if p == "" {
+					continue
+				}
+				if !filepath.IsAbs(p) {
+					return fmt.Errorf("must be an absolute path: %s", p)
+				}
+				paths = append(paths, p)
+			}
+			c.DnsBlocklists = paths
+			return nil
+		},
+	},
+	{
+		Key:         PolicyKeyDnsAllowlist,
+		Description: "comma separated domains which are never blocked, including every name below them",
+		get:         func(c *TunnelConfig) string { return strings.Join(c.DnsAllowlist, ",") },
+		set: func(c *TunnelConfig, value string) error {
+			domains, err := parseDomains(value)
+			if err != nil {
+				return err
+			}
+			c.DnsAllowlist = domains
+			return nil
+		},
+	},
+	{
+		Key:         PolicyKeyDnsBlockMode,
+		Description: "how blocked names are answered. one of: nxdomain, zero (0.0.0.0 and ::)",
+		get: func(c *TunnelConfig) string {
+			if c.DnsBlockMode == "" {
+				return constants.DnsBlockModeNxdomain
+			}
+			return c.DnsBlockMode
+		},
+		set: func(c *TunnelConfig, value string) error {
+			switch strings.ToLower(strings.TrimSpace(value)) {
+			case constants.DnsBlockModeNxdomain, constants.DnsBlockModeZero:
+				c.DnsBlockMode = strings.ToLower(strings.TrimSpace(value))
+				return nil
+			}
+			return fmt.Errorf("must be one of %s or %s", constants.DnsBlockModeNxdomain, constants.DnsBlockModeZero)
+		},
+	},
+	{
+		Key:         SettingServiceChangeWindowMs,
+		Description: "milliseconds service changes of every identity are collected before they are applied together. 0 for the default of 250",
+		unset:       "0",
+		get:         func(c *TunnelConfig) string { return strconv.Itoa(c.ServiceChangeWindowMs) },
+		set: func(c *TunnelConfig, value string) error {
+			ms, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || ms < 0 || ms > 10000 {
+				return fmt.Errorf("must be a number of milliseconds from 0 to 10000: %s", value)
+			}
+			c.ServiceChangeWindowMs = ms
+			return nil
+		},
+	},
+	{
+		Key:         "AddDns",
+		Description: "assign the ziti DNS server to the TUN interface in addition to using NRPT rules",
+		get:         func(c *TunnelConfig) string { return strconv.FormatBool(c.AddDns) },
+		set: func(c *TunnelConfig, value string) error {
+			b, err := strconv.ParseBool(strings.TrimSpace(value))
+			if err != nil {
+				return fmt.Errorf("not a boolean: %s", value)
+			}
+			c.AddDns = b
+			return nil
+		},
+	},
+}
+
+// isLogLevel reports if the service accepts the log level, in any case
+func isLogLevel(value string) bool {
+	switch strings.ToLower(value) {
+	case "panic", "fatal", "error", "warn", "warning", "info", "debug", "verbose", "trace":
+		return true
+	}
+	return false
+}
+
+// DefaultTunCandidatePool is searched in auto mode when no pool is configured. The carrier-grade NAT range comes first
+// to match the static default, followed by the benchmarking range which is rarely in use on real networks
+var DefaultTunCandidatePool = []string{"100.64.0.0/10", "198.18.0.0/15"}
+
+// CandidatePool returns the configured candidate pool or DefaultTunCandidatePool when none is configured
+func (c *TunnelConfig) CandidatePool() []string {
+	if len(c.TunCandidatePool) == 0 {
+		return DefaultTunCandidatePool
+	}
+	return c.TunCandidatePool
+}
+
+// IsAutoTunIpv4 reports if the TUN network is chosen automatically
+func (c *TunnelConfig) IsAutoTunIpv4() bool {
+	return c.TunIpv4Mode == constants.TunIpv4ModeAuto
+}
+
+// parseDnsServers reads a comma separated list of upstream DNS servers and returns them in their canonical form. See
+// dnsutil.ParseUpstream for the accepted forms
+func parseDnsServers(value string) ([]string, error) {
+	servers := make([]string, 0)
+	for _, s := range strings.Split(value, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		up, err := dnsutil.ParseUpstream(s)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, up.String())
+	}
+	return servers, nil
+}
+
+// parseDomains reads a comma separated list of domains. The domains are returned in lower case without leading or
+// trailing periods
+func parseDomains(value string) ([]string, error) {
+	domains := make([]string, 0)
+	for _, s := range strings.Split(value, ",") {
+		s = strings.ToLower(strings.Trim(strings.TrimSpace(s), "."))
+		if s == "" {
+			continue
+		}
+		if strings.ContainsAny(s, " *") {
+			return nil, fmt.Errorf("not a valid domain: %s", s)
+		}
+		domains = append(domains, s)
+	}
+	return domains, nil
+}
+
+// DnsAddressRetention returns how long unused intercept addresses are kept. 0 when the default is used
+func (c *TunnelConfig) DnsAddressRetention() time.Duration {
+	return time.Duration(c.DnsAddressRetentionDays) * 24 * time.Hour
+}
+
+// the longest ttl accepted for DNS answers: one day
+const maxDnsTtlSeconds = 24 * 60 * 60
+
+// parseTtl reads a number of seconds a DNS answer may be cached for
+func parseTtl(value string) (int, error) {
+	seconds, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || seconds < 0 || seconds > maxDnsTtlSeconds {
+		return 0, fmt.Errorf("not a number of seconds between 0 and %d: %s", maxDnsTtlSeconds, value)
+	}
+	return seconds, nil
+}
+
+// DnsTtl returns the ttl of the answers for intercepted names. 0 when the default is used
+func (c *TunnelConfig) DnsTtl() time.Duration {
+	return time.Duration(c.DnsTtlSeconds) * time.Second
+}
+
+// DnsInaccessibleTtl returns the ttl of the answers for names no accessible service intercepts. 0 when the default is
+// used
+func (c *TunnelConfig) DnsInaccessibleTtl() time.Duration {
+	return time.Duration(c.DnsInaccessibleTtlSeconds) * time.Second
+}
+
+// DefaultServiceChangeWindow is how long service changes are collected when ServiceChangeWindowMs is not set
+const DefaultServiceChangeWindow = 250 * time.Millisecond
+
+// ServiceChangeWindow returns how long service changes are collected before they are applied together
+func (c *TunnelConfig) ServiceChangeWindow() time.Duration {
+	if c.ServiceChangeWindowMs <= 0 {
+		return DefaultServiceChangeWindow
+	}
+	return time.Duration(c.ServiceChangeWindowMs) * time.Millisecond
+}
+
+// DnsForwardRuleMap returns the servers of every forwarding rule keyed by suffix
+func (c *TunnelConfig) DnsForwardRuleMap() map[string][]string {
+	rules := make(map[string][]string)
+	for _, r := range c.DnsForwardRules {
+		rules[r.Suffix] = r.Servers
+	}
+	return rules
+}
+
+// Settings returns every setting which can be read or changed by key
+func Settings() []*Setting {
+	return settings
+}
+
+// FindSetting looks up a setting by its key. Keys are not case sensitive
+func FindSetting(key string) (*Setting, error) {
+	for _, s := range settings {
+		if strings.EqualFold(s.Key, strings.TrimSpace(key)) {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown config key: %s", key)
+}
+
+func (s *Setting) Get(c *TunnelConfig) string {
+	return s.get(c)
+}
+
+// Set validates the value and stores it into the config. The config is unchanged when an error is returned
+func (s *Setting) Set(c *TunnelConfig, value string) error {
+	if err := s.set(c, value); err != nil {
+		return fmt.Errorf("invalid value for %s: %v", s.Key, err)
+	}
+	return nil
+}
+
+// Validate checks every setting in the config. Unset values are allowed as defaults are applied on startup
+func (c *TunnelConfig) Validate() error {
+	var errs []string
+	for _, s := range settings {
+		v := s.Get(c)
+		if v == "" || v == s.unset {
+			continue
+		}
+		scratch := *c
+		if err := s.Set(&scratch, v); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for i, id := range c.Identities {
+		if id == nil || strings.TrimSpace(id.FingerPrint) == "" {
+			errs = append(errs, fmt.Sprintf("identity at index %d has no fingerprint", i))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package config
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// TunnelConfig is what gets persisted to config.json. It deliberately holds only the settings which need to survive a
+// restart. Runtime values such as uptime, metrics and the services of an identity belong in dto.TunnelStatus.
+type TunnelConfig struct {
+	SchemaVersion int
+	Identities    []*IdentityConfig
+	LogLevel      string
+	TunIpv4       string
+	TunIpv4Mask   int
+	AddDns        bool
+
+	// TunIpv4Mode is either TunIpv4ModeStatic or TunIpv4ModeAuto. In auto mode TunIpv4 and TunIpv4Mask hold the last
+	// network chosen from TunCandidatePool
+	TunIpv4Mode      string   `json:",omitempty"`
+	TunCandidatePool []string `json:",omitempty"`
+
+	DnsUpstreamMode string `json:",omitempty"`
+	// DnsUpstreams replaces the DNS servers detected on the local interfaces when set
+	DnsUpstreams    []string         `json:",omitempty"`
+	DnsForwardRules []DnsForwardRule `json:",omitempty"`
+	// DnsPlainFallback allows plain DNS to the servers of the local interfaces when every encrypted upstream fails
+	DnsPlainFallback bool `json:",omitempty"`
+	// DnsLogFile receives every DNS query as a json line when set
+	DnsLogFile string `json:",omitempty"`
+	// DnsAddressRetentionDays is how long the address of a hostname which is no longer intercepted is kept. 0 for the
+	// default
+	DnsAddressRetentionDays int `json:",omitempty"`
+	// DnsTtlSeconds is how long clients may cache the answers for intercepted names. 0 for the default
+	DnsTtlSeconds int `json:",omitempty"`
+	// DnsInaccessibleTtlSeconds is the ttl used instead when every service intercepting a name fails its posture
+	// checks, so clients ask again soon after the checks pass. 0 for the default
+	DnsInaccessibleTtlSeconds int `json:",omitempty"`
+	// DnsSearchSuffixes are searched before the suffixes detected on the local interfaces
+	DnsSearchSuffixes []string `json:",omitempty"`
+	// DnsHostsFile is one of DnsHostsFileOff, DnsHostsFileAuto or DnsHostsFileAlways. When in use the intercepted
+	// hostnames are written to the hosts file as well
+	DnsHostsFile string `json:",omitempty"`
+	// DnsBlocklists are files in hosts or domain list format. Names on them which are not intercepted are answered
+	// as DnsBlockMode says instead of being sent to the upstream DNS
+	DnsBlocklists []string `json:",omitempty"`
+	// DnsAllowlist holds domains which are never blocked, even when a blocklist has them
+	DnsAllowlist []string `json:",omitempty"`
+	// DnsBlockMode is either DnsBlockModeNxdomain or DnsBlockModeZero
+	DnsBlockMode string `json:",omitempty"`
+
+	// ServiceChangeWindowMs is how long service changes are collected before they are applied together. 0 for the
+	// default
+	ServiceChangeWindowMs int `json:",omitempty"`
+}
+
+// DnsForwardRule sends queries for names at or below Suffix to Servers instead of the default upstream DNS
+type DnsForwardRule struct {
+	Suffix  string
+	Servers []string
+}
+
+type IdentityConfig struct {
+	Name        string
+	FingerPrint string
+	Active      bool
+	ZtAPI       string
+}
+
+func NewTunnelConfig() *TunnelConfig {
+	return &TunnelConfig{
+		SchemaVersion: SchemaVersion,
+		Identities:    make([]*IdentityConfig, 0),
+	}
+}
+
+// Read loads the config file at the given location, migrating it to the current SchemaVersion if needed. The version
+// the file was found in is returned so the caller can decide whether to persist the upgraded config.
+func Read(filename string) (*TunnelConfig, int, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	if info.Size() == 0 {
+		return nil, 0, fmt.Errorf("the config file at contains no bytes and is considered invalid: %s", filename)
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unexpected error opening config file: %v", err)
+	}
+	return Parse(b)
+}
+
+// Parse decodes a config document of any known schema version and migrates it to the current SchemaVersion
+func Parse(b []byte) (*TunnelConfig, int, error) {
+	raw := make(map[string]interface{})
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, 0, fmt.Errorf("unexpected error reading config file: %v", err)
+	}
+
+	from := schemaVersionOf(raw)
+	if err := migrate(raw, from); err != nil {
+		return nil, from, err
+	}
+
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, from, fmt.Errorf("unexpected error encoding migrated config: %v", err)
+	}
+	cfg := NewTunnelConfig()
+	if err = json.Unmarshal(migrated, cfg); err != nil {
+		return nil, from, fmt.Errorf("unexpected error reading migrated config: %v", err)
+	}
+	if cfg.Identities == nil {
+		cfg.Identities = make([]*IdentityConfig, 0)
+	}
+	return cfg, from, nil
+}
+
+// Write encodes the config as indented json
+func (c *TunnelConfig) Write(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return w.Flush()
+}
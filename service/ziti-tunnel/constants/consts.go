@@ -22,4 +22,18 @@ const (
 	Ipv4MaxMask     = 8
 	Ipv4MinMask     = 16
 	Ipv4DefaultMask = 10
+
+	TunIpv4ModeStatic = "static"
+	TunIpv4ModeAuto   = "auto"
+
+	DnsUpstreamModeSequential = "sequential"
+	DnsUpstreamModeRace       = "race"
+	DnsUpstreamModeRoundRobin = "roundrobin"
+
+	DnsHostsFileOff    = "off"
+	DnsHostsFileAuto   = "auto"
+	DnsHostsFileAlways = "always"
+
+	DnsBlockModeNxdomain = "nxdomain"
+	DnsBlockModeZero     = "zero"
 )
@@ -39,6 +39,13 @@ type IdentityOnOffPayload struct {
 	Fingerprint string
 }
 
+type ConfigEntry struct {
+	Key           string
+	Value         string
+	Description   string
+	PolicyManaged bool
+}
+
 type MonitorServiceResponse struct {
 	Code    int
 	Message string
@@ -19,6 +19,7 @@ package dto
 
 import (
 	"log"
+	"time"
 
 	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
 	idcfg "github.com/openziti/sdk-golang/ziti/config"
@@ -120,6 +121,11 @@ type TunnelStatus struct {
 	TunIpv4Mask    int
 	Status         string
 	AddDns         bool
+	PolicyManaged  []string       `json:",omitempty"`
+	DnsCache       *DnsCacheStats `json:",omitempty"`
+	DnsUpstreams   []DnsUpstream  `json:",omitempty"`
+
+	InterceptAddresses *InterceptAddressStats `json:",omitempty"`
 }
 
 type ServiceVersion struct {
@@ -153,11 +159,21 @@ type MetricsEvent struct {
 	Identities []*Identity
 }
 
+// BulkServiceEvent announces the services added and removed by every identity within the coalescing window. Fingerprint,
+// AddedServices and RemovedServices are only set when a single identity changed
 type BulkServiceEvent struct {
 	ActionEvent
 	Fingerprint     string
 	AddedServices   []*Service
 	RemovedServices []*Service
+	Identities      []ServiceChanges
+}
+
+// ServiceChanges are the services added and removed by one identity
+type ServiceChanges struct {
+	Fingerprint     string
+	AddedServices   []*Service
+	RemovedServices []*Service
 }
 
 type IdentityEvent struct {
@@ -170,6 +186,172 @@ type LogLevelEvent struct {
 	LogLevel string
 }
 
+type DnsCacheStats struct {
+	Entries int
+	Hits    uint64
+	Misses  uint64
+}
+
+// InterceptAddressStats reports the addresses of the TUN range handed out to intercepted hostnames
+type InterceptAddressStats struct {
+	PoolSize   int
+	Assigned   int      // hostnames with an address, including the ones no longer intercepted
+	Active     int      // hostnames intercepted right now
+	Exhausted  bool     // true when a hostname could not get an address
+	Unassigned []string `json:",omitempty"`
+}
+
+type DnsUpstream struct {
+	Address   string
+	Healthy   bool
+	LatencyMs int64
+	Failures  int
+	Queries   uint64
+	Errors    uint64
+}
+
+// how a DNS query was answered
+const (
+	DnsDispositionZiti    = "ziti"    // answered from the intercepted names
+	DnsDispositionProxied = "proxied" // answered by an upstream DNS
+	DnsDispositionCached  = "cached"  // answered from the upstream cache
+	DnsDispositionRefused = "refused" // a known name was asked for a type which is not answered
+	DnsDispositionExpired = "expired" // no upstream answered in time
+	DnsDispositionFailed  = "failed"  // the upstream DNS could not be reached
+	DnsDispositionBlocked = "blocked" // the name is on a blocklist
+)
+
+type DnsLogEntry struct {
+	Time        time.Time
+	Name        string
+	Type        string
+	Client      string
+	Disposition string
+	LatencyMs   float64
+}
+
+type DnsNameStats struct {
+	Name         string
+	Queries      uint64
+	Dispositions map[string]uint64
+	LastSeen     time.Time
+}
+
+type DnsLog struct {
+	Entries []DnsLogEntry
+	Names   []DnsNameStats
+}
+
+// the stage of the ziti DNS which answered a query
+const (
+	DnsStageRecords    = "records"                // a PTR for the TUN range or a record supplied by a service
+	DnsStageZiti       = "ziti"                   // an intercepted name
+	DnsStageZitiSuffix = "ziti-connection-suffix" // an intercepted name once the connection-specific suffix is removed
+	DnsStageCache      = "cache"                  // the upstream cache
+	DnsStageUpstream   = "upstream"               // an upstream DNS
+	DnsStageBlocklist  = "blocklist"              // a blocklist
+)
+
+type DnsOwner struct {
+	Service     string
+	ServiceId   string
+	Identity    string
+	FingerPrint string
+	Address     string
+}
+
+type DnsResolution struct {
+	Name             string
+	Type             string
+	Stage            string
+	Rcode            string
+	Answers          []string
+	IPs              []string
+	Upstream         string `json:",omitempty"`
+	Blocklist        string `json:",omitempty"`
+	Error            string `json:",omitempty"`
+	LatencyMs        float64
+	Owners           []DnsOwner
+	NrptNamespace    string
+	NrptServers      []string
+	NrptRoutesToZiti bool
+	NrptError        string `json:",omitempty"`
+}
+
+type TunReconfigureEvent struct {
+	ActionEvent
+	Step        string
+	TunIpv4     string
+	TunIpv4Mask int
+	AddDns      bool
+	Error       string
+}
+
+// NrptDriftEvent is sent when NRPT rules were found missing or no longer needed and have been repaired
+type NrptDriftEvent struct {
+	ActionEvent
+	Desired int // rules the tunnel needs
+	Missing int // rules added again, including rules pointing at another DNS server
+	Stale   int // rules removed as no hostname or domain needs them
+	Failed  int // rules which could not be repaired
+}
+
+// DnsBlocklistStats describes one blocklist file and how often it blocked a query since the service started
+type DnsBlocklistStats struct {
+	Name     string
+	Path     string
+	Domains  int
+	Hits     uint64
+	LastHit  time.Time `json:",omitempty"`
+	LoadedAt time.Time
+	Error    string `json:",omitempty"` // why the last load failed. the domains of the load before are still blocked
+}
+
+// DnsBlocklistStatus is the state of the blocklists of the ziti DNS
+type DnsBlocklistStatus struct {
+	Mode      string
+	Allowlist []string
+	Lists     []DnsBlocklistStats
+}
+
+// DnsBlocklistEvent is sent when lists blocked queries since the last event and when the lists were reloaded
+type DnsBlocklistEvent struct {
+	ActionEvent
+	Lists []DnsBlocklistStats
+}
+
+// ConsistencyReport lists every divergence found between the services of the active identities, the hostnames the
+// ziti DNS resolves and the NRPT rules. Changes which are still pending show up as divergences until they are applied
+type ConsistencyReport struct {
+	Consistent     bool
+	PendingChanges int // service changes received but not applied yet
+	Identities     int
+	Services       int
+	Hostnames      int
+	NrptRules      int
+	NrptError      string `json:",omitempty"`
+	Divergences    []Divergence
+}
+
+// Divergence is a single difference found by the consistency check
+type Divergence struct {
+	Kind        string
+	Name        string
+	FingerPrint string `json:",omitempty"`
+	Detail      string
+}
+
+const (
+	DivergenceDnsMissing      = "dns_missing"       // a service intercepts the hostname but the DNS does not count it for the identity
+	DivergenceDnsStale        = "dns_stale"         // the DNS counts the hostname for an identity none of whose services intercepts it
+	DivergenceDnsCount        = "dns_count"         // the DNS counts the hostname for a different number of services
+	DivergenceUnresolved      = "unresolved"        // the hostname is intercepted but the DNS has no address for it
+	DivergenceResolverStale   = "resolver_stale"    // the DNS resolves the hostname although no service intercepts it
+	DivergenceNrptMissing     = "nrpt_missing"      // no NRPT rule sends the namespace to the ziti DNS
+	DivergenceNrptWrongServer = "nrpt_wrong_server" // the NRPT rule of the namespace points at another DNS server
+	DivergenceNrptStale       = "nrpt_stale"        // an NRPT rule of the tunnel which no namespace needs
+)
+
 type MfaEvent struct {
 	ActionEvent
 	Fingerprint     string
@@ -33,12 +33,24 @@ const (
 	LOGLEVEL_OP     = "logLevel"
 	FEEDBACK_OP     = "CaptureLogs"
 	MFA_OP          = "mfa"
+	TUN_OP          = "tun"
+	DNS_OP          = "dns"
 
 	MFAEnrollmentChallengAtion      = "enrollment_challenge"
 	MFAEnrollmentVerificationAction = "enrollment_verification"
 	MFAEnrollmentRemovedAction      = "enrollment_remove"
 
 	MFA_AUTH_CHALLENGE_ACTION = "auth_challenge"
+
+	TunReconfigureProgressAction = "reconfigure_progress"
+	TunReconfigureCompleteAction = "reconfigure_complete"
+	TunReconfigureRollbackAction = "reconfigure_rollback"
+	TunReconfigureFailedAction   = "reconfigure_failed"
+
+	NrptDriftAction = "nrpt_drift"
+
+	DnsBlocklistHitsAction     = "blocklist_hits"
+	DnsBlocklistReloadedAction = "blocklist_reloaded"
 )
 
 var SERVICE_ADDED = ActionEvent{
@@ -106,3 +118,35 @@ var MFAAuthChallengeEvent = ActionEvent{
 	StatusEvent: StatusEvent{Op: MFA_OP},
 	Action:      MFA_AUTH_CHALLENGE_ACTION,
 }
+
+var TunReconfigureProgressEvent = ActionEvent{
+	StatusEvent: StatusEvent{Op: TUN_OP},
+	Action:      TunReconfigureProgressAction,
+}
+var TunReconfigureCompleteEvent = ActionEvent{
+	StatusEvent: StatusEvent{Op: TUN_OP},
+	Action:      TunReconfigureCompleteAction,
+}
+var TunReconfigureRollbackEvent = ActionEvent{
+	StatusEvent: StatusEvent{Op: TUN_OP},
+	Action:      TunReconfigureRollbackAction,
+}
+var TunReconfigureFailedEvent = ActionEvent{
+	StatusEvent: StatusEvent{Op: TUN_OP},
+	Action:      TunReconfigureFailedAction,
+}
+
+var NrptDriftDetectedEvent = ActionEvent{
+	StatusEvent: StatusEvent{Op: DNS_OP},
+	Action:      NrptDriftAction,
+}
+
+var DnsBlocklistHitsEvent = ActionEvent{
+	StatusEvent: StatusEvent{Op: DNS_OP},
+	Action:      DnsBlocklistHitsAction,
+}
+
+var DnsBlocklistReloadedEvent = ActionEvent{
+	StatusEvent: StatusEvent{Op: DNS_OP},
+	Action:      DnsBlocklistReloadedAction,
+}
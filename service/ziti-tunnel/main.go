@@ -113,6 +113,8 @@ func main() {
 		commandline.Execute()
 	case "config":
 		commandline.Execute()
+	case "dns":
+		commandline.Execute()
 	default:
 		usage(fmt.Sprintf("invalid command %s", cmd))
 	}
@@ -128,7 +130,7 @@ func usage(errmsg string) {
 		"%s\n\n"+
 			"usage: %s <command>\n"+
 			"       where <command> is one of\n"+
-			"       install, remove, debug, start, stop, pause, continue, list, identity, loglevel, feedback, config or version.\n",
+			"       install, remove, debug, start, stop, pause, continue, list, identity, loglevel, feedback, config, dns or version.\n",
 		errmsg, os.Args[0])
 	os.Exit(2)
 }
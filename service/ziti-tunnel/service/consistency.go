@@ -0,0 +1,50 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+// checkConsistency answers the CheckConsistency command with every divergence between the services of the active
+// identities, the ziti DNS and the NRPT rules
+func checkConsistency(out *json.Encoder) {
+	ids := make([]*cziti.ZIdentity, 0, len(rts.ids))
+	for _, id := range rts.ids {
+		if id.Active && id.CId != nil {
+			ids = append(ids, id.CId)
+		}
+	}
+	report := cziti.CheckConsistency(ids)
+	report.PendingChanges += int(atomic.LoadInt32(&batchedServiceChanges))
+
+	msg := "no divergence found"
+	if !report.Consistent {
+		msg = fmt.Sprintf("%d divergence(s) found", len(report.Divergences))
+		log.Warnf("consistency check: %s. pending service changes: %d", msg, report.PendingChanges)
+		for _, d := range report.Divergences {
+			log.Infof("consistency check: %s %s %s: %s", d.Kind, d.Name, d.FingerPrint, d.Detail)
+		}
+	}
+	respond(out, dto.Response{Message: msg, Code: SUCCESS, Error: "", Payload: report})
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+// DnsBlocklistInterval is how often the blocklist files are checked for changes and the hits since the last check
+// are sent to the UI
+const DnsBlocklistInterval = 10 * time.Second
+
+func runDnsBlocklistMonitor() {
+	ticker := time.NewTicker(DnsBlocklistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+			if cziti.ReloadDnsBlocklists(false) {
+				broadcastDnsBlocklists(dto.DnsBlocklistReloadedEvent, cziti.GetDnsBlocklists().Lists)
+			}
+			if hits := cziti.DnsBlocklistHits(); len(hits) > 0 {
+				broadcastDnsBlocklists(dto.DnsBlocklistHitsEvent, hits)
+			}
+		}
+	}
+}
+
+// applyDnsBlocklists hands the blocklist settings to the DNS server and tells the UI about the lists now in use
+func applyDnsBlocklists() {
+	cfg := rts.currentConfig()
+	status := cziti.SetDnsBlocklists(cfg.DnsBlocklists, cfg.DnsAllowlist, cfg.DnsBlockMode)
+	broadcastDnsBlocklists(dto.DnsBlocklistReloadedEvent, status.Lists)
+}
+
+// getDnsBlocklists answers the GetDnsBlocklists command. reload reads every list file again first
+func getDnsBlocklists(out *json.Encoder, reload bool) {
+	if reload && cziti.ReloadDnsBlocklists(true) {
+		broadcastDnsBlocklists(dto.DnsBlocklistReloadedEvent, cziti.GetDnsBlocklists().Lists)
+	}
+	respond(out, dto.Response{Message: "DNS blocklists", Code: SUCCESS, Error: "", Payload: cziti.GetDnsBlocklists()})
+}
+
+func broadcastDnsBlocklists(action dto.ActionEvent, lists []dto.DnsBlocklistStats) {
+	rts.BroadcastEvent(dto.DnsBlocklistEvent{
+		ActionEvent: action,
+		Lists:       lists,
+	})
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+// resolveDns answers the ResolveDns command with how the ziti DNS server resolves the name and which services own it
+func resolveDns(out *json.Encoder, name string, qtype string) {
+	result, err := cziti.ResolveDiagnostic(name, qtype)
+	if err != nil {
+		respondWithError(out, "could not resolve "+name, UNKNOWN_ERROR, err)
+		return
+	}
+	result.Owners = hostnameOwners(result.Name, result.Stage == dto.DnsStageZitiSuffix)
+	respond(out, dto.Response{Message: "resolved " + result.Name, Code: SUCCESS, Error: "", Payload: result})
+}
+
+// hostnameOwners finds every service of every identity intercepting the name. withSuffix also matches names followed
+// by a connection-specific suffix
+func hostnameOwners(name string, withSuffix bool) []dto.DnsOwner {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	owners := make([]dto.DnsOwner, 0)
+	for _, id := range rts.ids {
+		if id.CId == nil {
+			continue
+		}
+		id.CId.Services.Range(func(key interface{}, value interface{}) bool {
+			svc := value.(*cziti.ZService).Service
+			if svc == nil {
+				return true
+			}
+			for _, addr := range svc.Addresses {
+				if addr.IsHost && hostnameMatches(name, addr.HostName, withSuffix) {
+					owners = append(owners, dto.DnsOwner{
+						Service:     svc.Name,
+						ServiceId:   svc.Id,
+						Identity:    id.Name,
+						FingerPrint: id.FingerPrint,
+						Address:     addr.HostName,
+					})
+				}
+			}
+			return true
+		})
+	}
+	return owners
+}
+
+func hostnameMatches(name string, host string, withSuffix bool) bool {
+	host = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), "."))
+	if strings.HasPrefix(host, "*.") || strings.HasPrefix(host, ".") {
+		return strings.HasSuffix(name, "."+strings.TrimLeft(host, "*."))
+	}
+	return name == host || (withSuffix && strings.HasPrefix(name, host+"."))
+}
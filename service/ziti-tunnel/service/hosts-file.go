@@ -0,0 +1,88 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"sync"
+
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/windns"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+)
+
+// hostsFile tracks the hosts file fallback. Some machines ignore both the NRPT rules and the DNS server of the TUN,
+// the hosts file is then the only way left to resolve intercepted hostnames
+var hostsFile = struct {
+	sync.Mutex
+	// the result of the NRPT test when the TUN was last configured
+	nrptEffective bool
+	// the managed block is present in the hosts file
+	written bool
+}{nrptEffective: true}
+
+// setNrptEffective records the result of the NRPT test. In auto mode the hosts file is used when the test failed
+func setNrptEffective(effective bool) {
+	hostsFile.Lock()
+	hostsFile.nrptEffective = effective
+	hostsFile.Unlock()
+}
+
+// hostsFileWanted reports if the intercepted hostnames belong in the hosts file for the given mode. must hold the lock
+func hostsFileWanted(mode string) bool {
+	switch mode {
+	case constants.DnsHostsFileAlways:
+		return true
+	case constants.DnsHostsFileAuto:
+		return !hostsFile.nrptEffective
+	}
+	return false
+}
+
+// updateHostsFile writes the intercepted hostnames to the managed block of the hosts file when the fallback is in use
+// and removes the block when it is not. mode is the DnsHostsFile setting
+func updateHostsFile(mode string) {
+	hostsFile.Lock()
+	defer hostsFile.Unlock()
+
+	wanted := hostsFileWanted(mode)
+	if !wanted && !hostsFile.written {
+		return
+	}
+	var entries map[string]string
+	if wanted {
+		entries = cziti.HostsEntries()
+	}
+	if err := windns.WriteHostsEntries(windns.HostsFile(), entries); err != nil {
+		log.Errorf("could not update the hosts file: %v", err)
+		return
+	}
+	hostsFile.written = wanted
+}
+
+// removeHostsFile removes the managed block from the hosts file, including a block left behind when the service was
+// not stopped cleanly
+func removeHostsFile() {
+	hostsFile.Lock()
+	defer hostsFile.Unlock()
+
+	if err := windns.WriteHostsEntries(windns.HostsFile(), nil); err != nil {
+		log.Errorf("could not remove the managed block from the hosts file: %v", err)
+		return
+	}
+	hostsFile.written = false
+}
@@ -29,12 +29,14 @@ import (
 	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
 	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
 	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/util"
 	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/util/logging"
 	"github.com/openziti/foundation/identity/identity"
 	idcfg "github.com/openziti/sdk-golang/ziti/config"
 	"github.com/openziti/sdk-golang/ziti/enroll"
 	"golang.org/x/sys/windows/svc"
 	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -45,6 +47,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -60,19 +63,23 @@ func (p *Pipes) Close() {
 	_ = p.events.Close()
 }
 
-var shutdown = make(chan bool, 8) //a channel informing go routines to exit
+var shutdown = make(chan bool) //closed to inform go routines to exit
+var shutdownOnce sync.Once
 
 func SubMain(ops chan string, changes chan<- svc.Status) error {
 	log.Info("============================== service begins ==============================")
 	windns.RemoveAllNrptRules()
+	removeHostsFile()
 	// cleanup old ziti tun profiles
 	windns.CleanUpNetworkAdapterProfile()
 
 	rts.LoadConfig()
-	l := rts.state.LogLevel
+	l := rts.currentConfig().LogLevel
 	parsedLevel, cLogLevel := logging.ParseLevel(l)
 
-	rts.state.LogLevel = parsedLevel.String()
+	rts.updateConfig(func(c *config.TunnelConfig) {
+		c.LogLevel = parsedLevel.String()
+	})
 	logging.InitLogger(parsedLevel)
 
 	_ = logging.Elog.Info(InformationEvent, SvcName+" starting. log file located at "+config.LogFile())
@@ -92,7 +99,14 @@ func SubMain(ops chan string, changes chan<- svc.Status) error {
 
 	TunStarted = time.Now()
 
+	go util.OnIPChange(onNetworkChange)
+	watchInterfaces()
+
 	for _, id := range rts.ids {
+		if !controllerAllowed(id) {
+			log.Warnf("not connecting identity %s[%s]. controller %s is not allowed by policy", id.Name, id.FingerPrint, id.Config.ZtAPI)
+			continue
+		}
 		connectIdentity(id)
 	}
 
@@ -101,6 +115,10 @@ func SubMain(ops chan string, changes chan<- svc.Status) error {
 	//listen for services that show up
 	go acceptServices()
 
+	go runNrptReconciler()
+
+	go runDnsBlocklistMonitor()
+
 	// open the pipe for business
 	pipes, err := openPipes()
 	if err != nil {
@@ -129,6 +147,7 @@ func SubMain(ops chan string, changes chan<- svc.Status) error {
 	log.Debug("shutting down. ZitiDump complete")
 
 	requestShutdown("service shutdown")
+	unwatchInterfaces()
 
 	// signal to any connected consumers that the service is shutting down normally
 	rts.BroadcastEvent(dto.StatusEvent{
@@ -144,6 +163,7 @@ func SubMain(ops chan string, changes chan<- svc.Status) error {
 	<-shutdownDelay
 
 	windns.RemoveAllNrptRules()
+	removeHostsFile()
 
 	log.Infof("shutting down connections...")
 	pipes.shutdownConnections()
@@ -173,8 +193,10 @@ func SubMain(ops chan string, changes chan<- svc.Status) error {
 
 func requestShutdown(requester string) {
 	log.Infof("shutdown requested by %v", requester)
-	shutdown <- true // stops the metrics ticker
-	shutdown <- true // stops the service change listener
+	// every go routine waiting on the channel exits, however many there are and however often shutdown is requested
+	shutdownOnce.Do(func() {
+		close(shutdown)
+	})
 }
 
 func waitForStopRequest(ops <-chan string) {
@@ -265,8 +287,9 @@ func (p *Pipes) shutdownConnections() {
 func initialize(cLogLevel int) error {
 	//TODO: this all needs to be cleaned up. it's done it two places and redundant
 	//TODO: fix with mfa?
-	ipv4 := rts.state.TunIpv4
-	ipv4mask := rts.state.TunIpv4Mask
+	cfg := rts.currentConfig()
+	ipv4 := cfg.TunIpv4
+	ipv4mask := cfg.TunIpv4Mask
 	if strings.TrimSpace(ipv4) == "" {
 		log.Infof("ip not provided using default: %v", ipv4)
 		ipv4 = constants.Ipv4ip
@@ -277,37 +300,35 @@ func initialize(cLogLevel int) error {
 		ipv4mask = constants.Ipv4DefaultMask
 		rts.UpdateIpv4Mask(ipv4mask)
 	}
-	_, ipnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", ipv4, ipv4mask))
-	if err != nil {
-		return fmt.Errorf("error parsing CIDR block: (%v)", err)
+	if err := initTunnelerDns(ipv4, ipv4mask); err != nil {
+		return err
 	}
-	dnsIpAsUint32 := binary.BigEndian.Uint32(ipnet.IP)
-	cziti.InitTunnelerDns(dnsIpAsUint32, len(ipnet.Mask))
+	cfg = rts.currentConfig()
 
-	assignedIp, t, err := rts.CreateTun(rts.state.TunIpv4, rts.state.TunIpv4Mask, rts.state.AddDns)
+	assignedIp, t, err := rts.CreateTun(cfg.TunIpv4, cfg.TunIpv4Mask, cfg.AddDns)
 	if err != nil {
 		return err
 	}
 
-	cziti.Start(rts, rts.state.TunIpv4, rts.state.TunIpv4Mask, cLogLevel)
+	cziti.LoadInterceptAddresses(config.InterceptAddressesFile(), cfg.DnsAddressRetention())
+	cziti.Start(rts, cfg.TunIpv4, cfg.TunIpv4Mask, cLogLevel)
 	err = cziti.HookupTun(*t)
 	if err != nil {
 		log.Panicf("An unrecoverable error has occurred! %v", err)
 	}
 
-	setTunInfo(rts.state)
+	setTunInfo(rts.state, cfg.TunIpv4, cfg.TunIpv4Mask)
 
 	rts.state.Active = true
-	for _, id := range rts.state.Identities {
-		if id != nil {
-			i := &Id{
-				Identity: *id,
-				CId:      nil,
-			}
-			rts.ids[id.FingerPrint] = i
-		} else {
-			log.Warnf("identity was nil?")
-		}
+	if err := cziti.SetDnsUpstreamMode(cfg.DnsUpstreamMode); err != nil {
+		log.Warnf("using the default upstream DNS mode: %v", err)
+	}
+	cziti.ConfigureDnsForwarding(cfg.DnsUpstreams, cfg.DnsForwardRuleMap(), cfg.DnsPlainFallback)
+	cziti.SetDnsSearchSuffixes(cfg.DnsSearchSuffixes)
+	cziti.SetDnsTtl(cfg.DnsTtl(), cfg.DnsInaccessibleTtl())
+	cziti.SetDnsBlocklists(cfg.DnsBlocklists, cfg.DnsAllowlist, cfg.DnsBlockMode)
+	if err := cziti.SetDnsLogFile(cfg.DnsLogFile); err != nil {
+		log.Warn(err)
 	}
 	dnsReady := make(chan bool)
 	go cziti.RunDNSserver([]net.IP{assignedIp}, dnsReady)
@@ -316,20 +337,92 @@ func initialize(cLogLevel int) error {
 	return nil
 }
 
-func setTunInfo(s *dto.TunnelStatus) {
-	ipv4 := rts.state.TunIpv4
-	ipv4mask := rts.state.TunIpv4Mask
+// onNetworkChange runs whenever the local addresses change. The upstream DNS servers are detected again, cached
+// upstream answers may no longer be valid on the new network and, in auto mode, the TUN network moves when it starts to conflict with a local network.
+// Other VPN clients often replace the NRPT rules as they connect so the rules are checked as well
+func onNetworkChange() {
+	cziti.FlushDnsCache()
+	cziti.ReloadDnsUpstreams()
+	reevaluateAutoSubnet()
+	reconcileNrpt()
+}
+
+// how long interfaces must stay unchanged before the DNS search suffixes are detected again. Adding an adapter sends a
+// burst of notifications
+const interfaceChangeDebounce = 2 * time.Second
 
-	if strings.TrimSpace(ipv4) == "" {
-		ipv4 = constants.Ipv4ip
-		log.Infof("ip not provided in config file. using default: %v", ipv4)
-		rts.UpdateIpv4(ipv4)
+var interfaceWatch struct {
+	mu       sync.Mutex
+	callback *winipcfg.InterfaceChangeCallback
+	refresh  *time.Timer
+}
+
+// watchInterfaces detects the DNS search suffixes again when an interface is added or removed. Adding an adapter does
+// not always change an address
+func watchInterfaces() {
+	callback, err := winipcfg.RegisterInterfaceChangeCallback(func(notificationType winipcfg.MibNotificationType, _ *winipcfg.MibIPInterfaceRow) {
+		if notificationType != winipcfg.MibAddInstance && notificationType != winipcfg.MibDeleteInstance {
+			return
+		}
+		interfaceWatch.mu.Lock()
+		defer interfaceWatch.mu.Unlock()
+		if interfaceWatch.callback == nil {
+			// no longer watching
+			return
+		}
+		if interfaceWatch.refresh == nil {
+			interfaceWatch.refresh = time.AfterFunc(interfaceChangeDebounce, cziti.RefreshDnsSuffixes)
+		} else {
+			interfaceWatch.refresh.Reset(interfaceChangeDebounce)
+		}
+	})
+	if err != nil {
+		log.Warnf("DNS search suffixes are only detected again when an address changes. could not watch interfaces: %v", err)
+		return
 	}
-	if ipv4mask < constants.Ipv4MaxMask || ipv4mask > constants.Ipv4MinMask {
-		log.Warnf("provided mask is invalid: %d. using default value: %d", ipv4mask, constants.Ipv4DefaultMask)
-		ipv4mask = constants.Ipv4DefaultMask
-		rts.UpdateIpv4Mask(ipv4mask)
+	interfaceWatch.mu.Lock()
+	interfaceWatch.callback = callback
+	interfaceWatch.mu.Unlock()
+}
+
+// unwatchInterfaces stops watching the interfaces and drops a pending detection of the DNS search suffixes
+func unwatchInterfaces() {
+	interfaceWatch.mu.Lock()
+	callback := interfaceWatch.callback
+	interfaceWatch.callback = nil
+	if interfaceWatch.refresh != nil {
+		interfaceWatch.refresh.Stop()
+		interfaceWatch.refresh = nil
+	}
+	interfaceWatch.mu.Unlock()
+	if callback == nil {
+		return
+	}
+	if err := callback.Unregister(); err != nil {
+		log.Warnf("could not stop watching interfaces: %v", err)
+	}
+}
+
+// tunnelerDnsRange returns the first address and the size in bits of the TUN network handed to the tunneler
+func tunnelerDnsRange(ipv4 string, ipv4mask int) (uint32, int, error) {
+	_, ipnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", ipv4, ipv4mask))
+	if err != nil {
+		return 0, 0, fmt.Errorf("error parsing CIDR block: (%v)", err)
+	}
+	return binary.BigEndian.Uint32(ipnet.IP), len(ipnet.Mask), nil
+}
+
+func initTunnelerDns(ipv4 string, ipv4mask int) error {
+	ipBase, maskBits, err := tunnelerDnsRange(ipv4, ipv4mask)
+	if err != nil {
+		return err
 	}
+	cziti.InitTunnelerDns(ipBase, maskBits)
+	return nil
+}
+
+// setTunInfo records the address and network of the TUN in the status sent to the UI
+func setTunInfo(s *dto.TunnelStatus, ipv4 string, ipv4mask int) {
 	_, ipnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", ipv4, ipv4mask))
 	if err != nil {
 		log.Errorf("error parsing CIDR block: (%v)", err)
@@ -482,6 +575,10 @@ func serveIpc(conn net.Conn) {
 			rts.SaveState()
 		case "RemoveIdentity":
 			log.Debugf("Request received to remove an identity")
+			if !rts.policy.CanRemoveIdentity() {
+				respondWithError(enc, "removing identities is locked by policy", LOCKED_BY_POLICY, nil)
+				break
+			}
 			removeIdentity(enc, cmd.Payload["Fingerprint"].(string))
 
 			//save the state
@@ -496,6 +593,10 @@ func serveIpc(conn net.Conn) {
 			//save the state
 			rts.SaveState()
 		case "SetLogLevel":
+			if rts.policy.IsManaged(config.PolicyKeyLogLevel) {
+				respondWithError(enc, "the log level is locked by policy", LOCKED_BY_POLICY, nil)
+				break
+			}
 			setLogLevel(enc, cmd.Payload["Level"].(string))
 
 			//save the state
@@ -515,6 +616,29 @@ func serveIpc(conn net.Conn) {
 				addDns = strconv.FormatBool(cmd.Payload["AddDns"].(bool))
 			}
 			updateTunIpv4(enc, tunIPv4, tunIPv4Mask, addDns)
+		case "GetConfig":
+			key, _ := cmd.Payload["Key"].(string)
+			getConfig(enc, key)
+		case "SetConfig":
+			key, _ := cmd.Payload["Key"].(string)
+			value, _ := cmd.Payload["Value"].(string)
+			setConfig(enc, key, value)
+		case "GetDnsLog":
+			limit, _ := cmd.Payload["Limit"].(float64)
+			name, _ := cmd.Payload["Name"].(string)
+			respond(enc, dto.Response{Message: "DNS log", Code: SUCCESS, Error: "", Payload: cziti.GetDnsLog(int(limit), name)})
+		case "ResolveDns":
+			name, _ := cmd.Payload["Name"].(string)
+			qtype, _ := cmd.Payload["Type"].(string)
+			resolveDns(enc, name, qtype)
+		case "GetDnsBlocklists":
+			reload, _ := cmd.Payload["Reload"].(bool)
+			getDnsBlocklists(enc, reload)
+		case "CheckConsistency":
+			checkConsistency(enc)
+		case "FlushDnsCache":
+			stats := cziti.FlushDnsCache()
+			respond(enc, dto.Response{Message: "DNS cache flushed", Code: SUCCESS, Error: "", Payload: stats})
 		case "NotifyLogLevelUIAndUpdateService":
 			sendLogLevelAndNotify(enc, cmd.Payload["Level"].(string))
 		case "NotifyIdentityUI":
@@ -631,15 +755,135 @@ func removeMFA(out *json.Encoder, fingerprint string, code string) {
 }
 
 func setLogLevel(out *json.Encoder, level string) {
+	applyLogLevel(level)
+	respond(out, dto.Response{Message: "log level set", Code: SUCCESS, Error: "", Payload: nil})
+}
+
+func applyLogLevel(level string) {
 	goLevel, cLevel := logging.ParseLevel(level)
 	log.Infof("Setting logger levels to %s", goLevel)
 	logging.SetLoggingLevel(goLevel)
 	cziti.SetLogLevel(cLevel)
-	rts.state.LogLevel = goLevel.String()
-	respond(out, dto.Response{Message: "log level set", Code: SUCCESS, Error: "", Payload: nil})
+	rts.updateConfig(func(c *config.TunnelConfig) {
+		c.LogLevel = goLevel.String()
+	})
+}
+
+func configEntry(s *config.Setting) dto.ConfigEntry {
+	return dto.ConfigEntry{
+		Key:           s.Key,
+		Value:         s.Get(rts.currentConfig()),
+		Description:   s.Description,
+		PolicyManaged: rts.policy.IsManaged(s.Key),
+	}
+}
+
+// responds with the effective value of the given setting or of every setting when no key is provided
+func getConfig(out *json.Encoder, key string) {
+	entries := make([]dto.ConfigEntry, 0)
+	if strings.TrimSpace(key) == "" {
+		for _, s := range config.Settings() {
+			entries = append(entries, configEntry(s))
+		}
+	} else {
+		s, err := config.FindSetting(key)
+		if err != nil {
+			respondWithError(out, "could not get config", CONFIG_KEY_NOT_FOUND, err)
+			return
+		}
+		entries = append(entries, configEntry(s))
+	}
+	respond(out, dto.Response{Message: "config", Code: SUCCESS, Error: "", Payload: entries})
+}
+
+// applySetting sets an already validated value on the running configuration and saves it. The value is set again
+// rather than copying a candidate over the configuration so a TUN move made in the meantime is not undone
+func applySetting(s *config.Setting, value string) *config.TunnelConfig {
+	rts.updateConfig(func(c *config.TunnelConfig) {
+		_ = s.Set(c, value)
+	})
+	rts.SaveState()
+	return rts.currentConfig()
+}
+
+func setConfig(out *json.Encoder, key string, value string) {
+	s, err := config.FindSetting(key)
+	if err != nil {
+		respondWithError(out, "could not set config", CONFIG_KEY_NOT_FOUND, err)
+		return
+	}
+	if rts.policy.IsManaged(s.Key) {
+		respondWithError(out, fmt.Sprintf("%s is locked by policy", s.Key), LOCKED_BY_POLICY, nil)
+		return
+	}
+	candidate := rts.currentConfig()
+	if err = s.Set(candidate, value); err != nil {
+		respondWithError(out, "could not set config", CONFIG_VALUE_INVALID, err)
+		return
+	}
+
+	switch s.Key {
+	case config.PolicyKeyTunIpv4, config.PolicyKeyTunIpv4Mask, config.PolicyKeyAddDns:
+		// ReconfigureTun persists the settings once the TUN has been moved
+		if err = rts.ReconfigureTun(candidate.TunIpv4, candidate.TunIpv4Mask, candidate.AddDns); err != nil {
+			respondWithError(out, fmt.Sprintf("could not apply %s. the previous configuration was restored", s.Key), UNKNOWN_ERROR, err)
+			return
+		}
+	case config.PolicyKeyTunIpv4Mode, config.PolicyKeyTunCandidatePool:
+		applySetting(s, value)
+		reevaluateAutoSubnet()
+	case config.SettingDnsUpstreamMode:
+		cfg := applySetting(s, value)
+		_ = cziti.SetDnsUpstreamMode(cfg.DnsUpstreamMode)
+	case config.SettingDnsUpstreams, config.SettingDnsForwardRules, config.SettingDnsPlainFallback:
+		cfg := applySetting(s, value)
+		cziti.ConfigureDnsForwarding(cfg.DnsUpstreams, cfg.DnsForwardRuleMap(), cfg.DnsPlainFallback)
+		cziti.ReloadDnsUpstreams()
+	case config.SettingDnsLogFile:
+		if err = cziti.SetDnsLogFile(candidate.DnsLogFile); err != nil {
+			respondWithError(out, "could not set config", CONFIG_VALUE_INVALID, err)
+			return
+		}
+		applySetting(s, value)
+	case config.SettingDnsSearchSuffixes:
+		cfg := applySetting(s, value)
+		cziti.SetDnsSearchSuffixes(cfg.DnsSearchSuffixes)
+	case config.SettingDnsTtlSeconds, config.SettingDnsInaccessibleTtlSeconds:
+		cfg := applySetting(s, value)
+		cziti.SetDnsTtl(cfg.DnsTtl(), cfg.DnsInaccessibleTtl())
+	case config.SettingDnsAddressRetentionDays:
+		cfg := applySetting(s, value)
+		cziti.SetInterceptAddressRetention(cfg.DnsAddressRetention())
+	case config.PolicyKeyDnsBlocklists, config.PolicyKeyDnsAllowlist, config.PolicyKeyDnsBlockMode:
+		applySetting(s, value)
+		applyDnsBlocklists()
+	case config.SettingDnsHostsFile:
+		cfg := applySetting(s, value)
+		updateHostsFile(cfg.DnsHostsFile)
+	case config.PolicyKeyLogLevel:
+		applyLogLevel(candidate.LogLevel)
+		rts.BroadcastEvent(dto.LogLevelEvent{
+			ActionEvent: dto.LOGLEVEL_CHANGED,
+			LogLevel:    rts.currentConfig().LogLevel,
+		})
+		rts.SaveState()
+	default:
+		applySetting(s, value)
+	}
+	log.Infof("config %s set to %s", s.Key, s.Get(rts.currentConfig()))
+
+	respond(out, dto.Response{Message: fmt.Sprintf("%s is set", s.Key), Code: SUCCESS, Error: "", Payload: []dto.ConfigEntry{configEntry(s)}})
 }
 
 func updateTunIpv4(out *json.Encoder, ip string, ipMask int, addDns string) {
+	if ip != "" && rts.policy.IsManaged(config.PolicyKeyTunIpv4) {
+		respondWithError(out, "the TUN ip and mask are locked by policy", LOCKED_BY_POLICY, nil)
+		return
+	}
+	if addDns != "" && rts.policy.IsManaged(config.PolicyKeyAddDns) {
+		respondWithError(out, "AddDns is locked by policy", LOCKED_BY_POLICY, nil)
+		return
+	}
 
 	err := UpdateRuntimeStateIpv4(ip, ipMask, addDns)
 	if err != nil {
@@ -647,7 +891,7 @@ func updateTunIpv4(out *json.Encoder, ip string, ipMask int, addDns string) {
 		return
 	}
 
-	respond(out, dto.Response{Message: "TunIPv4 and mask is set, Manual Restart is required", Code: SUCCESS, Error: "", Payload: ""})
+	respond(out, dto.Response{Message: "TunIPv4 and mask is set", Code: SUCCESS, Error: "", Payload: ""})
 }
 
 func serveLogs(conn net.Conn) {
@@ -788,6 +1032,8 @@ func toggleIdentity(out *json.Encoder, fingerprint string, onOff bool) {
 			Error:   "",
 			Payload: nil,
 		})
+	} else if onOff && !controllerAllowed(id) {
+		respondWithError(out, fmt.Sprintf("the controller %s is not allowed by policy", id.Config.ZtAPI), LOCKED_BY_POLICY, nil)
 	} else {
 		if onOff {
 			connectIdentity(id)
@@ -819,6 +1065,11 @@ func removeTempFile(file os.File) {
 func newIdentity(newId dto.AddIdentity, out *json.Encoder) {
 	log.Debugf("new identity for %s: %s", newId.Id.Name, newId.EnrollmentFlags.JwtString)
 
+	if !rts.policy.CanAddIdentity() {
+		respondWithError(out, "adding identities is locked by policy", LOCKED_BY_POLICY, nil)
+		return
+	}
+
 	tokenStr := newId.EnrollmentFlags.JwtString
 	log.Debugf("jwt to parse: %s", tokenStr)
 	tkn, _, err := enroll.ParseToken(tokenStr)
@@ -827,6 +1078,10 @@ func newIdentity(newId dto.AddIdentity, out *json.Encoder) {
 		respondWithError(out, "failed to parse JWT: %s", COULD_NOT_ENROLL, err)
 		return
 	}
+	if !rts.policy.IsControllerAllowed(tkn.Issuer) {
+		respondWithError(out, fmt.Sprintf("the controller %s is not allowed by policy", tkn.Issuer), LOCKED_BY_POLICY, nil)
+		return
+	}
 	var certPath = ""
 	var keyPath = ""
 	var caOverride = ""
@@ -906,10 +1161,6 @@ func newIdentity(newId dto.AddIdentity, out *json.Encoder) {
 	id.Active = true //since it's a new id being added - presume that it's active
 	connectIdentity(id)
 
-	state := rts.state
-	//if successful parse the output and add the config to the identity
-	state.Identities = append(state.Identities, &newId.Id)
-
 	//return successful message
 	resp := dto.Response{Message: "success", Code: SUCCESS, Error: "", Payload: Clean(id)}
 
@@ -917,6 +1168,11 @@ func newIdentity(newId dto.AddIdentity, out *json.Encoder) {
 	log.Debugf("new identity for %s responded to", newId.Id.Name)
 }
 
+// identities which have never connected have no controller recorded yet and are allowed until they have one
+func controllerAllowed(id *Id) bool {
+	return id.Config.ZtAPI == "" || rts.policy.IsControllerAllowed(id.Config.ZtAPI)
+}
+
 func respondWithError(out *json.Encoder, msg string, code int, err error) {
 	if err != nil {
 		respond(out, dto.Response{Message: msg, Code: code, Error: err.Error()})
@@ -938,10 +1194,14 @@ func connectIdentity(id *Id) {
 	} else {
 		log.Debugf("%s[%s] is already loaded", id.Name, id.FingerPrint)
 
+		hostnames := make(map[string]bool)
 		id.CId.Services.Range(func(key interface{}, value interface{}) bool {
 			id.Services = append(id.Services, nil)
 
 			val := value.(*cziti.ZService)
+			for ns := range cziti.ClaimServiceHostnames(id.FingerPrint, val) {
+				hostnames[ns] = true
+			}
 			var wg sync.WaitGroup
 			wg.Add(1)
 			rwg := &cziti.TunnelerActionWaitGroup{
@@ -953,6 +1213,11 @@ func connectIdentity(id *Id) {
 
 			return true
 		})
+		cfg := rts.currentConfig()
+		if len(hostnames) > 0 {
+			windns.AddNrptRules(hostnames, cfg.TunIpv4)
+		}
+		updateHostsFile(cfg.DnsHostsFile)
 
 		rts.BroadcastEvent(dto.IdentityEvent{
 			ActionEvent: dto.IDENTITY_CONNECTED,
@@ -983,6 +1248,11 @@ func disconnectIdentity(id *Id) error {
 				wg.Wait()
 				return true
 			})
+			// the hostnames of the identity stop resolving unless another identity intercepts them too
+			if hostnames := cziti.ReleaseIdentityHostnames(id.FingerPrint); len(hostnames) > 0 {
+				windns.RemoveNrptRules(hostnames)
+			}
+			updateHostsFile(rts.currentConfig().DnsHostsFile)
 			rts.BroadcastEvent(dto.IdentityEvent{
 				ActionEvent: dto.IDENTITY_DISCONNECTED,
 				Id:          id.Identity,
@@ -1013,6 +1283,9 @@ func removeIdentity(out *json.Encoder, fingerprint string) {
 	}
 
 	rts.RemoveByFingerprint(fingerprint)
+	cziti.ForgetInterceptAddresses(fingerprint)
+	cziti.ForgetServiceTtls(fingerprint)
+	cziti.ForgetServiceRecords(fingerprint)
 
 	//remove the file from the filesystem - first verify it's the proper file
 	log.Debugf("removing identity file for fingerprint %s at %s", id.FingerPrint, id.Path())
@@ -1055,53 +1328,95 @@ func eventsPipeName() string {
 	return pipeName("events")
 }
 
+// acceptServices collects the service changes of every identity until none arrived for the configured window, or
+// for at most serviceChangeMaxWindows windows, and then applies them together
 func acceptServices() {
+	batch := newServiceChangeBatch()
+	var deadline time.Time
+	var apply <-chan time.Time
 	for {
 		select {
 		case <-shutdown:
 			return
-		case bulkServiceChange := <-cziti.BulkServiceChanges:
-			log.Debugf("processing a bulk service change event. Hostnames to add/remove:[%d/%d] service notifications added/removed: [%d/%d]",
-				len(bulkServiceChange.HostnamesToAdd),
-				len(bulkServiceChange.HostnamesToRemove),
-				len(bulkServiceChange.ServicesToAdd),
-				len(bulkServiceChange.ServicesToRemove))
-			handleBulkServiceChange(bulkServiceChange)
+		case <-cziti.PendingServiceChanges.Ready():
+			window := rts.currentConfig().ServiceChangeWindow()
+			if batch.empty() {
+				deadline = time.Now().Add(window * serviceChangeMaxWindows)
+			}
+			for _, bulkServiceChange := range cziti.PendingServiceChanges.Take() {
+				log.Debugf("received a bulk service change event for %s. Hostnames to add/remove:[%d/%d] service notifications added/removed: [%d/%d]",
+					bulkServiceChange.Fingerprint,
+					len(bulkServiceChange.HostnamesToAdd),
+					len(bulkServiceChange.HostnamesToRemove),
+					len(bulkServiceChange.ServicesToAdd),
+					len(bulkServiceChange.ServicesToRemove))
+				batch.merge(bulkServiceChange)
+			}
+			atomic.StoreInt32(&batchedServiceChanges, int32(batch.merged))
+			wait := window
+			if untilDeadline := time.Until(deadline); untilDeadline < wait {
+				wait = untilDeadline
+			}
+			apply = time.After(wait)
+		case <-apply:
+			apply = nil
+			handleBulkServiceChange(batch)
+			batch = newServiceChangeBatch()
+			atomic.StoreInt32(&batchedServiceChanges, 0)
+		}
+	}
+}
+
+// logNrptResults logs the namespaces which succeeded together and each failure on its own
+func logNrptResults(msg string, results []windns.NrptResult) {
+	succeeded := make([]string, 0, len(results))
+	for _, r := range results {
+		if r.Err != nil {
+			log.Errorf("NRPT rule for %s failed: %v", r.Namespace, r.Err)
+		} else {
+			succeeded = append(succeeded, r.Namespace)
 		}
 	}
+	if len(succeeded) > 0 {
+		log.Infof("%s: %v", msg, succeeded)
+	}
 }
 
-func handleBulkServiceChange(sc cziti.BulkServiceChange) {
-	if len(sc.HostnamesToRemove) > 0 {
+// handleBulkServiceChange applies the coalesced service changes of every identity as a single NRPT change and
+// announces them with a single event
+func handleBulkServiceChange(batch *serviceChangeBatch) {
+	hostnamesToAdd, hostnamesToRemove := cziti.CurrentNrptChanges(batch.hostnamesToAdd, batch.hostnamesToRemove)
+	log.Debugf("applying %d coalesced service change(s) of %d identities. Hostnames to add/remove:[%d/%d]",
+		batch.merged, len(batch.identities), len(hostnamesToAdd), len(hostnamesToRemove))
+
+	if len(hostnamesToRemove) > 0 {
 		log.Debug("removing rules from NRPT")
-		windns.RemoveNrptRules(sc.HostnamesToRemove)
-		log.Info("removed NRPT rules for: %v", sc.HostnamesToRemove)
+		results := windns.Nrpt.Remove(windns.Namespaces(hostnamesToRemove))
+		logNrptResults("removed NRPT rules for", results)
 	} else {
 		log.Debug("bulk service change had no hostnames to remove")
 	}
 
-	if len(sc.HostnamesToAdd) > 0 {
+	cfg := rts.currentConfig()
+	if len(hostnamesToAdd) > 0 {
 		log.Debug("adding rules to NRPT")
-		windns.AddNrptRules(sc.HostnamesToAdd, rts.state.TunIpv4)
-		log.Infof("mapped the following hostnames: %v", sc.HostnamesToAdd)
-	}
-
-	be := dto.BulkServiceEvent{
-		ActionEvent:     dto.SERVICE_BULK,
-		Fingerprint:     sc.Fingerprint,
-		AddedServices:   sc.ServicesToAdd,
-		RemovedServices: sc.ServicesToRemove,
+		results := windns.Nrpt.Add(windns.Namespaces(hostnamesToAdd), cfg.TunIpv4)
+		logNrptResults("mapped the following hostnames", results)
 	}
+	updateHostsFile(cfg.DnsHostsFile)
 
+	be := batch.event()
 	rts.BroadcastEvent(be)
 
-	var m = dto.IdentityEvent{
-		ActionEvent: dto.IdentityUpdateComplete,
-		Id: dto.Identity{
-			FingerPrint: sc.Fingerprint,
-		},
+	for _, changes := range be.Identities {
+		var m = dto.IdentityEvent{
+			ActionEvent: dto.IdentityUpdateComplete,
+			Id: dto.Identity{
+				FingerPrint: changes.Fingerprint,
+			},
+		}
+		rts.BroadcastEvent(m)
 	}
-	rts.BroadcastEvent(m)
 }
 
 func handleEvents(isInitialized chan struct{}) {
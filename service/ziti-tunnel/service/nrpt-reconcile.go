@@ -0,0 +1,62 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"time"
+
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+// NrptReconcileInterval is how often the NRPT rules are checked. Group policy refreshes and other VPN clients replace
+// the rules without notice
+const NrptReconcileInterval = time.Minute
+
+func runNrptReconciler() {
+	ticker := time.NewTicker(NrptReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+			reconcileNrpt()
+		}
+	}
+}
+
+// reconcileNrpt repairs the NRPT rules and tells the UI when any rule had to be repaired
+func reconcileNrpt() {
+	// moving the TUN replaces every rule. checking the rules halfway through would undo it
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	drift, err := cziti.ReconcileNrpt()
+	if err != nil {
+		log.Debugf("NRPT rules were not checked: %v", err)
+		return
+	}
+	if drift.Missing == 0 && drift.Stale == 0 {
+		log.Tracef("all %d NRPT rules are in place", drift.Desired)
+		return
+	}
+	log.Infof("repaired NRPT rules. needed: %d, added again: %d, removed: %d, failed: %d", drift.Desired, drift.Missing, drift.Stale, drift.Failed)
+	drift.ActionEvent = dto.NrptDriftDetectedEvent
+	rts.BroadcastEvent(drift)
+}
@@ -62,6 +62,10 @@ const (
 	MFA_FAILED_TO_RETURN_CODES   = 201
 	MFA_FINGERPRINT_NOT_FOUND    = 202
 
+	LOCKED_BY_POLICY     = 300
+	CONFIG_KEY_NOT_FOUND = 301
+	CONFIG_VALUE_INVALID = 302
+
 	DEFAULT_REFRESH_INTERVAL = 10
 
 	cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPauseAndContinue | svc.AcceptPowerEvent
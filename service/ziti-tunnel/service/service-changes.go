@@ -0,0 +1,139 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"sort"
+
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+// a batch is applied at the latest this many windows after its first change, even when changes keep arriving
+const serviceChangeMaxWindows = 8
+
+// how many changes were merged into the batch which has not been applied yet. read by the consistency check
+var batchedServiceChanges int32
+
+// serviceChangeBatch collects the service changes of every identity arriving within the coalescing window so they
+// are applied as a single NRPT change and announced with a single event
+type serviceChangeBatch struct {
+	hostnamesToAdd    map[string]bool
+	hostnamesToRemove map[string]bool
+	identities        map[string]*identityServiceChanges
+	merged            int // how many changes were merged into the batch
+}
+
+// identityServiceChanges are the pending service changes of one identity keyed by service id
+type identityServiceChanges struct {
+	added   map[string]*dto.Service
+	removed map[string]*dto.Service
+}
+
+func newServiceChangeBatch() *serviceChangeBatch {
+	return &serviceChangeBatch{
+		hostnamesToAdd:    make(map[string]bool),
+		hostnamesToRemove: make(map[string]bool),
+		identities:        make(map[string]*identityServiceChanges),
+	}
+}
+
+func (b *serviceChangeBatch) empty() bool {
+	return b.merged == 0
+}
+
+// merge adds a change to the batch. The removals of a change are applied before its additions, the same order
+// eventCB produced them in. A hostname or service added and then removed within the batch is dropped altogether, a
+// hostname removed and then added again keeps its NRPT rule
+func (b *serviceChangeBatch) merge(sc cziti.BulkServiceChange) {
+	b.merged++
+	for ns := range sc.HostnamesToRemove {
+		if b.hostnamesToAdd[ns] {
+			delete(b.hostnamesToAdd, ns)
+		} else {
+			b.hostnamesToRemove[ns] = true
+		}
+	}
+	for ns := range sc.HostnamesToAdd {
+		if b.hostnamesToRemove[ns] {
+			delete(b.hostnamesToRemove, ns)
+		} else {
+			b.hostnamesToAdd[ns] = true
+		}
+	}
+
+	id, found := b.identities[sc.Fingerprint]
+	if !found {
+		id = &identityServiceChanges{
+			added:   make(map[string]*dto.Service),
+			removed: make(map[string]*dto.Service),
+		}
+		b.identities[sc.Fingerprint] = id
+	}
+	for _, svc := range sc.ServicesToRemove {
+		_, wasAdded := id.added[svc.Id]
+		_, wasRemoved := id.removed[svc.Id]
+		delete(id.added, svc.Id)
+		if !wasAdded && !wasRemoved {
+			// only a service which was known before the batch has to be removed
+			id.removed[svc.Id] = svc
+		}
+	}
+	for _, svc := range sc.ServicesToAdd {
+		id.added[svc.Id] = svc
+	}
+}
+
+// event builds the single event announcing every change of the batch. When only one identity changed the event has
+// the same form as before changes were coalesced
+func (b *serviceChangeBatch) event() dto.BulkServiceEvent {
+	be := dto.BulkServiceEvent{
+		ActionEvent: dto.SERVICE_BULK,
+		Identities:  make([]dto.ServiceChanges, 0, len(b.identities)),
+	}
+	fingerprints := make([]string, 0, len(b.identities))
+	for fp := range b.identities {
+		fingerprints = append(fingerprints, fp)
+	}
+	sort.Strings(fingerprints)
+	for _, fp := range fingerprints {
+		id := b.identities[fp]
+		be.Identities = append(be.Identities, dto.ServiceChanges{
+			Fingerprint:     fp,
+			AddedServices:   sortedServices(id.added),
+			RemovedServices: sortedServices(id.removed),
+		})
+	}
+	if len(be.Identities) == 1 {
+		be.Fingerprint = be.Identities[0].Fingerprint
+		be.AddedServices = be.Identities[0].AddedServices
+		be.RemovedServices = be.Identities[0].RemovedServices
+	}
+	return be
+}
+
+func sortedServices(byId map[string]*dto.Service) []*dto.Service {
+	services := make([]*dto.Service, 0, len(byId))
+	for _, svc := range byId {
+		services = append(services, svc)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+	return services
+}
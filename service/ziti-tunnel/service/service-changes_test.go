@@ -0,0 +1,181 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+func hostnameSet(hostnames ...string) map[string]bool {
+	set := make(map[string]bool)
+	for _, h := range hostnames {
+		set[h] = true
+	}
+	return set
+}
+
+func setKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func serviceNames(services []*dto.Service) []string {
+	names := make([]string, 0, len(services))
+	for _, svc := range services {
+		names = append(names, svc.Name)
+	}
+	return names
+}
+
+func TestServiceChangeBatchMerge(t *testing.T) {
+	web := &dto.Service{Id: "web-id", Name: "web"}
+	ssh := &dto.Service{Id: "ssh-id", Name: "ssh"}
+	tests := []struct {
+		name        string
+		changes     []cziti.BulkServiceChange
+		wantAdd     []string
+		wantRemove  []string
+		wantAdded   []string
+		wantRemoved []string
+	}{
+		{
+			name: "add",
+			changes: []cziti.BulkServiceChange{
+				{Fingerprint: "a", HostnamesToAdd: hostnameSet("web.example.com"), ServicesToAdd: []*dto.Service{web}},
+				{Fingerprint: "a", HostnamesToAdd: hostnameSet("ssh.example.com"), ServicesToAdd: []*dto.Service{ssh}},
+			},
+			wantAdd:     []string{"ssh.example.com", "web.example.com"},
+			wantRemove:  []string{},
+			wantAdded:   []string{"ssh", "web"},
+			wantRemoved: []string{},
+		},
+		{
+			name: "add then remove",
+			changes: []cziti.BulkServiceChange{
+				{Fingerprint: "a", HostnamesToAdd: hostnameSet("web.example.com"), ServicesToAdd: []*dto.Service{web}},
+				{Fingerprint: "a", HostnamesToRemove: hostnameSet("web.example.com"), ServicesToRemove: []*dto.Service{web}},
+			},
+			wantAdd:     []string{},
+			wantRemove:  []string{},
+			wantAdded:   []string{},
+			wantRemoved: []string{},
+		},
+		{
+			name: "remove then add keeps the NRPT rule",
+			changes: []cziti.BulkServiceChange{
+				{Fingerprint: "a", HostnamesToRemove: hostnameSet("web.example.com"), ServicesToRemove: []*dto.Service{web}},
+				{Fingerprint: "a", HostnamesToAdd: hostnameSet("web.example.com"), ServicesToAdd: []*dto.Service{web}},
+			},
+			wantAdd:     []string{},
+			wantRemove:  []string{},
+			wantAdded:   []string{"web"},
+			wantRemoved: []string{"web"},
+		},
+		{
+			name: "changed service",
+			changes: []cziti.BulkServiceChange{
+				{
+					Fingerprint:       "a",
+					HostnamesToRemove: hostnameSet("web.example.com", "old.example.com"),
+					HostnamesToAdd:    hostnameSet("web.example.com", "new.example.com"),
+					ServicesToRemove:  []*dto.Service{web},
+					ServicesToAdd:     []*dto.Service{web},
+				},
+			},
+			wantAdd:     []string{"new.example.com"},
+			wantRemove:  []string{"old.example.com"},
+			wantAdded:   []string{"web"},
+			wantRemoved: []string{"web"},
+		},
+		{
+			name: "added then removed within the batch among other changes",
+			changes: []cziti.BulkServiceChange{
+				{Fingerprint: "a", HostnamesToRemove: hostnameSet("ssh.example.com"), ServicesToRemove: []*dto.Service{ssh}},
+				{Fingerprint: "a", HostnamesToAdd: hostnameSet("web.example.com"), ServicesToAdd: []*dto.Service{web}},
+				{Fingerprint: "a", HostnamesToRemove: hostnameSet("web.example.com"), ServicesToRemove: []*dto.Service{web}},
+			},
+			wantAdd:     []string{},
+			wantRemove:  []string{"ssh.example.com"},
+			wantAdded:   []string{},
+			wantRemoved: []string{"ssh"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newServiceChangeBatch()
+			if !b.empty() {
+				t.Fatal("a new batch is not empty")
+			}
+			for _, sc := range tt.changes {
+				b.merge(sc)
+			}
+			if b.empty() {
+				t.Error("batch is empty after merging changes")
+			}
+			if got := setKeys(b.hostnamesToAdd); !reflect.DeepEqual(got, tt.wantAdd) {
+				t.Errorf("hostnames to add = %v, want %v", got, tt.wantAdd)
+			}
+			if got := setKeys(b.hostnamesToRemove); !reflect.DeepEqual(got, tt.wantRemove) {
+				t.Errorf("hostnames to remove = %v, want %v", got, tt.wantRemove)
+			}
+
+			be := b.event()
+			if be.Fingerprint != "a" || len(be.Identities) != 1 {
+				t.Fatalf("event of a single identity is for %q with %d identities", be.Fingerprint, len(be.Identities))
+			}
+			if got := serviceNames(be.AddedServices); !reflect.DeepEqual(got, tt.wantAdded) {
+				t.Errorf("added services = %v, want %v", got, tt.wantAdded)
+			}
+			if got := serviceNames(be.RemovedServices); !reflect.DeepEqual(got, tt.wantRemoved) {
+				t.Errorf("removed services = %v, want %v", got, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestServiceChangeBatchEventOfSeveralIdentities(t *testing.T) {
+	b := newServiceChangeBatch()
+	b.merge(cziti.BulkServiceChange{Fingerprint: "b", ServicesToAdd: []*dto.Service{{Id: "2", Name: "web"}, {Id: "1", Name: "db"}}})
+	b.merge(cziti.BulkServiceChange{Fingerprint: "a", ServicesToRemove: []*dto.Service{{Id: "3", Name: "ssh"}}})
+
+	be := b.event()
+	if be.ActionEvent != dto.SERVICE_BULK {
+		t.Errorf("event action = %v, want %v", be.ActionEvent, dto.SERVICE_BULK)
+	}
+	if be.Fingerprint != "" || be.AddedServices != nil || be.RemovedServices != nil {
+		t.Errorf("event of several identities has the changes of %q", be.Fingerprint)
+	}
+	if len(be.Identities) != 2 || be.Identities[0].Fingerprint != "a" || be.Identities[1].Fingerprint != "b" {
+		t.Fatalf("identities of the event = %+v, want a and b", be.Identities)
+	}
+	if got := serviceNames(be.Identities[0].RemovedServices); !reflect.DeepEqual(got, []string{"ssh"}) {
+		t.Errorf("removed services of a = %v", got)
+	}
+	if got := serviceNames(be.Identities[1].AddedServices); !reflect.DeepEqual(got, []string{"db", "web"}) {
+		t.Errorf("added services of b = %v, want them sorted by name", got)
+	}
+}
@@ -38,6 +38,7 @@ import (
 	"net"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -45,6 +46,9 @@ import (
 
 type RuntimeState struct {
 	state   *dto.TunnelStatus
+	cfg     *config.TunnelConfig
+	userCfg *config.TunnelConfig
+	policy  *config.Policy
 	tun     *tun.Device
 	tunName string
 	ids     map[string]*Id
@@ -76,11 +80,10 @@ func (t *RuntimeState) SaveState() {
 		log.Panicf("An unexpected and unrecoverable error has occurred while %s: %v", "opening the config file", err)
 	}
 
-	w := bufio.NewWriter(bufio.NewWriter(cfg))
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "  ")
-	_ = enc.Encode(t.ToStatus(false))
-	_ = w.Flush()
+	err = t.ToConfig().Write(cfg)
+	if err != nil {
+		log.Errorf("unexpected error writing the config file: %v", err)
+	}
 
 	err = cfg.Close()
 	if err != nil {
@@ -109,6 +112,42 @@ func backupConfig() (string, error) {
 	return backup, err
 }
 
+// currentConfig returns a copy of the running configuration. It waits while the TUN is being reconfigured
+func (t *RuntimeState) currentConfig() *config.TunnelConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	c := *t.cfg
+	return &c
+}
+
+// updateConfig changes the running configuration. It waits while the TUN is being reconfigured
+func (t *RuntimeState) updateConfig(change func(c *config.TunnelConfig)) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	change(t.cfg)
+}
+
+// ToConfig returns the persistable configuration with the identities currently known to the runtime
+func (t *RuntimeState) ToConfig() *config.TunnelConfig {
+	c := t.currentConfig()
+	c.SchemaVersion = config.SchemaVersion
+	t.policy.Revert(c, t.userCfg)
+	c.Identities = make([]*config.IdentityConfig, 0, len(t.ids))
+	for _, id := range t.ids {
+		c.Identities = append(c.Identities, &config.IdentityConfig{
+			Name:        id.Name,
+			FingerPrint: id.FingerPrint,
+			Active:      id.Active,
+			ZtAPI:       id.Config.ZtAPI,
+		})
+	}
+	// t.ids is a map. sorted so saving the same identities always writes the same file
+	sort.Slice(c.Identities, func(i, j int) bool {
+		return c.Identities[i].FingerPrint < c.Identities[j].FingerPrint
+	})
+	return c
+}
+
 func (t *RuntimeState) ToStatus(onlyInitialized bool) dto.TunnelStatus {
 	var uptime int64
 
@@ -116,17 +155,24 @@ func (t *RuntimeState) ToStatus(onlyInitialized bool) dto.TunnelStatus {
 	tunStart := now.Sub(TunStarted)
 	uptime = tunStart.Milliseconds()
 
+	cfg := t.currentConfig()
 	clean := dto.TunnelStatus{
 		Active:         t.state.Active,
 		Duration:       uptime,
 		Identities:     make([]*dto.Identity, 0),
 		IpInfo:         t.state.IpInfo,
-		LogLevel:       t.state.LogLevel,
+		LogLevel:       cfg.LogLevel,
 		ServiceVersion: Version,
-		TunIpv4:        t.state.TunIpv4,
-		TunIpv4Mask:    t.state.TunIpv4Mask,
-		AddDns:         t.state.AddDns,
+		TunIpv4:        cfg.TunIpv4,
+		TunIpv4Mask:    cfg.TunIpv4Mask,
+		AddDns:         cfg.AddDns,
+		PolicyManaged:  t.policy.ManagedKeys(),
 	}
+	dnsCache := cziti.GetDnsCacheStats()
+	clean.DnsCache = &dnsCache
+	clean.DnsUpstreams = cziti.GetDnsUpstreams()
+	addresses := cziti.GetInterceptAddressStats()
+	clean.InterceptAddresses = &addresses
 
 	i := 0
 	for _, id := range t.ids {
@@ -186,9 +232,24 @@ func (t *RuntimeState) CreateTun(ipv4 string, ipv4mask int, applyDns bool) (net.
 		return nil, nil, fmt.Errorf("error getting TUN name: (%v)", err)
 	}
 
-	nativeTunDevice := tunDevice.(*tun.NativeTun)
-	luid := winipcfg.LUID(nativeTunDevice.LUID())
+	ip, err := t.configureTun(ipv4, ipv4mask, applyDns)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ip, t.tun, nil
+}
+
+func (t *RuntimeState) tunLuid() winipcfg.LUID {
+	nativeTunDevice := (*t.tun).(*tun.NativeTun)
+	return winipcfg.LUID(nativeTunDevice.LUID())
+}
+
+// configureTun assigns the address, routes and DNS server of the TUN. It is used when the TUN is created and again
+// when the TUN is re-addressed while the service is running
+func (t *RuntimeState) configureTun(ipv4 string, ipv4mask int, applyDns bool) (net.IP, error) {
+	luid := t.tunLuid()
 
+	// only reached when the TUN is created. ReconfigureTun rejects these settings before it takes configMutex
 	if strings.TrimSpace(ipv4) == "" {
 		log.Infof("ip not provided using default: %v", ipv4)
 		ipv4 = constants.Ipv4ip
@@ -201,30 +262,31 @@ func (t *RuntimeState) CreateTun(ipv4 string, ipv4mask int, applyDns bool) (net.
 	}
 	ip, ipnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", ipv4, ipv4mask))
 	if err != nil {
-		return nil, nil, fmt.Errorf("error parsing CIDR block: (%v)", err)
+		return nil, fmt.Errorf("error parsing CIDR block: (%v)", err)
 	}
 
 	log.Infof("setting TUN interface address to [%s]", ip)
 	err = luid.SetIPAddresses([]net.IPNet{{IP: ip, Mask: ipnet.Mask}})
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to set IP address to %v: (%v)", ip, err)
+		return nil, fmt.Errorf("failed to set IP address to %v: (%v)", ip, err)
 	}
 
 	log.Info("checking TUN dns servers")
 	dns, err := luid.DNS()
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to fetch DNS address: (%v)", err)
+		return nil, fmt.Errorf("failed to fetch DNS address: (%v)", err)
 	}
 	log.Infof("TUN dns servers set to: %s", dns)
 
 	log.Infof("setting routes for cidr: %s. Next Hop: %s", ipnet.String(), ipnet.IP.String())
 	err = luid.SetRoutes([]*winipcfg.RouteData{{Destination: *ipnet, NextHop: ipnet.IP, Metric: 0}})
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to SetRoutes: (%v)", err)
+		return nil, fmt.Errorf("failed to SetRoutes: (%v)", err)
 	}
 	log.Info("routing applied")
 
 	zitiPoliciesEffective := windns.IsNrptPoliciesEffective(ipv4)
+	setNrptEffective(zitiPoliciesEffective)
 	interfaceMetric := 255
 	if applyDns || !zitiPoliciesEffective {
 		if applyDns {
@@ -236,11 +298,14 @@ func (t *RuntimeState) CreateTun(ipv4 string, ipv4mask int, applyDns bool) (net.
 		//for windows 10+, could 'domains' be able to replace NRPT? dunno - didn't test it
 		luid.SetDNS(windows.AF_INET, []net.IP{ip}, nil)
 		interfaceMetric = 5
+	} else {
+		// the TUN may be re-addressed with the DNS server of a previous address still assigned
+		luid.FlushDNS(windows.AF_INET)
 	}
 	cziti.SetInterfaceMetric(TunName, interfaceMetric)
 	log.Debugf("Interface Metric of %s is set to %d", TunName, interfaceMetric)
 
-	return ip, t.tun, nil
+	return ip, nil
 }
 
 func (t *RuntimeState) LoadIdentity(id *Id, refreshInterval int) {
@@ -314,13 +379,48 @@ func (t *RuntimeState) LoadConfig() {
 	//find/fix orphaned identities
 	t.scanForOrphanedIdentities(config.Path())
 
+	//machine-wide policy is merged over the user's settings. the user's own values are kept so they can be saved as-is
+	userCfg := *t.cfg
+	t.userCfg = &userCfg
+	policy, err := config.LoadPolicy(config.DefaultPolicySources())
+	if err != nil {
+		log.Errorf("problem loading the machine policy. some settings may not be managed as expected: %v", err)
+	}
+	t.policy = policy
+	t.policy.Apply(t.cfg)
+	if managed := t.policy.ManagedKeys(); len(managed) > 0 {
+		log.Infof("the following settings are managed by policy: %v", managed)
+	}
+
 	//any specific code needed when starting the process. some values need to be cleared
 	TunStarted = time.Now() //reset the time on startup
+	t.state = &dto.TunnelStatus{}
+
+	for _, idCfg := range t.cfg.Identities {
+		if idCfg == nil {
+			log.Warnf("identity was nil?")
+			continue
+		}
+		id := &Id{
+			Identity: dto.Identity{
+				Name:        idCfg.Name,
+				FingerPrint: idCfg.FingerPrint,
+				Active:      idCfg.Active,
+				Config:      idcfg.Config{ZtAPI: idCfg.ZtAPI},
+			},
+			CId: nil,
+		}
+		t.ids[id.FingerPrint] = id
+	}
 
-	if t.state.TunIpv4Mask > constants.Ipv4MinMask {
-		log.Warnf("provided mask: [%d] is smaller than the minimum permitted: [%d] and will be changed", rts.state.TunIpv4Mask, constants.Ipv4MinMask)
+	if t.cfg.TunIpv4Mask > constants.Ipv4MinMask {
+		log.Warnf("provided mask: [%d] is smaller than the minimum permitted: [%d] and will be changed", rts.cfg.TunIpv4Mask, constants.Ipv4MinMask)
 		rts.UpdateIpv4Mask(constants.Ipv4MinMask)
 	}
+
+	if t.cfg.IsAutoTunIpv4() {
+		t.selectAutoSubnet()
+	}
 }
 
 func (t *RuntimeState) scanForOrphanedIdentities(folder string) {
@@ -339,8 +439,8 @@ func (t *RuntimeState) scanForOrphanedIdentities(folder string) {
 			if strings.TrimSpace(cfg.ID.Key) != "" {
 				log.Debugf("Config file appears to be valid for network: %s", cfg.ZtAPI)
 				fingerprint := strings.Split(f.Name(), ".")[0]
-				var found *dto.Identity
-				for _, sid := range t.state.Identities {
+				var found *config.IdentityConfig
+				for _, sid := range t.cfg.Identities {
 					if sid.FingerPrint == fingerprint {
 						found = sid
 						break
@@ -348,14 +448,14 @@ func (t *RuntimeState) scanForOrphanedIdentities(folder string) {
 				}
 				if found == nil {
 					log.Infof("found orphaned identity %s. Adding back to the configuration", fingerprint)
-					newId := dto.Identity{
+					newId := config.IdentityConfig{
 						Name:        "recovered identity",
 						FingerPrint: fingerprint,
 						Active:      false,
-						Config:      cfg,
+						ZtAPI:       cfg.ZtAPI,
 					}
 
-					t.state.Identities = append(t.state.Identities, &newId)
+					t.cfg.Identities = append(t.cfg.Identities, &newId)
 				} else {
 					log.Debugf("identity with fingerprint is known: %s", fingerprint)
 				}
@@ -381,51 +481,53 @@ func probeIdentityFile(path string, cfg *idcfg.Config) error {
 
 func readConfig(t *RuntimeState, filename string) error {
 	log.Infof("reading config file located at: %s", filename)
-	info, err := os.Stat(filename)
+	cfg, fromVersion, err := config.Read(filename)
 	if os.IsNotExist(err) {
 		log.Infof("the config file does not exist. this is normal if this is a new install or if the config file was removed manually")
-		rts.state = &dto.TunnelStatus{}
+		t.cfg = config.NewTunnelConfig()
 		return nil
 	}
-
-	if info.Size() == 0 {
-		return fmt.Errorf("the config file at contains no bytes and is considered invalid: %s", filename)
-	}
-
-	file, err := os.OpenFile(filename, os.O_RDONLY, 0644)
 	if err != nil {
-		return fmt.Errorf("unexpected error opening config file: %v", err)
+		return err
 	}
 
-	r := bufio.NewReader(file)
-	dec := json.NewDecoder(r)
-
-	err = dec.Decode(&t.state)
-	defer file.Close()
-
-	if err != nil {
-		return fmt.Errorf("unexpected error reading config file: %v", err)
+	if fromVersion < config.SchemaVersion {
+		log.Infof("config file was migrated from schema version %d to %d. it will be saved once the service has started", fromVersion, config.SchemaVersion)
+	} else if fromVersion > config.SchemaVersion {
+		log.Warnf("config file has schema version %d which is newer than this version understands (%d). settings not understood will be lost", fromVersion, config.SchemaVersion)
 	}
+	t.cfg = cfg
 	return nil
 }
 
 func (t *RuntimeState) UpdateIpv4Mask(ipv4mask int) {
-	rts.state.TunIpv4Mask = ipv4mask
+	rts.updateConfig(func(c *config.TunnelConfig) {
+		c.TunIpv4Mask = ipv4mask
+	})
 	rts.SaveState()
 }
 func (t *RuntimeState) UpdateIpv4(ipv4 string) {
-	rts.state.TunIpv4 = ipv4
+	rts.updateConfig(func(c *config.TunnelConfig) {
+		c.TunIpv4 = ipv4
+	})
 	rts.SaveState()
 }
 
+// UpdateRuntimeStateIpv4 validates the requested TUN settings and applies them to the running TUN. An empty ip keeps
+// the current ip and mask, an empty addDns keeps the current DNS setting
 func UpdateRuntimeStateIpv4(ip string, ipv4Mask int, addDns string) error {
 
-	log.Infof("updating configuration ip: %s, mask: %d, dns: %t", ip, ipv4Mask, addDns)
+	log.Infof("updating configuration ip: %s, mask: %d, dns: %s", ip, ipv4Mask, addDns)
 
 	if ipv4Mask < constants.Ipv4MaxMask || ipv4Mask > constants.Ipv4MinMask {
 		return errors.New(fmt.Sprintf("ipv4Mask should be between %d and %d", constants.Ipv4MaxMask, constants.Ipv4MinMask))
 	}
 
+	cfg := rts.currentConfig()
+	newIp := cfg.TunIpv4
+	newMask := cfg.TunIpv4Mask
+	newAddDns := cfg.AddDns
+
 	if addDns != "" {
 		addDnsBool, err := strconv.ParseBool(addDns)
 
@@ -433,18 +535,16 @@ func UpdateRuntimeStateIpv4(ip string, ipv4Mask int, addDns string) error {
 			return errors.New(fmt.Sprintf("Incorrect addDns %v", err))
 		}
 
-		rts.state.AddDns = addDnsBool
+		newAddDns = addDnsBool
 	}
 
 	// if ip is not empty, then we set both ip and mask
 	if ip != "" {
-		rts.state.TunIpv4 = ip
-		rts.state.TunIpv4Mask = ipv4Mask
+		newIp = ip
+		newMask = ipv4Mask
 	}
 
-	rts.SaveState()
-
-	return nil
+	return rts.ReconfigureTun(newIp, newMask, newAddDns)
 }
 
 // uses the registry to determine if IPv6 is enabled or disabled on this machine. If it is disabled an IPv6 DNS entry
@@ -474,15 +574,11 @@ func iPv6Disabled() bool {
 }
 
 func (t *RuntimeState) AddRoute(destination net.IPNet, nextHop net.IP, metric uint32) error {
-	nativeTunDevice := (*t.tun).(*tun.NativeTun)
-	luid := winipcfg.LUID(nativeTunDevice.LUID())
-	return luid.AddRoute(destination, nextHop, metric)
+	return t.tunLuid().AddRoute(destination, nextHop, metric)
 }
 
 func (t *RuntimeState) RemoveRoute(destination net.IPNet, nextHop net.IP) error {
-	nativeTunDevice := (*t.tun).(*tun.NativeTun)
-	luid := winipcfg.LUID(nativeTunDevice.LUID())
-	return luid.DeleteRoute(destination, nextHop)
+	return t.tunLuid().DeleteRoute(destination, nextHop)
 }
 
 func (t *RuntimeState) Close() {
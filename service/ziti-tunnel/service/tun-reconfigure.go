@@ -0,0 +1,187 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/openziti/desktop-edge-win/service/cziti"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/dto"
+)
+
+// configMutex guards rts.cfg. ReconfigureTun holds it while the TUN moves so the settings are never read halfway
+// through a move and two moves never run at once
+var configMutex = sync.RWMutex{}
+
+type tunSettings struct {
+	ipv4     string
+	ipv4Mask int
+	addDns   bool
+}
+
+type reconfigureStep struct {
+	name string
+	run  func() error
+}
+
+// ReconfigureTun moves the running TUN to a new address, mask and DNS setting without restarting the service. When any
+// step fails the previous settings are put back in place and the error is returned.
+func (t *RuntimeState) ReconfigureTun(ipv4 string, ipv4Mask int, addDns bool) error {
+	configMutex.Lock()
+	requested, err := t.reconfigureTunLocked(ipv4, ipv4Mask, addDns)
+	configMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	t.reconfigured(requested)
+	return nil
+}
+
+// reconfigured saves and announces the settings of a moved TUN. must not hold configMutex
+func (t *RuntimeState) reconfigured(s tunSettings) {
+	t.SaveState()
+	t.broadcastReconfigure(dto.TunReconfigureCompleteEvent, "", s, nil)
+	t.BroadcastEvent(dto.TunnelStatusEvent{
+		StatusEvent: dto.StatusEvent{Op: "status"},
+		Status:      t.ToStatus(true),
+		ApiVersion:  API_VERSION,
+	})
+	log.Infof("TUN reconfigured to %s/%d", s.ipv4, s.ipv4Mask)
+}
+
+// reconfigureTunLocked moves the TUN and rolls back on failure. must hold configMutex for writing
+func (t *RuntimeState) reconfigureTunLocked(ipv4 string, ipv4Mask int, addDns bool) (tunSettings, error) {
+	previous := tunSettings{ipv4: t.cfg.TunIpv4, ipv4Mask: t.cfg.TunIpv4Mask, addDns: t.cfg.AddDns}
+	requested := tunSettings{ipv4: ipv4, ipv4Mask: ipv4Mask, addDns: addDns}
+	if ipv4Mask < constants.Ipv4MaxMask || ipv4Mask > constants.Ipv4MinMask {
+		return requested, fmt.Errorf("ipv4Mask should be between %d and %d", constants.Ipv4MaxMask, constants.Ipv4MinMask)
+	}
+	if _, _, err := net.ParseCIDR(fmt.Sprintf("%s/%d", ipv4, ipv4Mask)); err != nil {
+		return requested, fmt.Errorf("error parsing CIDR block: (%v)", err)
+	}
+
+	log.Infof("reconfiguring TUN from %s/%d (dns: %t) to %s/%d (dns: %t)",
+		previous.ipv4, previous.ipv4Mask, previous.addDns, requested.ipv4, requested.ipv4Mask, requested.addDns)
+
+	err := t.applyTunSettings(requested, dto.TunReconfigureProgressEvent)
+	if err != nil {
+		log.Errorf("could not reconfigure TUN to %s/%d: %v. restoring %s/%d", requested.ipv4, requested.ipv4Mask, err, previous.ipv4, previous.ipv4Mask)
+		t.broadcastReconfigure(dto.TunReconfigureRollbackEvent, "", requested, err)
+
+		if rollbackErr := t.applyTunSettings(previous, dto.TunReconfigureRollbackEvent); rollbackErr != nil {
+			log.Errorf("could not restore the previous TUN configuration. a restart of the service is required: %v", rollbackErr)
+			t.broadcastReconfigure(dto.TunReconfigureFailedEvent, "", previous, rollbackErr)
+			return requested, fmt.Errorf("%v. restoring the previous configuration also failed: %v", err, rollbackErr)
+		}
+		t.broadcastReconfigure(dto.TunReconfigureFailedEvent, "", previous, err)
+		return requested, err
+	}
+	return requested, nil
+}
+
+// applyTunSettings runs every step needed to move the TUN to the given settings, broadcasting each step as it starts.
+// must hold configMutex for writing
+func (t *RuntimeState) applyTunSettings(s tunSettings, progress dto.ActionEvent) error {
+	t.cfg.TunIpv4 = s.ipv4
+	t.cfg.TunIpv4Mask = s.ipv4Mask
+	t.cfg.AddDns = s.addDns
+
+	var assignedIp net.IP
+	steps := []reconfigureStep{
+		{name: "removing intercepts", run: func() error {
+			t.forEachInterceptedService(cziti.RemoveIntercept)
+			return nil
+		}},
+		{name: "configuring TUN address and routes", run: func() (err error) {
+			assignedIp, err = t.configureTun(s.ipv4, s.ipv4Mask, s.addDns)
+			return err
+		}},
+		{name: "initializing DNS range", run: func() error {
+			ipBase, maskBits, err := tunnelerDnsRange(s.ipv4, s.ipv4Mask)
+			if err != nil {
+				return err
+			}
+			cziti.ReinitTunnelerDns(ipBase, maskBits)
+			cziti.DnsReinit(s.ipv4, s.ipv4Mask)
+			return nil
+		}},
+		{name: "restarting DNS listener", run: func() error {
+			return cziti.RebindDNSListeners([]net.IP{assignedIp})
+		}},
+		{name: "updating NRPT rules", run: func() error {
+			cziti.ResetNrptRules(assignedIp.String())
+			return nil
+		}},
+		{name: "adding intercepts", run: func() error {
+			t.forEachInterceptedService(cziti.AddIntercept)
+			return nil
+		}},
+		{name: "updating hosts file", run: func() error {
+			updateHostsFile(t.cfg.DnsHostsFile)
+			return nil
+		}},
+	}
+
+	for _, step := range steps {
+		log.Infof("TUN reconfiguration: %s", step.name)
+		t.broadcastReconfigure(progress, step.name, s, nil)
+		if err := step.run(); err != nil {
+			return fmt.Errorf("%s failed: %v", step.name, err)
+		}
+	}
+
+	setTunInfo(t.state, s.ipv4, s.ipv4Mask)
+	return nil
+}
+
+// forEachInterceptedService sends every service of each active identity to the given tunneler action, waiting for
+// each action to complete. The Active flag of the identities is left as is.
+func (t *RuntimeState) forEachInterceptedService(action func(*cziti.TunnelerActionWaitGroup)) {
+	for _, id := range t.ids {
+		if !id.Active || id.CId == nil || !id.CId.Loaded {
+			continue
+		}
+		id.CId.Services.Range(func(key interface{}, value interface{}) bool {
+			var wg sync.WaitGroup
+			wg.Add(1)
+			action(&cziti.TunnelerActionWaitGroup{
+				Wg:    &wg,
+				Czsvc: value.(*cziti.ZService),
+			})
+			wg.Wait()
+			return true
+		})
+	}
+}
+
+func (t *RuntimeState) broadcastReconfigure(action dto.ActionEvent, step string, s tunSettings, err error) {
+	e := dto.TunReconfigureEvent{
+		ActionEvent: action,
+		Step:        step,
+		TunIpv4:     s.ipv4,
+		TunIpv4Mask: s.ipv4Mask,
+		AddDns:      s.addDns,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	t.BroadcastEvent(e)
+}
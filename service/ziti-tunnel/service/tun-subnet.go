@@ -0,0 +1,188 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/constants"
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/util/iputil"
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+// interfacePrefixSource reads the prefixes in use from the address and route tables of every interface except the TUN
+type interfacePrefixSource struct {
+	exclude winipcfg.LUID
+}
+
+func (s *interfacePrefixSource) UsedPrefixes() ([]net.IPNet, error) {
+	used := make([]net.IPNet, 0)
+
+	addrs, err := winipcfg.GetUnicastIPAddressTable(windows.AF_INET)
+	if err != nil {
+		return nil, fmt.Errorf("could not list interface addresses: %v", err)
+	}
+	for i := range addrs {
+		if addrs[i].InterfaceLUID == s.exclude {
+			continue
+		}
+		ip := addrs[i].Address.IP().To4()
+		if ip == nil || ip.IsLoopback() {
+			continue
+		}
+		mask := net.CIDRMask(int(addrs[i].OnLinkPrefixLength), 32)
+		used = append(used, net.IPNet{IP: ip.Mask(mask), Mask: mask})
+	}
+
+	routes, err := winipcfg.GetIPForwardTable2(windows.AF_INET)
+	if err != nil {
+		return nil, fmt.Errorf("could not list routes: %v", err)
+	}
+	for i := range routes {
+		if routes[i].InterfaceLUID == s.exclude {
+			continue
+		}
+		dest := routes[i].DestinationPrefix.IPNet()
+		if dest.IP.To4() == nil || dest.IP.IsLoopback() || dest.IP.IsMulticast() || dest.IP.Equal(net.IPv4bcast) {
+			continue
+		}
+		used = append(used, dest)
+	}
+	return used, nil
+}
+
+func (t *RuntimeState) prefixSource() iputil.PrefixSource {
+	src := &interfacePrefixSource{}
+	if t.tun != nil {
+		src.exclude = t.tunLuid()
+	}
+	return src
+}
+
+// chooseAutoSubnet keeps the current TUN network while it is inside the candidate pool and free. Otherwise the first
+// free network in the pool is returned. Networks of the configured size are tried first, then smaller networks down to
+// Ipv4MinMask.
+func chooseAutoSubnet(c *config.TunnelConfig, src iputil.PrefixSource) (string, int, error) {
+	used, err := src.UsedPrefixes()
+	if err != nil {
+		return "", 0, err
+	}
+
+	pool := make([]net.IPNet, 0)
+	for _, cidr := range c.CandidatePool() {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Warnf("ignoring invalid network in the TUN candidate pool: %s", cidr)
+			continue
+		}
+		pool = append(pool, *ipnet)
+	}
+
+	maskBits := c.TunIpv4Mask
+	if maskBits < constants.Ipv4MaxMask || maskBits > constants.Ipv4MinMask {
+		maskBits = constants.Ipv4DefaultMask
+	}
+
+	if _, current, err := net.ParseCIDR(fmt.Sprintf("%s/%d", c.TunIpv4, maskBits)); err == nil && inPool(*current, pool) {
+		conflict := iputil.Conflicts(*current, used)
+		if conflict == nil {
+			return c.TunIpv4, maskBits, nil
+		}
+		log.Infof("TUN network %s conflicts with local network %s", current, conflict)
+	}
+
+	for bits := maskBits; bits <= constants.Ipv4MinMask; bits++ {
+		if subnet, err := iputil.FindFreeSubnet(pool, bits, used); err == nil {
+			return iputil.Ipv4Inc(subnet.IP, bits).String(), bits, nil
+		}
+	}
+	return "", 0, fmt.Errorf("no network in the TUN candidate pool %v is free", c.CandidatePool())
+}
+
+func inPool(network net.IPNet, pool []net.IPNet) bool {
+	ones, _ := network.Mask.Size()
+	for _, p := range pool {
+		poolOnes, _ := p.Mask.Size()
+		if poolOnes <= ones && p.Contains(network.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectAutoSubnet updates the config with a free TUN network before the TUN is created
+func (t *RuntimeState) selectAutoSubnet() {
+	changed := false
+	t.updateConfig(func(c *config.TunnelConfig) {
+		ip, mask, err := chooseAutoSubnet(c, t.prefixSource())
+		if err != nil {
+			log.Errorf("could not choose a TUN network automatically. using %s/%d: %v", c.TunIpv4, c.TunIpv4Mask, err)
+			return
+		}
+		if ip != c.TunIpv4 || mask != c.TunIpv4Mask {
+			log.Infof("automatically chose TUN network %s/%d", ip, mask)
+			c.TunIpv4 = ip
+			c.TunIpv4Mask = mask
+			changed = true
+		}
+	})
+	if changed {
+		t.SaveState()
+	}
+}
+
+// reevaluateAutoSubnet moves the running TUN when its network is no longer free. Called whenever the local addresses
+// change and when auto mode is turned on. The network is chosen and moved under one lock so a concurrent change of
+// the settings cannot slip in between
+func reevaluateAutoSubnet() {
+	configMutex.Lock()
+	moved, err := reevaluateAutoSubnetLocked()
+	configMutex.Unlock()
+	if err != nil {
+		log.Errorf("could not move the TUN network: %v", err)
+		return
+	}
+	if moved != nil {
+		rts.reconfigured(*moved)
+	}
+}
+
+// reevaluateAutoSubnetLocked returns the new settings when the TUN was moved. must hold configMutex for writing
+func reevaluateAutoSubnetLocked() (*tunSettings, error) {
+	if !rts.cfg.IsAutoTunIpv4() {
+		return nil, nil
+	}
+	ip, mask, err := chooseAutoSubnet(rts.cfg, rts.prefixSource())
+	if err != nil {
+		log.Warnf("could not re-evaluate the TUN network: %v", err)
+		return nil, nil
+	}
+	if ip == rts.cfg.TunIpv4 && mask == rts.cfg.TunIpv4Mask {
+		log.Debugf("TUN network %s/%d is still free", ip, mask)
+		return nil, nil
+	}
+	log.Infof("moving TUN network from %s/%d to %s/%d", rts.cfg.TunIpv4, rts.cfg.TunIpv4Mask, ip, mask)
+	requested, err := rts.reconfigureTunLocked(ip, mask, rts.cfg.AddDns)
+	if err != nil {
+		return nil, err
+	}
+	return &requested, nil
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package service
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/openziti/desktop-edge-win/service/ziti-tunnel/config"
+)
+
+type fakePrefixSource struct {
+	used []string
+	err  error
+}
+
+func (f *fakePrefixSource) UsedPrefixes() ([]net.IPNet, error) {
+	used := make([]net.IPNet, 0, len(f.used))
+	for _, cidr := range f.used {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		used = append(used, *n)
+	}
+	return used, f.err
+}
+
+func TestChooseAutoSubnet(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.TunnelConfig
+		src      *fakePrefixSource
+		wantIp   string
+		wantMask int
+		wantErr  bool
+	}{
+		{
+			name:     "keeps the current network",
+			cfg:      config.TunnelConfig{TunIpv4: "100.80.0.1", TunIpv4Mask: 12},
+			src:      &fakePrefixSource{used: []string{"192.168.1.0/24", "100.64.0.0/16"}},
+			wantIp:   "100.80.0.1",
+			wantMask: 12,
+		},
+		{
+			name:     "current network conflicts with a local route",
+			cfg:      config.TunnelConfig{TunIpv4: "100.64.0.1", TunIpv4Mask: 12},
+			src:      &fakePrefixSource{used: []string{"100.64.0.0/16"}},
+			wantIp:   "100.80.0.1",
+			wantMask: 12,
+		},
+		{
+			name:     "default route is ignored",
+			cfg:      config.TunnelConfig{TunIpv4: "100.64.0.1", TunIpv4Mask: 10},
+			src:      &fakePrefixSource{used: []string{"0.0.0.0/0"}},
+			wantIp:   "100.64.0.1",
+			wantMask: 10,
+		},
+		{
+			name:     "current network outside of the pool",
+			cfg:      config.TunnelConfig{TunIpv4: "100.64.0.1", TunIpv4Mask: 16, TunCandidatePool: []string{"10.200.0.0/16"}},
+			src:      &fakePrefixSource{used: []string{"0.0.0.0/0"}},
+			wantIp:   "10.200.0.1",
+			wantMask: 16,
+		},
+		{
+			name:     "invalid mask uses the default",
+			cfg:      config.TunnelConfig{TunIpv4: "100.64.0.1", TunIpv4Mask: 24},
+			src:      &fakePrefixSource{},
+			wantIp:   "100.64.0.1",
+			wantMask: 10,
+		},
+		{
+			name:     "falls back to a smaller mask",
+			cfg:      config.TunnelConfig{TunIpv4: "100.64.0.1", TunIpv4Mask: 10},
+			src:      &fakePrefixSource{used: []string{"100.64.0.0/16"}},
+			wantIp:   "100.96.0.1",
+			wantMask: 11,
+		},
+		{
+			name:     "falls back to the next pool entry",
+			cfg:      config.TunnelConfig{TunIpv4: "100.64.0.1", TunIpv4Mask: 10},
+			src:      &fakePrefixSource{used: []string{"100.64.0.0/10", "0.0.0.0/0"}},
+			wantIp:   "198.18.0.1",
+			wantMask: 15,
+		},
+		{
+			name:     "invalid pool entries are ignored",
+			cfg:      config.TunnelConfig{TunIpv4: "100.64.0.1", TunIpv4Mask: 16, TunCandidatePool: []string{"10.300.0.0/16", "10.200.0.0/16"}},
+			src:      &fakePrefixSource{},
+			wantIp:   "10.200.0.1",
+			wantMask: 16,
+		},
+		{
+			name:    "exhausted pool",
+			cfg:     config.TunnelConfig{TunIpv4: "100.64.0.1", TunIpv4Mask: 10},
+			src:     &fakePrefixSource{used: []string{"100.64.0.0/10", "198.18.0.0/16", "198.19.0.0/16"}},
+			wantErr: true,
+		},
+		{
+			name:    "prefixes cannot be listed",
+			cfg:     config.TunnelConfig{TunIpv4: "100.64.0.1", TunIpv4Mask: 10},
+			src:     &fakePrefixSource{err: errors.New("access denied")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, mask, err := chooseAutoSubnet(&tt.cfg, tt.src)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("chooseAutoSubnet = %s/%d, want an error", ip, mask)
+				}
+				return
+			}
+			if err != nil || ip != tt.wantIp || mask != tt.wantMask {
+				t.Errorf("chooseAutoSubnet = %s/%d, %v, want %s/%d", ip, mask, err, tt.wantIp, tt.wantMask)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package dnsutil
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	ProtoPlain = "dns"
+	ProtoTLS   = "tls"
+	ProtoHTTPS = "https"
+
+	// prefix of the fragment pinning the certificate of an encrypted upstream
+	pinPrefix = "pin-sha256="
+)
+
+// Upstream is a parsed upstream DNS server. Accepted forms are:
+//
+//	ip or ip:port                        plain DNS, port 53 by default
+//	tls://host[:port]                    DNS over TLS, port 853 by default
+//	https://host[:port]/path             DNS over HTTPS
+//
+// Encrypted upstreams may pin the server certificate by appending #pin-sha256=<base64 sha256 of the public key>, the
+// same value used by HPKP. When pinned, the certificate chain is not verified against the system roots so a self
+// signed server such as a local test server can be used
+type Upstream struct {
+	Proto string
+	Host  string // host name or ip, used as the TLS server name
+	Port  int
+	Path  string // the url path of a DoH upstream
+	Pin   []byte // sha256 of the SubjectPublicKeyInfo of the server certificate, if pinned
+}
+
+// ParseUpstream reads an upstream DNS server in any of the accepted forms
+func ParseUpstream(spec string) (*Upstream, error) {
+	spec = strings.TrimSpace(spec)
+	if !strings.Contains(spec, "://") {
+		return parsePlain(spec)
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("not a valid DNS server url: %s", spec)
+	}
+	up := &Upstream{Host: u.Hostname(), Path: u.Path}
+	switch strings.ToLower(u.Scheme) {
+	case ProtoTLS:
+		up.Proto = ProtoTLS
+		up.Port = 853
+		if u.Path != "" && u.Path != "/" {
+			return nil, fmt.Errorf("DNS over TLS server cannot have a path: %s", spec)
+		}
+		up.Path = ""
+	case ProtoHTTPS:
+		up.Proto = ProtoHTTPS
+		up.Port = 443
+		if up.Path == "" {
+			up.Path = "/dns-query"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported DNS server scheme %s. use tls:// or https://", u.Scheme)
+	}
+	if up.Host == "" {
+		return nil, fmt.Errorf("no host in DNS server url: %s", spec)
+	}
+	if p := u.Port(); p != "" {
+		if up.Port, err = parsePort(p); err != nil {
+			return nil, err
+		}
+	}
+	if u.Fragment != "" {
+		if !strings.HasPrefix(u.Fragment, pinPrefix) {
+			return nil, fmt.Errorf("unknown option #%s. only #%s<base64> is supported", u.Fragment, pinPrefix)
+		}
+		up.Pin, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(u.Fragment, pinPrefix))
+		if err != nil || len(up.Pin) != sha256.Size {
+			return nil, fmt.Errorf("pin must be the base64 encoded sha256 of the server public key: %s", u.Fragment)
+		}
+	}
+	return up, nil
+}
+
+func parsePlain(spec string) (*Upstream, error) {
+	host, port := spec, "53"
+	if net.ParseIP(spec) == nil {
+		var err error
+		if host, port, err = net.SplitHostPort(spec); err != nil {
+			return nil, fmt.Errorf("not a valid DNS server: %s", spec)
+		}
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("not a valid ip address: %s", host)
+	}
+	p, err := parsePort(port)
+	if err != nil {
+		return nil, err
+	}
+	return &Upstream{Proto: ProtoPlain, Host: host, Port: p}, nil
+}
+
+func parsePort(port string) (int, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return 0, fmt.Errorf("not a valid port: %s", port)
+	}
+	return p, nil
+}
+
+// Addr returns host:port
+func (u *Upstream) Addr() string {
+	return net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+}
+
+// IsEncrypted reports if queries to the upstream are sent over TLS or HTTPS
+func (u *Upstream) IsEncrypted() bool {
+	return u.Proto != ProtoPlain
+}
+
+// String returns the upstream in its canonical form. Plain upstreams are ip:port
+func (u *Upstream) String() string {
+	var s string
+	switch u.Proto {
+	case ProtoTLS:
+		s = "tls://" + u.Addr()
+	case ProtoHTTPS:
+		s = "https://" + u.Addr() + u.Path
+	default:
+		return u.Addr()
+	}
+	if len(u.Pin) > 0 {
+		s += "#" + pinPrefix + base64.StdEncoding.EncodeToString(u.Pin)
+	}
+	return s
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package iputil
+
+import (
+	"fmt"
+	"net"
+)
+
+// PrefixSource lists the ipv4 prefixes already in use on this machine, from both interface addresses and routes
+type PrefixSource interface {
+	UsedPrefixes() ([]net.IPNet, error)
+}
+
+// Overlaps reports whether the two networks share any address
+func Overlaps(a net.IPNet, b net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// Conflicts returns the first used prefix overlapping the given network. Default routes are ignored as they overlap
+// every network.
+func Conflicts(network net.IPNet, used []net.IPNet) *net.IPNet {
+	for i := range used {
+		if ones, _ := used[i].Mask.Size(); ones == 0 {
+			continue
+		}
+		if Overlaps(network, used[i]) {
+			return &used[i]
+		}
+	}
+	return nil
+}
+
+// FindFreeSubnet walks every network of the given size inside each pool entry in order and returns the first one which
+// overlaps none of the used prefixes.
+func FindFreeSubnet(pool []net.IPNet, maskBits int, used []net.IPNet) (*net.IPNet, error) {
+	mask := net.CIDRMask(maskBits, 32)
+	size := uint64(1) << uint(32-maskBits)
+	for _, p := range pool {
+		poolOnes, poolBits := p.Mask.Size()
+		if poolBits != 32 || poolOnes > maskBits {
+			// not ipv4 or too small to hold a network of the requested size
+			continue
+		}
+		start := uint64(Ipv4ToUint32(p.IP.To4()))
+		end := start + (uint64(1) << uint(32-poolOnes))
+		for base := start; base < end; base += size {
+			candidate := net.IPNet{IP: Uint32ToIpv4(uint32(base)), Mask: mask}
+			if Conflicts(candidate, used) == nil {
+				return &candidate, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no /%d network in the candidate pool is free", maskBits)
+}
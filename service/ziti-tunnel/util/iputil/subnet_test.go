@@ -0,0 +1,93 @@
+/*
+ * Copyright NetFoundry, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package iputil
+
+import (
+	"net"
+	"testing"
+)
+
+func cidrs(t *testing.T, s ...string) []net.IPNet {
+	t.Helper()
+	nets := make([]net.IPNet, 0, len(s))
+	for _, c := range s {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatalf("invalid network %s: %v", c, err)
+		}
+		nets = append(nets, *n)
+	}
+	return nets
+}
+
+func TestConflicts(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		used    []string
+		want    string
+	}{
+		{name: "no prefix in use", network: "100.64.0.0/10"},
+		{name: "local network inside", network: "100.64.0.0/10", used: []string{"192.168.1.0/24", "100.100.0.0/16"}, want: "100.100.0.0/16"},
+		{name: "route around", network: "100.64.0.0/16", used: []string{"100.0.0.0/8"}, want: "100.0.0.0/8"},
+		{name: "adjacent network", network: "100.64.0.0/10", used: []string{"100.128.0.0/10", "100.0.0.0/10"}},
+		{name: "default route is ignored", network: "100.64.0.0/10", used: []string{"0.0.0.0/0"}},
+		{name: "first conflict", network: "100.64.0.0/10", used: []string{"0.0.0.0/0", "100.64.1.0/24", "100.64.0.0/10"}, want: "100.64.1.0/24"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Conflicts(cidrs(t, tt.network)[0], cidrs(t, tt.used...))
+			if got == nil && tt.want != "" || got != nil && got.String() != tt.want {
+				t.Errorf("Conflicts(%s, %v) = %v, want %q", tt.network, tt.used, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindFreeSubnet(t *testing.T) {
+	tests := []struct {
+		name     string
+		pool     []string
+		maskBits int
+		used     []string
+		want     string
+	}{
+		{name: "first network of the pool", pool: []string{"100.64.0.0/10"}, maskBits: 16, want: "100.64.0.0/16"},
+		{name: "default route is ignored", pool: []string{"100.64.0.0/10"}, maskBits: 10, used: []string{"0.0.0.0/0"}, want: "100.64.0.0/10"},
+		{name: "skips a network in use", pool: []string{"100.64.0.0/10"}, maskBits: 16, used: []string{"100.64.3.0/24"}, want: "100.65.0.0/16"},
+		{name: "next pool entry", pool: []string{"100.64.0.0/10", "198.18.0.0/15"}, maskBits: 16, used: []string{"100.64.0.0/10"}, want: "198.18.0.0/16"},
+		{name: "pool entry too small", pool: []string{"198.18.0.0/15", "100.64.0.0/10"}, maskBits: 12, want: "100.64.0.0/12"},
+		{name: "ipv6 pool entry", pool: []string{"fd00::/8", "100.64.0.0/10"}, maskBits: 12, want: "100.64.0.0/12"},
+		{name: "exhausted", pool: []string{"100.64.0.0/10", "198.18.0.0/15"}, maskBits: 16, used: []string{"100.64.0.0/10", "198.18.0.0/16", "198.19.255.0/24"}},
+		{name: "empty pool", maskBits: 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FindFreeSubnet(cidrs(t, tt.pool...), tt.maskBits, cidrs(t, tt.used...))
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("FindFreeSubnet returned %v, want an error", got)
+				}
+				return
+			}
+			if err != nil || got.String() != tt.want {
+				t.Errorf("FindFreeSubnet = %v, %v, want %s", got, err, tt.want)
+			}
+		})
+	}
+}